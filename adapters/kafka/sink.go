@@ -0,0 +1,97 @@
+// Package kafka provides a ready-made WorkContext handler that publishes each batch of a
+// payloadqueue Queue to a Kafka topic.
+//
+//	w := &kafkago.Writer{Addr: kafkago.TCP("localhost:9092"), Topic: "events", RequiredAcks: kafkago.RequireAll}
+//	sink := &kafka.Sink{Writer: w}
+//	q := plq.Queue{WorkContext: sink.Work}
+//
+// A message is produced per payload. When the writer reports per-message errors, only the failed
+// payloads are retried or dead-lettered by the queue. Data that arrived already compressed (see
+// payloadqueue.Compressed) is produced as is, with a Content-Encoding message header.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	kafkago "github.com/segmentio/kafka-go"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Writer to produce messages to Kafka. It is satisfied by *kafka.Writer of
+// github.com/segmentio/kafka-go, which returns once the messages are acknowledged according to its
+// RequiredAcks.
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafkago.Message) error
+}
+
+// Sink to publish the batches to Kafka
+type Sink struct {
+	Writer  Writer
+	Topic   string                            // topic of each message. Leave empty when the Writer has a Topic
+	Marshal func(interface{}) ([]byte, error) // serializes the Data of a payload. Default is json.Marshal
+	Key     func(p plq.Payload) []byte        // extracts the message key. Default is the payload Id
+	Order   bool                              // carries the Sequence and Batch of each payload as headers too, see plq.OrderHeaders
+}
+
+// Work to publish the batch, one message per payload, carrying the payload Headers as message
+// headers. It is shaped as a WorkContext handler.
+func (s *Sink) Work(ctx context.Context, batch []interface{}) error {
+	marshal := s.Marshal
+	if marshal == nil {
+		marshal = json.Marshal
+	}
+	var pls []plq.Payload
+	if b, ok := plq.BatchFromContext(ctx); ok && len(b.Payloads) == len(batch) {
+		pls = b.Payloads
+	}
+	msgs := make([]kafkago.Message, len(batch))
+	for i, data := range batch {
+		p := plq.Payload{Data: data}
+		if pls != nil {
+			p = pls[i]
+		}
+		value, enc, compressed := plq.Compressed(p)
+		if !compressed {
+			var err error
+			if value, err = marshal(data); err != nil {
+				return err
+			}
+		}
+		msgs[i] = kafkago.Message{Topic: s.Topic, Value: value}
+		if compressed && p.Headers[plq.HeaderContentEncoding] == "" {
+			msgs[i].Headers = append(msgs[i].Headers, kafkago.Header{Key: plq.HeaderContentEncoding, Value: []byte(enc)})
+		}
+		if pls == nil {
+			continue
+		}
+		if s.Key != nil {
+			msgs[i].Key = s.Key(pls[i])
+		} else if pls[i].Id != "" {
+			msgs[i].Key = []byte(pls[i].Id)
+		}
+		for k, v := range pls[i].Headers {
+			msgs[i].Headers = append(msgs[i].Headers, kafkago.Header{Key: k, Value: []byte(v)})
+		}
+		if !s.Order {
+			continue
+		}
+		for k, v := range pls[i].OrderHeaders() {
+			msgs[i].Headers = append(msgs[i].Headers, kafkago.Header{Key: k, Value: []byte(v)})
+		}
+	}
+	err := s.Writer.WriteMessages(ctx, msgs...)
+	var writeErrs kafkago.WriteErrors
+	if errors.As(err, &writeErrs) {
+		results := make([]plq.PayloadResult, 0, writeErrs.Count())
+		for i, e := range writeErrs {
+			if e != nil {
+				results = append(results, plq.PayloadResult{Index: i, Err: e})
+			}
+		}
+		return &plq.BatchError{Results: results}
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/adapters/kafka"
+)
+
+// fakeWriter to record the produced messages and fail the ones listed in fail
+type fakeWriter struct {
+	msgs chan []kafkago.Message
+	fail map[int]bool
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	w.msgs <- msgs
+	if len(w.fail) == 0 {
+		return nil
+	}
+	errs := make(kafkago.WriteErrors, len(msgs))
+	for i := range msgs {
+		if w.fail[i] {
+			errs[i] = errors.New("not leader for partition")
+		}
+	}
+	return errs
+}
+
+func TestSink(t *testing.T) {
+	t.Run("Publish a batch", func(t *testing.T) {
+		w := &fakeWriter{msgs: make(chan []kafkago.Message, 1)}
+		sink := &kafka.Sink{Writer: w, Topic: "events"}
+		q := &plq.Queue{Tag: "QueueA", MaxSize: 2, MaxAge: 200, WorkContext: sink.Work}
+		q.Start()
+		q.Append(plq.Payload{Id: "1", Data: map[string]int{"n": 1}, Headers: map[string]string{"tenant": "acme"}})
+		q.Append(plq.Payload{Id: "2", Data: map[string]int{"n": 2}})
+
+		select {
+		case msgs := <-w.msgs:
+			if len(msgs) != 2 || string(msgs[0].Key) != "1" || string(msgs[0].Value) != `{"n":1}` || msgs[0].Topic != "events" {
+				t.Errorf("Unexpected messages: %+v", msgs)
+			}
+			if len(msgs[0].Headers) != 1 || msgs[0].Headers[0].Key != "tenant" {
+				t.Errorf("Expected the payload headers, got %+v", msgs[0].Headers)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the batch to be published")
+		}
+		q.Close()
+	})
+
+	t.Run("Carry the order of the payloads", func(t *testing.T) {
+		w := &fakeWriter{msgs: make(chan []kafkago.Message, 1)}
+		sink := &kafka.Sink{Writer: w, Order: true}
+		q := &plq.Queue{Tag: "QueueA", MaxSize: 2, MaxAge: 200, WorkContext: sink.Work}
+		q.Start()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		q.Append(plq.Payload{Id: "2", Data: "b"})
+
+		select {
+		case msgs := <-w.msgs:
+			headers := make(map[string]string)
+			for _, h := range msgs[1].Headers {
+				headers[h.Key] = string(h.Value)
+			}
+			if headers[plq.HeaderSequence] != "2" || headers[plq.HeaderBatch] != "1" {
+				t.Errorf("Expected the sequence and batch number, got %+v", msgs[1].Headers)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the batch to be published")
+		}
+		q.Close()
+	})
+
+	t.Run("Compressed data is produced as is", func(t *testing.T) {
+		w := &fakeWriter{msgs: make(chan []kafkago.Message, 1)}
+		sink := &kafka.Sink{Writer: w}
+		q := &plq.Queue{Tag: "QueueA", MaxSize: 2, MaxAge: 200, WorkContext: sink.Work}
+		q.Start()
+		q.Append(plq.Payload{Id: "1", Data: []byte{0x1f, 0x8b, 0x08, 0x00}})
+		q.Append(plq.Payload{Id: "2", Data: []byte("br-data"), Headers: map[string]string{plq.HeaderContentEncoding: "br"}})
+
+		select {
+		case msgs := <-w.msgs:
+			if len(msgs) != 2 || string(msgs[0].Value) != "\x1f\x8b\x08\x00" || string(msgs[1].Value) != "br-data" {
+				t.Errorf("Expected the data unchanged, got %+v", msgs)
+			}
+			if len(msgs[0].Headers) != 1 || msgs[0].Headers[0].Key != plq.HeaderContentEncoding || string(msgs[0].Headers[0].Value) != "gzip" {
+				t.Errorf("Expected the detected gzip encoding, got %+v", msgs[0].Headers)
+			}
+			if len(msgs[1].Headers) != 1 || string(msgs[1].Headers[0].Value) != "br" {
+				t.Errorf("Expected the flagged encoding once, got %+v", msgs[1].Headers)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the batch to be published")
+		}
+		q.Close()
+	})
+
+	t.Run("Failed messages are dead-lettered individually", func(t *testing.T) {
+		w := &fakeWriter{msgs: make(chan []kafkago.Message, 1), fail: map[int]bool{1: true}}
+		dead := make(chan []plq.Payload, 1)
+		sink := &kafka.Sink{Writer: w}
+		q := &plq.Queue{
+			Tag:         "QueueA",
+			MaxSize:     2,
+			MaxAge:      200,
+			WorkContext: sink.Work,
+			DeadLetter:  func(pls []plq.Payload, err error) { dead <- pls },
+		}
+		q.Start()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		q.Append(plq.Payload{Id: "2", Data: "b"})
+		select {
+		case pls := <-dead:
+			if len(pls) != 1 || pls[0].Id != "2" {
+				t.Errorf("Expected only payload 2 to be dead-lettered, got %v", pls)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the failed message to be dead-lettered")
+		}
+		q.Close()
+	})
+}
@@ -0,0 +1,170 @@
+// Package sqs provides a ready-made WorkContext handler that sends each batch of a payloadqueue
+// Queue to an AWS SQS queue with SendMessageBatch.
+//
+//	sink := &sqs.Sink{Client: sqs.NewFromConfig(cfg), QueueURL: url}
+//	q := plq.Queue{WorkContext: sink.Work, MaxRetries: 3}
+//
+// A batch is split into as many SendMessageBatch calls as needed to respect the SQS limits of 10
+// messages and 256KB per call. Entries reported as failed are returned as a BatchError, so only
+// those payloads are retried or dead-lettered by the queue.
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+const (
+	// MaxEntries is the most messages SQS accepts in one SendMessageBatch call.
+	MaxEntries = 10
+	// MaxBytes is the largest total size SQS accepts in one SendMessageBatch call.
+	MaxBytes = 256 * 1024
+)
+
+// SendMessageBatchAPI to send a batch of messages. It is satisfied by *sqs.Client of
+// github.com/aws/aws-sdk-go-v2/service/sqs.
+type SendMessageBatchAPI interface {
+	SendMessageBatch(ctx context.Context, params *awssqs.SendMessageBatchInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageBatchOutput, error)
+}
+
+// Sink to send the batches to an SQS queue
+type Sink struct {
+	Client   SendMessageBatchAPI
+	QueueURL string
+	Marshal  func(interface{}) ([]byte, error) // serializes the Data of a payload. Default is json.Marshal
+	GroupId  func(p plq.Payload) string        // message group of a FIFO queue, where the payload Id is also the deduplication id
+	Order    bool                              // carries the Sequence and Batch of each payload as Number attributes too, see plq.OrderHeaders
+}
+
+// entry is a message of the batch with the size it counts against MaxBytes
+type entry struct {
+	index int
+	req   types.SendMessageBatchRequestEntry
+	size  int
+}
+
+// Work to send the batch, one message per payload, carrying the payload Headers as String message
+// attributes. It is shaped as a WorkContext handler.
+func (s *Sink) Work(ctx context.Context, batch []interface{}) error {
+	marshal := s.Marshal
+	if marshal == nil {
+		marshal = json.Marshal
+	}
+	var pls []plq.Payload
+	if b, ok := plq.BatchFromContext(ctx); ok && len(b.Payloads) == len(batch) {
+		pls = b.Payloads
+	}
+	var results []plq.PayloadResult
+	entries := make([]entry, 0, len(batch))
+	for i, data := range batch {
+		body, err := marshal(data)
+		if err != nil {
+			results = append(results, plq.PayloadResult{Index: i, Err: err})
+			continue
+		}
+		e := entry{index: i, size: len(body)}
+		e.req.Id = aws.String(strconv.Itoa(i))
+		e.req.MessageBody = aws.String(string(body))
+		if pls != nil {
+			for k, v := range pls[i].Headers {
+				if e.req.MessageAttributes == nil {
+					e.req.MessageAttributes = make(map[string]types.MessageAttributeValue)
+				}
+				e.req.MessageAttributes[k] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+				e.size += len(k) + len("String") + len(v)
+			}
+			for k, v := range order(s.Order, pls[i]) {
+				if e.req.MessageAttributes == nil {
+					e.req.MessageAttributes = make(map[string]types.MessageAttributeValue)
+				}
+				e.req.MessageAttributes[k] = types.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String(v)}
+				e.size += len(k) + len("Number") + len(v)
+			}
+			if s.GroupId != nil {
+				e.req.MessageGroupId = aws.String(s.GroupId(pls[i]))
+				e.req.MessageDeduplicationId = aws.String(pls[i].Id)
+			}
+		}
+		if e.size > MaxBytes {
+			results = append(results, plq.PayloadResult{Index: i, Err: errors.New("message is larger than " + strconv.Itoa(MaxBytes) + " bytes")})
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	var lastErr error
+	for _, chunk := range split(entries) {
+		failed, err := s.send(ctx, chunk)
+		if err != nil {
+			lastErr = err
+		}
+		results = append(results, failed...)
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	if len(results) == len(batch) && lastErr != nil {
+		return lastErr
+	}
+	return &plq.BatchError{Results: results}
+}
+
+// send to make one SendMessageBatch call, returning the entries that failed
+func (s *Sink) send(ctx context.Context, chunk []entry) ([]plq.PayloadResult, error) {
+	in := &awssqs.SendMessageBatchInput{QueueUrl: aws.String(s.QueueURL)}
+	for _, e := range chunk {
+		in.Entries = append(in.Entries, e.req)
+	}
+	out, err := s.Client.SendMessageBatch(ctx, in)
+	if err != nil {
+		failed := make([]plq.PayloadResult, len(chunk))
+		for i, e := range chunk {
+			failed[i] = plq.PayloadResult{Index: e.index, Err: err}
+		}
+		return failed, err
+	}
+	var failed []plq.PayloadResult
+	for _, f := range out.Failed {
+		i, convErr := strconv.Atoi(aws.ToString(f.Id))
+		if convErr != nil {
+			continue
+		}
+		failed = append(failed, plq.PayloadResult{Index: i, Err: errors.New(aws.ToString(f.Code) + ": " + aws.ToString(f.Message))})
+	}
+	return failed, nil
+}
+
+// split to group the entries into calls of at most MaxEntries messages and MaxBytes
+func split(entries []entry) [][]entry {
+	var chunks [][]entry
+	var chunk []entry
+	size := 0
+	for _, e := range entries {
+		if len(chunk) == MaxEntries || (len(chunk) > 0 && size+e.size > MaxBytes) {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, e)
+		size += e.size
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// order to return the OrderHeaders of the payload when the Sink carries them
+func order(carry bool, p plq.Payload) map[string]string {
+	if !carry {
+		return nil
+	}
+	return p.OrderHeaders()
+}
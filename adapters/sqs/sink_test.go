@@ -0,0 +1,78 @@
+package sqs_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/adapters/sqs"
+)
+
+// fakeClient to record the calls and fail the entries with an Id listed in fail
+type fakeClient struct {
+	calls []*awssqs.SendMessageBatchInput
+	fail  map[string]bool
+}
+
+func (c *fakeClient) SendMessageBatch(ctx context.Context, in *awssqs.SendMessageBatchInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageBatchOutput, error) {
+	c.calls = append(c.calls, in)
+	out := &awssqs.SendMessageBatchOutput{}
+	for _, e := range in.Entries {
+		if c.fail[aws.ToString(e.Id)] {
+			out.Failed = append(out.Failed, types.BatchResultErrorEntry{Id: e.Id, Code: aws.String("InternalError"), Message: aws.String("try again")})
+		}
+	}
+	return out, nil
+}
+
+func TestSink(t *testing.T) {
+	t.Run("Batch is split by the entry limit", func(t *testing.T) {
+		c := &fakeClient{}
+		sink := &sqs.Sink{Client: c, QueueURL: "https://sqs/queue"}
+		batch := make([]interface{}, 25)
+		for i := range batch {
+			batch[i] = i
+		}
+		if err := sink.Work(context.Background(), batch); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		if len(c.calls) != 3 || len(c.calls[0].Entries) != 10 || len(c.calls[2].Entries) != 5 {
+			t.Errorf("Expected calls of 10, 10 and 5 entries, got %d calls", len(c.calls))
+		}
+	})
+
+	t.Run("Batch is split by the size limit", func(t *testing.T) {
+		c := &fakeClient{}
+		sink := &sqs.Sink{Client: c, QueueURL: "https://sqs/queue"}
+		big := strings.Repeat("x", 100*1024)
+		if err := sink.Work(context.Background(), []interface{}{big, big, big}); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		if len(c.calls) != 2 {
+			t.Errorf("Expected 2 calls, got %d", len(c.calls))
+		}
+	})
+
+	t.Run("Failed entries are reported per payload", func(t *testing.T) {
+		c := &fakeClient{fail: map[string]bool{"1": true, "12": true}}
+		sink := &sqs.Sink{Client: c, QueueURL: "https://sqs/queue"}
+		batch := make([]interface{}, 15)
+		for i := range batch {
+			batch[i] = i
+		}
+		err := sink.Work(context.Background(), batch)
+		var batchErr *plq.BatchError
+		if !errors.As(err, &batchErr) {
+			t.Fatalf("Expected a BatchError, got %v", err)
+		}
+		if len(batchErr.Results) != 2 || batchErr.Results[0].Index != 1 || batchErr.Results[1].Index != 12 {
+			t.Errorf("Unexpected results: %+v", batchErr.Results)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// hedgeSamples is how many recent request latencies the hedge delay is taken from
+const hedgeSamples = 100
+
+// hedgeWarmup is how many latencies are observed before a Sink without a HedgeAfter hedges
+const hedgeWarmup = 20
+
+// latencies to hold the most recent request latencies of a Sink
+type latencies struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// observe to record the latency of a request that got a response
+func (l *latencies) observe(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.samples) < hedgeSamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % hedgeSamples
+}
+
+// p95 to return the 95th percentile of the recent latencies, zero until enough are observed
+func (l *latencies) p95() time.Duration {
+	l.mutex.Lock()
+	sorted := slices.Clone(l.samples)
+	l.mutex.Unlock()
+	if len(sorted) < hedgeWarmup {
+		return 0
+	}
+	slices.Sort(sorted)
+	return sorted[len(sorted)*95/100]
+}
+
+// hedgeDelay to return how long the first request runs before a second is sent, zero when the Sink
+// does not hedge
+func (s *Sink) hedgeDelay() time.Duration {
+	if !s.Hedge {
+		return 0
+	}
+	if s.HedgeAfter > 0 {
+		return s.HedgeAfter
+	}
+	return s.latencies.p95()
+}
+
+// hedged to make one attempt at the body as send does. When the response takes longer than the
+// hedge delay, a second request is sent and the first response wins; the other request is
+// canceled. A failure waits for the other request, if one is outstanding.
+func (s *Sink) hedged(ctx context.Context, body []byte, encoding, key string) (time.Duration, error) {
+	delay := s.hedgeDelay()
+	if delay <= 0 {
+		return s.send(ctx, body, encoding, key)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // cancels the request that lost
+	type result struct {
+		wait time.Duration
+		err  error
+	}
+	results := make(chan result, 2)
+	request := func() {
+		wait, err := s.send(ctx, body, encoding, key)
+		results <- result{wait, err}
+	}
+	go request()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	outstanding := 1
+	for {
+		select {
+		case <-timer.C:
+			s.hedges.Add(1)
+			outstanding++
+			go request()
+		case r := <-results:
+			if outstanding--; r.err == nil || outstanding == 0 {
+				return r.wait, r.err
+			}
+		}
+	}
+}
+
+// Hedges to return the number of second requests the Sink sent because the first was slow
+func (s *Sink) Hedges() int64 {
+	return s.hedges.Load()
+}
@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Notifier to post the outcome of every batch to a URL as a Notification, so an orchestrator can
+// react to completed batches without polling. Its Done method is shaped as an OnBatchDone handler:
+//
+//	n := &webhook.Notifier{URL: "https://jobs.example.com/hooks/batches"}
+//	q := plq.Queue{WorkContext: sink.Work, OnBatchDone: n.Done}
+//
+// The notification is posted before the worker takes the next batch, so it is bounded by the
+// Timeout.
+type Notifier struct {
+	URL         string
+	Header      http.Header   // sent with every request, e.g. the Authorization
+	Client      *http.Client  // default is http.DefaultClient
+	MaxAttempts int           // attempts per notification, including the first. Default is 3
+	Backoff     time.Duration // wait before a retry without Retry-After, doubled per attempt. Default is 1 second
+	Timeout     time.Duration // bound of a notification, retries included. Default is 5 seconds
+	OnError     func(error)   // receives the error of a notification that could not be posted
+}
+
+// Notification is the JSON body posted by a Notifier for a batch
+type Notification struct {
+	BatchId      string            `json:"batch_id"`
+	Tag          string            `json:"tag"`
+	Status       string            `json:"status"` // delivered, partial or failed
+	Payloads     int               `json:"payloads"`
+	Delivered    int               `json:"delivered"`
+	Failed       int               `json:"failed"`        // retried or dead-lettered
+	DeadLettered int               `json:"dead_lettered"` // failed with no retries left
+	Started      time.Time         `json:"started"`
+	DurationMs   float64           `json:"duration_ms"`
+	Error        string            `json:"error,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// Done to post the outcome of the batch. It is shaped as an OnBatchDone handler.
+func (n *Notifier) Done(r plq.BatchResult) {
+	body, err := json.Marshal(notification(r))
+	if err == nil {
+		timeout := n.Timeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		s := &Sink{URL: n.URL, Header: n.Header, Client: n.Client, MaxAttempts: n.MaxAttempts, Backoff: n.Backoff}
+		err = s.post(ctx, body, "", "")
+	}
+	if err != nil && n.OnError != nil {
+		n.OnError(err)
+	}
+}
+
+// notification to describe the batch result
+func notification(r plq.BatchResult) Notification {
+	v := Notification{
+		BatchId:      r.BatchId,
+		Tag:          r.Tag,
+		Status:       "delivered",
+		Payloads:     len(r.PayloadIds),
+		Delivered:    len(r.PayloadIds) - len(r.Failed),
+		Failed:       len(r.Failed),
+		DeadLettered: len(r.DeadLettered),
+		Started:      r.Started,
+		DurationMs:   float64(r.Duration) / float64(time.Millisecond),
+		Annotations:  r.Annotations,
+	}
+	switch {
+	case v.Failed > 0 && v.Delivered > 0:
+		v.Status = "partial"
+	case v.Failed > 0:
+		v.Status = "failed"
+	}
+	if r.Err != nil {
+		v.Error = r.Err.Error()
+	}
+	return v
+}
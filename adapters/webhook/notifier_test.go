@@ -0,0 +1,80 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/adapters/webhook"
+)
+
+func TestNotifier(t *testing.T) {
+	t.Run("Post the outcome of every batch", func(t *testing.T) {
+		notified := make(chan webhook.Notification, 2)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var n webhook.Notification
+			json.NewDecoder(r.Body).Decode(&n)
+			notified <- n
+		}))
+		defer srv.Close()
+		n := &webhook.Notifier{URL: srv.URL}
+		q := &plq.Queue{
+			MaxSize:     2,
+			MaxAge:      1000,
+			Tag:         "QueueA",
+			OnBatchDone: n.Done,
+			Work: func(pls []interface{}) int {
+				return 0
+			},
+		}
+		if err := q.Start(); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		defer q.Close()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		q.Append(plq.Payload{Id: "2", Data: "b"})
+		select {
+		case v := <-notified:
+			if v.Tag != "QueueA" || v.BatchId == "" || v.Status != "delivered" || v.Payloads != 2 || v.Delivered != 2 || v.Failed != 0 {
+				t.Errorf("Unexpected notification: %+v", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a notification")
+		}
+	})
+
+	t.Run("Report a partial batch with its error", func(t *testing.T) {
+		notified := make(chan webhook.Notification, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var n webhook.Notification
+			json.NewDecoder(r.Body).Decode(&n)
+			notified <- n
+		}))
+		defer srv.Close()
+		n := &webhook.Notifier{URL: srv.URL}
+		n.Done(plq.BatchResult{BatchId: "b1", PayloadIds: []string{"1", "2"}, Failed: []string{"2"}, DeadLettered: []string{"2"},
+			Duration: 1500 * time.Microsecond, Err: errors.New("boom")})
+		v := <-notified
+		if v.Status != "partial" || v.Delivered != 1 || v.DeadLettered != 1 || v.DurationMs != 1.5 || v.Error != "boom" {
+			t.Errorf("Unexpected notification: %+v", v)
+		}
+	})
+
+	t.Run("Report a notification that could not be posted", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer srv.Close()
+		var failed error
+		n := &webhook.Notifier{URL: srv.URL, OnError: func(err error) { failed = err }}
+		n.Done(plq.BatchResult{BatchId: "b1"})
+		var status *webhook.StatusError
+		if !errors.As(failed, &status) || status.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected the status error, got %v", failed)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+// Package webhook provides a ready-made WorkContext handler that posts each batch of a
+// payloadqueue Queue to an HTTP endpoint as a JSON array, and a Notifier of the batch outcomes.
+//
+//	sink := &webhook.Sink{URL: "https://api.example.com/events", Header: http.Header{"Authorization": {"Bearer " + token}}}
+//	q := plq.Queue{WorkContext: sink.Work, WorkTimeout: 30 * time.Second}
+//
+// Requests that fail with a 5xx or 429 status are retried, honoring Retry-After. When the queue has
+// a Compressor and the Sink no Marshal, the compressed batch is posted with its Content-Encoding.
+// With Hedge, a request slower than the p95 of the recent ones is sent a second time and the first
+// response wins, to cut the tail latency of latency-sensitive endpoints.
+// A Notifier posts the outcome of every batch, as an OnBatchDone handler.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Sink to send the batches to a URL
+type Sink struct {
+	URL         string
+	Method      string                              // default is POST
+	Header      http.Header                         // sent with every request, e.g. the Authorization
+	Marshal     func([]interface{}) ([]byte, error) // serializes the batch. Default is json.Marshal
+	ContentType string                              // default is application/json
+	Client      *http.Client                        // default is http.DefaultClient
+	MaxAttempts int                                 // attempts per batch, including the first. Default is 3
+	Backoff     time.Duration                       // wait before a retry without Retry-After, doubled per attempt. Default is 1 second
+	Hedge       bool                                // a request still without a response after the HedgeAfter is sent again, the slower one is canceled
+	HedgeAfter  time.Duration                       // how long a request runs before it is hedged. Default is the p95 latency of the recent requests, once 20 are observed
+	KeyHeader   string                              // the header carrying the batch Id, so the endpoint can tell a hedged or retried request from a new batch. Default is Idempotency-Key
+	latencies   latencies
+	hedges      atomic.Int64
+}
+
+// StatusError is returned for a response that is not a 2xx status
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook responded %d: %s", e.StatusCode, e.Body)
+}
+
+// Unwrap to classify a 413 response as plq.ErrBatchTooLarge, so the queue splits the batch
+func (e *StatusError) Unwrap() error {
+	if e.StatusCode == http.StatusRequestEntityTooLarge {
+		return plq.ErrBatchTooLarge
+	}
+	return nil
+}
+
+// Work to send the batch, retrying on 5xx and 429 responses. It is shaped as a WorkContext handler.
+func (s *Sink) Work(ctx context.Context, batch []interface{}) error {
+	var body []byte
+	var encoding string
+	var err error
+	marshal := s.Marshal
+	if marshal == nil {
+		marshal = func(v []interface{}) ([]byte, error) { return json.Marshal(v) }
+		if body, encoding, err = plq.CompressedBatch(ctx); err != nil {
+			return err
+		}
+	}
+	if encoding == "" {
+		if body, err = marshal(batch); err != nil {
+			return err
+		}
+	}
+	key := ""
+	if b, ok := plq.BatchFromContext(ctx); ok {
+		key = b.Id
+	}
+	return s.post(ctx, body, encoding, key)
+}
+
+// post to send the body, retrying on 5xx and 429 responses. The key, unless empty, is sent in the
+// KeyHeader of every attempt.
+func (s *Sink) post(ctx context.Context, body []byte, encoding, key string) error {
+	attempts := s.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	backoff := s.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		wait, err := s.hedged(ctx, body, encoding, key)
+		if err == nil || wait < 0 || attempt == attempts {
+			return err
+		}
+		if wait == 0 {
+			wait = backoff << (attempt - 1)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// send to make one request, with the Content-Encoding of the body and the key unless empty. The
+// returned wait is negative when the error must not be retried, zero when the default backoff
+// applies, or the Retry-After of the response.
+func (s *Sink) send(ctx context.Context, body []byte, encoding, key string) (time.Duration, error) {
+	method := s.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	for k, vs := range s.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if s.ContentType != "" {
+		req.Header.Set("Content-Type", s.ContentType)
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if key != "" {
+		header := s.KeyHeader
+		if header == "" {
+			header = "Idempotency-Key"
+		}
+		req.Header.Set(header, key)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	started := time.Now()
+	res, err := client.Do(req)
+	if err == nil {
+		s.latencies.observe(time.Since(started))
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, err
+		}
+		return 0, err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return 0, nil
+	}
+	err = &StatusError{StatusCode: res.StatusCode, Body: string(msg)}
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode < 500 {
+		return -1, err
+	}
+	return retryAfter(res.Header.Get("Retry-After")), err
+}
+
+// retryAfter to parse a Retry-After header given in seconds or as an HTTP date
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,163 @@
+package webhook_test
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/adapters/webhook"
+)
+
+func TestSink(t *testing.T) {
+	t.Run("Post the batch as a JSON array", func(t *testing.T) {
+		var body, auth string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			body, auth = string(b), r.Header.Get("Authorization")
+		}))
+		defer srv.Close()
+		sink := &webhook.Sink{URL: srv.URL, Header: http.Header{"Authorization": {"Bearer t"}}}
+		if err := sink.Work(context.Background(), []interface{}{map[string]int{"n": 1}, "b"}); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		if body != `[{"n":1},"b"]` || auth != "Bearer t" {
+			t.Errorf("Unexpected request: %s %s", body, auth)
+		}
+	})
+
+	t.Run("Retry on 5xx honoring Retry-After", func(t *testing.T) {
+		var calls int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer srv.Close()
+		sink := &webhook.Sink{URL: srv.URL, Backoff: time.Millisecond}
+		start := time.Now()
+		if err := sink.Work(context.Background(), []interface{}{1}); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		if calls != 2 || time.Since(start) < time.Second {
+			t.Errorf("Expected a retry after 1 second, got %d calls in %s", calls, time.Since(start))
+		}
+	})
+
+	t.Run("No retry on 4xx", func(t *testing.T) {
+		var calls int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer srv.Close()
+		sink := &webhook.Sink{URL: srv.URL, Backoff: time.Millisecond}
+		err := sink.Work(context.Background(), []interface{}{1})
+		var statusErr *webhook.StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest || calls != 1 {
+			t.Errorf("Expected a single 400, got %v after %d calls", err, calls)
+		}
+	})
+
+	t.Run("Report a 413 as a batch too large", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}))
+		defer srv.Close()
+		sink := &webhook.Sink{URL: srv.URL, Backoff: time.Millisecond}
+		if err := sink.Work(context.Background(), []interface{}{1, 2}); !errors.Is(err, plq.ErrBatchTooLarge) {
+			t.Errorf("Expected the batch to be too large, got %v", err)
+		}
+	})
+
+	t.Run("Give up after MaxAttempts", func(t *testing.T) {
+		var calls int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer srv.Close()
+		sink := &webhook.Sink{URL: srv.URL, MaxAttempts: 3, Backoff: time.Millisecond}
+		if err := sink.Work(context.Background(), []interface{}{1}); err == nil || calls != 3 {
+			t.Errorf("Expected an error after 3 calls, got %v after %d calls", err, calls)
+		}
+	})
+
+	t.Run("Post the batch compressed by the queue's Compressor", func(t *testing.T) {
+		var mutex sync.Mutex
+		var body, encoding string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			b, _ := io.ReadAll(zr)
+			mutex.Lock()
+			body, encoding = string(b), r.Header.Get("Content-Encoding")
+			mutex.Unlock()
+		}))
+		defer srv.Close()
+		sink := &webhook.Sink{URL: srv.URL}
+		q := &plq.Queue{Tag: "QueueA", MaxSize: 2, MaxAge: 200, WorkContext: sink.Work, Compressor: plq.GzipCompressor{}}
+		q.Start()
+		defer q.Close()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		q.Append(plq.Payload{Id: "2", Data: "b"})
+		time.Sleep(100 * time.Millisecond)
+		mutex.Lock()
+		if body != `["a","b"]` || encoding != "gzip" {
+			t.Errorf("Unexpected request: %s %s", body, encoding)
+		}
+		mutex.Unlock()
+		if s := q.Stats(); s.Delivered != 2 || s.SerializedBytes != 9 || s.CompressedBytes == 0 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+	})
+
+	t.Run("Hedge a slow request and keep the first response", func(t *testing.T) {
+		var mutex sync.Mutex
+		var keys []string
+		var calls int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+			mutex.Unlock()
+			if atomic.AddInt32(&calls, 1) == 1 {
+				select {
+				case <-time.After(time.Second):
+				case <-r.Context().Done():
+				}
+			}
+		}))
+		defer srv.Close()
+		sink := &webhook.Sink{URL: srv.URL, Hedge: true, HedgeAfter: 50 * time.Millisecond}
+		var took time.Duration
+		q := &plq.Queue{Tag: "QueueA", MaxSize: 1, MaxAge: 200, WorkContext: func(ctx context.Context, batch []interface{}) error {
+			started := time.Now()
+			err := sink.Work(ctx, batch)
+			took = time.Since(started)
+			return err
+		}}
+		q.Start()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		time.Sleep(300 * time.Millisecond)
+		q.Close()
+		if s := q.Stats(); s.Delivered != 1 || took > 500*time.Millisecond {
+			t.Errorf("Expected the hedged request to deliver the batch, got %+v in %s", s, took)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if sink.Hedges() != 1 || len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] {
+			t.Errorf("Expected 2 requests with the same key, got %d hedges and keys %v", sink.Hedges(), keys)
+		}
+	})
+}
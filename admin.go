@@ -0,0 +1,157 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+// ErrForbidden is returned by an Authorizer that does not allow the caller the action
+var ErrForbidden = errors.New("the action is not allowed")
+
+// ErrNoDeadLetters is returned by Redrive and DeadLetters when the Storage of the queue does not
+// keep its dead-lettered payloads, see RedriveStorage and DeadLetterReader
+var ErrNoDeadLetters = errors.New("the storage of the queue does not keep dead-lettered payloads")
+
+// Action is an admin operation on a queue, gated by an Authorizer on the HTTP and gRPC surfaces
+type Action string
+
+const (
+	ActionPause   Action = "pause"   // stop cutting batches, see Pause
+	ActionResume  Action = "resume"  // cut batches again, see Resume
+	ActionFlush   Action = "flush"   // push the pending payloads now, see Flush
+	ActionRedrive Action = "redrive" // return the dead-lettered payloads to the queue, see Redrive
+	ActionPurge   Action = "purge"   // drop the pending payloads, see Purge
+	ActionInspect Action = "inspect" // read the dead-lettered payloads, see DeadLetters
+	ActionObserve Action = "observe" // read the stats, health and events, see Stats
+	ActionReplay  Action = "replay"  // enqueue delivered payloads again, see Replay
+)
+
+// Caller identifies who requests an admin action, as established by the HTTP or gRPC surface,
+// e.g. from a verified token or client certificate
+type Caller struct {
+	Subject string
+	Roles   []string
+}
+
+// Authorizer to decide whether the caller may perform the action on the queue with the tag. It
+// returns nil to allow it, or an error, usually ErrForbidden, to refuse it.
+type Authorizer interface {
+	Authorize(ctx context.Context, caller Caller, tag string, action Action) error
+}
+
+// AuthorizerFunc to use a function as an Authorizer
+type AuthorizerFunc func(ctx context.Context, caller Caller, tag string, action Action) error
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, caller Caller, tag string, action Action) error {
+	return f(ctx, caller, tag, action)
+}
+
+// RoleAuthorizer to allow a caller the actions listed for any of its Roles, on every queue:
+//
+//	plq.RoleAuthorizer{
+//		"operator": {plq.ActionObserve, plq.ActionPause, plq.ActionResume, plq.ActionFlush},
+//		"admin":    {plq.ActionObserve, plq.ActionPause, plq.ActionResume, plq.ActionFlush, plq.ActionRedrive, plq.ActionPurge, plq.ActionInspect, plq.ActionReplay},
+//	}
+type RoleAuthorizer map[string][]Action
+
+func (r RoleAuthorizer) Authorize(ctx context.Context, caller Caller, tag string, action Action) error {
+	for _, role := range caller.Roles {
+		for _, a := range r[role] {
+			if a == action {
+				return nil
+			}
+		}
+	}
+	return ErrForbidden
+}
+
+// Pause to stop cutting batches, e.g. while the downstream is under maintenance. Appended payloads
+// are still accepted and wait, within MaxPending, until Resume. Flush still pushes a batch.
+func (q *Queue) Pause() {
+	q.payloadMutex.Lock()
+	q.paused = true
+	q.payloadMutex.Unlock()
+	q.event("Buffer Queue: Paused")
+}
+
+// Resume to cut batches again. The payloads that waited while the queue was paused are pushed
+// straight away.
+func (q *Queue) Resume() {
+	q.payloadMutex.Lock()
+	q.paused = false
+	waiting := q.payloadQueue.len()
+	q.payloadMutex.Unlock()
+	q.event("Buffer Queue: Resumed")
+	if waiting > 0 {
+		q.flush()
+	}
+}
+
+// Paused to report whether the queue is paused
+func (q *Queue) Paused() bool {
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
+	return q.paused
+}
+
+// Purge to drop the pending and delayed payloads without pushing them, returning how many were
+// dropped. They are acknowledged in the Storage, so no other instance claims them. Batches already
+// being processed are not affected.
+func (q *Queue) Purge() int {
+	q.payloadMutex.Lock()
+	purged := append(q.payloadQueue.take(q.payloadQueue.len()), q.delayed...)
+	q.delayed = nil
+	spilled := q.spilled
+	q.payloadMutex.Unlock()
+	if q.Spill != nil && q.Storage == nil {
+		purged = append(purged, q.unspill(spilled)...)
+	}
+	q.release()
+	q.tally(purged, func(c *DailyCounts, n int64) { c.Dropped += n })
+	q.acknowledge(purged)
+	q.event("Buffer Queue: Purged " + strconv.Itoa(len(purged)) + " payloads")
+	return len(purged)
+}
+
+// Redrive to return the payloads dead-lettered in the Storage to the queue for another round of
+// attempts, returning how many were redriven. It fails with ErrNoDeadLetters unless the Storage is
+// a RedriveStorage.
+func (q *Queue) Redrive(ctx context.Context) (int, error) {
+	rs, ok := q.Storage.(RedriveStorage)
+	if !ok {
+		return 0, ErrNoDeadLetters
+	}
+	n, err := rs.Redrive(q.seal(withCodec(ctx, q.Codec)))
+	if err != nil {
+		q.event("Storage: Redrive failed. " + err.Error())
+		return 0, err
+	}
+	q.event("Storage: Redrove " + strconv.Itoa(n) + " dead-lettered payloads")
+	q.fill()
+	q.check("redrive")
+	return n, nil
+}
+
+// DeadLetters to return up to max of the payloads dead-lettered in the Storage, most recent first,
+// e.g. to inspect them before a Redrive. It fails with ErrNoDeadLetters unless the Storage is a
+// DeadLetterReader.
+func (q *Queue) DeadLetters(ctx context.Context, max int) ([]DeadLetter, error) {
+	dr, ok := q.Storage.(DeadLetterReader)
+	if !ok {
+		return nil, ErrNoDeadLetters
+	}
+	return dr.DeadLetters(q.seal(withCodec(ctx, q.Codec)), max)
+}
+
+// hold to keep the batch window of a paused or draining queue, or of one whose breaker is open,
+// open so the timer does not spin on it, and report whether batching is held
+func (q *Queue) hold() bool {
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
+	held := q.paused || q.draining || q.tripped()
+	if held {
+		q.reopen()
+	}
+	return held
+}
@@ -0,0 +1,206 @@
+package payloadqueue_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestQueueAdmin(t *testing.T) {
+	t.Run("A paused queue holds its payloads until resumed", func(t *testing.T) {
+		var runMutex sync.Mutex
+		batched := 0
+		q := &payloadqueue.Queue{
+			MaxSize: 2,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched += len(pls)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		q.Pause()
+		for i := 0; i < 5; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i)})
+		}
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		if batched != 0 || !q.Paused() {
+			t.Errorf("Expected no batches while paused, got %d payloads batched", batched)
+		}
+		runMutex.Unlock()
+		q.Resume()
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		if batched != 5 {
+			t.Errorf("Expected the held payloads pushed on Resume, got %d", batched)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+
+	t.Run("Purge drops the pending payloads", func(t *testing.T) {
+		q := &payloadqueue.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work:    func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		q.AppendAfter(payloadqueue.Payload{Id: "2"}, time.Hour)
+		time.Sleep(10 * time.Millisecond)
+		if n := q.Purge(); n != 2 || q.Size() != 0 {
+			t.Errorf("Expected 2 payloads purged, got %d and a size of %d", n, q.Size())
+		}
+		if _, err := q.Redrive(context.Background()); !errors.Is(err, payloadqueue.ErrNoDeadLetters) {
+			t.Errorf("Expected ErrNoDeadLetters without a Storage, got %v", err)
+		}
+		if _, err := q.DeadLetters(context.Background(), 10); !errors.Is(err, payloadqueue.ErrNoDeadLetters) {
+			t.Errorf("Expected ErrNoDeadLetters without a Storage, got %v", err)
+		}
+		if _, err := q.Replay(context.Background(), "batch"); !errors.Is(err, payloadqueue.ErrNoArchive) {
+			t.Errorf("Expected ErrNoArchive without a Storage, got %v", err)
+		}
+		q.Close()
+	})
+
+	t.Run("Peek and Find return copies of the held payloads", func(t *testing.T) {
+		q := &payloadqueue.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work:    func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		q.AppendAfter(payloadqueue.Payload{Id: "3"}, time.Hour)
+		q.Append(payloadqueue.Payload{Id: "1", Headers: map[string]string{"tenant": "a"}})
+		q.Append(payloadqueue.Payload{Id: "2"})
+
+		pls := q.Peek(10)
+		if len(pls) != 3 || pls[0].Id != "1" || pls[1].Id != "2" || pls[2].Id != "3" {
+			t.Errorf("Expected the pending payloads then the delayed one, got %v", pls)
+		}
+		if pls := q.Peek(1); len(pls) != 1 || pls[0].Id != "1" {
+			t.Errorf("Expected the first payload only, got %v", pls)
+		}
+		pls[0].Headers["tenant"] = "b"
+		p, ok := q.Find("1")
+		if !ok || p.Headers["tenant"] != "a" {
+			t.Errorf("Expected the payload found unchanged, got %v", p)
+		}
+		if _, ok := q.Find("4"); ok {
+			t.Errorf("Expected no payload 4")
+		}
+		if q.Size() != 3 {
+			t.Errorf("Expected the payloads left in the queue, got a size of %d", q.Size())
+		}
+		q.Close()
+	})
+
+	t.Run("Remove pulls a payload out before it is batched", func(t *testing.T) {
+		var runMutex sync.Mutex
+		var batched []interface{}
+		events := make(chan string, 100)
+		q := &payloadqueue.Queue{
+			MaxSize:   3,
+			MaxAge:    200,
+			Tag:       "QueueA",
+			EventFeed: func(e string) { events <- e },
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1", Data: "1"})
+		q.Append(payloadqueue.Payload{Id: "2", Data: "2"})
+		q.AppendAfter(payloadqueue.Payload{Id: "3", Data: "3"}, time.Hour)
+		if !q.Remove("1") || !q.Remove("3") || q.Remove("4") {
+			t.Errorf("Expected payloads 1 and 3 removed, and no payload 4")
+		}
+		q.Append(payloadqueue.Payload{Id: "5", Data: "5"})
+		q.Append(payloadqueue.Payload{Id: "6", Data: "6"})
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 3 || batched[0] != "2" || batched[1] != "5" || batched[2] != "6" {
+			t.Errorf("Expected the removed payloads left out of the batch, got %v", batched)
+		}
+		runMutex.Unlock()
+		if s := q.Stats(); s.Removed != 2 || s.Delayed != 0 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+		found := false
+		for len(events) > 0 {
+			if strings.Contains(<-events, "Payload Removed [id]: 1") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected the removal event")
+		}
+		q.Close()
+	})
+
+	t.Run("Remove resolves the outcome of the payload and those coalesced into it", func(t *testing.T) {
+		q := &payloadqueue.Queue{
+			MaxSize:     10,
+			MaxAge:      60000,
+			CoalesceKey: func(p payloadqueue.Payload) string { return p.Headers["device"] },
+			Work:        func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		defer q.Close()
+		device := map[string]string{"device": "a"}
+		q.Append(payloadqueue.Payload{Id: "1", Data: "on", Headers: device})
+		q.Append(payloadqueue.Payload{Id: "2", Data: "on", Headers: device})
+		outcomes := make(chan payloadqueue.Outcome, 2)
+		for _, id := range []string{"1", "2"} {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				out, _ := q.Await(ctx, id)
+				outcomes <- out
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		if !q.Remove("1") {
+			t.Fatal("Expected payload 1 removed")
+		}
+		for range 2 {
+			if out := <-outcomes; !out.Removed || out.Delivered {
+				t.Errorf("Expected the Await to return a removed outcome, got %+v", out)
+			}
+		}
+	})
+
+	t.Run("RoleAuthorizer allows the actions of the roles", func(t *testing.T) {
+		auth := payloadqueue.RoleAuthorizer{
+			"operator": {payloadqueue.ActionPause, payloadqueue.ActionResume},
+			"admin":    {payloadqueue.ActionPurge},
+		}
+		ctx := context.Background()
+		op := payloadqueue.Caller{Subject: "sam", Roles: []string{"operator"}}
+		if err := auth.Authorize(ctx, op, "QueueA", payloadqueue.ActionPause); err != nil {
+			t.Errorf("Expected the operator to pause, got %s", err.Error())
+		}
+		if err := auth.Authorize(ctx, op, "QueueA", payloadqueue.ActionPurge); !errors.Is(err, payloadqueue.ErrForbidden) {
+			t.Errorf("Expected the operator not to purge, got %v", err)
+		}
+		both := payloadqueue.Caller{Subject: "kim", Roles: []string{"operator", "admin"}}
+		if err := auth.Authorize(ctx, both, "QueueA", payloadqueue.ActionPurge); err != nil {
+			t.Errorf("Expected the admin to purge, got %s", err.Error())
+		}
+	})
+}
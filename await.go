@@ -0,0 +1,127 @@
+package payloadqueue
+
+import (
+	"context"
+	"sync"
+)
+
+// Outcome to report how a payload left the Queue, see Await
+type Outcome struct {
+	PayloadId   string
+	BatchId     string // the batch it was last pushed in. Empty if it expired before being batched
+	Delivered   bool
+	Expired     bool
+	Removed     bool              // pulled out of the queue by Remove before it was batched
+	Err         error             // the error of the handler when the payload was dead-lettered or discarded
+	Annotations map[string]string // attached to the batch by the sink, see Annotate
+}
+
+// Await to wait until the payload with the id is delivered, dead-lettered, discarded, expired or
+// removed, and return its Outcome. A payload that left the queue before Await was called is found among the
+// last AwaitHistory outcomes. Retries are waited for; purged payloads never resolve.
+func (q *Queue) Await(ctx context.Context, id string) (Outcome, error) {
+	outcome, stop := q.Watch(id)
+	defer stop()
+	select {
+	case o := <-outcome:
+		return o, nil
+	case <-ctx.Done():
+		return Outcome{PayloadId: id}, ctx.Err()
+	}
+}
+
+// Watch to start waiting for the Outcome of the payload with the id, e.g. before it is appended, so
+// it cannot leave the last AwaitHistory outcomes before it is waited for. The channel receives the
+// Outcome once; stop ends the wait.
+func (q *Queue) Watch(id string) (outcome <-chan Outcome, stop func()) {
+	ch := q.outcomes.wait(id)
+	return ch, func() { q.outcomes.forget(id, ch) }
+}
+
+// outcomes to hold the recent outcomes of a Queue and the Await calls waiting on one
+type outcomes struct {
+	mutex   sync.Mutex
+	limit   int
+	recent  map[string]Outcome
+	order   []string // ids in recent, oldest first
+	waiters map[string][]chan Outcome
+}
+
+// wait to return a channel that receives the outcome of the payload with the id
+func (o *outcomes) wait(id string) chan Outcome {
+	ch := make(chan Outcome, 1)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if out, ok := o.recent[id]; ok {
+		ch <- out
+		return ch
+	}
+	if o.waiters == nil {
+		o.waiters = make(map[string][]chan Outcome)
+	}
+	o.waiters[id] = append(o.waiters[id], ch)
+	return ch
+}
+
+// forget to stop waiting on the channel
+func (o *outcomes) forget(id string, ch chan Outcome) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	chs := o.waiters[id]
+	for i, c := range chs {
+		if c == ch {
+			chs = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(chs) == 0 {
+		delete(o.waiters, id)
+		return
+	}
+	o.waiters[id] = chs
+}
+
+// resolve to remember the outcomes and hand them to the Await calls waiting on them
+func (o *outcomes) resolve(outs []Outcome) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.recent == nil {
+		o.recent = make(map[string]Outcome)
+	}
+	for _, out := range outs {
+		for _, ch := range o.waiters[out.PayloadId] {
+			ch <- out
+		}
+		delete(o.waiters, out.PayloadId)
+		if o.limit <= 0 {
+			continue
+		}
+		if _, ok := o.recent[out.PayloadId]; !ok {
+			o.order = append(o.order, out.PayloadId)
+		}
+		o.recent[out.PayloadId] = out
+		for len(o.order) > o.limit {
+			delete(o.recent, o.order[0])
+			o.order = o.order[1:]
+		}
+	}
+}
+
+// settle to resolve the outcomes of the payloads of a batch
+func (q *Queue) settle(batch *Batch, pls []Payload, delivered bool, err error) {
+	if len(pls) == 0 {
+		return
+	}
+	annotations := batch.Annotations()
+	outs := make([]Outcome, 0, len(pls))
+	for _, p := range pls {
+		for _, id := range append([]string{p.Id}, p.coalesced...) {
+			out := Outcome{PayloadId: id, BatchId: batch.Id, Delivered: delivered, Annotations: annotations}
+			if !delivered {
+				out.Err = err
+			}
+			outs = append(outs, out)
+		}
+	}
+	q.outcomes.resolve(outs)
+}
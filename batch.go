@@ -0,0 +1,181 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Batch to describe the batch that is being pushed to the Work handler. It is carried by the
+// context passed to WorkContext so the handler can reach the payload Ids and Headers alongside the
+// Data it receives, and annotate the batch with where it was delivered to, see Annotate.
+type Batch struct {
+	Id          string
+	Number      uint64 // counts the batches pushed by the queue, from 1, so consumers can detect a missing batch
+	Tag         string
+	Payloads    []Payload
+	SplitFrom   string // the Id of the batch this one is a chunk of, when the handler rejected that one as too large, see TooLarge
+	mutex       sync.Mutex
+	annotations map[string]string
+	ack         AckFunc // settles a batch taken from Batches
+}
+
+// Annotate to attach the annotation to the batch, e.g. "location" and the object the batch was
+// uploaded to. The annotations are recorded in the Journal, the "batch finished" event and the
+// Outcomes returned by Await. Annotating a key again replaces its value.
+func (b *Batch) Annotate(key, value string) {
+	b.mutex.Lock()
+	if b.annotations == nil {
+		b.annotations = make(map[string]string)
+	}
+	b.annotations[key] = value
+	b.mutex.Unlock()
+}
+
+// Annotations to return a copy of the annotations attached to the batch so far
+func (b *Batch) Annotations() map[string]string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.annotations) == 0 {
+		return nil
+	}
+	a := make(map[string]string, len(b.annotations))
+	for k, v := range b.annotations {
+		a[k] = v
+	}
+	return a
+}
+
+// ErrNacked is the error of the payloads of a batch given back with Nack and no error
+var ErrNacked = errors.New("the batch was nacked")
+
+// Ack to acknowledge a batch taken from Batches as delivered. Only the first Ack or Nack counts, and
+// it does nothing for a batch pushed to a Work handler.
+func (b *Batch) Ack() {
+	b.settle(nil)
+}
+
+// Nack to fail a batch taken from Batches, so its payloads are retried or dead-lettered as for a
+// failed batch. A BatchError fails only the payloads it reports. Nil fails them with ErrNacked.
+func (b *Batch) Nack(err error) {
+	if err == nil {
+		err = ErrNacked
+	}
+	b.settle(err)
+}
+
+// settle to call the AckFunc of the batch, if it has one
+func (b *Batch) settle(err error) {
+	b.mutex.Lock()
+	ack := b.ack
+	b.mutex.Unlock()
+	if ack != nil {
+		ack(err)
+	}
+}
+
+// Annotate to attach the annotation to the batch carried by the context passed to WorkContext. It
+// does nothing outside of a batch.
+func Annotate(ctx context.Context, key, value string) {
+	if b, ok := BatchFromContext(ctx); ok {
+		b.Annotate(key, value)
+	}
+}
+
+// batchKey is the context key of the Batch
+type batchKey struct{}
+
+// BatchFromContext to return the Batch carried by the context passed to WorkContext.
+func BatchFromContext(ctx context.Context) (*Batch, bool) {
+	b, ok := ctx.Value(batchKey{}).(*Batch)
+	return b, ok
+}
+
+// withBatch to return a context carrying the Batch
+func withBatch(ctx context.Context, b *Batch) context.Context {
+	return context.WithValue(ctx, batchKey{}, b)
+}
+
+// PayloadResult to report the outcome of the payload at Index of the batch passed to the handler
+type PayloadResult struct {
+	Index int
+	Err   error
+}
+
+// BatchError to be returned by WorkContext when only some of the payloads in the batch failed.
+// Only the payloads with a non-nil Err in the Results are retried or dead-lettered; the rest of
+// the batch is treated as delivered.
+type BatchError struct {
+	Results []PayloadResult
+}
+
+func (e *BatchError) Error() string {
+	n := 0
+	var first error
+	for _, r := range e.Results {
+		if r.Err != nil {
+			if first == nil {
+				first = r.Err
+			}
+			n++
+		}
+	}
+	if first == nil {
+		return "no payloads failed"
+	}
+	return strconv.Itoa(n) + " payloads failed, first error: " + first.Error()
+}
+
+// failures to return the payloads of the batch that the BatchError reports as failed
+func (e *BatchError) failures(pls []Payload) []Payload {
+	failed := make([]Payload, 0, len(e.Results))
+	for _, r := range e.Results {
+		if r.Err != nil && r.Index >= 0 && r.Index < len(pls) {
+			failed = append(failed, pls[r.Index])
+		}
+	}
+	return failed
+}
+
+// BatchResult to report what became of a batch processed by a Queue, see OnBatchDone
+type BatchResult struct {
+	BatchId      string
+	Tag          string
+	PayloadIds   []string
+	Failed       []string // ids of the payloads that failed, retried or dead-lettered
+	DeadLettered []string // ids of the failed payloads with no retries left
+	Started      time.Time
+	Duration     time.Duration
+	Result       int   // the result code returned by the Work handler. Zero on success and for WorkContext
+	Err          error // the error of the handler, a ResultCodeError for a non-zero result code
+	Annotations  map[string]string
+}
+
+// batchDoneHandler to receive the result of a batch once its failed payloads are settled
+type batchDoneHandler func(BatchResult)
+
+// newBatchResult to describe the processed batch
+func newBatchResult(b *Batch, started, finished time.Time, failures, dead []Payload, err error) BatchResult {
+	r := BatchResult{
+		BatchId:     b.Id,
+		Tag:         b.Tag,
+		PayloadIds:  payloadIds(b.Payloads),
+		Started:     started,
+		Duration:    finished.Sub(started),
+		Err:         err,
+		Annotations: b.Annotations(),
+	}
+	if len(failures) > 0 {
+		r.Failed = payloadIds(failures)
+	}
+	if len(dead) > 0 {
+		r.DeadLettered = payloadIds(dead)
+	}
+	var code ResultCodeError
+	if errors.As(err, &code) {
+		r.Result = int(code)
+	}
+	return r
+}
@@ -0,0 +1,63 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+)
+
+// Transform to turn a batch of one queue into the data appended to the next queue of a Pipe. A
+// result that is a Payload is appended as is, keeping its Id and Headers; any other result
+// becomes the Data of a new Payload.
+type Transform func(ctx context.Context, pls []interface{}) ([]interface{}, error)
+
+// Pipe to return a WorkContext handler that transforms each batch and appends the results to the
+// next queue, e.g. to batch-validate then batch-upload. A nil transform passes the batch on as is.
+// When the next queue is full the handler fails (OverflowReject), so the batch is retried, or
+// waits (OverflowBlock), holding the Concurrency of this queue until there is room; either way a
+// slow downstream pushes back upstream instead of piling payloads up.
+func Pipe(next *Queue, transform Transform) workContextHandler {
+	return func(ctx context.Context, pls []interface{}) error {
+		results := pls
+		if transform != nil {
+			var err error
+			if results, err = transform(ctx, pls); err != nil {
+				return err
+			}
+		}
+		out := make([]Payload, 0, len(results))
+		for _, v := range results {
+			if p, ok := v.(Payload); ok {
+				out = append(out, p)
+				continue
+			}
+			out = append(out, next.NewPayload(v))
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		// the results the Validator of the next queue rejects are reported by it; retrying the
+		// batch would only append the valid ones again
+		if err := next.appendBatch(out); err != nil && !errors.Is(err, ErrInvalidPayload) {
+			return err
+		}
+		return nil
+	}
+}
+
+// Chain to connect the queues into a pipeline: the batches of each queue are transformed by the
+// transform at the same index and appended to the queue after it. The last queue keeps its own
+// Work. The queues may be started before or after they are chained.
+func Chain(queues []*Queue, transforms ...Transform) error {
+	if len(queues) < 2 {
+		return errors.New("a chain needs at least two queues")
+	}
+	if len(transforms) != len(queues)-1 {
+		return errors.New("a chain needs one transform, possibly nil, between each pair of queues")
+	}
+	for i, t := range transforms {
+		if err := queues[i].SetWorkContext(Pipe(queues[i+1], t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package payloadqueue_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestChain(t *testing.T) {
+	t.Run("Validated batches are uploaded by the next queue", func(t *testing.T) {
+		var runMutex sync.Mutex
+		uploaded := []interface{}{}
+		validate := &payloadqueue.Queue{Tag: "Validate", MaxSize: 4, MaxAge: 200}
+		upload := &payloadqueue.Queue{
+			Tag:     "Upload",
+			MaxSize: 2,
+			MaxAge:  200,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				uploaded = append(uploaded, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		err := payloadqueue.Chain([]*payloadqueue.Queue{validate, upload}, func(ctx context.Context, pls []interface{}) ([]interface{}, error) {
+			var valid []interface{}
+			for _, v := range pls {
+				if v.(int)%2 == 0 {
+					valid = append(valid, v)
+				}
+			}
+			return valid, nil
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		validate.Start()
+		upload.Start()
+		for i := 0; i < 12; i++ {
+			validate.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+		}
+		validate.Close()
+		upload.Close()
+		if len(uploaded) != 6 {
+			t.Errorf("Expected the 6 valid payloads uploaded, got %v", uploaded)
+		}
+	})
+
+	t.Run("A slow downstream pushes back upstream", func(t *testing.T) {
+		var runMutex sync.Mutex
+		most, delivered := 0, 0
+		upload := &payloadqueue.Queue{
+			Tag:         "Upload",
+			MaxSize:     5,
+			MaxAge:      200,
+			MaxPending:  10,
+			Overflow:    payloadqueue.OverflowBlock,
+			Concurrency: 1,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				time.Sleep(20 * time.Millisecond)
+				runMutex.Lock()
+				delivered += len(pls)
+				runMutex.Unlock()
+				return nil
+			},
+		}
+		upload.Start()
+		validate := &payloadqueue.Queue{
+			Tag:         "Validate",
+			MaxSize:     5,
+			MaxAge:      200,
+			Concurrency: 1,
+			WorkContext: payloadqueue.Pipe(upload, nil),
+		}
+		validate.Start()
+		for i := 0; i < 50; i++ {
+			validate.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+			s := upload.Stats()
+			runMutex.Lock()
+			if held := s.Pending + s.ActiveWork*5; held > most {
+				most = held
+			}
+			runMutex.Unlock()
+		}
+		validate.Close()
+		upload.Close()
+		if delivered != 50 {
+			t.Errorf("Expected all 50 payloads delivered, got %d", delivered)
+		}
+		if most > 15 {
+			t.Errorf("Expected the upload queue to hold at most 15 payloads, held %d", most)
+		}
+		if s := upload.Stats(); s.Rejected != 0 {
+			t.Errorf("Expected no payload rejected, got %d", s.Rejected)
+		}
+	})
+}
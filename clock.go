@@ -0,0 +1,129 @@
+package payloadqueue
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Clock to tell the time of the batch windows, delays, expiries and latencies of a Queue. The
+// system clock is used unless one is supplied; queuetest.Clock is a fake one that only moves when
+// told to, so the batch-window logic can be tested without real sleeps.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	After(d time.Duration) <-chan time.Time
+}
+
+// MonotonicClock is implemented by a Clock that also tells the time elapsed on a monotonic clock,
+// which adjustments of the wall clock (NTP corrections, a VM suspended and resumed) do not move.
+// The batch windows of a Queue follow it, and a wall clock that moves apart from it is reported as
+// a jump. The system clock and queuetest.Clock implement it.
+type MonotonicClock interface {
+	Clock
+	// Elapsed returns the monotonic time elapsed since a fixed point in the past.
+	Elapsed() time.Duration
+}
+
+// clockJump is how far the wall clock may move apart from the monotonic clock between two wakes
+// of the timer before it is reported as a jump
+const clockJump = time.Second
+
+// Timer of a Clock, as a time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// systemClock to tell the time with the time package
+type systemClock struct{}
+
+// epoch is the fixed point the monotonic time of the systemClock is elapsed from
+var epoch = time.Now()
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) Elapsed() time.Duration                 { return time.Since(epoch) }
+func (systemClock) NewTimer(d time.Duration) Timer         { return systemTimer{time.NewTimer(d)} }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// systemTimer to adapt a time.Timer to the Timer
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+// clock to return the Clock, or the system clock when none is supplied
+func (q *Queue) clock() Clock {
+	if q.Clock == nil {
+		return systemClock{}
+	}
+	return q.Clock
+}
+
+// now to return the time of the Clock
+func (q *Queue) now() time.Time {
+	return q.clock().Now()
+}
+
+// afterFunc to call f in its own goroutine once d has passed on the Clock, unless the returned stop
+// is called first
+func (q *Queue) afterFunc(d time.Duration, f func()) (stop func()) {
+	timer := q.clock().NewTimer(d)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-timer.C():
+			f()
+		case <-stopped:
+		}
+	}()
+	return func() {
+		timer.Stop()
+		close(stopped)
+	}
+}
+
+// elapsed to return the time elapsed since the queue started on the clock its batch windows follow:
+// the monotonic time of a MonotonicClock unless WallClock is set, the time of the Clock otherwise
+func (q *Queue) elapsed() time.Duration {
+	if mc, ok := q.clock().(MonotonicClock); ok && !q.WallClock {
+		return mc.Elapsed() - q.origin.elapsed
+	}
+	return q.now().Round(0).Sub(q.origin.wall)
+}
+
+// watchClock to report a jump of the wall clock against the monotonic clock since the last wake
+// of the timer. It is only called by the timer.
+func (q *Queue) watchClock() {
+	mc, ok := q.clock().(MonotonicClock)
+	if !ok {
+		return
+	}
+	wall, elapsed := mc.Now().Round(0), mc.Elapsed()
+	jump := wall.Sub(q.watched.wall) - (elapsed - q.watched.elapsed)
+	q.watched = clockReading{wall: wall, elapsed: elapsed}
+	if jump > -clockJump && jump < clockJump {
+		return
+	}
+	follow := "the batch windows keep to the monotonic clock"
+	if q.WallClock {
+		follow = "the batch windows follow the wall clock"
+	}
+	q.log(slog.LevelWarn, "clock jumped", "Clock: Wall clock jumped by "+jump.String()+", "+follow,
+		slog.Duration("jump", jump))
+}
+
+// clockReading to hold the wall and the monotonic time read at the same moment
+type clockReading struct {
+	wall    time.Time
+	elapsed time.Duration
+}
+
+// read to return the wall and the monotonic time of the clock
+func (q *Queue) read() clockReading {
+	r := clockReading{wall: q.now().Round(0)}
+	if mc, ok := q.clock().(MonotonicClock); ok {
+		r.elapsed = mc.Elapsed()
+	}
+	return r
+}
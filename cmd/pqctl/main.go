@@ -0,0 +1,258 @@
+// pqctl administers the queues of a running process served by the httpserver.
+//
+//	pqctl -addr http://localhost:8080 queues
+//	pqctl stats QueueA
+//	pqctl events -level warn QueueA
+//	pqctl flush|pause|resume|redrive|purge QueueA
+//	pqctl deadletters -max 20 QueueA
+//	pqctl replay -batch ID QueueA
+//	pqctl replay -since 2026-10-14T09:00:00Z QueueA
+//
+// queues lists every queue with its depth, in-flight batches and outcomes; stats prints the Stats
+// of a queue and events follows its events until interrupted. replay enqueues again the payloads
+// delivered in a batch, or since a time. The admin actions and deadletters are subject to the
+// Authorizer of the server, which is sent the -token as a bearer token.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/httpserver"
+)
+
+// client to call the httpserver
+type client struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+func main() {
+	addr := flag.String("addr", "http://localhost:8080", "base URL of the httpserver")
+	token := flag.String("token", os.Getenv("PQCTL_TOKEN"), "bearer token sent to the server (default $PQCTL_TOKEN)")
+	timeout := flag.Duration("timeout", 10*time.Second, "deadline of each request, except events")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: pqctl [flags] queues | stats TAG | events [-level LEVEL] TAG | flush|pause|resume|redrive|purge TAG | deadletters [-max N] TAG | replay -batch ID|-since TIME TAG")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c := &client{addr: strings.TrimRight(*addr, "/"), token: *token, http: &http.Client{Timeout: *timeout}}
+	if err := c.run(flag.Arg(0), flag.Args()[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "pqctl:", err)
+		os.Exit(1)
+	}
+}
+
+// run to run the command with its arguments
+func (c *client) run(cmd string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	level := fs.String("level", "info", "lowest level of the events followed: debug, info, warn or error")
+	max := fs.Int("max", 20, "most dead-lettered payloads listed, 0 for all")
+	batch := fs.String("batch", "", "id of the batch whose payloads are replayed")
+	since := fs.String("since", "", "replay the payloads delivered since the time, in RFC 3339")
+	fs.Parse(args)
+	if cmd == "queues" {
+		return c.queues(out)
+	}
+	if fs.NArg() != 1 {
+		return errors.New(cmd + " needs the tag of a queue")
+	}
+	tag := fs.Arg(0)
+	switch cmd {
+	case "stats":
+		var stats plq.Stats
+		if err := c.get(queuePath(tag, "stats"), &stats); err != nil {
+			return err
+		}
+		return printJSON(out, statsView{Stats: stats, TimeInQueue: summarize(stats.TimeInQueue), BatchLatency: summarize(stats.BatchLatency)})
+	case "events":
+		return c.events(out, tag, *level)
+	case "deadletters":
+		var dls []plq.DeadLetter
+		if err := c.get(queuePath(tag, "deadletters")+"?"+url.Values{"max": {strconv.Itoa(*max)}}.Encode(), &dls); err != nil {
+			return err
+		}
+		for _, d := range dls {
+			data, _ := json.Marshal(d.Payload.Data)
+			fmt.Fprintf(out, "%s %s attempts=%d reason=%q data=%s\n", d.At.Format(time.RFC3339), d.Payload.Id, d.Payload.Attempts, d.Reason, data)
+		}
+		return nil
+	case "replay":
+		query := url.Values{}
+		if *batch != "" {
+			query.Set("batch", *batch)
+		}
+		if *since != "" {
+			query.Set("since", *since)
+		}
+		var result map[string]interface{}
+		if err := c.do(http.MethodPost, queuePath(tag, "replay")+"?"+query.Encode(), &result); err != nil {
+			return err
+		}
+		return printJSON(out, result)
+	case "flush", "pause", "resume", "redrive", "purge":
+		var result map[string]interface{}
+		if err := c.do(http.MethodPost, queuePath(tag, cmd), &result); err != nil {
+			return err
+		}
+		if result == nil {
+			fmt.Fprintln(out, cmd, "requested")
+			return nil
+		}
+		return printJSON(out, result)
+	}
+	return errors.New("unknown command " + cmd)
+}
+
+// queuePath to return the path of the resource of the queue, with the tag escaped
+func queuePath(tag, resource string) string {
+	return "/queues/" + url.PathEscape(tag) + "/" + resource
+}
+
+// statsView to print the Stats with their histograms summarized
+type statsView struct {
+	plq.Stats
+	TimeInQueue  summary `json:"time_in_queue"`
+	BatchLatency summary `json:"batch_latency"`
+}
+
+// summary of a Histogram
+type summary struct {
+	Count int64  `json:"count"`
+	Mean  string `json:"mean"`
+	P50   string `json:"p50"`
+	P99   string `json:"p99"`
+}
+
+// summarize to summarize the histogram by its count, mean, p50 and p99
+func summarize(h plq.Histogram) summary {
+	return summary{Count: h.Count, Mean: h.Mean().String(), P50: h.Quantile(0.5).String(), P99: h.Quantile(0.99).String()}
+}
+
+// queues to list every queue of the server
+func (c *client) queues(out io.Writer) error {
+	var statuses []httpserver.QueueStatus
+	if err := c.get("/queues", &statuses); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "QUEUE\tDEPTH\tDELAYED\tIN-FLIGHT\tDELIVERED\tFAILED\tDLQ\tP99\t")
+	for _, st := range statuses {
+		tag := st.Tag
+		if st.Paused {
+			tag += " (paused)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.1fms\t\n",
+			tag, st.Pending, st.Delayed, st.ActiveWork, st.Delivered, st.Failed, st.DeadLettered, st.Latency.P99)
+	}
+	return w.Flush()
+}
+
+// events to print the events of the queue as they come, until interrupted
+func (c *client) events(out io.Writer, tag, level string) error {
+	req, err := c.request(http.MethodGet, queuePath(tag, "events")+"?"+url.Values{"level": {level}}.Encode())
+	if err != nil {
+		return err
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+	streaming := &http.Client{Transport: c.http.Transport}
+	res, err := streaming.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := check(res); err != nil {
+		return err
+	}
+	go func() {
+		<-stop
+		res.Body.Close()
+	}()
+	dec := json.NewDecoder(res.Body)
+	for {
+		var e httpserver.Event
+		if err := dec.Decode(&e); err != nil {
+			return nil
+		}
+		fmt.Fprintf(out, "%s %-5s [%s] %s\n", e.Time.Format("15:04:05.000"), e.Level, e.Tag, e.Message)
+	}
+}
+
+// get to read the JSON response of a GET
+func (c *client) get(path string, v interface{}) error {
+	return c.do(http.MethodGet, path, v)
+}
+
+// do to send the request and decode its JSON response into v, if it has one
+func (c *client) do(method, path string, v interface{}) error {
+	req, err := c.request(method, path)
+	if err != nil {
+		return err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := check(res); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil || len(body) == 0 {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// request to build a request to the server, with the token
+func (c *client) request(method, path string) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// check to turn an error response into an error, with the message of the server
+func check(res *http.Response) error {
+	if res.StatusCode < 300 {
+		return nil
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(res.Body).Decode(&e)
+	if e.Error == "" {
+		return errors.New(res.Request.Method + " " + res.Request.URL.Path + ": " + res.Status)
+	}
+	return errors.New(res.Request.Method + " " + res.Request.URL.Path + ": " + res.Status + ": " + e.Error)
+}
+
+// printJSON to print v as indented JSON
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	var runMutex sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runMutex.Lock()
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("Authorization"))
+		runMutex.Unlock()
+		path := r.URL.EscapedPath()
+		switch {
+		case path == "/queues":
+			w.Write([]byte(`[{"tag": "orders/eu", "pending": 3, "paused": true, "latency": {"p99_ms": 1.5}}]`))
+		case strings.HasSuffix(path, "/stats"):
+			w.Write([]byte(`{"tag": "orders/eu", "pending": 3}`))
+		case strings.HasSuffix(path, "/events"):
+			w.Write([]byte(`{"time": "2026-10-15T09:00:00Z", "tag": "orders/eu", "level": "WARN", "message": "Batch failed"}` + "\n"))
+		case strings.HasSuffix(path, "/deadletters"):
+			w.Write([]byte(`[{"Payload": {"Id": "1", "Data": "a", "Attempts": 3}, "Reason": "boom", "At": "2026-10-15T09:00:00Z"}]`))
+		case strings.HasSuffix(path, "/replay"):
+			w.Write([]byte(`{"replayed": 2}`))
+		case strings.HasSuffix(path, "/flush"):
+			w.WriteHeader(http.StatusAccepted)
+		case strings.HasSuffix(path, "/purge"):
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "forbidden"}`))
+		default:
+			w.Write([]byte(`{"paused": true}`))
+		}
+	}))
+	defer srv.Close()
+	c := &client{addr: srv.URL, token: "secret", http: srv.Client()}
+	run := func(t *testing.T, cmd string, args ...string) (string, string) {
+		t.Helper()
+		runMutex.Lock()
+		requests = nil
+		runMutex.Unlock()
+		var out bytes.Buffer
+		if err := c.run(cmd, args, &out); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if len(requests) != 1 {
+			t.Fatalf("Expected one request, got %v", requests)
+		}
+		return requests[0], out.String()
+	}
+
+	t.Run("queues lists every queue", func(t *testing.T) {
+		req, out := run(t, "queues")
+		if req != "GET /queues Bearer secret" {
+			t.Errorf("Unexpected request %s", req)
+		}
+		if !strings.Contains(out, "orders/eu (paused)") || !strings.Contains(out, "1.5ms") {
+			t.Errorf("Expected the queue listed, got %s", out)
+		}
+	})
+
+	t.Run("stats escapes the tag", func(t *testing.T) {
+		req, out := run(t, "stats", "orders/eu")
+		if req != "GET /queues/orders%2Feu/stats Bearer secret" {
+			t.Errorf("Unexpected request %s", req)
+		}
+		if !strings.Contains(out, `"pending": 3`) {
+			t.Errorf("Expected the stats printed, got %s", out)
+		}
+	})
+
+	t.Run("events follows the events of the queue", func(t *testing.T) {
+		req, out := run(t, "events", "-level", "warn", "orders/eu")
+		if req != "GET /queues/orders%2Feu/events?level=warn Bearer secret" {
+			t.Errorf("Unexpected request %s", req)
+		}
+		if !strings.Contains(out, "WARN  [orders/eu] Batch failed") {
+			t.Errorf("Expected the event printed, got %s", out)
+		}
+	})
+
+	t.Run("deadletters lists the dead letters", func(t *testing.T) {
+		req, out := run(t, "deadletters", "-max", "5", "orders/eu")
+		if req != "GET /queues/orders%2Feu/deadletters?max=5 Bearer secret" {
+			t.Errorf("Unexpected request %s", req)
+		}
+		if !strings.Contains(out, `1 attempts=3 reason="boom" data="a"`) {
+			t.Errorf("Expected the dead letter printed, got %s", out)
+		}
+	})
+
+	t.Run("replay escapes the batch", func(t *testing.T) {
+		req, out := run(t, "replay", "-batch", "a&b=c", "orders/eu")
+		if req != "POST /queues/orders%2Feu/replay?batch=a%26b%3Dc Bearer secret" {
+			t.Errorf("Unexpected request %s", req)
+		}
+		if !strings.Contains(out, `"replayed": 2`) {
+			t.Errorf("Expected the result printed, got %s", out)
+		}
+	})
+
+	t.Run("The admin actions are posted", func(t *testing.T) {
+		for _, cmd := range []string{"flush", "pause", "resume", "redrive"} {
+			req, out := run(t, cmd, "orders/eu")
+			if req != "POST /queues/orders%2Feu/"+cmd+" Bearer secret" {
+				t.Errorf("Unexpected request %s", req)
+			}
+			if out == "" {
+				t.Errorf("Expected the result of %s printed", cmd)
+			}
+		}
+	})
+
+	t.Run("A refused action returns the error of the server", func(t *testing.T) {
+		err := c.run("purge", []string{"orders/eu"}, &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), "403 Forbidden: forbidden") {
+			t.Errorf("Expected the refusal, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+// pqreplay steps through the decisions recorded in the DecisionLog of a payloadqueue.Queue.
+//
+//	pqreplay -file decisions.log -tag QueueA -flushes
+//
+// Every decision is printed with the inputs it was based on. With -step the replay waits for
+// Enter after each decision (q and Enter quits).
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+func main() {
+	file := flag.String("file", "", "decision log to replay (default stdin)")
+	tag := flag.String("tag", "", "only replay the decisions of this queue")
+	flushes := flag.Bool("flushes", false, "only replay the decisions that flushed a batch")
+	step := flag.Bool("step", false, "wait for Enter after each decision")
+	flag.Parse()
+
+	in := os.Stdin
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	ds, err := plq.ReadDecisions(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var keys *bufio.Reader
+	if *step {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer tty.Close()
+		keys = bufio.NewReader(tty)
+	}
+	for i, d := range ds {
+		if *tag != "" && d.Tag != *tag {
+			continue
+		}
+		if *flushes && !d.Flush {
+			continue
+		}
+		fmt.Println(describe(i+1, d))
+		if keys != nil {
+			line, _ := keys.ReadString('\n')
+			if strings.TrimSpace(line) == "q" {
+				return
+			}
+		}
+	}
+}
+
+// describe to explain a decision in one line
+func describe(n int, d plq.Decision) string {
+	s := fmt.Sprintf("#%d %s [%s] %s: depth %d/%d, delayed %d", n, d.Time.Format("15:04:05.000"), d.Tag, d.Trigger, d.Depth, d.BatchSize, d.Delayed)
+	if d.Trigger == "schedule" {
+		return s + fmt.Sprintf(", next wake in %s", d.NextWake)
+	}
+	s += fmt.Sprintf(", age %s/%s", d.Age.Round(1e6), d.MaxAge)
+	switch d.Reason {
+	case "full":
+		return s + " -> flush: batch size reached"
+	case "expired":
+		return s + " -> flush: max age reached"
+	}
+	return s + " -> wait"
+}
@@ -0,0 +1,187 @@
+// pqtop live-displays the queues of a process served by the httpserver, polling GET /queues.
+//
+//	pqtop -addr http://localhost:8080 -interval 1s -token $TOKEN
+//
+// Every queue is shown with its depth, in-flight batches, dead-lettered payloads, batch and
+// payload throughput, and sparklines of its throughput and p50 latency. q and Enter quits.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sam-ish/payloadqueue/httpserver"
+)
+
+// sparks are the levels of a sparkline, lowest first
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// series to hold what is shown of a queue between polls
+type series struct {
+	last       httpserver.QueueStatus
+	at         time.Time
+	batchRate  float64
+	throughput []float64 // delivered payloads per second, oldest first
+	latency    []float64 // p50 in milliseconds, oldest first
+}
+
+func main() {
+	addr := flag.String("addr", "http://localhost:8080", "base URL of the httpserver")
+	interval := flag.Duration("interval", time.Second, "how often the queues are polled")
+	width := flag.Int("width", 30, "number of polls the sparklines cover")
+	token := flag.String("token", os.Getenv("PQCTL_TOKEN"), "bearer token sent to the server (default $PQCTL_TOKEN)")
+	flag.Parse()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	go func() {
+		keys := bufio.NewScanner(os.Stdin)
+		for keys.Scan() {
+			if strings.TrimSpace(keys.Text()) == "q" {
+				quit <- os.Interrupt
+				return
+			}
+		}
+		// stdin is not a terminal or was closed: only an interrupt quits
+	}()
+
+	client := &http.Client{Timeout: *interval}
+	all := make(map[string]*series)
+	fmt.Print("\x1b[?25l")
+	defer fmt.Print("\x1b[?25h")
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		statuses, err := poll(client, *addr, *token)
+		now := time.Now()
+		if err == nil {
+			for _, st := range statuses {
+				update(all, st, now, *width)
+			}
+		}
+		fmt.Print("\x1b[H\x1b[2J" + render(*addr, now, statuses, all, *width, err))
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll to read the QueueStatus of every queue the token may observe
+func poll(client *http.Client, addr, token string) ([]httpserver.QueueStatus, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/queues", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /queues: %s", res.Status)
+	}
+	var statuses []httpserver.QueueStatus
+	if err := json.NewDecoder(res.Body).Decode(&statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// update to add the status of a queue to its series, keeping the last width points
+func update(all map[string]*series, st httpserver.QueueStatus, now time.Time, width int) {
+	s, ok := all[st.Tag]
+	if !ok {
+		all[st.Tag] = &series{last: st, at: now}
+		return
+	}
+	secs := now.Sub(s.at).Seconds()
+	if secs <= 0 {
+		return
+	}
+	s.batchRate = float64(since(st.Batches, s.last.Batches)) / secs
+	s.throughput = keep(append(s.throughput, float64(since(st.Delivered, s.last.Delivered))/secs), width)
+	s.latency = keep(append(s.latency, st.Latency.P50), width)
+	s.last, s.at = st, now
+}
+
+// since to count how much a counter grew, counting from zero when it went backwards as the
+// server restarted
+func since(now, last int64) int64 {
+	if now < last {
+		return now
+	}
+	return now - last
+}
+
+// keep to drop the oldest points beyond width
+func keep(points []float64, width int) []float64 {
+	if len(points) > width {
+		return points[len(points)-width:]
+	}
+	return points
+}
+
+// render to draw the screen
+func render(addr string, now time.Time, statuses []httpserver.QueueStatus, all map[string]*series, width int, err error) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "pqtop  %s  %s  (q and Enter quits)\n\n", addr, now.Format("15:04:05"))
+	if err != nil {
+		fmt.Fprintf(&b, "poll failed: %s\n", err.Error())
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%-16s %7s %7s %9s %7s %8s %9s %9s  %s %s\n",
+		"QUEUE", "DEPTH", "DELAYED", "IN-FLIGHT", "DLQ", "BATCH/S", "PAYLOAD/S", "P50", pad("THROUGHPUT", width), "LATENCY")
+	for _, st := range statuses {
+		s := all[st.Tag]
+		tag := st.Tag
+		if st.Paused {
+			tag += " (paused)"
+		}
+		var payloadRate float64
+		if n := len(s.throughput); n > 0 {
+			payloadRate = s.throughput[n-1]
+		}
+		fmt.Fprintf(&b, "%-16s %7d %7d %9d %7d %8.1f %9.1f %7.1fms  %s %s\n",
+			tag, st.Pending, st.Delayed, st.ActiveWork, st.DeadLettered, s.batchRate, payloadRate,
+			st.Latency.P50, pad(sparkline(s.throughput), width), sparkline(s.latency))
+	}
+	return b.String()
+}
+
+// sparkline to draw the points, scaled to the largest of them
+func sparkline(points []float64) string {
+	var top float64
+	for _, p := range points {
+		top = max(top, p)
+	}
+	var b strings.Builder
+	for _, p := range points {
+		level := 0
+		if top > 0 && p > 0 {
+			level = min(int(p/top*float64(len(sparks)-1)), len(sparks)-1)
+		}
+		b.WriteRune(sparks[level])
+	}
+	return b.String()
+}
+
+// pad to pad the text with spaces to width runes, as the sparks take several bytes each
+func pad(text string, width int) string {
+	if n := utf8.RuneCountInString(text); n < width {
+		return text + strings.Repeat(" ", width-n)
+	}
+	return text
+}
@@ -0,0 +1,75 @@
+package payloadqueue
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+)
+
+// digest to record the hash of the Data of the payloads as encoded by the Codec, once, when a
+// CoalesceKey is supplied. Data that is a []byte or a string is hashed as is.
+func (q *Queue) digest(pls []Payload) {
+	if q.CoalesceKey == nil {
+		return
+	}
+	codec := q.Codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	for i := range pls {
+		if pls[i].digest != 0 {
+			continue
+		}
+		h := fnv.New64a()
+		switch d := pls[i].Data.(type) {
+		case []byte:
+			h.Write(d)
+		case string:
+			h.Write([]byte(d))
+		default:
+			b, err := codec.Marshal(d)
+			if err != nil {
+				continue
+			}
+			h.Write(b)
+		}
+		pls[i].digest = h.Sum64() | 1 // never zero, which means not hashed
+	}
+}
+
+// coalesce to fold the payload into the last pending payload when both are new, have the same
+// CoalesceKey and equal Data, returning whether it was folded. Payloads persisted to a Storage are
+// never coalesced. The payloadMutex must be held.
+func (q *Queue) coalesce(p Payload) bool {
+	n := q.payloadQueue.len()
+	if q.CoalesceKey == nil || q.Storage != nil || n == 0 || p.Attempts > 0 || p.digest == 0 {
+		return false
+	}
+	last := q.payloadQueue.at(n - 1)
+	if last.Attempts > 0 || last.digest != p.digest {
+		return false
+	}
+	key := q.CoalesceKey(p)
+	if key == "" || key != q.CoalesceKey(*last) {
+		return false
+	}
+	last.Count = max(last.Count, 1) + max(p.Count, 1)
+	last.coalesced = append(append(last.coalesced, p.Id), p.coalesced...)
+	return true
+}
+
+// folded to report the payloads coalesced into a pending payload. They have left the queue as far
+// as the Replicator is concerned; their outcomes are those of the payload they were folded into.
+func (q *Queue) folded(pls []Payload) {
+	if len(pls) == 0 {
+		return
+	}
+	q.counters.add(func(s *Stats) { s.Coalesced += int64(len(pls)) })
+	if q.logging(slog.LevelDebug) {
+		for _, p := range pls {
+			q.log(slog.LevelDebug, "payload coalesced", "Payload Coalesced [id]: "+p.Id+" x"+strconv.Itoa(max(p.Count, 1)),
+				slog.String("payload_id", p.Id))
+		}
+	}
+	q.acknowledge(pls)
+}
@@ -0,0 +1,207 @@
+package payloadqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Codec to serialize the Data of payloads for the Storage backends and the network modules. Data
+// is an interface{}, so Unmarshal into a *interface{} must restore a value of the type that was
+// marshalled, as far as the format allows.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec to serialize Data as JSON. Into a *interface{}, objects decode as
+// map[string]interface{} and numbers as float64. It is the default Codec.
+type JSONCodec struct{}
+
+// Marshal to encode the value as JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal to decode the JSON into the value
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec to serialize Data with encoding/gob, which restores the concrete types. Every type
+// carried as Data must be registered with gob.Register.
+type GobCodec struct{}
+
+// gobValue to carry the value as an interface, so gob records its concrete type
+type gobValue struct {
+	V interface{}
+}
+
+// Marshal to encode the value with gob
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gobValue{V: v}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal to decode the gob into the value, a *interface{} or a pointer to the marshalled type
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	var gv gobValue
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&gv); err != nil {
+		return err
+	}
+	return assign(v, gv.V)
+}
+
+// ProtoCodec to serialize Data that is a proto.Message. It is wrapped in an Any, so the message
+// type is restored from the global registry on Unmarshal.
+type ProtoCodec struct{}
+
+// Marshal to encode the message
+func (ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("payloadqueue: %T is not a proto.Message", v)
+	}
+	a, err := anypb.New(m)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(a)
+}
+
+// Unmarshal to decode the message into the value, a *interface{} or a proto.Message of its type
+func (ProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	var a anypb.Any
+	if err := proto.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	if m, ok := v.(proto.Message); ok {
+		return a.UnmarshalTo(m)
+	}
+	m, err := a.UnmarshalNew()
+	if err != nil {
+		return err
+	}
+	return assign(v, m)
+}
+
+// assign to store the decoded value through the pointer v
+func assign(v interface{}, decoded interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("payloadqueue: Unmarshal needs a non-nil pointer")
+	}
+	if decoded == nil {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		return nil
+	}
+	dv := reflect.ValueOf(decoded)
+	if !dv.Type().AssignableTo(rv.Elem().Type()) {
+		return fmt.Errorf("payloadqueue: cannot unmarshal %T into %s", decoded, rv.Elem().Type())
+	}
+	rv.Elem().Set(dv)
+	return nil
+}
+
+// codecKey is the context key of the Codec
+type codecKey struct{}
+
+// CodecFromContext to return the Codec of the queue that made the Storage or Replicator call, or
+// the JSONCodec.
+func CodecFromContext(ctx context.Context) Codec {
+	if c, ok := ctx.Value(codecKey{}).(Codec); ok && c != nil {
+		return c
+	}
+	return JSONCodec{}
+}
+
+// StorageCodec to return the Codec a Storage with a Codec of its own encodes with: that Codec,
+// encrypted by the Encryption of the queue that made the call, if it has one, as CodecFromContext
+// is. Without its own Codec, it is CodecFromContext.
+func StorageCodec(ctx context.Context, own Codec) Codec {
+	if own == nil {
+		return CodecFromContext(ctx)
+	}
+	if s, ok := ctx.Value(codecKey{}).(sealing); ok {
+		s.codec = own
+		return s
+	}
+	return own
+}
+
+// withCodec to return a context carrying the Codec
+func withCodec(ctx context.Context, c Codec) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, codecKey{}, c)
+}
+
+// Envelope is the serialized form of a Payload: its Data encoded by a Codec, the rest as is.
+type Envelope struct {
+	Id             string            `json:"id"`
+	Data           []byte            `json:"data"`
+	NotBefore      time.Time         `json:"not_before,omitzero"`
+	ExpiresAt      time.Time         `json:"expires_at,omitzero"`
+	Attempts       int               `json:"attempts,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	Sequence       uint64            `json:"sequence,omitempty"`
+	Batch          uint64            `json:"batch,omitempty"`
+	Appended       time.Time         `json:"appended,omitzero"` // when the queue accepted the payload, so it is counted on that day once restored
+}
+
+// EncodePayload to serialize the payload into an Envelope, encoded as JSON
+func EncodePayload(c Codec, p Payload) ([]byte, error) {
+	data, err := c.Marshal(p.Data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{
+		Id:             p.Id,
+		Data:           data,
+		NotBefore:      p.NotBefore,
+		ExpiresAt:      p.ExpiresAt,
+		Attempts:       p.Attempts,
+		Headers:        p.Headers,
+		IdempotencyKey: p.IdempotencyKey,
+		Sequence:       p.Sequence,
+		Batch:          p.Batch,
+		Appended:       p.appended,
+	})
+}
+
+// DecodePayload to restore a payload serialized by EncodePayload with the same Codec
+func DecodePayload(c Codec, b []byte) (Payload, error) {
+	var e Envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Payload{}, err
+	}
+	var data interface{}
+	if err := c.Unmarshal(e.Data, &data); err != nil {
+		return Payload{}, err
+	}
+	return Payload{
+		Id:             e.Id,
+		Data:           data,
+		NotBefore:      e.NotBefore,
+		ExpiresAt:      e.ExpiresAt,
+		Attempts:       e.Attempts,
+		Headers:        e.Headers,
+		IdempotencyKey: e.IdempotencyKey,
+		Sequence:       e.Sequence,
+		Batch:          e.Batch,
+		appended:       e.Appended,
+	}, nil
+}
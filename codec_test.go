@@ -0,0 +1,114 @@
+package payloadqueue_test
+
+import (
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+type order struct {
+	Id     string
+	Amount float64
+}
+
+func init() {
+	gob.Register(order{})
+}
+
+func TestCodec(t *testing.T) {
+	t.Run("JSON decodes into the generic form", func(t *testing.T) {
+		c := payloadqueue.JSONCodec{}
+		b, _ := c.Marshal(order{Id: "1", Amount: 2.5})
+		var v interface{}
+		if err := c.Unmarshal(b, &v); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if m, ok := v.(map[string]interface{}); !ok || m["Id"] != "1" || m["Amount"] != 2.5 {
+			t.Errorf("Unexpected value: %#v", v)
+		}
+	})
+
+	t.Run("Gob restores the registered type", func(t *testing.T) {
+		c := payloadqueue.GobCodec{}
+		b, err := c.Marshal(order{Id: "1", Amount: 2.5})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		var v interface{}
+		if err := c.Unmarshal(b, &v); err != nil || v != (order{Id: "1", Amount: 2.5}) {
+			t.Errorf("Unexpected value: %#v %v", v, err)
+		}
+		var o order
+		if err := c.Unmarshal(b, &o); err != nil || o.Id != "1" {
+			t.Errorf("Unexpected value: %#v %v", o, err)
+		}
+	})
+
+	t.Run("Proto restores the message type", func(t *testing.T) {
+		c := payloadqueue.ProtoCodec{}
+		b, err := c.Marshal(wrapperspb.String("hello"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		var v interface{}
+		if err := c.Unmarshal(b, &v); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if m, ok := v.(proto.Message); !ok || !proto.Equal(m, wrapperspb.String("hello")) {
+			t.Errorf("Unexpected value: %#v", v)
+		}
+		if _, err := c.Marshal("not a message"); err == nil {
+			t.Errorf("Expected error - not a proto.Message")
+		}
+	})
+
+	t.Run("Payloads keep their state in the envelope", func(t *testing.T) {
+		p := payloadqueue.Payload{
+			Id:        "1",
+			Data:      order{Id: "1", Amount: 2.5},
+			ExpiresAt: time.Now().Add(time.Hour).Round(0),
+			Attempts:  2,
+			Headers:   map[string]string{"tenant": "acme"},
+			Sequence:  7,
+			Batch:     3,
+		}
+		b, err := payloadqueue.EncodePayload(payloadqueue.GobCodec{}, p)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		out, err := payloadqueue.DecodePayload(payloadqueue.GobCodec{}, b)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if out.Id != "1" || out.Data != p.Data || !out.ExpiresAt.Equal(p.ExpiresAt) || out.Attempts != 2 || out.Headers["tenant"] != "acme" || !out.NotBefore.IsZero() ||
+			out.Sequence != 7 || out.Batch != 3 {
+			t.Errorf("Unexpected payload: %+v", out)
+		}
+	})
+}
+
+func TestCompressed(t *testing.T) {
+	t.Run("Compression is detected by the magic bytes or the header", func(t *testing.T) {
+		if enc := payloadqueue.Encoding([]byte{0x1f, 0x8b, 0x08}); enc != "gzip" {
+			t.Errorf("Expected gzip, got %q", enc)
+		}
+		if enc := payloadqueue.Encoding([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}); enc != "zstd" {
+			t.Errorf("Expected zstd, got %q", enc)
+		}
+		if enc := payloadqueue.Encoding("\x1f\x8b"); enc != "" {
+			t.Errorf("Expected a string not to be compressed, got %q", enc)
+		}
+		flagged := payloadqueue.Payload{Data: []byte("data"), Headers: map[string]string{payloadqueue.HeaderContentEncoding: "br"}}
+		if b, enc, ok := payloadqueue.Compressed(flagged); !ok || enc != "br" || string(b) != "data" {
+			t.Errorf("Expected the flagged encoding, got %q %v", enc, ok)
+		}
+		if _, _, ok := payloadqueue.Compressed(payloadqueue.Payload{Data: []byte(`{"n":1}`)}); ok {
+			t.Errorf("Expected plain bytes not to be compressed")
+		}
+	})
+}
@@ -0,0 +1,175 @@
+// Package compress trains zstd dictionaries on the payloads appended to a payloadqueue Queue.
+// Small, similar JSON payloads share most of their bytes (keys, enums, common values) yet are too
+// short for zstd to learn that on its own; compressed against a dictionary trained on a sample of
+// them, they typically shrink several times further.
+package compress
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Dictionary to compress and decompress with a trained zstd dictionary. Frames carry the ID of the
+// dictionary, so it must be kept (see Raw) for as long as data compressed with it is stored.
+type Dictionary struct {
+	ID  uint32
+	Raw []byte // the dictionary in the zstd format, as stored next to the compressed data
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// NewDictionary to load a dictionary in the zstd format, e.g. one persisted from Raw
+func NewDictionary(raw []byte) (*Dictionary, error) {
+	info, err := zstd.InspectDictionary(raw)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(raw))
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(raw))
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return &Dictionary{ID: info.ID(), Raw: raw, enc: enc, dec: dec}, nil
+}
+
+// Compress to compress the bytes into a zstd frame
+func (d *Dictionary) Compress(b []byte) []byte {
+	return d.enc.EncodeAll(b, nil)
+}
+
+// Decompress to decompress a zstd frame compressed with the dictionary
+func (d *Dictionary) Decompress(b []byte) ([]byte, error) {
+	return d.dec.DecodeAll(b, nil)
+}
+
+// Marshal to wrap a marshal function so that its output is compressed with the dictionary. It is
+// shaped as the Marshal of the byte-oriented sinks, e.g. the kafka Sink. Data that is already
+// compressed (see payloadqueue.Encoding) is returned as is.
+func (d *Dictionary) Marshal(marshal func(interface{}) ([]byte, error)) func(interface{}) ([]byte, error) {
+	return func(v interface{}) ([]byte, error) {
+		if plq.Encoding(v) != "" {
+			return v.([]byte), nil
+		}
+		b, err := marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return d.Compress(b), nil
+	}
+}
+
+// Trainer to sample payloads as they are appended and train a Dictionary on them once enough are
+// collected. Use Observe as (or call it from) the OnAppend of the queue. Training runs in the
+// background, so appends are not held up by it.
+type Trainer struct {
+	Samples     int                               // number of payloads trained on. Default is 1000
+	SampleEvery int                               // every how many appended payloads one is sampled. Default is 1
+	MaxDictSize int                               // upper bound of the dictionary size in bytes. Default is 16KB
+	Marshal     func(interface{}) ([]byte, error) // serializes the Data of a payload as the sink will. Default is json.Marshal
+	OnTrained   func(*Dictionary, error)          // receives the trained dictionary, or why training failed
+	mutex       sync.Mutex
+	seen        int
+	samples     [][]byte
+	training    bool
+	dictionary  *Dictionary
+}
+
+// Observe to sample the payload. It is shaped as an OnAppend handler.
+func (t *Trainer) Observe(p plq.Payload) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.training || t.dictionary != nil {
+		return
+	}
+	t.seen++
+	if every := t.SampleEvery; every > 1 && t.seen%every != 0 {
+		return
+	}
+	marshal := t.Marshal
+	if marshal == nil {
+		marshal = json.Marshal
+	}
+	b, err := marshal(p.Data)
+	if err != nil {
+		return
+	}
+	t.samples = append(t.samples, b)
+	if len(t.samples) >= t.sampleCount() {
+		t.training = true
+		go t.train(t.samples)
+		t.samples = nil
+	}
+}
+
+// Train to train a dictionary on the payloads sampled so far, without waiting for Samples of them
+func (t *Trainer) Train() (*Dictionary, error) {
+	t.mutex.Lock()
+	if t.training {
+		t.mutex.Unlock()
+		return nil, errors.New("compress: training is already in progress")
+	}
+	samples := t.samples
+	t.samples = nil
+	t.training = true
+	t.mutex.Unlock()
+	return t.train(samples)
+}
+
+// Dictionary to return the trained dictionary, or nil until training has finished
+func (t *Trainer) Dictionary() *Dictionary {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.dictionary
+}
+
+// train to build the dictionary from the samples. On failure the trainer starts sampling again.
+func (t *Trainer) train(samples [][]byte) (*Dictionary, error) {
+	d, err := build(samples, t.maxDictSize())
+	t.mutex.Lock()
+	t.training = false
+	if err == nil {
+		t.dictionary = d
+	}
+	t.mutex.Unlock()
+	if t.OnTrained != nil {
+		t.OnTrained(d, err)
+	}
+	return d, err
+}
+
+// build to train a dictionary of at most maxSize bytes on the samples
+func build(samples [][]byte, maxSize int) (*Dictionary, error) {
+	if len(samples) == 0 {
+		return nil, errors.New("compress: no payloads sampled")
+	}
+	raw, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: maxSize, HashBytes: 6})
+	if err != nil {
+		return nil, errors.New("compress: training on " + strconv.Itoa(len(samples)) + " payloads failed: " + err.Error())
+	}
+	return NewDictionary(raw)
+}
+
+func (t *Trainer) sampleCount() int {
+	if t.Samples <= 0 {
+		return 1000
+	}
+	return t.Samples
+}
+
+func (t *Trainer) maxDictSize() int {
+	if t.MaxDictSize <= 0 {
+		return 16 << 10
+	}
+	return t.MaxDictSize
+}
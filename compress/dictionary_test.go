@@ -0,0 +1,116 @@
+package compress_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/compress"
+)
+
+// order to return a small JSON payload like the ones a queue typically carries
+func order(i int) map[string]interface{} {
+	return map[string]interface{}{
+		"order_id":   "ord-" + strconv.Itoa(100000+i*7),
+		"customer":   map[string]interface{}{"id": "cus-" + strconv.Itoa(i%50), "segment": []string{"retail", "wholesale"}[i%2]},
+		"status":     []string{"created", "paid", "shipped"}[i%3],
+		"currency":   "EUR",
+		"amount":     float64(i%997) + 0.99,
+		"created_at": time.Date(2026, 1, 1, 0, 0, i, 0, time.UTC).Format(time.RFC3339),
+	}
+}
+
+func TestTrainer(t *testing.T) {
+	t.Run("Trained on appended payloads, the dictionary improves the ratio", func(t *testing.T) {
+		trained := make(chan *compress.Dictionary, 1)
+		trainer := &compress.Trainer{
+			Samples: 500,
+			OnTrained: func(d *compress.Dictionary, err error) {
+				if err != nil {
+					t.Errorf("Unexpected error: %s", err.Error())
+				}
+				trained <- d
+			},
+		}
+		q := &plq.Queue{
+			MaxSize:  1000,
+			MaxAge:   200,
+			OnAppend: trainer.Observe,
+			Work:     func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		for i := 0; i < 500; i++ {
+			q.Append(q.NewPayload(order(i)))
+		}
+		// training takes a while, far longer under the race detector, so it is waited for however long
+		// it takes, within the deadline of the test binary
+		d := <-trained
+		if trainer.Dictionary() != d {
+			t.Errorf("Expected the trained dictionary to be kept")
+		}
+
+		plain, _ := zstd.NewWriter(nil)
+		raw, withDict := 0, 0
+		for i := 1000; i < 1100; i++ {
+			b, _ := json.Marshal(order(i))
+			raw += len(plain.EncodeAll(b, nil))
+			c := d.Compress(b)
+			withDict += len(c)
+			if out, err := d.Decompress(c); err != nil || string(out) != string(b) {
+				t.Fatalf("Round trip failed: %v", err)
+			}
+		}
+		if withDict*2 > raw {
+			t.Errorf("Expected the dictionary to at least halve the size, got %d against %d bytes", withDict, raw)
+		}
+	})
+
+	t.Run("A persisted dictionary decompresses what it compressed", func(t *testing.T) {
+		trainer := &compress.Trainer{}
+		for i := 0; i < 200; i++ {
+			trainer.Observe(plq.Payload{Id: strconv.Itoa(i), Data: order(i)})
+		}
+		d, err := trainer.Train()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		loaded, err := compress.NewDictionary(d.Raw)
+		if err != nil || loaded.ID != d.ID {
+			t.Fatalf("Unexpected dictionary: %v", err)
+		}
+		marshal := d.Marshal(json.Marshal)
+		c, _ := marshal(order(1))
+		if out, err := loaded.Decompress(c); err != nil || len(out) == 0 {
+			t.Errorf("Unexpected decompression: %v", err)
+		}
+		if again, _ := marshal(c); !bytes.Equal(again, c) {
+			t.Errorf("Expected compressed data to pass through, got %d bytes from %d", len(again), len(c))
+		}
+	})
+}
+
+func TestZstd(t *testing.T) {
+	batch := make([]interface{}, 100)
+	for i := range batch {
+		batch[i] = order(i)
+	}
+	raw, _ := json.Marshal(batch)
+	z := &compress.Zstd{}
+	b, err := z.Compress(raw)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if z.Encoding() != "zstd" || plq.Encoding(b) != "zstd" || len(b) >= len(raw)/2 {
+		t.Errorf("Expected a zstd frame of less than half of %d bytes, got %d", len(raw), len(b))
+	}
+	dec, _ := zstd.NewReader(nil)
+	defer dec.Close()
+	if out, err := dec.DecodeAll(b, nil); err != nil || !bytes.Equal(out, raw) {
+		t.Errorf("Expected the batch back, got %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package compress
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Zstd to compress whole batches with zstd. It is a payloadqueue.Compressor:
+//
+//	q := plq.Queue{WorkContext: sink.Work, Compressor: &compress.Zstd{}}
+type Zstd struct {
+	Level zstd.EncoderLevel // Default is zstd.SpeedDefault
+	once  sync.Once
+	enc   *zstd.Encoder
+	err   error
+}
+
+// Encoding to name the compression: zstd
+func (z *Zstd) Encoding() string {
+	return "zstd"
+}
+
+// Compress to compress the bytes into a zstd frame. The encoder is created on first use and shared
+// by the batches compressed concurrently.
+func (z *Zstd) Compress(b []byte) ([]byte, error) {
+	z.once.Do(func() {
+		level := z.Level
+		if level == 0 {
+			level = zstd.SpeedDefault
+		}
+		z.enc, z.err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	})
+	if z.err != nil {
+		return nil, z.err
+	}
+	return z.enc.EncodeAll(b, nil), nil
+}
@@ -0,0 +1,148 @@
+package payloadqueue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// Compressor to compress the serialized batch for a byte-oriented handler or sink, see
+// CompressedBatch. GzipCompressor is provided here, a zstd one by the compress package.
+type Compressor interface {
+	// Encoding returns the name of the compression as a Content-Encoding, e.g. gzip.
+	Encoding() string
+	// Compress returns the bytes compressed.
+	Compress(b []byte) ([]byte, error)
+}
+
+// GzipCompressor to compress with gzip
+type GzipCompressor struct {
+	Level int // the gzip level. Default is gzip.DefaultCompression
+}
+
+// Encoding to name the compression: gzip
+func (c GzipCompressor) Encoding() string {
+	return "gzip"
+}
+
+// Compress to compress the bytes into a gzip stream
+func (c GzipCompressor) Compress(b []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type bodyKey struct{}
+
+// batchBody to serialize and compress a batch once, on the first call to CompressedBatch
+type batchBody struct {
+	once     sync.Once
+	batch    []interface{} // the batch encoded
+	encoding string
+	encode   func() ([]byte, error)
+	body     []byte
+	err      error
+}
+
+// CompressedBatch to return the batch handed to the handler, serialized by the Codec and compressed
+// by the Compressor of the queue, with the Content-Encoding to send it with. The batch is compressed
+// on the first call, so a handler that does not ask pays nothing. Without a Compressor it returns
+// no bytes and an empty encoding.
+func CompressedBatch(ctx context.Context) ([]byte, string, error) {
+	b, ok := ctx.Value(bodyKey{}).(*batchBody)
+	if !ok {
+		return nil, "", nil
+	}
+	b.once.Do(func() { b.body, b.err = b.encode() })
+	if b.err != nil {
+		return nil, "", b.err
+	}
+	return b.body, b.encoding, nil
+}
+
+// compressing to make the batch available compressed to the handler, see CompressedBatch. It wraps
+// the handler inside the Middleware, so the batch is the one the handler receives.
+func (q *Queue) compressing(work workContextHandler, c Compressor) workContextHandler {
+	return func(ctx context.Context, pl []interface{}) error {
+		if b, ok := ctx.Value(bodyKey{}).(*batchBody); ok && b.encodes(pl) {
+			return work(ctx, pl)
+		}
+		b := &batchBody{encoding: c.Encoding(), batch: pl, encode: func() ([]byte, error) { return q.compress(c, pl) }}
+		return work(context.WithValue(ctx, bodyKey{}, b), pl)
+	}
+}
+
+// preencode to serialize and compress the batch in one of the EncodeWorkers before it takes a slot
+// of the Concurrency. It returns nil without EncodeWorkers or a Compressor.
+func (q *Queue) preencode(pls []Payload) *batchBody {
+	q.workMutex.RLock()
+	c := q.Compressor
+	q.workMutex.RUnlock()
+	if q.encoders == nil || c == nil {
+		return nil
+	}
+	pl := batchData(pls)
+	b := &batchBody{encoding: c.Encoding(), batch: pl, encode: func() ([]byte, error) { return q.compress(c, pl) }}
+	q.encoders.acquire()
+	defer q.encoders.release()
+	b.once.Do(func() { b.body, b.err = b.encode() })
+	return b
+}
+
+// encodes to report whether the body is the encoding of the batch, rather than of a batch replaced
+// by a Middleware
+func (b *batchBody) encodes(pl []interface{}) bool {
+	return len(pl) == len(b.batch) && (len(pl) == 0 || &pl[0] == &b.batch[0])
+}
+
+// compress to serialize the batch with the Codec and compress it, reporting the ratio
+func (q *Queue) compress(c Compressor, pl []interface{}) ([]byte, error) {
+	codec := q.Codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	raw, err := codec.Marshal(pl)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Compress(raw)
+	if err != nil {
+		q.event("Compressor: " + c.Encoding() + " failed. " + err.Error())
+		return nil, err
+	}
+	q.counters.add(func(s *Stats) {
+		s.SerializedBytes += int64(len(raw))
+		s.CompressedBytes += int64(len(body))
+	})
+	ratio := compressionRatio(Stats{SerializedBytes: int64(len(raw)), CompressedBytes: int64(len(body))})
+	q.log(slog.LevelDebug, "batch compressed",
+		"Batch Push ["+q.Tag+"]: Compressed "+strconv.Itoa(len(raw))+" to "+strconv.Itoa(len(body))+" bytes with "+c.Encoding()+
+			" ("+strconv.FormatFloat(ratio, 'f', 1, 64)+"x)",
+		slog.Int("bytes", len(raw)), slog.Int("compressed_bytes", len(body)), slog.Float64("compression_ratio", ratio))
+	return body, nil
+}
+
+// compressionRatio to return the serialized bytes per compressed byte, zero before any batch is
+// compressed
+func compressionRatio(s Stats) float64 {
+	if s.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.SerializedBytes) / float64(s.CompressedBytes)
+}
@@ -0,0 +1,99 @@
+package payloadqueue
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// BatchPricing to describe the cost of a sink that is billed per request and per item, and how
+// long a payload may wait in the queue. When supplied on a Queue the batch size is chosen from the
+// observed traffic to minimize the cost without breaking the LatencyTarget.
+type BatchPricing struct {
+	PerRequest    float64       // cost of each Work call
+	PerItem       float64       // cost of each payload sent in a Work call
+	LatencyTarget time.Duration // the longest a payload should wait in the queue before it is batched
+}
+
+// Cost to return the cost of delivering the payloads in batches of batchSize.
+func (bp BatchPricing) Cost(batchSize int, payloads int) float64 {
+	if batchSize < 1 || payloads < 1 {
+		return 0
+	}
+	requests := math.Ceil(float64(payloads) / float64(batchSize))
+	return requests*bp.PerRequest + float64(payloads)*bp.PerItem
+}
+
+// OptimalSize to return the cheapest batch size for the arrival rate (payloads per second) that
+// still fills within the LatencyTarget. The per-request cost is shared by every payload in a batch,
+// so the cheapest size is the largest one that can be filled in time, capped at maxSize.
+func (bp BatchPricing) OptimalSize(rate float64, maxSize int) int {
+	if maxSize < 1 {
+		return 1
+	}
+	if bp.LatencyTarget <= 0 || bp.PerRequest <= 0 {
+		return maxSize
+	}
+	size := int(rate * bp.LatencyTarget.Seconds())
+	if size < 1 {
+		return 1
+	}
+	if size > maxSize {
+		return maxSize
+	}
+	return size
+}
+
+// costOptimizer to track the arrival rate of a queue and derive its batch size from the pricing
+type costOptimizer struct {
+	mutex    sync.Mutex
+	pricing  BatchPricing
+	arrivals arrivals
+}
+
+// observe to record n payloads arriving at now
+func (o *costOptimizer) observe(now time.Time, n int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.arrivals.observe(now, n)
+}
+
+// arrivals to measure the arrival rate of payloads. The caller guards it.
+type arrivals struct {
+	rate   float64 // payloads per second, smoothed
+	count  int     // payloads seen since the window started
+	window time.Time
+}
+
+// observe to record n payloads arriving at now, updating the rate once a second. It reports whether
+// the rate was updated.
+func (a *arrivals) observe(now time.Time, n int) bool {
+	if a.window.IsZero() {
+		a.window = now
+	}
+	a.count += n
+	elapsed := now.Sub(a.window)
+	if elapsed < time.Second {
+		return false
+	}
+	current := float64(a.count) / elapsed.Seconds()
+	if a.rate == 0 {
+		a.rate = current
+	} else {
+		a.rate = 0.7*a.rate + 0.3*current
+	}
+	a.count = 0
+	a.window = now
+	return true
+}
+
+// batchSize to return the optimal batch size for the observed rate. Until a rate is observed the
+// maxSize is used and the LatencyTarget alone bounds how long payloads wait.
+func (o *costOptimizer) batchSize(maxSize int) int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.arrivals.rate == 0 {
+		return maxSize
+	}
+	return o.pricing.OptimalSize(o.arrivals.rate, maxSize)
+}
@@ -0,0 +1,41 @@
+package payloadqueue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestBatchPricingCost(t *testing.T) {
+	bp := payloadqueue.BatchPricing{PerRequest: 1, PerItem: 0.01}
+	t.Run("Cost of full batches", func(t *testing.T) {
+		if c := bp.Cost(10, 100); c != 11 {
+			t.Errorf("Expected cost to be 11, got %f", c)
+		}
+	})
+	t.Run("Cost of a partial batch", func(t *testing.T) {
+		if c := bp.Cost(30, 100); c != 5 {
+			t.Errorf("Expected cost to be 5, got %f", c)
+		}
+	})
+}
+
+func TestBatchPricingOptimalSize(t *testing.T) {
+	bp := payloadqueue.BatchPricing{PerRequest: 1, PerItem: 0.01, LatencyTarget: 2 * time.Second}
+	t.Run("Size fills within the latency target", func(t *testing.T) {
+		if n := bp.OptimalSize(25, 100); n != 50 {
+			t.Errorf("Expected size to be 50, got %d", n)
+		}
+	})
+	t.Run("Size is capped at MaxSize", func(t *testing.T) {
+		if n := bp.OptimalSize(1000, 100); n != 100 {
+			t.Errorf("Expected size to be 100, got %d", n)
+		}
+	})
+	t.Run("Size with no traffic", func(t *testing.T) {
+		if n := bp.OptimalSize(0, 100); n != 1 {
+			t.Errorf("Expected size to be 1, got %d", n)
+		}
+	})
+}
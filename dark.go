@@ -0,0 +1,125 @@
+package payloadqueue
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyWindow is the number of recent deliveries the Latency is computed over
+const latencyWindow = 1024
+
+// LatencySummary to describe the end-to-end latency of the recently delivered payloads: from the
+// Append to the handler returning for the batch they were part of.
+type LatencySummary struct {
+	Count int64 // payloads measured since the queue started
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// latencies to hold the latencies of the last latencyWindow delivered payloads
+type latencies struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+	count   int64
+}
+
+// observe to record the latency of a delivered payload
+func (l *latencies) observe(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.samples) < latencyWindow {
+		l.samples = append(l.samples, d)
+	} else {
+		l.samples[l.count%latencyWindow] = d
+	}
+	l.count++
+}
+
+// summary to compute the percentiles over the window
+func (l *latencies) summary() LatencySummary {
+	l.mutex.Lock()
+	sorted := append([]time.Duration(nil), l.samples...)
+	s := LatencySummary{Count: l.count}
+	l.mutex.Unlock()
+	if len(sorted) == 0 {
+		return s
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration { return sorted[int(p*float64(len(sorted)-1))] }
+	s.P50, s.P95, s.P99, s.Max = at(0.50), at(0.95), at(0.99), sorted[len(sorted)-1]
+	return s
+}
+
+// Latency to return the end-to-end latency of the payloads the queue delivered recently. Payloads
+// claimed from a Storage are not measured. A DarkQueue measures from the Append to the production
+// queue.
+func (q *Queue) Latency() LatencySummary {
+	return q.latencies.summary()
+}
+
+// measure to record the latency of the delivered payloads
+func (q *Queue) measure(pls []Payload) {
+	now := q.now()
+	var total time.Duration
+	n := 0
+	for _, p := range pls {
+		if !p.appended.IsZero() {
+			q.latencies.observe(now.Sub(p.appended))
+			total += now.Sub(p.appended)
+			n++
+		}
+	}
+	if q.LatencySLO > 0 && n > 0 {
+		q.tuner.delivered(total / time.Duration(n))
+	}
+}
+
+// darkBudget to hold how many payloads were copied to the DarkQueue in the current second
+type darkBudget struct {
+	mutex  sync.Mutex
+	second int64
+	used   int
+}
+
+// take to spend one of the limit of copies per second, reporting whether one was left
+func (b *darkBudget) take(now time.Time, limit int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if s := now.Unix(); s != b.second {
+		b.second, b.used = s, 0
+	}
+	if limit > 0 && b.used >= limit {
+		return false
+	}
+	b.used++
+	return true
+}
+
+// darken to copy the DarkRatio of the accepted payloads, within the DarkLimit, to the DarkQueue.
+// The copies keep the time they were appended here, so the DarkQueue measures the latency real
+// traffic would see with its settings and sink. A failing DarkQueue never affects this queue.
+func (q *Queue) darken(pls []Payload) {
+	if q.DarkQueue == nil || q.DarkRatio <= 0 {
+		return
+	}
+	now := q.now()
+	var dark []Payload
+	for _, p := range pls {
+		if rand.Float64() >= q.DarkRatio || !q.darkBudget.take(now, q.DarkLimit) {
+			continue
+		}
+		dark = append(dark, p)
+	}
+	if len(dark) == 0 {
+		return
+	}
+	q.counters.add(func(s *Stats) { s.Dark += int64(len(dark)) })
+	if err := q.DarkQueue.accept(dark, "append"); err != nil {
+		q.event("Dark Traffic: Copy of " + strconv.Itoa(len(dark)) + " payloads failed. " + err.Error())
+	}
+}
@@ -0,0 +1,100 @@
+package payloadqueue
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Decision to record a trigger evaluation or a scheduling decision of a Queue together with the
+// inputs it was based on. Decisions are written as JSON lines to the DecisionLog of a Queue and can
+// be read back with ReadDecisions to find out why a batch was flushed when it was.
+type Decision struct {
+	Time      time.Time     `json:"time"`
+	Tag       string        `json:"tag"`
+	Trigger   string        `json:"trigger"` // append, timer or schedule
+	Depth     int           `json:"depth"`   // payloads eligible for batching
+	Delayed   int           `json:"delayed"` // payloads waiting on their NotBefore
+	BatchSize int           `json:"batch_size"`
+	Age       time.Duration `json:"age"`     // how long the current batch has been open
+	MaxAge    time.Duration `json:"max_age"` // length of the current batch window
+	Flush     bool          `json:"flush"`
+	Reason    string        `json:"reason"`              // full, expired or waiting for trigger evaluations
+	NextWake  time.Duration `json:"next_wake,omitempty"` // for schedule decisions, when the timer fires next
+}
+
+// ReadDecisions to read the decisions written to a DecisionLog.
+func ReadDecisions(r io.Reader) ([]Decision, error) {
+	var ds []Decision
+	dec := json.NewDecoder(r)
+	for {
+		var d Decision
+		if err := dec.Decode(&d); err == io.EOF {
+			return ds, nil
+		} else if err != nil {
+			return ds, err
+		}
+		ds = append(ds, d)
+	}
+}
+
+// decisionRecorder to serialize the decisions of a Queue into its DecisionLog
+type decisionRecorder struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+func (r *decisionRecorder) write(d Decision) {
+	r.mutex.Lock()
+	r.enc.Encode(d)
+	r.mutex.Unlock()
+}
+
+// recordTrigger to record the evaluation of the batch triggers
+func (q *Queue) recordTrigger(trigger string, full bool, expired bool) {
+	if q.recorder == nil {
+		return
+	}
+	now := q.now()
+	q.payloadMutex.Lock()
+	d := Decision{
+		Time:      now,
+		Tag:       q.Tag,
+		Trigger:   trigger,
+		Depth:     q.payloadQueue.len(),
+		Delayed:   len(q.delayed),
+		BatchSize: q.batchSize(),
+		MaxAge:    q.window,
+		Flush:     full || expired,
+		Reason:    "waiting",
+	}
+	d.Age = q.elapsed() - (q.expires - d.MaxAge)
+	q.payloadMutex.Unlock()
+	if full {
+		d.Reason = "full"
+	} else if expired {
+		d.Reason = "expired"
+	}
+	q.recorder.write(d)
+}
+
+// recordSchedule to record when the timer was scheduled to wake up next
+func (q *Queue) recordSchedule(next time.Duration) {
+	if q.recorder == nil {
+		return
+	}
+	q.payloadMutex.Lock()
+	d := Decision{
+		Time:      q.now(),
+		Tag:       q.Tag,
+		Trigger:   "schedule",
+		Depth:     q.payloadQueue.len(),
+		Delayed:   len(q.delayed),
+		BatchSize: q.batchSize(),
+		MaxAge:    q.window,
+		NextWake:  next,
+	}
+	q.payloadMutex.Unlock()
+	q.recorder.write(d)
+}
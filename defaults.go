@@ -0,0 +1,102 @@
+package payloadqueue
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Defaults to hold the values used for the settings a Queue is started without. They are derived
+// from GOMAXPROCS and the memory available to the process, so a queue performs sensibly on a tiny
+// container as well as on a large host.
+type Defaults struct {
+	Workers       int   // batches processed concurrently by a Queue (Concurrency)
+	Shards        int   // shards of a ShardedQueue
+	ChannelBuffer int   // capacity of the ingestion channel of a Queue (ChannelBuffer)
+	MemoryLimit   int64 // bytes available to the process, zero when unknown
+}
+
+var (
+	defaultsMutex sync.Mutex
+	frozen        *Defaults
+)
+
+// RuntimeDefaults to derive the Defaults from the current GOMAXPROCS and memory limit. Work
+// handlers are usually I/O bound, so two workers per processor are used; hosts with less than
+// 512MB get a smaller ingestion buffer.
+func RuntimeDefaults() Defaults {
+	procs := runtime.GOMAXPROCS(0)
+	d := Defaults{
+		Workers:       2 * procs,
+		Shards:        procs,
+		ChannelBuffer: 64 * procs,
+		MemoryLimit:   memoryLimit(),
+	}
+	if d.Workers > 64 {
+		d.Workers = 64
+	}
+	if d.MemoryLimit > 0 && d.MemoryLimit < 512<<20 {
+		d.Workers = procs
+		d.ChannelBuffer = 16 * procs
+	}
+	return d
+}
+
+// FreezeDefaults to pin the Defaults used by the queues started afterwards, instead of deriving
+// them from the runtime each time. Fields left at zero are still derived from the runtime.
+func FreezeDefaults(d Defaults) {
+	defaultsMutex.Lock()
+	frozen = &d
+	defaultsMutex.Unlock()
+}
+
+// CurrentDefaults to return the frozen Defaults, or the RuntimeDefaults when none are frozen.
+func CurrentDefaults() Defaults {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+	d := RuntimeDefaults()
+	if frozen == nil {
+		return d
+	}
+	if frozen.Workers > 0 {
+		d.Workers = frozen.Workers
+	}
+	if frozen.Shards > 0 {
+		d.Shards = frozen.Shards
+	}
+	if frozen.ChannelBuffer > 0 {
+		d.ChannelBuffer = frozen.ChannelBuffer
+	}
+	if frozen.MemoryLimit > 0 {
+		d.MemoryLimit = frozen.MemoryLimit
+	}
+	return d
+}
+
+// memoryLimit to return the lower of GOMEMLIMIT and the cgroup memory limit, zero when neither is
+// set.
+func memoryLimit() int64 {
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		limit = 0
+	}
+	for _, f := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		// cgroup v1 reports a huge number when there is no limit
+		if err != nil || v <= 0 || v >= math.MaxInt64/2 {
+			continue
+		}
+		if limit == 0 || v < limit {
+			limit = v
+		}
+	}
+	return limit
+}
@@ -0,0 +1,71 @@
+package payloadqueue_test
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestRuntimeDefaults(t *testing.T) {
+	t.Run("Defaults follow GOMAXPROCS", func(t *testing.T) {
+		d := payloadqueue.RuntimeDefaults()
+		if d.Workers < runtime.GOMAXPROCS(0) || d.Shards != runtime.GOMAXPROCS(0) || d.ChannelBuffer < 1 {
+			t.Errorf("Unexpected defaults: %+v", d)
+		}
+	})
+
+	t.Run("Frozen defaults are used by Start", func(t *testing.T) {
+		payloadqueue.FreezeDefaults(payloadqueue.Defaults{Workers: 3, ChannelBuffer: 7})
+		defer payloadqueue.FreezeDefaults(payloadqueue.Defaults{})
+
+		q := &payloadqueue.Queue{Tag: "QueueA", Work: func(pls []interface{}) int { return 0 }}
+		q.Start()
+		if q.Concurrency != 3 || q.ChannelBuffer != 7 || cap(q.Input()) != 7 {
+			t.Errorf("Expected the frozen defaults, got %d and %d", q.Concurrency, q.ChannelBuffer)
+		}
+		if payloadqueue.CurrentDefaults().Shards != runtime.GOMAXPROCS(0) {
+			t.Errorf("Expected the Shards to be derived from the runtime")
+		}
+		q.Close()
+	})
+}
+
+func TestQueueConcurrency(t *testing.T) {
+	t.Run("Batches are bounded by Concurrency", func(t *testing.T) {
+		var runMutex sync.Mutex
+		active, peak := 0, 0
+		q := &payloadqueue.Queue{
+			MaxSize:     1,
+			MaxAge:      200,
+			Tag:         "QueueA",
+			Concurrency: 2,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				active++
+				if active > peak {
+					peak = active
+				}
+				runMutex.Unlock()
+				time.Sleep(100 * time.Millisecond)
+				runMutex.Lock()
+				active--
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		for i := 0; i < 6; i++ {
+			q.Input() <- payloadqueue.Payload{Id: "p"}
+		}
+		time.Sleep(500 * time.Millisecond)
+		runMutex.Lock()
+		if peak != 2 {
+			t.Errorf("Expected at most 2 concurrent batches, got %d", peak)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+}
@@ -0,0 +1,112 @@
+package payloadqueue
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Drain to deliver as much of the buffer as possible before the context ends, e.g. within the
+// grace period of a shutdown. The pending payloads are pushed oldest first, in batches of the
+// DrainBatch with the DrainTimeout as their deadline, one at a time, so that a slow downstream
+// costs a small batch rather than the whole buffer. Normal batching is held while draining. It
+// returns the number of payloads left, including the delayed payloads that are not due yet, and
+// the error of the context when it ended before the buffer was empty.
+func (q *Queue) Drain(ctx context.Context) (int, error) {
+	q.payloadMutex.Lock()
+	q.draining = true
+	q.payloadMutex.Unlock()
+	defer func() {
+		q.payloadMutex.Lock()
+		q.draining = false
+		q.payloadMutex.Unlock()
+	}()
+	q.event("Buffer Queue: Draining " + strconv.Itoa(q.Size()) + " payloads")
+	work := q.handler()
+	for {
+		timeout, ok := q.drainTimeout(ctx)
+		if !ok {
+			break
+		}
+		q.expire()
+		q.promote()
+		q.reload()
+		pls := q.oldest(q.drainBatch())
+		if len(pls) == 0 {
+			break
+		}
+		q.runWithin(work, pls, timeout)
+		q.payloadMutex.Lock()
+		q.inflight -= len(pls)
+		q.countOut(pls, -1)
+		q.payloadMutex.Unlock()
+		q.release()
+	}
+	left := q.Size()
+	q.event("Buffer Queue: Drained, " + strconv.Itoa(left) + " payloads left")
+	if _, ok := q.drainTimeout(ctx); left > 0 && !ok {
+		if err := ctx.Err(); err != nil {
+			return left, err
+		}
+		// the deadline has passed a moment before the context reports it
+		return left, context.DeadlineExceeded
+	}
+	return left, nil
+}
+
+// oldest to take up to n of the pending payloads that were appended first, counting them as
+// active work
+func (q *Queue) oldest(n int) []Payload {
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
+	pending := q.payloadQueue.take(q.payloadQueue.len())
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].appended.Before(pending[j].appended)
+	})
+	n = min(n, len(pending))
+	pls := pending[:n:n]
+	q.payloadQueue.push(pending[n:]...)
+	if len(pls) > 0 {
+		q.activeWork.Add(1)
+		q.inflight += len(pls)
+		q.countOut(pls, 1)
+	}
+	return pls
+}
+
+// drainBatch to return the size of the batches cut by Drain, at most the MaxBatchSize
+func (q *Queue) drainBatch() int {
+	size := q.DrainBatch
+	if size <= 0 {
+		q.payloadMutex.Lock()
+		size = max(q.batchSize()/4, 1)
+		q.payloadMutex.Unlock()
+	}
+	if q.MaxBatchSize > 0 && size > q.MaxBatchSize {
+		return q.MaxBatchSize
+	}
+	return size
+}
+
+// drainTimeout to return the deadline of the next batch of a Drain: the DrainTimeout, or a quarter
+// of the WorkTimeout, or of the time left when there is none, capped by the time left. It reports
+// false once the context has ended.
+func (q *Queue) drainTimeout(ctx context.Context) (time.Duration, bool) {
+	deadline, bounded := ctx.Deadline()
+	left := time.Until(deadline)
+	if ctx.Err() != nil || (bounded && left <= 0) {
+		return 0, false
+	}
+	timeout := q.DrainTimeout
+	if timeout <= 0 {
+		timeout = q.WorkTimeout / 4
+	}
+	if timeout <= 0 && bounded {
+		timeout = left / 4
+	}
+	if bounded && (timeout <= 0 || timeout > left) {
+		timeout = left
+	}
+	return timeout, true
+}
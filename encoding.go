@@ -0,0 +1,46 @@
+package payloadqueue
+
+import "bytes"
+
+// HeaderContentEncoding is the payload header that flags Data already compressed by the producer,
+// e.g. "gzip", so that it is passed through as is, see Compressed.
+const HeaderContentEncoding = "Content-Encoding"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Encoding to detect the compression of the Data by its magic bytes: "gzip" or "zstd" for a []byte
+// that starts with theirs, empty otherwise.
+func Encoding(data interface{}) string {
+	b, ok := data.([]byte)
+	if !ok {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(b, zstdMagic):
+		return "zstd"
+	}
+	return ""
+}
+
+// Compressed to return the Data of the payload and its encoding when it arrived already compressed,
+// so that sinks and codecs pass it through instead of compressing it again and label it downstream
+// instead. It is when the Data is a []byte flagged by the Content-Encoding header, or detected by
+// Encoding.
+func Compressed(p Payload) ([]byte, string, bool) {
+	b, ok := p.Data.([]byte)
+	if !ok {
+		return nil, "", false
+	}
+	if enc := p.Headers[HeaderContentEncoding]; enc != "" && enc != "identity" {
+		return b, enc, true
+	}
+	if enc := Encoding(b); enc != "" {
+		return b, enc, true
+	}
+	return nil, "", false
+}
@@ -0,0 +1,127 @@
+package payloadqueue
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// sealVersion marks the format of the Data encrypted by the Encryption of a queue
+const sealVersion byte = 1
+
+// ErrNotSealed is returned when Data read from a Storage was not encrypted by a KeyProvider, e.g.
+// when it was written before the Encryption was set.
+var ErrNotSealed = errors.New("payloadqueue: the Data is not encrypted")
+
+// KeyProvider to supply the AES keys that encrypt the Data of payloads at rest, see
+// Queue.Encryption. Keys are 16, 24 or 32 bytes, for AES-128, AES-192 or AES-256. A provider backed
+// by a KMS can rotate keys: new payloads are encrypted with the current key, and the payloads still
+// stored are decrypted with the key they were encrypted with.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt with and its id, recorded next to the encrypted Data.
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	// Key returns the key with the id, to decrypt Data encrypted with it.
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// StaticKey to encrypt with a single key supplied by the application, e.g. read from a secret
+type StaticKey struct {
+	Id     string // recorded with the encrypted Data, at most 255 bytes
+	Secret []byte // the key, 16, 24 or 32 bytes
+}
+
+// CurrentKey to return the key
+func (k StaticKey) CurrentKey(ctx context.Context) (string, []byte, error) {
+	return k.Id, k.Secret, nil
+}
+
+// Key to return the key when the id is its own
+func (k StaticKey) Key(ctx context.Context, id string) ([]byte, error) {
+	if id != k.Id {
+		return nil, fmt.Errorf("payloadqueue: unknown key %q", id)
+	}
+	return k.Secret, nil
+}
+
+// sealing is the Codec handed to the Storage backends of a queue with an Encryption. It encrypts
+// what the Codec of the queue encodes with AES-GCM, as version, key id, nonce and sealed bytes, the
+// key id being authenticated with them.
+type sealing struct {
+	codec Codec
+	keys  KeyProvider
+	ctx   context.Context
+}
+
+// seal to return the context with its Codec encrypting, when the queue has an Encryption
+func (q *Queue) seal(ctx context.Context) context.Context {
+	if q.Encryption == nil {
+		return ctx
+	}
+	return withCodec(ctx, sealing{codec: CodecFromContext(ctx), keys: q.Encryption, ctx: ctx})
+}
+
+// Marshal to encode the value with the Codec and encrypt it with the current key
+func (s sealing) Marshal(v interface{}) ([]byte, error) {
+	plain, err := s.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	id, key, err := s.keys.CurrentKey(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("payloadqueue: key id %q is longer than 255 bytes", id)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 2+len(id)+aead.NonceSize()+len(plain)+aead.Overhead())
+	out = append(out, sealVersion, byte(len(id)))
+	out = append(out, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plain, out[:2+len(id)]), nil
+}
+
+// Unmarshal to decrypt the bytes with the key they were encrypted with and decode them with the
+// Codec
+func (s sealing) Unmarshal(data []byte, v interface{}) error {
+	if len(data) < 2 || data[0] != sealVersion || len(data) < 2+int(data[1]) {
+		return ErrNotSealed
+	}
+	header := data[:2+int(data[1])]
+	key, err := s.keys.Key(s.ctx, string(header[2:]))
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	rest := data[len(header):]
+	if len(rest) < aead.NonceSize() {
+		return ErrNotSealed
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return err
+	}
+	return s.codec.Unmarshal(plain, v)
+}
+
+// newAEAD to return AES-GCM with the key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,11 @@
+package payloadqueue
+
+import "time"
+
+// SetMemoryReader to replace how the queue reads its memory use and limit, see MemoryPressure
+func (q *Queue) SetMemoryReader(read func() (used uint64, limit int64)) {
+	q.memory.mutex.Lock()
+	q.memory.read = read
+	q.memory.sampled = time.Time{}
+	q.memory.mutex.Unlock()
+}
@@ -0,0 +1,60 @@
+package payloadqueue
+
+import (
+	"context"
+	"strconv"
+)
+
+// Flags to hold the feature flags of a batch by name, e.g. {"new-serializer": "true"}. A value
+// may also name a variant of a rollout.
+type Flags map[string]string
+
+// Enabled to report whether the flag is set to a true value such as "true" or "1"
+func (f Flags) Enabled(name string) bool {
+	on, _ := strconv.ParseBool(f[name])
+	return on
+}
+
+// FlagProvider to evaluate the feature flags of each batch, e.g. from a rollout service by the
+// Tag of the batch or the Headers of its payloads. The flags are carried by the context of the
+// batch, so the Middleware, the hooks and the WorkContext can branch on them without a new release
+// of the queue, see FlagsFromContext.
+type FlagProvider interface {
+	Flags(ctx context.Context, b *Batch) (Flags, error)
+}
+
+// FlagProviderFunc to use a function as a FlagProvider
+type FlagProviderFunc func(ctx context.Context, b *Batch) (Flags, error)
+
+func (f FlagProviderFunc) Flags(ctx context.Context, b *Batch) (Flags, error) {
+	return f(ctx, b)
+}
+
+// flagsKey is the context key of the Flags
+type flagsKey struct{}
+
+// FlagsFromContext to return the Flags of the batch carried by the context. Without a FlagProvider
+// the Flags are empty, so every flag is off.
+func FlagsFromContext(ctx context.Context) Flags {
+	f, _ := ctx.Value(flagsKey{}).(Flags)
+	return f
+}
+
+// WithFlags to return a context carrying the Flags, e.g. to test a handler with a flag turned on
+func WithFlags(ctx context.Context, f Flags) context.Context {
+	return context.WithValue(ctx, flagsKey{}, f)
+}
+
+// flag to evaluate the Flags of the batch into its context. When the FlagProvider fails, the batch
+// is pushed with every flag off rather than held up.
+func (q *Queue) flag(ctx context.Context, b *Batch) context.Context {
+	if q.FlagProvider == nil {
+		return ctx
+	}
+	f, err := q.FlagProvider.Flags(ctx, b)
+	if err != nil {
+		q.event("Flags: Evaluation failed, flags are off. " + err.Error())
+		return ctx
+	}
+	return WithFlags(ctx, f)
+}
@@ -0,0 +1,65 @@
+package payloadqueue_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestQueueFlags(t *testing.T) {
+	t.Run("The flags of the batch reach the middleware and the handler", func(t *testing.T) {
+		seen := make(chan bool, 2)
+		q := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			FlagProvider: payloadqueue.FlagProviderFunc(func(ctx context.Context, b *payloadqueue.Batch) (payloadqueue.Flags, error) {
+				return payloadqueue.Flags{"new-serializer": b.Payloads[0].Headers["tenant"]}, nil
+			}),
+			Middleware: []payloadqueue.Middleware{func(next payloadqueue.WorkFunc) payloadqueue.WorkFunc {
+				return func(ctx context.Context, pls []interface{}) error {
+					seen <- payloadqueue.FlagsFromContext(ctx).Enabled("new-serializer")
+					return next(ctx, pls)
+				}
+			}},
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				seen <- payloadqueue.FlagsFromContext(ctx).Enabled("new-serializer")
+				return nil
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1", Headers: map[string]string{"tenant": "true"}})
+		if !<-seen || !<-seen {
+			t.Errorf("Expected the flag on in the middleware and the handler")
+		}
+		q.Append(payloadqueue.Payload{Id: "2", Headers: map[string]string{"tenant": "off"}})
+		if <-seen || <-seen {
+			t.Errorf("Expected the flag off")
+		}
+		q.Close()
+	})
+
+	t.Run("A failing provider leaves the flags off", func(t *testing.T) {
+		seen := make(chan payloadqueue.Flags, 1)
+		q := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			FlagProvider: payloadqueue.FlagProviderFunc(func(ctx context.Context, b *payloadqueue.Batch) (payloadqueue.Flags, error) {
+				return nil, errors.New("rollout service unavailable")
+			}),
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				seen <- payloadqueue.FlagsFromContext(ctx)
+				return nil
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		if f := <-seen; f.Enabled("new-serializer") {
+			t.Errorf("Expected the flags off, got %v", f)
+		}
+		q.Close()
+	})
+}
@@ -0,0 +1,147 @@
+package grpc
+
+import (
+	"context"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/grpc/pb"
+)
+
+// Client to enqueue payloads into a remote Server over the connection
+type Client struct {
+	Conn  grpc.ClientConnInterface
+	Codec plq.Codec // serializes the Data as the Codec of the remote queue. Default is JSONCodec
+}
+
+func (c *Client) rpc() pb.PayloadQueueClient {
+	return pb.NewPayloadQueueClient(c.Conn)
+}
+
+// Enqueue to append the payloads to the remote queue with the tag, returning their Ids. The Data
+// of each payload is sent encoded by the Codec, with its Id, Headers, NotBefore and ExpiresAt. When
+// the remote queue refuses a payload, e.g. because it is full, the Ids of the payloads accepted
+// before it are returned with the error.
+func (c *Client) Enqueue(ctx context.Context, tag string, pls ...plq.Payload) ([]string, error) {
+	req := &pb.EnqueueRequest{Tag: tag}
+	for _, p := range pls {
+		data, err := codec(c.Codec).Marshal(p.Data)
+		if err != nil {
+			return nil, err
+		}
+		req.Payloads = append(req.Payloads, &pb.Payload{
+			Id:        p.Id,
+			Data:      data,
+			Headers:   p.Headers,
+			NotBefore: unixNano(p.NotBefore),
+			ExpiresAt: unixNano(p.ExpiresAt),
+		})
+	}
+	res, err := c.rpc().Enqueue(ctx, req)
+	if err != nil {
+		return accepted(err), err
+	}
+	return res.GetIds(), nil
+}
+
+// accepted to return the Ids of the payloads an Enqueue refused part way had accepted
+func accepted(err error) []string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+	for _, d := range st.Details() {
+		if res, ok := d.(*pb.EnqueueResponse); ok {
+			return res.GetIds()
+		}
+	}
+	return nil
+}
+
+// Flush to push the pending payloads of the remote queue now
+func (c *Client) Flush(ctx context.Context, tag string) error {
+	_, err := c.rpc().Flush(ctx, &pb.FlushRequest{Tag: tag})
+	return err
+}
+
+// Pause to stop the remote queue from cutting batches
+func (c *Client) Pause(ctx context.Context, tag string) error {
+	_, err := c.rpc().Pause(ctx, &pb.PauseRequest{Tag: tag})
+	return err
+}
+
+// Resume to let the remote queue cut batches again
+func (c *Client) Resume(ctx context.Context, tag string) error {
+	_, err := c.rpc().Resume(ctx, &pb.ResumeRequest{Tag: tag})
+	return err
+}
+
+// Redrive to return the dead-lettered payloads to the remote queue, returning how many
+func (c *Client) Redrive(ctx context.Context, tag string) (int, error) {
+	res, err := c.rpc().Redrive(ctx, &pb.RedriveRequest{Tag: tag})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.GetRedriven()), nil
+}
+
+// Purge to drop the pending payloads of the remote queue, returning how many
+func (c *Client) Purge(ctx context.Context, tag string) (int, error) {
+	res, err := c.rpc().Purge(ctx, &pb.PurgeRequest{Tag: tag})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.GetPurged()), nil
+}
+
+// Stats to return the activity of the remote queue
+func (c *Client) Stats(ctx context.Context, tag string) (plq.Stats, error) {
+	res, err := c.rpc().Stats(ctx, &pb.StatsRequest{Tag: tag})
+	if err != nil {
+		return plq.Stats{}, err
+	}
+	return plq.Stats{
+		Tag:          res.GetTag(),
+		Pending:      int(res.GetPending()),
+		Delayed:      int(res.GetDelayed()),
+		ActiveWork:   int(res.GetActiveWork()),
+		Appended:     res.GetAppended(),
+		Batches:      res.GetBatches(),
+		Delivered:    res.GetDelivered(),
+		Failed:       res.GetFailed(),
+		Retried:      res.GetRetried(),
+		DeadLettered: res.GetDeadLettered(),
+		Expired:      res.GetExpired(),
+		Duplicates:   res.GetDuplicates(),
+		Dark:         res.GetDark(),
+		Rejected:     res.GetRejected(),
+	}, nil
+}
+
+// WatchEvents to stream the events of the remote queue with the tag (or all queues when empty)
+// until the context is cancelled. The channel is closed when the stream ends.
+func (c *Client) WatchEvents(ctx context.Context, tag string) (<-chan string, error) {
+	stream, err := c.rpc().WatchEvents(ctx, &pb.WatchEventsRequest{Tag: tag})
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		for {
+			e, err := stream.Recv()
+			if err == io.EOF || err != nil {
+				return
+			}
+			select {
+			case events <- "[" + e.GetTag() + "] " + e.GetMessage():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
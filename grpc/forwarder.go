@@ -0,0 +1,51 @@
+package grpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Forwarder to forward the batches of a Queue to a queue of a remote Server, so queues can be
+// federated into a hierarchy (edge -> regional -> central) that batches at every level. Use its
+// Work as the WorkContext of the local queue:
+//
+//	fwd := &pqgrpc.Forwarder{Conn: conn, Tag: "regional"}
+//	q := &plq.Queue{Tag: "edge", WorkContext: fwd.Work, WorkTimeout: 10 * time.Second}
+//
+// The payloads keep their Id, Headers and ExpiresAt on the way, so a payload has the same envelope
+// at every hop. When the remote queue refuses part of a batch, e.g. because it is full, the rest is
+// reported in a BatchError and only it is retried by the local queue.
+type Forwarder struct {
+	Conn  grpc.ClientConnInterface
+	Tag   string    // the tag of the remote queue
+	Codec plq.Codec // serializes the Data as the Codec of the remote queue. Default is JSONCodec
+}
+
+// Work to enqueue the batch into the remote queue. It is shaped as a WorkContext handler.
+func (f *Forwarder) Work(ctx context.Context, batch []interface{}) error {
+	var pls []plq.Payload
+	if b, ok := plq.BatchFromContext(ctx); ok && len(b.Payloads) == len(batch) {
+		pls = make([]plq.Payload, len(b.Payloads))
+		for i, p := range b.Payloads {
+			pls[i] = plq.Payload{Id: p.Id, Data: p.Data, Headers: p.Headers, ExpiresAt: p.ExpiresAt}
+		}
+	} else {
+		pls = make([]plq.Payload, len(batch))
+		for i, data := range batch {
+			pls[i] = plq.Payload{Data: data}
+		}
+	}
+	client := &Client{Conn: f.Conn, Codec: f.Codec}
+	ids, err := client.Enqueue(ctx, f.Tag, pls...)
+	if err == nil || len(ids) == 0 {
+		return err
+	}
+	results := make([]plq.PayloadResult, 0, len(pls)-len(ids))
+	for i := len(ids); i < len(pls); i++ {
+		results = append(results, plq.PayloadResult{Index: i, Err: err})
+	}
+	return &plq.BatchError{Results: results}
+}
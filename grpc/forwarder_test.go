@@ -0,0 +1,62 @@
+package grpc_test
+
+import (
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	pqgrpc "github.com/sam-ish/payloadqueue/grpc"
+	"github.com/sam-ish/payloadqueue/queuetest"
+)
+
+func TestForwarder(t *testing.T) {
+	t.Run("The batches arrive with their envelopes", func(t *testing.T) {
+		rec := &queuetest.Recorder{}
+		central := &plq.Queue{Tag: "central", MaxSize: 100, MaxAge: 200, WorkContext: rec.Work}
+		central.Start()
+		defer central.Close()
+		fwd := &pqgrpc.Forwarder{Conn: listen(t, (&pqgrpc.Server{Queues: []*plq.Queue{central}}).Register), Tag: "central"}
+		edge := &plq.Queue{Tag: "edge", MaxSize: 2, MaxAge: 200, WorkContext: fwd.Work}
+		edge.Start()
+		defer edge.Close()
+
+		expires := time.Now().Add(time.Hour).Round(0)
+		edge.Append(plq.Payload{Id: "1", Data: map[string]interface{}{"name": "a"}, Headers: map[string]string{"tenant": "acme"}, ExpiresAt: expires})
+		edge.Append(plq.Payload{Id: "2", Data: map[string]interface{}{"name": "b"}})
+		queuetest.Flush(t, edge, time.Second)
+		queuetest.Flush(t, central, time.Second)
+
+		batches := rec.WaitForBatches(t, 1, time.Second)
+		pls := batches[0].Payloads
+		if len(pls) != 2 || pls[0].Id != "1" || pls[1].Id != "2" {
+			t.Fatalf("Unexpected payloads: %+v", pls)
+		}
+		if pls[0].Headers["tenant"] != "acme" || !pls[0].ExpiresAt.Equal(expires) || pls[0].Data.(map[string]interface{})["name"] != "a" {
+			t.Errorf("Unexpected envelope: %+v", pls[0])
+		}
+		if s := edge.Stats(); s.Delivered != 2 {
+			t.Errorf("Expected 2 payloads forwarded, got %+v", s)
+		}
+	})
+
+	t.Run("Only the refused payloads fail", func(t *testing.T) {
+		central := &plq.Queue{Tag: "central", MaxSize: 100, MaxAge: 200, MaxPending: 1, Work: func([]interface{}) int { return 0 }}
+		central.Start()
+		defer central.Close()
+		central.Pause()
+		fwd := &pqgrpc.Forwarder{Conn: listen(t, (&pqgrpc.Server{Queues: []*plq.Queue{central}}).Register), Tag: "central"}
+		edge := &plq.Queue{Tag: "edge", MaxSize: 2, MaxAge: 200, WorkContext: fwd.Work}
+		edge.Start()
+		defer edge.Close()
+
+		edge.Append(plq.Payload{Id: "1", Data: "a"})
+		edge.Append(plq.Payload{Id: "2", Data: "b"})
+		queuetest.Flush(t, edge, time.Second)
+		if s := edge.Stats(); s.Delivered != 1 || s.DeadLettered != 1 {
+			t.Errorf("Expected the second payload to be refused, got %+v", s)
+		}
+		if s := central.Stats(); s.Pending != 1 || s.Rejected != 1 {
+			t.Errorf("Expected one payload held by the central queue, got %+v", s)
+		}
+	})
+}
@@ -0,0 +1,269 @@
+// Package grpc serves payloadqueue Queues over gRPC, so payloads can be produced from other
+// services and languages into a central batching process, and provides a thin Go client for it.
+// The service is defined in payloadqueue.proto; payload data travels encoded by a Codec, JSON by
+// default.
+package grpc
+
+//go:generate buf generate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/grpc/pb"
+)
+
+// Server to implement the PayloadQueue service on top of the Queues, routed by their Tag. To
+// stream the events of a queue to WatchEvents, use Feed as (or call it from) its EventFeed. The
+// admin actions, Flush, Pause, Resume, Redrive and Purge, are allowed to everyone unless an
+// Authorizer is supplied.
+type Server struct {
+	pb.UnimplementedPayloadQueueServer
+	Queues      []*plq.Queue
+	WatchBuffer int                                           // events buffered per watcher before they are dropped. Default is 256
+	Authorizer  plq.Authorizer                                // when supplied, gates the admin actions
+	Identify    func(ctx context.Context) (plq.Caller, error) // establishes the Caller for the Authorizer, e.g. from the peer certificate or metadata. An error is served as Unauthenticated
+	watchMutex  sync.Mutex
+	watchers    map[chan *pb.Event]string
+}
+
+// Register to register the service on the gRPC server
+func (s *Server) Register(g *grpc.Server) {
+	pb.RegisterPayloadQueueServer(g, s)
+}
+
+// Feed to broadcast an event of the queues to the watchers. It is shaped as an EventFeed.
+func (s *Server) Feed(e string) {
+	tag, msg := splitEvent(e)
+	s.watchMutex.Lock()
+	defer s.watchMutex.Unlock()
+	for ch, filter := range s.watchers {
+		if filter != "" && filter != tag {
+			continue
+		}
+		select {
+		case ch <- &pb.Event{Tag: tag, Message: msg}:
+		default:
+			// a slow watcher misses events rather than stalling the queue
+		}
+	}
+}
+
+// Enqueue to append the payloads to the queue
+func (s *Server) Enqueue(ctx context.Context, req *pb.EnqueueRequest) (*pb.EnqueueResponse, error) {
+	q, err := s.queue(req.GetTag())
+	if err != nil {
+		return nil, err
+	}
+	pls := make([]plq.Payload, 0, len(req.GetPayloads()))
+	for _, v := range req.GetPayloads() {
+		var data interface{}
+		if err := codec(q.Codec).Unmarshal(v.GetData(), &data); err != nil || data == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "payload data cannot be decoded: %v", err)
+		}
+		p := q.NewPayload(data)
+		if v.GetId() != "" {
+			p.Id = v.GetId()
+		}
+		p.Headers = v.GetHeaders()
+		p.NotBefore = fromUnixNano(v.GetNotBefore())
+		p.ExpiresAt = fromUnixNano(v.GetExpiresAt())
+		pls = append(pls, p)
+	}
+	res := &pb.EnqueueResponse{}
+	for _, p := range pls {
+		if err := q.AppendContext(ctx, p); err != nil {
+			code := codes.Unavailable
+			switch {
+			case errors.Is(err, plq.ErrQueueFull) || errors.Is(err, plq.ErrWouldBlock):
+				code = codes.ResourceExhausted
+			case errors.Is(err, plq.ErrInvalidPayload):
+				code = codes.InvalidArgument
+			}
+			return nil, refused(code, err, res)
+		}
+		res.Ids = append(res.Ids, p.Id)
+	}
+	return res, nil
+}
+
+// refused to return the status of an Enqueue refused part way, carrying the Ids of the payloads
+// accepted before in its details
+func refused(code codes.Code, err error, res *pb.EnqueueResponse) error {
+	st := status.New(code, err.Error())
+	if len(res.GetIds()) == 0 {
+		return st.Err()
+	}
+	if withIds, derr := st.WithDetails(res); derr == nil {
+		st = withIds
+	}
+	return st.Err()
+}
+
+// Flush to push the pending payloads of the queue now
+func (s *Server) Flush(ctx context.Context, req *pb.FlushRequest) (*pb.FlushResponse, error) {
+	q, err := s.admin(ctx, req.GetTag(), plq.ActionFlush)
+	if err != nil {
+		return nil, err
+	}
+	q.Flush()
+	return &pb.FlushResponse{}, nil
+}
+
+// Pause to stop the queue from cutting batches
+func (s *Server) Pause(ctx context.Context, req *pb.PauseRequest) (*pb.PauseResponse, error) {
+	q, err := s.admin(ctx, req.GetTag(), plq.ActionPause)
+	if err != nil {
+		return nil, err
+	}
+	q.Pause()
+	return &pb.PauseResponse{}, nil
+}
+
+// Resume to let the queue cut batches again
+func (s *Server) Resume(ctx context.Context, req *pb.ResumeRequest) (*pb.ResumeResponse, error) {
+	q, err := s.admin(ctx, req.GetTag(), plq.ActionResume)
+	if err != nil {
+		return nil, err
+	}
+	q.Resume()
+	return &pb.ResumeResponse{}, nil
+}
+
+// Redrive to return the dead-lettered payloads of the Storage to the queue
+func (s *Server) Redrive(ctx context.Context, req *pb.RedriveRequest) (*pb.RedriveResponse, error) {
+	q, err := s.admin(ctx, req.GetTag(), plq.ActionRedrive)
+	if err != nil {
+		return nil, err
+	}
+	n, err := q.Redrive(ctx)
+	if errors.Is(err, plq.ErrNoDeadLetters) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.RedriveResponse{Redriven: int64(n)}, nil
+}
+
+// Purge to drop the pending payloads of the queue
+func (s *Server) Purge(ctx context.Context, req *pb.PurgeRequest) (*pb.PurgeResponse, error) {
+	q, err := s.admin(ctx, req.GetTag(), plq.ActionPurge)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PurgeResponse{Purged: int64(q.Purge())}, nil
+}
+
+// admin to find the queue with the tag and check the admin action with the Authorizer
+func (s *Server) admin(ctx context.Context, tag string, action plq.Action) (*plq.Queue, error) {
+	q, err := s.queue(tag)
+	if err != nil || s.Authorizer == nil {
+		return q, err
+	}
+	var caller plq.Caller
+	if s.Identify != nil {
+		if caller, err = s.Identify(ctx); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+	if err := s.Authorizer.Authorize(ctx, caller, tag, action); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return q, nil
+}
+
+// Stats to return the activity of the queue
+func (s *Server) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+	q, err := s.queue(req.GetTag())
+	if err != nil {
+		return nil, err
+	}
+	st := q.Stats()
+	return &pb.StatsResponse{
+		Tag:          st.Tag,
+		Pending:      int64(st.Pending),
+		Delayed:      int64(st.Delayed),
+		ActiveWork:   int64(st.ActiveWork),
+		Appended:     st.Appended,
+		Batches:      st.Batches,
+		Delivered:    st.Delivered,
+		Failed:       st.Failed,
+		Retried:      st.Retried,
+		DeadLettered: st.DeadLettered,
+		Expired:      st.Expired,
+		Duplicates:   st.Duplicates,
+		Dark:         st.Dark,
+		Rejected:     st.Rejected,
+	}, nil
+}
+
+// WatchEvents to stream the events passed to Feed until the client goes away
+func (s *Server) WatchEvents(req *pb.WatchEventsRequest, stream grpc.ServerStreamingServer[pb.Event]) error {
+	if req.GetTag() != "" {
+		if _, err := s.queue(req.GetTag()); err != nil {
+			return err
+		}
+	}
+	size := s.WatchBuffer
+	if size <= 0 {
+		size = 256
+	}
+	ch := make(chan *pb.Event, size)
+	s.watchMutex.Lock()
+	if s.watchers == nil {
+		s.watchers = make(map[chan *pb.Event]string)
+	}
+	s.watchers[ch] = req.GetTag()
+	s.watchMutex.Unlock()
+	defer func() {
+		s.watchMutex.Lock()
+		delete(s.watchers, ch)
+		s.watchMutex.Unlock()
+	}()
+	for {
+		select {
+		case e := <-ch:
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// queue to find the Queue with the tag
+func (s *Server) queue(tag string) (*plq.Queue, error) {
+	for _, q := range s.Queues {
+		if q.Tag == tag {
+			return q, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "queue %s does not exist", tag)
+}
+
+// codec to return the Codec, or the JSONCodec when none is supplied
+func codec(c plq.Codec) plq.Codec {
+	if c == nil {
+		return plq.JSONCodec{}
+	}
+	return c
+}
+
+// splitEvent to separate the "[tag] " prefix of a queue event from its message
+func splitEvent(e string) (string, string) {
+	if strings.HasPrefix(e, "[") {
+		if i := strings.Index(e, "] "); i > 0 {
+			return e[1:i], e[i+2:]
+		}
+	}
+	return "", e
+}
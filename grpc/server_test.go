@@ -0,0 +1,139 @@
+package grpc_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	plq "github.com/sam-ish/payloadqueue"
+	pqgrpc "github.com/sam-ish/payloadqueue/grpc"
+)
+
+// serve to run the Server for the queues over an in-memory listener and return a Client for it
+func serve(t *testing.T, srv *pqgrpc.Server) *pqgrpc.Client {
+	return &pqgrpc.Client{Conn: listen(t, srv.Register)}
+}
+
+// listen to run a gRPC server with the services registered over an in-memory listener and
+// return a connection to it
+func listen(t *testing.T, register func(*grpc.Server)) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	g := grpc.NewServer()
+	register(g)
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestServer(t *testing.T) {
+	var runMutex sync.Mutex
+	batched := []interface{}{}
+	srv := &pqgrpc.Server{}
+	q := &plq.Queue{
+		Tag:       "QueueA",
+		MaxAge:    200,
+		EventFeed: srv.Feed,
+		Work: func(pls []interface{}) int {
+			runMutex.Lock()
+			batched = append(batched, pls...)
+			runMutex.Unlock()
+			return 0
+		},
+	}
+	q.Start()
+	defer q.Close()
+	srv.Queues = []*plq.Queue{q}
+	client := serve(t, srv)
+	ctx := context.Background()
+
+	t.Run("Enqueue, watch, flush and read the stats", func(t *testing.T) {
+		wctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		events, err := client.WatchEvents(wctx, "QueueA")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		time.Sleep(50 * time.Millisecond) // the watcher is registered once the stream is open
+
+		ids, err := client.Enqueue(ctx, "QueueA",
+			plq.Payload{Data: map[string]string{"name": "a"}},
+			plq.Payload{Id: "b-1", Data: map[string]string{"name": "b"}, Headers: map[string]string{"tenant": "acme"}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if len(ids) != 2 || ids[1] != "b-1" {
+			t.Errorf("Unexpected ids: %v", ids)
+		}
+		select {
+		case e := <-events:
+			if !strings.HasPrefix(e, "[QueueA] Payload Queued") {
+				t.Errorf("Unexpected event: %s", e)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected an event")
+		}
+
+		if err := client.Flush(ctx, "QueueA"); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+		stats, err := client.Stats(ctx, "QueueA")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if stats.Appended != 2 || stats.Delivered != 2 {
+			t.Errorf("Unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("Unknown queue", func(t *testing.T) {
+		if _, err := client.Enqueue(ctx, "QueueZ", plq.Payload{Data: 1}); err == nil {
+			t.Errorf("Expected error - queue does not exist")
+		}
+	})
+}
+
+func TestServerAuthorization(t *testing.T) {
+	q := &plq.Queue{Tag: "QueueA", MaxAge: 200, Work: func(pls []interface{}) int { return 0 }}
+	q.Start()
+	defer q.Close()
+	srv := &pqgrpc.Server{
+		Queues:     []*plq.Queue{q},
+		Authorizer: plq.RoleAuthorizer{"admin": {plq.ActionPurge}},
+		Identify: func(ctx context.Context) (plq.Caller, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			return plq.Caller{Roles: md.Get("x-role")}, nil
+		},
+	}
+	client := serve(t, srv)
+	q.Append(plq.Payload{Id: "1"})
+	time.Sleep(10 * time.Millisecond)
+
+	if err := client.Pause(context.Background(), "QueueA"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied without a role, got %v", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-role", "admin")
+	if n, err := client.Purge(ctx, "QueueA"); err != nil || n != 1 {
+		t.Errorf("Expected the admin to purge 1 payload, got %d, %v", n, err)
+	}
+	if _, err := client.Redrive(ctx, "QueueA"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for the redrive, got %v", err)
+	}
+}
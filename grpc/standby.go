@@ -0,0 +1,152 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/grpc/pb"
+)
+
+// StandbyServer to implement the Standby service on top of the Standbys, routed by their Tag. It
+// runs in the warm standby process; the primary replicates to it through a Replicator.
+type StandbyServer struct {
+	pb.UnimplementedStandbyServer
+	Standbys []*plq.Standby
+	Codec    plq.Codec // decodes the Data as the Codec of the primary queue. Default is JSONCodec
+}
+
+// Register to register the service on the gRPC server
+func (s *StandbyServer) Register(g *grpc.Server) {
+	pb.RegisterStandbyServer(g, s)
+}
+
+// Replicate to hold the payloads in the standby
+func (s *StandbyServer) Replicate(ctx context.Context, req *pb.ReplicateRequest) (*pb.ReplicateResponse, error) {
+	sb, err := s.standby(req.GetTag())
+	if err != nil {
+		return nil, err
+	}
+	pls := make([]plq.Payload, 0, len(req.GetPayloads()))
+	for _, v := range req.GetPayloads() {
+		p, err := fromReplica(codec(s.Codec), v)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "payload data cannot be decoded: %v", err)
+		}
+		pls = append(pls, p)
+	}
+	if err := sb.Replicate(ctx, pls); err != nil {
+		return nil, standbyError(err)
+	}
+	return &pb.ReplicateResponse{}, nil
+}
+
+// Commit to release the payloads from the standby
+func (s *StandbyServer) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	sb, err := s.standby(req.GetTag())
+	if err != nil {
+		return nil, err
+	}
+	if err := sb.Commit(ctx, req.GetIds()); err != nil {
+		return nil, standbyError(err)
+	}
+	return &pb.CommitResponse{}, nil
+}
+
+// standby to find the Standby with the tag
+func (s *StandbyServer) standby(tag string) (*plq.Standby, error) {
+	for _, sb := range s.Standbys {
+		if sb.Tag == tag {
+			return sb, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "standby %s does not exist", tag)
+}
+
+// standbyError to map an error of a Standby to a status
+func standbyError(err error) error {
+	if errors.Is(err, plq.ErrPromoted) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+// Replicator to replicate the payloads of the primary queue with the Tag to a remote
+// StandbyServer over the connection. Use it as the Replicator of the primary queue. The Data of
+// each payload is sent encoded by the Codec of the queue, so the standby holds it in the form that
+// Codec decodes to.
+type Replicator struct {
+	Conn grpc.ClientConnInterface
+	Tag  string
+}
+
+// Replicate to mirror the payloads to the remote standby
+func (r *Replicator) Replicate(ctx context.Context, pls []plq.Payload) error {
+	req := &pb.ReplicateRequest{Tag: r.Tag}
+	for _, p := range pls {
+		v, err := toReplica(plq.CodecFromContext(ctx), p)
+		if err != nil {
+			return err
+		}
+		req.Payloads = append(req.Payloads, v)
+	}
+	_, err := pb.NewStandbyClient(r.Conn).Replicate(ctx, req)
+	return err
+}
+
+// Commit to release the payloads from the remote standby
+func (r *Replicator) Commit(ctx context.Context, ids []string) error {
+	_, err := pb.NewStandbyClient(r.Conn).Commit(ctx, &pb.CommitRequest{Tag: r.Tag, Ids: ids})
+	return err
+}
+
+// toReplica to encode the payload with its scheduling state
+func toReplica(c plq.Codec, p plq.Payload) (*pb.Payload, error) {
+	data, err := c.Marshal(p.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Payload{
+		Id:        p.Id,
+		Data:      data,
+		Headers:   p.Headers,
+		NotBefore: unixNano(p.NotBefore),
+		ExpiresAt: unixNano(p.ExpiresAt),
+		Attempts:  int32(p.Attempts),
+	}, nil
+}
+
+// fromReplica to decode the payload encoded by toReplica
+func fromReplica(c plq.Codec, v *pb.Payload) (plq.Payload, error) {
+	var data interface{}
+	if err := c.Unmarshal(v.GetData(), &data); err != nil {
+		return plq.Payload{}, err
+	}
+	return plq.Payload{
+		Id:        v.GetId(),
+		Data:      data,
+		Headers:   v.GetHeaders(),
+		NotBefore: fromUnixNano(v.GetNotBefore()),
+		ExpiresAt: fromUnixNano(v.GetExpiresAt()),
+		Attempts:  int(v.GetAttempts()),
+	}, nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,51 @@
+package grpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	pqgrpc "github.com/sam-ish/payloadqueue/grpc"
+)
+
+func TestStandby(t *testing.T) {
+	standby := &plq.Standby{Tag: "QueueA"}
+	srv := &pqgrpc.StandbyServer{Standbys: []*plq.Standby{standby}}
+	conn := listen(t, srv.Register)
+
+	t.Run("Replicate and commit over the connection", func(t *testing.T) {
+		expires := time.Now().Add(time.Hour).Round(0)
+		primary := &plq.Queue{
+			MaxSize:    10,
+			MaxAge:     200,
+			Tag:        "QueueA",
+			Replicator: &pqgrpc.Replicator{Conn: conn, Tag: "QueueA"},
+			Work:       func(pls []interface{}) int { return 0 },
+		}
+		primary.Start()
+		defer primary.Close()
+		primary.Append(plq.Payload{Id: "1", Data: map[string]string{"name": "a"}})
+		primary.Flush()
+		time.Sleep(100 * time.Millisecond)
+		primary.Append(plq.Payload{Id: "2", Data: map[string]string{"name": "b"}, ExpiresAt: expires, Headers: map[string]string{"tenant": "acme"}})
+
+		pls := standby.Pending()
+		if len(pls) != 1 || pls[0].Id != "2" {
+			t.Fatalf("Expected payload 2 to be held, got %+v", pls)
+		}
+		if !pls[0].ExpiresAt.Equal(expires) || pls[0].Headers["tenant"] != "acme" {
+			t.Errorf("Unexpected payload: %+v", pls[0])
+		}
+		if data, ok := pls[0].Data.(map[string]interface{}); !ok || data["name"] != "b" {
+			t.Errorf("Unexpected data: %v", pls[0].Data)
+		}
+	})
+
+	t.Run("Unknown standby", func(t *testing.T) {
+		r := &pqgrpc.Replicator{Conn: conn, Tag: "QueueZ"}
+		if err := r.Replicate(context.Background(), nil); err == nil {
+			t.Errorf("Expected error - standby does not exist")
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package payloadqueue
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// ErrNotRunning is returned by Healthy for a queue that is not started, or is closed
+var ErrNotRunning = errors.New("the queue is not running")
+
+// ErrNotReady is wrapped by the error Ready returns for a running queue that should not be sent
+// payloads for now
+var ErrNotReady = errors.New("the queue is not ready")
+
+// BreakerState to tell whether the breaker of a Queue holds its batches, see BreakerThreshold
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // batches are pushed
+	BreakerOpen     BreakerState = "open"      // batches are held after BreakerThreshold batches in a row delivered nothing
+	BreakerHalfOpen BreakerState = "half-open" // the BreakerCooldown has passed and batches probe the downstream
+)
+
+// HealthReport to describe the health of a Queue, as served to liveness and readiness probes
+type HealthReport struct {
+	Tag                 string       `json:"tag"`
+	Running             bool         `json:"running"`              // between Start and Close
+	Paused              bool         `json:"paused"`               // see Pause
+	Draining            bool         `json:"draining"`             // see Drain
+	LastSuccess         time.Time    `json:"last_success"`         // when a batch last delivered payloads, zero until one has
+	ConsecutiveFailures int          `json:"consecutive_failures"` // batches in a row that delivered nothing
+	Depth               int          `json:"depth"`                // payloads held, as counted against the MaxPending
+	Capacity            int          `json:"capacity"`             // the MaxPending, zero for no limit
+	Breaker             BreakerState `json:"breaker"`
+}
+
+// Healthy to report whether the queue is alive, for a liveness probe: ErrNotRunning unless it is
+// running. A failing downstream does not make the queue unhealthy, since restarting it would not
+// help; see Ready.
+func (r HealthReport) Healthy() error {
+	if !r.Running {
+		return ErrNotRunning
+	}
+	return nil
+}
+
+// Ready to report whether the queue should be sent payloads, for a readiness probe. It is not ready
+// while it drains, while its breaker is open and while it holds its MaxPending.
+func (r HealthReport) Ready() error {
+	if err := r.Healthy(); err != nil {
+		return err
+	}
+	switch {
+	case r.Draining:
+		return fmt.Errorf("%w: the queue is draining", ErrNotReady)
+	case r.Breaker == BreakerOpen:
+		return fmt.Errorf("%w: the breaker is open after %d failed batches", ErrNotReady, r.ConsecutiveFailures)
+	case r.Capacity > 0 && r.Depth >= r.Capacity:
+		return fmt.Errorf("%w: %w", ErrNotReady, ErrQueueFull)
+	}
+	return nil
+}
+
+// Health to report the health of the queue
+func (q *Queue) Health() HealthReport {
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
+	return HealthReport{
+		Tag:                 q.Tag,
+		Running:             q.running.Load(),
+		Paused:              q.paused,
+		Draining:            q.draining,
+		LastSuccess:         q.breaker.lastSuccess,
+		ConsecutiveFailures: q.breaker.failures,
+		Depth:               q.load(),
+		Capacity:            q.MaxPending,
+		Breaker:             q.breaker.current(),
+	}
+}
+
+// Healthy to report whether the queue is alive, see HealthReport.Healthy
+func (q *Queue) Healthy() error {
+	return q.Health().Healthy()
+}
+
+// Ready to report whether the queue should be sent payloads, see HealthReport.Ready
+func (q *Queue) Ready() error {
+	return q.Health().Ready()
+}
+
+// breaker to count the batches in a row that delivered nothing, and hold the batches once there are
+// BreakerThreshold of them. It is guarded by the payloadMutex.
+type breaker struct {
+	state       BreakerState
+	failures    int
+	opened      time.Time // when the breaker last opened
+	lastSuccess time.Time
+}
+
+// current to return the state of the breaker, closed until a batch fails
+func (b *breaker) current() BreakerState {
+	if b.state == "" {
+		return BreakerClosed
+	}
+	return b.state
+}
+
+// tripped to report whether the breaker holds the batches. Once the BreakerCooldown has passed,
+// it is half-open and the batches probe the downstream. The payloadMutex must be held.
+func (q *Queue) tripped() bool {
+	if q.breaker.state != BreakerOpen {
+		return false
+	}
+	if q.now().Sub(q.breaker.opened) < q.BreakerCooldown {
+		return true
+	}
+	q.breaker.state = BreakerHalfOpen
+	return false
+}
+
+// trip to record whether a batch delivered anything, opening the breaker after BreakerThreshold
+// batches in a row delivered nothing and closing it once one does
+func (q *Queue) trip(delivered bool) {
+	q.payloadMutex.Lock()
+	b := &q.breaker
+	was := b.current()
+	if delivered {
+		b.state, b.failures, b.lastSuccess = BreakerClosed, 0, q.now()
+	} else if b.failures++; q.BreakerThreshold > 0 && b.failures >= q.BreakerThreshold {
+		b.state, b.opened = BreakerOpen, q.now()
+	}
+	state, failures := b.current(), b.failures
+	q.payloadMutex.Unlock()
+	switch {
+	case state == was:
+	case state == BreakerOpen:
+		q.log(slog.LevelWarn, "breaker open", "Buffer Queue: Breaker open after "+strconv.Itoa(failures)+" failed batches",
+			slog.Int("failures", failures))
+	case state == BreakerClosed:
+		q.event("Buffer Queue: Breaker closed")
+	}
+}
@@ -0,0 +1,135 @@
+package payloadqueue
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// histogramBounds are the upper bounds of the buckets of a Histogram, the last bucket holding what
+// is above them
+var histogramBounds = [...]time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// HistogramBounds to return the upper bounds of the buckets of a Histogram, shortest first
+func HistogramBounds() []time.Duration {
+	return append([]time.Duration(nil), histogramBounds[:]...)
+}
+
+// Histogram to count durations into the buckets of HistogramBounds, as reported in the Stats
+type Histogram struct {
+	Counts [len(histogramBounds) + 1]int64 `json:"counts"` // durations per bucket, the last one above every bound
+	Count  int64                           `json:"count"`
+	Sum    time.Duration                   `json:"sum"`
+	Max    time.Duration                   `json:"max"` // the longest duration, the upper end of the last bucket
+}
+
+// observe to count the duration into its bucket
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+	h.Max = max(h.Max, d)
+}
+
+// Quantile to estimate the duration below which the fraction p of the counted durations fall, e.g.
+// 0.99, by interpolating within its bucket. The last bucket, beyond every bound, reaches up to the
+// Max.
+func (h Histogram) Quantile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := p * float64(h.Count)
+	var seen int64
+	var lower time.Duration
+	for i, c := range h.Counts {
+		upper := h.Max
+		if i < len(histogramBounds) {
+			upper = min(histogramBounds[i], h.Max)
+		}
+		if c > 0 && float64(seen+c) >= rank {
+			return lower + time.Duration(float64(upper-lower)*(rank-float64(seen))/float64(c))
+		}
+		seen += c
+		lower = upper
+	}
+	return h.Max
+}
+
+// Mean to return the mean of the counted durations
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// sloWindow to hold the time in queue of the payloads batched since the window opened, for the
+// TimeInQueueSLO
+type sloWindow struct {
+	mutex    sync.Mutex
+	opened   time.Time
+	window   Histogram
+	breached bool // the p99 of the last window closed exceeded the TimeInQueueSLO
+}
+
+// timed to count the time the payloads of a pushed batch spent in the queue and how long the
+// handler took for it, and check the TimeInQueueSLO
+func (q *Queue) timed(pls []Payload, started time.Time) {
+	took := q.now().Sub(started)
+	var waited []time.Duration
+	for _, p := range pls {
+		if !p.appended.IsZero() {
+			waited = append(waited, started.Sub(p.appended))
+		}
+	}
+	q.counters.add(func(s *Stats) {
+		s.BatchLatency.observe(took)
+		for _, d := range waited {
+			s.TimeInQueue.observe(d)
+		}
+	})
+	if q.TimeInQueueSLO > 0 {
+		q.checkSLO(waited)
+	}
+}
+
+// checkSLO to count the time in queue into the open window and, once the SLOWindow has passed,
+// warn when its p99 exceeds the TimeInQueueSLO, and tell when it is back within it
+func (q *Queue) checkSLO(waited []time.Duration) {
+	now := q.now()
+	w := &q.slo
+	w.mutex.Lock()
+	if w.opened.IsZero() {
+		w.opened = now
+	}
+	for _, d := range waited {
+		w.window.observe(d)
+	}
+	if now.Sub(w.opened) < q.SLOWindow || w.window.Count == 0 {
+		w.mutex.Unlock()
+		return
+	}
+	p99, count := w.window.Quantile(0.99), w.window.Count
+	was := w.breached
+	w.breached = p99 > q.TimeInQueueSLO
+	w.opened, w.window = now, Histogram{}
+	breached := w.breached
+	w.mutex.Unlock()
+	switch {
+	case breached:
+		q.log(slog.LevelWarn, "time in queue over SLO", "Buffer Queue: p99 time in queue of "+p99.String()+" exceeds the SLO of "+
+			q.TimeInQueueSLO.String()+" over "+q.SLOWindow.String()+". Check the MaxAge and how long the handler takes",
+			slog.Duration("p99", p99), slog.Duration("slo", q.TimeInQueueSLO), slog.Int64("payloads", count))
+	case was:
+		q.log(slog.LevelInfo, "time in queue within SLO", "Buffer Queue: p99 time in queue of "+p99.String()+" is back within the SLO of "+
+			q.TimeInQueueSLO.String(), slog.Duration("p99", p99), slog.Duration("slo", q.TimeInQueueSLO), slog.Int64("payloads", count))
+	}
+}
@@ -0,0 +1,73 @@
+package httpserver
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Prometheus to serve the Metrics of the queues in the Prometheus text format, one series per queue
+// labelled by its tag. A metric is named after its Description, e.g. /queue/payloads/delivered:payloads
+// as payloadqueue_payloads_delivered_payloads_total, and a histogram has its buckets in seconds.
+func Prometheus(queues ...*plq.Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		b := bufio.NewWriter(w)
+		defer b.Flush()
+		all := make([][]plq.Metric, len(queues))
+		for i, q := range queues {
+			all[i] = q.Metrics()
+		}
+		bounds := plq.HistogramBounds()
+		for i, d := range plq.AllMetrics() {
+			name := promName(d)
+			b.WriteString("# HELP " + name + " " + d.Description + "\n")
+			b.WriteString("# TYPE " + name + " " + d.Kind.String() + "\n")
+			for _, ms := range all {
+				m := ms[i]
+				tag := `tag="` + promLabel(m.Tag) + `"`
+				if m.Histogram == nil {
+					b.WriteString(name + "{" + tag + "} " + promFloat(m.Value) + "\n")
+					continue
+				}
+				var count int64
+				for j, c := range m.Histogram.Counts {
+					count += c
+					le := "+Inf"
+					if j < len(bounds) {
+						le = promFloat(bounds[j].Seconds())
+					}
+					b.WriteString(name + "_bucket{" + tag + `,le="` + le + `"} ` + strconv.FormatInt(count, 10) + "\n")
+				}
+				b.WriteString(name + "_sum{" + tag + "} " + promFloat(m.Histogram.Sum.Seconds()) + "\n")
+				b.WriteString(name + "_count{" + tag + "} " + strconv.FormatInt(m.Histogram.Count, 10) + "\n")
+			}
+		}
+	})
+}
+
+// promName to return the Prometheus name of a metric
+func promName(d plq.Description) string {
+	name := strings.TrimPrefix(d.Name, "/queue/")
+	name = "payloadqueue_" + strings.NewReplacer("/", "_", ":", "_", "-", "_").Replace(name)
+	if d.Kind == plq.KindCounter {
+		name += "_total"
+	}
+	return name
+}
+
+// promLabel to escape a label value
+func promLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
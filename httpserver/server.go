@@ -0,0 +1,515 @@
+// Package httpserver exposes payloadqueue Queues over HTTP so the library can run as a small
+// standalone batching service:
+//
+//	GET  /healthz                   the liveness probe of the queues, see Liveness
+//	GET  /readyz                    the readiness probe of the queues, see Readiness
+//	GET  /metrics                   the Metrics of the queues in the Prometheus text format, see Prometheus
+//	GET  /queues                    return the QueueStatus of every queue, as polled by cmd/pqtop
+//	POST /queues/{tag}/payloads     enqueue a JSON payload, or a JSON array of payloads
+//	GET  /queues/{tag}/stats        return the Stats of the queue
+//	GET  /queues/{tag}/health       return the HealthReport of the queue
+//	GET  /queues/{tag}/events       stream the events of the queue as NDJSON, from the level query, e.g. ?level=warn
+//	GET  /queues/{tag}/deadletters  return the dead-lettered payloads of the Storage, up to the max query
+//	POST /queues/{tag}/flush        flush the pending payloads of the queue now
+//	POST /queues/{tag}/pause        stop cutting batches until resumed
+//	POST /queues/{tag}/resume       cut batches again
+//	POST /queues/{tag}/redrive      return the dead-lettered payloads of the Storage to the queue
+//	POST /queues/{tag}/purge        drop the pending payloads of the queue
+//	POST /queues/{tag}/replay       enqueue again the payloads delivered in the batch query, or since the since query (RFC 3339)
+//
+// A payload is posted as {"id": "...", "data": ..., "headers": {...}, "idempotency_key": "..."}.
+// The id is optional and a random one is assigned when it is missing.
+//
+// The admin actions, from flush on, the dead letters, and the stats, health and events of the
+// queues are allowed to everyone unless an Authorizer is supplied; the Identify function then
+// establishes the Caller of each request. Reading the stats, health and events is ActionObserve,
+// and GET /queues lists the queues the caller may observe. The probes and the metrics stay open to
+// the kubelet and the scraper, and expose no more than counts and the health of each queue.
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Server to route the HTTP requests to the Queues by their Tag
+type Server struct {
+	Queues       []*plq.Queue
+	MaxBodyBytes int64                                   // largest request body accepted. Default is 1MB
+	Authorizer   plq.Authorizer                          // when supplied, gates the admin actions and what the queues expose
+	Identify     func(*http.Request) (plq.Caller, error) // establishes the Caller for the Authorizer, e.g. from a verified token. An error is served as 401
+}
+
+// actions are the admin actions by their path
+var actions = map[string]plq.Action{
+	"flush":   plq.ActionFlush,
+	"pause":   plq.ActionPause,
+	"resume":  plq.ActionResume,
+	"redrive": plq.ActionRedrive,
+	"purge":   plq.ActionPurge,
+	"replay":  plq.ActionReplay,
+}
+
+// QueueStatus is the wire format of a queue in GET /queues: its Stats, whether it is paused and the
+// latency of its recent deliveries
+type QueueStatus struct {
+	plq.Stats
+	Paused  bool    `json:"paused"`
+	Latency Latency `json:"latency"`
+}
+
+// Latency is the wire format of a LatencySummary, in milliseconds
+type Latency struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// Event is the wire format of an event in GET /queues/{tag}/events
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Tag     string            `json:"tag"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// Probe is the response of a liveness or readiness probe: the HealthReport of every queue, and the
+// error of the first that failed the probe
+type Probe struct {
+	Error  string             `json:"error,omitempty"`
+	Queues []plq.HealthReport `json:"queues"`
+}
+
+// Liveness to serve a liveness probe of the queues: 200 while every queue is Healthy, 503
+// otherwise, e.g. for a Kubernetes livenessProbe
+func Liveness(queues ...*plq.Queue) http.Handler {
+	return probe(queues, plq.HealthReport.Healthy)
+}
+
+// Readiness to serve a readiness probe of the queues: 200 while every queue is Ready, 503
+// otherwise, e.g. for a Kubernetes readinessProbe
+func Readiness(queues ...*plq.Queue) http.Handler {
+	return probe(queues, plq.HealthReport.Ready)
+}
+
+// probe to serve the Probe of the queues, failed by the first error of check
+func probe(queues []*plq.Queue, check func(plq.HealthReport) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		p := Probe{Queues: make([]plq.HealthReport, 0, len(queues))}
+		for _, q := range queues {
+			h := q.Health()
+			if err := check(h); err != nil && p.Error == "" {
+				p.Error = h.Tag + ": " + err.Error()
+			}
+			p.Queues = append(p.Queues, h)
+		}
+		status := http.StatusOK
+		if p.Error != "" {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, p)
+	})
+}
+
+// payload is the wire format of a posted payload
+type payload struct {
+	Id             string            `json:"id,omitempty"`
+	Data           interface{}       `json:"data"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+}
+
+// ServeHTTP to handle the queue requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the parts are split before they are unescaped, so a tag may hold a slash
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		if unescaped, err := url.PathUnescape(part); err == nil {
+			parts[i] = unescaped
+		}
+	}
+	switch r.URL.Path {
+	case "/healthz":
+		Liveness(s.Queues...).ServeHTTP(w, r)
+		return
+	case "/readyz":
+		Readiness(s.Queues...).ServeHTTP(w, r)
+		return
+	case "/metrics":
+		Prometheus(s.Queues...).ServeHTTP(w, r)
+		return
+	}
+	if len(parts) == 1 && parts[0] == "queues" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		caller, ok := s.identify(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, s.statuses(r, caller))
+		return
+	}
+	if len(parts) != 3 || parts[0] != "queues" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	q := s.queue(parts[1])
+	if q == nil {
+		writeError(w, http.StatusNotFound, "queue "+parts[1]+" does not exist")
+		return
+	}
+	switch parts[2] {
+	case "payloads":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		s.enqueue(w, r, q)
+	case "stats":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !s.authorize(w, r, q, plq.ActionObserve) {
+			return
+		}
+		writeJSON(w, http.StatusOK, q.Stats())
+	case "health":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !s.authorize(w, r, q, plq.ActionObserve) {
+			return
+		}
+		writeJSON(w, http.StatusOK, q.Health())
+	case "events":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !s.authorize(w, r, q, plq.ActionObserve) {
+			return
+		}
+		s.events(w, r, q)
+	case "deadletters":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !s.authorize(w, r, q, plq.ActionInspect) {
+			return
+		}
+		s.deadLetters(w, r, q)
+	default:
+		action, ok := actions[parts[2]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !s.authorize(w, r, q, action) {
+			return
+		}
+		s.admin(w, r, q, action)
+	}
+}
+
+// authorize to check the admin action with the Authorizer, writing the error when it is refused
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, q *plq.Queue, action plq.Action) bool {
+	if s.Authorizer == nil {
+		return true
+	}
+	caller, ok := s.identify(w, r)
+	if !ok {
+		return false
+	}
+	if err := s.Authorizer.Authorize(r.Context(), caller, q.Tag, action); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// identify to establish the Caller of the request for the Authorizer, writing the error when it
+// cannot be
+func (s *Server) identify(w http.ResponseWriter, r *http.Request) (plq.Caller, bool) {
+	if s.Authorizer == nil || s.Identify == nil {
+		return plq.Caller{}, true
+	}
+	caller, err := s.Identify(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return plq.Caller{}, false
+	}
+	return caller, true
+}
+
+// admin to perform the admin action on the queue
+func (s *Server) admin(w http.ResponseWriter, r *http.Request, q *plq.Queue, action plq.Action) {
+	switch action {
+	case plq.ActionFlush:
+		q.Flush()
+		w.WriteHeader(http.StatusAccepted)
+	case plq.ActionPause, plq.ActionResume:
+		if action == plq.ActionPause {
+			q.Pause()
+		} else {
+			q.Resume()
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Paused bool `json:"paused"`
+		}{q.Paused()})
+	case plq.ActionRedrive:
+		n, err := q.Redrive(r.Context())
+		if errors.Is(err, plq.ErrNoDeadLetters) {
+			writeError(w, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Redriven int `json:"redriven"`
+		}{n})
+	case plq.ActionPurge:
+		writeJSON(w, http.StatusOK, struct {
+			Purged int `json:"purged"`
+		}{q.Purge()})
+	case plq.ActionReplay:
+		s.replay(w, r, q)
+	}
+}
+
+// replay to enqueue again the payloads delivered in the batch of the batch query, or since the time
+// of the since query
+func (s *Server) replay(w http.ResponseWriter, r *http.Request, q *plq.Queue) {
+	var n int
+	var err error
+	batch, since := r.URL.Query().Get("batch"), r.URL.Query().Get("since")
+	switch {
+	case batch != "" && since == "":
+		n, err = q.Replay(r.Context(), batch)
+	case since != "" && batch == "":
+		t, perr := time.Parse(time.RFC3339, since)
+		if perr != nil {
+			writeError(w, http.StatusBadRequest, "invalid since "+since+", expected RFC 3339")
+			return
+		}
+		n, err = q.ReplaySince(r.Context(), t)
+	default:
+		writeError(w, http.StatusBadRequest, "replay needs either a batch or a since query")
+		return
+	}
+	if errors.Is(err, plq.ErrNoArchive) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Replayed int `json:"replayed"`
+	}{n})
+}
+
+// levels are the event levels by their name in the level query
+var levels = map[string]plq.EventLevel{
+	"debug": plq.EventDebug,
+	"info":  plq.EventInfo,
+	"warn":  plq.EventWarn,
+	"error": plq.EventError,
+}
+
+// events to stream the events of the queue, one Event per line, until the request ends
+func (s *Server) events(w http.ResponseWriter, r *http.Request, q *plq.Queue) {
+	level := plq.EventInfo
+	if name := r.URL.Query().Get("level"); name != "" {
+		var ok bool
+		if level, ok = levels[strings.ToLower(name)]; !ok {
+			writeError(w, http.StatusBadRequest, "unknown level "+name)
+			return
+		}
+	}
+	events, cancel := q.Subscribe(level)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-events:
+			attrs := make(map[string]string, len(e.Attrs))
+			for _, a := range e.Attrs {
+				attrs[a.Key] = a.Value.String()
+			}
+			if err := enc.Encode(Event{Time: e.Time, Tag: e.Tag, Level: e.Level.String(), Message: e.Message, Attrs: attrs}); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// deadLetters to return the dead-lettered payloads of the queue
+func (s *Server) deadLetters(w http.ResponseWriter, r *http.Request, q *plq.Queue) {
+	max := 100
+	if v := r.URL.Query().Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid max "+v)
+			return
+		}
+		max = n
+	}
+	dls, err := q.DeadLetters(r.Context(), max)
+	if errors.Is(err, plq.ErrNoDeadLetters) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if dls == nil {
+		dls = []plq.DeadLetter{}
+	}
+	writeJSON(w, http.StatusOK, dls)
+}
+
+// statuses to return the QueueStatus of every queue the caller may observe
+func (s *Server) statuses(r *http.Request, caller plq.Caller) []QueueStatus {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	statuses := make([]QueueStatus, 0, len(s.Queues))
+	for _, q := range s.Queues {
+		if s.Authorizer != nil && s.Authorizer.Authorize(r.Context(), caller, q.Tag, plq.ActionObserve) != nil {
+			continue
+		}
+		l := q.Latency()
+		statuses = append(statuses, QueueStatus{
+			Stats:   q.Stats(),
+			Paused:  q.Paused(),
+			Latency: Latency{Count: l.Count, P50: ms(l.P50), P95: ms(l.P95), P99: ms(l.P99), Max: ms(l.Max)},
+		})
+	}
+	return statuses
+}
+
+// queue to find the Queue with the tag
+func (s *Server) queue(tag string) *plq.Queue {
+	for _, q := range s.Queues {
+		if q.Tag == tag {
+			return q
+		}
+	}
+	return nil
+}
+
+// enqueue to append the posted payloads to the queue
+func (s *Server) enqueue(w http.ResponseWriter, r *http.Request, q *plq.Queue) {
+	max := s.MaxBodyBytes
+	if max <= 0 {
+		max = 1 << 20
+	}
+	pls, err := decode(http.MaxBytesReader(w, r.Body, max))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ids := make([]string, 0, len(pls))
+	for _, v := range pls {
+		p := q.NewPayload(v.Data)
+		if v.Id != "" {
+			p.Id = v.Id
+		}
+		p.Headers = v.Headers
+		p.IdempotencyKey = v.IdempotencyKey
+		if err := q.AppendContext(r.Context(), p); err != nil {
+			code := http.StatusServiceUnavailable
+			switch {
+			case errors.Is(err, plq.ErrQueueFull) || errors.Is(err, plq.ErrWouldBlock):
+				code = http.StatusTooManyRequests
+			case errors.Is(err, plq.ErrInvalidPayload):
+				code = http.StatusUnprocessableEntity
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		ids = append(ids, p.Id)
+	}
+	writeJSON(w, http.StatusAccepted, struct {
+		Ids []string `json:"ids"`
+	}{ids})
+}
+
+// decode to read a single payload or an array of payloads
+func decode(r io.Reader) ([]payload, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("empty request body")
+	}
+	var pls []payload
+	if body[0] == '[' {
+		err = json.Unmarshal(body, &pls)
+	} else {
+		var p payload
+		err = json.Unmarshal(body, &p)
+		pls = append(pls, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pls {
+		if p.Data == nil {
+			return nil, errors.New("payload data is missing")
+		}
+	}
+	return pls, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
@@ -0,0 +1,347 @@
+package httpserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/httpserver"
+)
+
+func TestServer(t *testing.T) {
+	var runMutex sync.Mutex
+	batched := []interface{}{}
+	q := &plq.Queue{
+		Tag:    "QueueA",
+		MaxAge: 200,
+		Work: func(pls []interface{}) int {
+			runMutex.Lock()
+			batched = append(batched, pls...)
+			runMutex.Unlock()
+			return 0
+		},
+	}
+	q.Start()
+	defer q.Close()
+	srv := httptest.NewServer(&httpserver.Server{Queues: []*plq.Queue{q}})
+	defer srv.Close()
+
+	t.Run("Enqueue payloads", func(t *testing.T) {
+		res, err := http.Post(srv.URL+"/queues/QueueA/payloads", "application/json",
+			strings.NewReader(`[{"data":{"name":"a"}},{"id":"b-1","data":{"name":"b"},"headers":{"tenant":"acme"}}]`))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusAccepted {
+			t.Errorf("Expected status 202, got %d", res.StatusCode)
+		}
+		var body struct{ Ids []string }
+		json.NewDecoder(res.Body).Decode(&body)
+		if len(body.Ids) != 2 || body.Ids[1] != "b-1" {
+			t.Errorf("Unexpected ids: %v", body.Ids)
+		}
+		if q.Size() != 2 {
+			t.Errorf("Expected Size() to be 2, got %d", q.Size())
+		}
+	})
+
+	t.Run("Enqueue an invalid payload", func(t *testing.T) {
+		res, err := http.Post(srv.URL+"/queues/QueueA/payloads", "application/json", strings.NewReader(`{"id":"x"}`))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("Flush and read the stats", func(t *testing.T) {
+		res, err := http.Post(srv.URL+"/queues/QueueA/flush", "", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		res.Body.Close()
+		time.Sleep(100 * time.Millisecond)
+
+		res, err = http.Get(srv.URL + "/queues/QueueA/stats")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		defer res.Body.Close()
+		var stats plq.Stats
+		json.NewDecoder(res.Body).Decode(&stats)
+		if stats.Appended != 2 || stats.Delivered != 2 || stats.Pending != 0 {
+			t.Errorf("Unexpected stats: %+v", stats)
+		}
+		runMutex.Lock()
+		if len(batched) != 2 {
+			t.Errorf("Expected 2 payloads to be batched, got %d", len(batched))
+		}
+		runMutex.Unlock()
+	})
+
+	t.Run("Read the status of every queue", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/queues")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		defer res.Body.Close()
+		var statuses []httpserver.QueueStatus
+		json.NewDecoder(res.Body).Decode(&statuses)
+		if len(statuses) != 1 || statuses[0].Tag != "QueueA" || statuses[0].Delivered != 2 || statuses[0].Latency.Count != 2 || statuses[0].Paused {
+			t.Errorf("Unexpected statuses: %+v", statuses)
+		}
+	})
+
+	t.Run("Probe the health of the queues", func(t *testing.T) {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			res, err := http.Get(srv.URL + path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			var p httpserver.Probe
+			json.NewDecoder(res.Body).Decode(&p)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || p.Error != "" || len(p.Queues) != 1 || !p.Queues[0].Running {
+				t.Errorf("Expected %s to pass, got %d %+v", path, res.StatusCode, p)
+			}
+		}
+		res, err := http.Get(srv.URL + "/queues/QueueA/health")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		defer res.Body.Close()
+		var h plq.HealthReport
+		json.NewDecoder(res.Body).Decode(&h)
+		if h.LastSuccess.IsZero() || h.Breaker != plq.BreakerClosed {
+			t.Errorf("Unexpected health: %+v", h)
+		}
+
+		stopped := httptest.NewRecorder()
+		httpserver.Liveness(q, &plq.Queue{Tag: "QueueB"}).ServeHTTP(stopped, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if stopped.Code != http.StatusServiceUnavailable || !strings.Contains(stopped.Body.String(), "QueueB") {
+			t.Errorf("Expected a queue that is not started to fail, got %d %s", stopped.Code, stopped.Body.String())
+		}
+	})
+
+	t.Run("Scrape the metrics", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/metrics")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		for _, line := range []string{
+			"# TYPE payloadqueue_payloads_delivered_payloads_total counter",
+			`payloadqueue_payloads_delivered_payloads_total{tag="QueueA"} 2`,
+			"# TYPE payloadqueue_payloads_time_in_queue_seconds histogram",
+			`payloadqueue_payloads_time_in_queue_seconds_bucket{tag="QueueA",le="+Inf"} 2`,
+			`payloadqueue_payloads_time_in_queue_seconds_count{tag="QueueA"} 2`,
+			`payloadqueue_batches_latency_seconds_count{tag="QueueA"} 1`,
+		} {
+			if !strings.Contains(string(body), line+"\n") {
+				t.Errorf("Expected the line %s in:\n%s", line, body)
+			}
+		}
+	})
+
+	t.Run("Follow the events", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/queues/QueueA/events?level=info", nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", res.StatusCode)
+		}
+		q.Append(plq.Payload{Id: "c", Data: "c"})
+		q.Flush()
+		dec := json.NewDecoder(res.Body)
+		for {
+			var e httpserver.Event
+			if err := dec.Decode(&e); err != nil {
+				t.Fatalf("Expected the batch events, got %v", err)
+			}
+			if e.Tag == "QueueA" && e.Attrs["batch_size"] == "1" && strings.Contains(e.Message, "Finished") {
+				break
+			}
+		}
+
+		res, err = http.Get(srv.URL + "/queues/QueueA/events?level=loud")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for an unknown level, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("Dead letters need a storage that keeps them", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/queues/QueueA/deadletters")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotImplemented {
+			t.Errorf("Expected status 501, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("Replay needs a batch or a since and a storage that archives", func(t *testing.T) {
+		for query, status := range map[string]int{
+			"":                                    http.StatusBadRequest,
+			"?since=yesterday":                    http.StatusBadRequest,
+			"?batch=1&since=2026-10-14T09:00:00Z": http.StatusBadRequest,
+			"?batch=1":                            http.StatusNotImplemented,
+			"?since=2026-10-14T09:00:00Z":         http.StatusNotImplemented,
+		} {
+			res, err := http.Post(srv.URL+"/queues/QueueA/replay"+query, "", nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			res.Body.Close()
+			if res.StatusCode != status {
+				t.Errorf("Expected status %d for %q, got %d", status, query, res.StatusCode)
+			}
+		}
+	})
+
+	t.Run("Unknown queue", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/queues/QueueZ/stats")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("A tag with a slash is routed escaped", func(t *testing.T) {
+		eu := &plq.Queue{Tag: "orders/eu", MaxAge: 200, Work: func(pls []interface{}) int { return 0 }}
+		eu.Start()
+		defer eu.Close()
+		srv := httptest.NewServer(&httpserver.Server{Queues: []*plq.Queue{eu}})
+		defer srv.Close()
+		res, err := http.Get(srv.URL + "/queues/orders%2Feu/stats")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		var stats plq.Stats
+		json.NewDecoder(res.Body).Decode(&stats)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || stats.Tag != "orders/eu" {
+			t.Errorf("Expected the stats of the queue, got %d %+v", res.StatusCode, stats)
+		}
+	})
+}
+
+func TestServerAuthorization(t *testing.T) {
+	q := &plq.Queue{Tag: "QueueA", MaxAge: 200, Work: func(pls []interface{}) int { return 0 }}
+	q.Start()
+	defer q.Close()
+	srv := httptest.NewServer(&httpserver.Server{
+		Queues:     []*plq.Queue{q},
+		Authorizer: plq.RoleAuthorizer{"operator": {plq.ActionPause, plq.ActionResume}, "viewer": {plq.ActionObserve}},
+		Identify: func(r *http.Request) (plq.Caller, error) {
+			role := r.Header.Get("X-Role")
+			if role == "" {
+				return plq.Caller{}, errors.New("no credentials")
+			}
+			return plq.Caller{Subject: "test", Roles: []string{role}}, nil
+		},
+	})
+	defer srv.Close()
+	post := func(path, role string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, nil)
+		if role != "" {
+			req.Header.Set("X-Role", role)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	t.Run("An unidentified caller is refused", func(t *testing.T) {
+		if code := post("/queues/QueueA/pause", ""); code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", code)
+		}
+	})
+
+	t.Run("The caller may only perform the actions of its roles", func(t *testing.T) {
+		if code := post("/queues/QueueA/pause", "operator"); code != http.StatusOK || !q.Paused() {
+			t.Errorf("Expected the operator to pause the queue, got %d", code)
+		}
+		if code := post("/queues/QueueA/purge", "operator"); code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", code)
+		}
+		if code := post("/queues/QueueA/resume", "operator"); code != http.StatusOK || q.Paused() {
+			t.Errorf("Expected the operator to resume the queue, got %d", code)
+		}
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/queues/QueueA/deadletters", nil)
+		req.Header.Set("X-Role", "operator")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected the dead letters to need the inspect action, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("The stats, health and events need the observe action", func(t *testing.T) {
+		get := func(path, role string) *http.Response {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+			if role != "" {
+				req.Header.Set("X-Role", role)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			t.Cleanup(func() { res.Body.Close() })
+			return res
+		}
+		for _, path := range []string{"/queues/QueueA/stats", "/queues/QueueA/health", "/queues/QueueA/events"} {
+			if code := get(path, "").StatusCode; code != http.StatusUnauthorized {
+				t.Errorf("Expected status 401 for %s, got %d", path, code)
+			}
+			if code := get(path, "operator").StatusCode; code != http.StatusForbidden {
+				t.Errorf("Expected status 403 for %s, got %d", path, code)
+			}
+		}
+		if code := get("/queues/QueueA/stats", "viewer").StatusCode; code != http.StatusOK {
+			t.Errorf("Expected the viewer to read the stats, got %d", code)
+		}
+		var statuses []httpserver.QueueStatus
+		json.NewDecoder(get("/queues", "operator").Body).Decode(&statuses)
+		if len(statuses) != 0 {
+			t.Errorf("Expected no queue listed to a caller who may not observe it, got %+v", statuses)
+		}
+		json.NewDecoder(get("/queues", "viewer").Body).Decode(&statuses)
+		if len(statuses) != 1 || statuses[0].Tag != "QueueA" {
+			t.Errorf("Expected the queue listed to the viewer, got %+v", statuses)
+		}
+		if code := get("/healthz", "").StatusCode; code != http.StatusOK {
+			t.Errorf("Expected the probes open to everyone, got %d", code)
+		}
+	})
+}
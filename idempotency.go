@@ -0,0 +1,174 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// ErrUncertainDelivery is the error a payload is dead-lettered with when its IdempotencyKey was
+// already dispatched, e.g. by an instance that crashed during the batch, and it cannot be told
+// whether it was delivered. It is left to an operator rather than risk delivering it twice.
+var ErrUncertainDelivery = errors.New("the payload was dispatched before and may have been delivered")
+
+// IdempotencyStore to share the payloads seen by several replicas of a queue, so that the same
+// logical payload appended to more than one instance is only batched once.
+type IdempotencyStore interface {
+	// Claim records the key for the ttl and reports whether it was claimed by this caller, i.e.
+	// the key was not already recorded.
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+// KeyLookup is implemented by an IdempotencyStore that can report whether a key is recorded without
+// claiming it. A payload restored after a crash whose IdempotencyKey is recorded as delivered is
+// then acknowledged instead of dead-lettered with ErrUncertainDelivery.
+type KeyLookup interface {
+	Recorded(ctx context.Context, key string) (bool, error)
+}
+
+// KeyReleaser is implemented by an IdempotencyStore that can forget a key. The dispatch claim of a
+// payload whose batch failed is then released before it is retried, so the retry can be dispatched
+// wherever it turns up, e.g. claimed back from a Storage by another instance or after a restart.
+type KeyReleaser interface {
+	Release(ctx context.Context, key string) error
+}
+
+// claim to check the payload against the IdempotencyStore. A store that cannot be reached does not
+// block the queue: the payload is accepted and an event is written.
+func (q *Queue) claim(p Payload) bool {
+	if q.Idempotency == nil || p.Id == "" || p.Attempts > 0 {
+		return true
+	}
+	key := p.Id
+	if p.IdempotencyKey != "" {
+		key = p.IdempotencyKey
+	}
+	if q.DedupKey != nil {
+		key = q.DedupKey(p)
+	}
+	ttl := q.idempotencyTTL()
+	ctx := context.Background()
+	if q.WorkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.WorkTimeout)
+		defer cancel()
+	}
+	claimed, err := q.Idempotency.Claim(ctx, q.Tag+":"+key, ttl)
+	if err != nil {
+		q.event("Idempotency: Claim of " + key + " failed, payload accepted. " + err.Error())
+		return true
+	}
+	if !claimed {
+		q.counters.add(func(s *Stats) { s.Duplicates++ })
+		q.event("Payload Duplicate [id]: " + p.Id + " already claimed as " + key)
+	}
+	return claimed
+}
+
+// screen to keep the payloads with an IdempotencyKey from being dispatched twice. The key is claimed
+// before its first dispatch; a payload whose key was claimed before, but not by this queue, is
+// acknowledged when the key is recorded as delivered and dead-lettered with ErrUncertainDelivery
+// otherwise. It returns the payloads to dispatch. A store that cannot be reached does not block
+// the queue: the payload is dispatched and an event is written.
+func (q *Queue) screen(pls []Payload) []Payload {
+	if q.Idempotency == nil {
+		return pls
+	}
+	var dispatch, done, uncertain []Payload
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	for _, p := range pls {
+		if p.IdempotencyKey == "" || p.claimed {
+			dispatch = append(dispatch, p)
+			continue
+		}
+		claimed, err := q.Idempotency.Claim(ctx, q.Tag+":dispatch:"+p.IdempotencyKey, q.idempotencyTTL())
+		if err != nil {
+			q.event("Idempotency: Claim of " + p.IdempotencyKey + " for dispatch failed, payload dispatched. " + err.Error())
+			claimed = true
+		}
+		if claimed {
+			p.claimed = true
+			dispatch = append(dispatch, p)
+			continue
+		}
+		if q.deliveredBefore(ctx, p.IdempotencyKey) {
+			done = append(done, p)
+		} else {
+			uncertain = append(uncertain, p)
+		}
+	}
+	batch := &Batch{Tag: q.Tag}
+	if len(done) > 0 {
+		q.counters.add(func(s *Stats) { s.Duplicates += int64(len(done)) })
+		for _, p := range done {
+			q.log(slog.LevelInfo, "payload delivered before", "Payload Duplicate [id]: "+p.Id+" already delivered as "+p.IdempotencyKey,
+				slog.String("payload_id", p.Id))
+		}
+		q.tally(done, func(c *DailyCounts, n int64) { c.Delivered += n })
+		q.acknowledge(done)
+		q.settle(batch, done, true, nil)
+	}
+	if len(uncertain) > 0 {
+		q.deadLetter(uncertain, ErrUncertainDelivery)
+		q.settle(batch, uncertain, false, ErrUncertainDelivery)
+	}
+	return dispatch
+}
+
+// undispatch to release the dispatch claim of a payload of a failed batch before it is retried, with
+// a store that implements KeyReleaser. A batch that timed out may still be delivered by the
+// abandoned handler, so its claims are kept.
+func (q *Queue) undispatch(p *Payload, err error) {
+	releaser, ok := q.Idempotency.(KeyReleaser)
+	if !ok || !p.claimed || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return
+	}
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	if err := releaser.Release(ctx, q.Tag+":dispatch:"+p.IdempotencyKey); err != nil {
+		q.event("Idempotency: Release of " + p.IdempotencyKey + " for a retry failed. " + err.Error())
+		return
+	}
+	p.claimed = false
+}
+
+// deliveredBefore to look up whether the IdempotencyKey is recorded as delivered, with a store
+// that implements KeyLookup
+func (q *Queue) deliveredBefore(ctx context.Context, key string) bool {
+	lookup, ok := q.Idempotency.(KeyLookup)
+	if !ok {
+		return false
+	}
+	recorded, err := lookup.Recorded(ctx, q.Tag+":delivered:"+key)
+	if err != nil {
+		q.event("Idempotency: Lookup of " + key + " failed. " + err.Error())
+		return false
+	}
+	return recorded
+}
+
+// dispatched to record the IdempotencyKeys of the delivered payloads, see screen
+func (q *Queue) dispatched(pls []Payload) {
+	if q.Idempotency == nil {
+		return
+	}
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	for _, p := range pls {
+		if p.IdempotencyKey == "" {
+			continue
+		}
+		if _, err := q.Idempotency.Claim(ctx, q.Tag+":delivered:"+p.IdempotencyKey, q.idempotencyTTL()); err != nil {
+			q.event("Idempotency: Record of " + p.IdempotencyKey + " as delivered failed. " + err.Error())
+		}
+	}
+}
+
+func (q *Queue) idempotencyTTL() time.Duration {
+	if q.IdempotencyTTL <= 0 {
+		return 24 * time.Hour
+	}
+	return q.IdempotencyTTL
+}
@@ -0,0 +1,93 @@
+package payloadqueue
+
+import (
+	"log/slog"
+	"maps"
+)
+
+// Peek to return copies of up to n of the payloads held by the queue, without removing them: the
+// pending payloads in the order they will be batched, then the delayed payloads in the order they
+// fall due. Batches already being processed are not included.
+func (q *Queue) Peek(n int) []Payload {
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
+	if n <= 0 {
+		return nil
+	}
+	pls := make([]Payload, 0, min(n, q.payloadQueue.len()+len(q.delayed)))
+	for i := 0; i < q.payloadQueue.len() && len(pls) < n; i++ {
+		pls = append(pls, q.payloadQueue.at(i).clone())
+	}
+	for _, p := range q.delayed {
+		if len(pls) == n {
+			break
+		}
+		pls = append(pls, p.clone())
+	}
+	return pls
+}
+
+// Find to return a copy of the pending or delayed payload with the id, reporting whether the queue
+// holds it
+func (q *Queue) Find(id string) (Payload, bool) {
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
+	for i := 0; i < q.payloadQueue.len(); i++ {
+		if p := q.payloadQueue.at(i); p.Id == id {
+			return p.clone(), true
+		}
+	}
+	for _, p := range q.delayed {
+		if p.Id == id {
+			return p.clone(), true
+		}
+	}
+	return Payload{}, false
+}
+
+// Remove to pull the pending or delayed payload with the id out of the queue before it is batched,
+// e.g. because the record it was about to sync was deleted, reporting whether the queue held it. It
+// is acknowledged in the Storage, so no other instance claims it. A payload already in a batch being
+// processed is not affected.
+func (q *Queue) Remove(id string) bool {
+	q.payloadMutex.Lock()
+	found := false
+	removed := q.payloadQueue.remove(func(p Payload) bool {
+		if found || p.Id != id {
+			return false
+		}
+		found = true
+		return true
+	})
+	for i, p := range q.delayed {
+		if p.Id == id {
+			removed = append(removed, p)
+			q.delayed = append(q.delayed[:i:i], q.delayed[i+1:]...)
+			break
+		}
+	}
+	q.payloadMutex.Unlock()
+	if len(removed) == 0 {
+		return false
+	}
+	q.release()
+	q.counters.add(func(s *Stats) { s.Removed += int64(len(removed)) })
+	q.tally(removed, func(c *DailyCounts, n int64) { c.Dropped += n })
+	q.acknowledge(removed)
+	var outs []Outcome
+	for _, p := range removed {
+		for _, id := range append([]string{p.Id}, p.coalesced...) {
+			outs = append(outs, Outcome{PayloadId: id, Removed: true})
+		}
+	}
+	q.outcomes.resolve(outs)
+	q.log(slog.LevelInfo, "payload removed", "Payload Removed [id]: "+id, slog.String("payload_id", id))
+	return true
+}
+
+// clone to copy the payload with its own Headers, so a caller changing them does not reach the
+// queue. The Data is shared.
+func (p Payload) clone() Payload {
+	p.Headers = maps.Clone(p.Headers)
+	return p
+}
@@ -0,0 +1,86 @@
+package payloadqueue
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// BatchRecord to record a batch processed by a Queue, with the annotations its sink attached, see
+// Annotate. Records are written as JSON lines to the Journal of a Queue and can be read back with
+// ReadJournal to find out where a payload was delivered to.
+type BatchRecord struct {
+	Id          string            `json:"id"`
+	Number      uint64            `json:"number"`
+	Tag         string            `json:"tag"`
+	Started     time.Time         `json:"started"`
+	Finished    time.Time         `json:"finished"`
+	PayloadIds  []string          `json:"payload_ids"`
+	Failed      []string          `json:"failed,omitempty"` // ids of the payloads that were retried or dead-lettered
+	Error       string            `json:"error,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	SplitFrom   string            `json:"split_from,omitempty"` // the Id of the batch this one is a chunk of, see TooLarge
+	SplitInto   []string          `json:"split_into,omitempty"` // the Ids of the chunks the batch was split into, as the handler rejected it as too large
+}
+
+// ReadJournal to read the batch records written to a Journal.
+func ReadJournal(r io.Reader) ([]BatchRecord, error) {
+	var rs []BatchRecord
+	dec := json.NewDecoder(r)
+	for {
+		var b BatchRecord
+		if err := dec.Decode(&b); err == io.EOF {
+			return rs, nil
+		} else if err != nil {
+			return rs, err
+		}
+		rs = append(rs, b)
+	}
+}
+
+// journalWriter to serialize the batch records of a Queue into its Journal
+type journalWriter struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+// batchRecord to return the record of the processed batch
+func (q *Queue) batchRecord(batch *Batch, started time.Time, failures []Payload, err error) BatchRecord {
+	r := BatchRecord{
+		Id:          batch.Id,
+		Number:      batch.Number,
+		Tag:         batch.Tag,
+		Started:     started,
+		Finished:    q.now(),
+		PayloadIds:  payloadIds(batch.Payloads),
+		Annotations: batch.Annotations(),
+		SplitFrom:   batch.SplitFrom,
+	}
+	if len(failures) > 0 {
+		r.Failed = payloadIds(failures)
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// record to write the record into the Journal
+func (q *Queue) record(r BatchRecord) {
+	if q.journal == nil {
+		return
+	}
+	q.journal.mutex.Lock()
+	q.journal.enc.Encode(r)
+	q.journal.mutex.Unlock()
+}
+
+// payloadIds to return the ids of the payloads
+func payloadIds(pls []Payload) []string {
+	ids := make([]string, len(pls))
+	for i, p := range pls {
+		ids[i] = p.Id
+	}
+	return ids
+}
@@ -0,0 +1,55 @@
+package payloadqueue
+
+import (
+	"context"
+	"fmt"
+)
+
+// Group to run goroutines whose errors end the lifecycle of the application. It is satisfied by
+// an *errgroup.Group of golang.org/x/sync.
+type Group interface {
+	Go(f func() error)
+}
+
+// Go to start the queue with its internal goroutines registered in the group, so the lifecycle of
+// the application includes them:
+//
+//	g, ctx := errgroup.WithContext(ctx)
+//	if err := q.Go(ctx, g); err != nil {
+//		return err
+//	}
+//	...
+//	return g.Wait()
+//
+// When the context ends, the pending payloads are flushed and the queue is closed. The batches run
+// in the group too, so g.Wait returns once its Work has completed, even when the queue was closed
+// or shut down before. An internal goroutine that panics is reported to the group as an
+// error instead of crashing the process.
+func (q *Queue) Go(ctx context.Context, g Group) error {
+	q.group = g
+	err := q.start(ctx, func(f func()) {
+		g.Go(func() error { return q.guard(f) })
+	})
+	if err != nil {
+		return err
+	}
+	g.Go(func() error {
+		<-ctx.Done()
+		q.Flush()
+		q.Close()
+		return nil
+	})
+	return nil
+}
+
+// guard to run an internal goroutine of the queue, turning a panic into an error
+func (q *Queue) guard(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("queue %s: internal goroutine panicked: %v", q.Tag, r)
+			q.event("Buffer Queue: Internal goroutine panicked. " + fmt.Sprint(r))
+		}
+	}()
+	f()
+	return nil
+}
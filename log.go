@@ -0,0 +1,59 @@
+package payloadqueue
+
+import (
+	"context"
+	"log/slog"
+)
+
+// log to write an event to the Logger as a structured record, with the tag and the attributes, to
+// the EventFeed as its text and to the subscribers of its level. The message of the record is
+// constant, the values are all in the attributes, so records can be filtered and aggregated
+// without parsing the text.
+func (q *Queue) log(level slog.Level, msg string, text string, attrs ...slog.Attr) {
+	if q.EventFeed != nil {
+		q.EventFeed("[" + q.Tag + "] " + text)
+	}
+	q.publish(level, text, attrs)
+	if q.Logger == nil || !q.Logger.Enabled(context.Background(), level) {
+		return
+	}
+	q.Logger.LogAttrs(context.Background(), level, msg, append([]slog.Attr{slog.String("tag", q.Tag)}, attrs...)...)
+}
+
+// logging to report whether an event at the level reaches the EventFeed, a subscriber or the
+// Logger, so that the events of every payload are only formatted when someone receives them
+func (q *Queue) logging(level slog.Level) bool {
+	if q.EventFeed != nil || (q.Logger != nil && q.Logger.Enabled(context.Background(), level)) {
+		return true
+	}
+	for s := q; s != nil; s = s.parent {
+		s.subscribers.mutex.RLock()
+		for sub := range s.subscribers.subs {
+			if EventLevel(level) >= sub.level {
+				s.subscribers.mutex.RUnlock()
+				return true
+			}
+		}
+		s.subscribers.mutex.RUnlock()
+	}
+	return false
+}
+
+// headerAttr to carry the Headers of the payload as a group of attributes
+func (p Payload) headerAttr() slog.Attr {
+	return mapAttr("headers", p.Headers)
+}
+
+// mapAttr to carry the Headers or annotations as a group of attributes
+func mapAttr(key string, m map[string]string) slog.Attr {
+	attrs := make([]any, 0, len(m))
+	for k, v := range m {
+		attrs = append(attrs, slog.String(k, v))
+	}
+	return slog.Group(key, attrs...)
+}
+
+// resultAttr to report the outcome of a batch
+func resultAttr(err error) slog.Attr {
+	return slog.String("result", resultText(err))
+}
@@ -0,0 +1,81 @@
+package payloadqueue
+
+import (
+	"log/slog"
+	"math"
+	"runtime/debug"
+	runtimemetrics "runtime/metrics"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memorySampling is how often the memory use is read at most, see MemoryPressure
+const memorySampling = 50 * time.Millisecond
+
+// memoryGauge to hold the last reading of the memory use against the GOMEMLIMIT
+type memoryGauge struct {
+	mutex   sync.Mutex
+	sampled time.Time
+	pressed bool
+	read    func() (used uint64, limit int64) // reads the memory use, readMemory unless replaced in tests
+}
+
+// readMemory to return the memory the Go runtime holds, as counted against its memory limit, and
+// the limit, set by GOMEMLIMIT or debug.SetMemoryLimit
+func readMemory() (used uint64, limit int64) {
+	samples := []runtimemetrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	runtimemetrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64(), debug.SetMemoryLimit(-1)
+}
+
+// pressed to report whether the process holds more than the MemoryPressure of its memory limit,
+// from a reading at most memorySampling old on the Clock. Without a limit there is no pressure.
+func (q *Queue) pressed() bool {
+	if q.MemoryPressure <= 0 {
+		return false
+	}
+	g := &q.memory
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := q.now()
+	if now.Sub(g.sampled) < memorySampling {
+		return g.pressed
+	}
+	g.sampled = now
+	read := g.read
+	if read == nil {
+		read = readMemory
+	}
+	used, limit := read()
+	was := g.pressed
+	g.pressed = limit < math.MaxInt64 && float64(used) >= q.MemoryPressure*float64(limit)
+	switch {
+	case g.pressed && !was:
+		q.log(slog.LevelWarn, "memory pressure",
+			"Buffer Queue: Memory pressure, "+strconv.FormatUint(used, 10)+" of "+strconv.FormatInt(limit, 10)+" bytes in use",
+			slog.Uint64("memory_used", used), slog.Int64("memory_limit", limit))
+	case was && !g.pressed:
+		q.log(slog.LevelInfo, "memory relieved",
+			"Buffer Queue: Memory relieved, "+strconv.FormatUint(used, 10)+" of "+strconv.FormatInt(limit, 10)+" bytes in use",
+			slog.Uint64("memory_used", used), slog.Int64("memory_limit", limit))
+	}
+	return g.pressed
+}
+
+// relieve to hand the pending payloads to the handler while the process is under memory pressure,
+// rather than hold them until the batch is full. A paused queue keeps them.
+func (q *Queue) relieve() {
+	if !q.pressed() || q.Paused() {
+		return
+	}
+	q.payloadMutex.Lock()
+	pending := q.payloadQueue.len()
+	q.payloadMutex.Unlock()
+	if pending > 0 {
+		q.flush()
+	}
+}
@@ -0,0 +1,99 @@
+package payloadqueue
+
+// MetricKind to tell how a Metric behaves over time
+type MetricKind int
+
+const (
+	// KindCounter is a Metric that only increases while the queue runs.
+	KindCounter MetricKind = iota
+	// KindGauge is a Metric that reports a current level and can go up or down.
+	KindGauge
+	// KindHistogram is a Metric that counts durations into buckets. Its Value is the count.
+	KindHistogram
+)
+
+func (k MetricKind) String() string {
+	switch k {
+	case KindCounter:
+		return "counter"
+	case KindHistogram:
+		return "histogram"
+	}
+	return "gauge"
+}
+
+// Description to describe a Metric a Queue exposes, named in the style of runtime/metrics:
+// a path followed by the unit.
+type Description struct {
+	Name        string
+	Kind        MetricKind
+	Description string
+}
+
+// Metric to hold the value of a measurement of a Queue
+type Metric struct {
+	Description
+	Tag       string
+	Value     float64
+	Histogram *Histogram // the buckets of a KindHistogram
+}
+
+// metric is a Description with how its value is read from the Stats
+type metric struct {
+	Description
+	value     func(s Stats) float64
+	histogram func(s Stats) Histogram // for a KindHistogram
+}
+
+var metrics = []metric{
+	{Description{"/queue/payloads/pending:payloads", KindGauge, "Payloads waiting to be batched."}, func(s Stats) float64 { return float64(s.Pending) }, nil},
+	{Description{"/queue/payloads/delayed:payloads", KindGauge, "Payloads waiting on their NotBefore."}, func(s Stats) float64 { return float64(s.Delayed) }, nil},
+	{Description{"/queue/batches/active:batches", KindGauge, "Batches being processed by the handler."}, func(s Stats) float64 { return float64(s.ActiveWork) }, nil},
+	{Description{"/queue/payloads/appended:payloads", KindCounter, "Payloads accepted by Append."}, func(s Stats) float64 { return float64(s.Appended) }, nil},
+	{Description{"/queue/batches/pushed:batches", KindCounter, "Batches pushed to the handler."}, func(s Stats) float64 { return float64(s.Batches) }, nil},
+	{Description{"/queue/payloads/delivered:payloads", KindCounter, "Payloads in batches that succeeded."}, func(s Stats) float64 { return float64(s.Delivered) }, nil},
+	{Description{"/queue/payloads/failed:payloads", KindCounter, "Payloads in batches that failed."}, func(s Stats) float64 { return float64(s.Failed) }, nil},
+	{Description{"/queue/payloads/retried:payloads", KindCounter, "Failed payloads re-queued for another attempt."}, func(s Stats) float64 { return float64(s.Retried) }, nil},
+	{Description{"/queue/payloads/dead-lettered:payloads", KindCounter, "Failed payloads with no retries left."}, func(s Stats) float64 { return float64(s.DeadLettered) }, nil},
+	{Description{"/queue/payloads/expired:payloads", KindCounter, "Payloads that passed their ExpiresAt in the queue."}, func(s Stats) float64 { return float64(s.Expired) }, nil},
+	{Description{"/queue/payloads/duplicates:payloads", KindCounter, "Payloads dropped because their key was already claimed."}, func(s Stats) float64 { return float64(s.Duplicates) }, nil},
+	{Description{"/queue/payloads/dark:payloads", KindCounter, "Payloads copied to the DarkQueue."}, func(s Stats) float64 { return float64(s.Dark) }, nil},
+	{Description{"/queue/payloads/rejected:payloads", KindCounter, "Payloads refused by Append because the queue was full."}, func(s Stats) float64 { return float64(s.Rejected) }, nil},
+	{Description{"/queue/payloads/blocked:payloads", KindCounter, "Payloads whose Append waited for room."}, func(s Stats) float64 { return float64(s.Blocked) }, nil},
+	{Description{"/queue/payloads/would-block:payloads", KindCounter, "Payloads whose Append gave up waiting for room at the MaxBlock."}, func(s Stats) float64 { return float64(s.WouldBlock) }, nil},
+	{Description{"/queue/payloads/invalid:payloads", KindCounter, "Payloads refused by Append because the Validator rejected them."}, func(s Stats) float64 { return float64(s.Invalid) }, nil},
+	{Description{"/queue/payloads/removed:payloads", KindCounter, "Payloads pulled out of the queue by Remove."}, func(s Stats) float64 { return float64(s.Removed) }, nil},
+	{Description{"/queue/payloads/merged:payloads", KindCounter, "Payloads left out of their batch by the BatchTransformer."}, func(s Stats) float64 { return float64(s.Merged) }, nil},
+	{Description{"/queue/payloads/coalesced:payloads", KindCounter, "Payloads folded into an identical pending payload."}, func(s Stats) float64 { return float64(s.Coalesced) }, nil},
+	{Description{"/queue/payloads/over-quota:payloads", KindCounter, "Payloads refused by Append because their tenant had its quota pending."}, func(s Stats) float64 { return float64(s.OverQuota) }, nil},
+	{Description{"/queue/batches/split:batches", KindCounter, "Batches the handler rejected as too large, pushed again in halves."}, func(s Stats) float64 { return float64(s.Split) }, nil},
+	{Description{"/queue/batches/serialized:bytes", KindCounter, "Bytes of the batches serialized for the Compressor."}, func(s Stats) float64 { return float64(s.SerializedBytes) }, nil},
+	{Description{"/queue/batches/compressed:bytes", KindCounter, "Bytes of the same batches once compressed."}, func(s Stats) float64 { return float64(s.CompressedBytes) }, nil},
+	{Description{"/queue/batches/compression:ratio", KindGauge, "Serialized bytes per compressed byte of the batches compressed so far."}, compressionRatio, nil},
+	{Description{"/queue/payloads/time-in-queue:seconds", KindHistogram, "Time from the Append of a payload to its batch being pushed."}, nil, func(s Stats) Histogram { return s.TimeInQueue }},
+	{Description{"/queue/batches/latency:seconds", KindHistogram, "Time the handler took for a batch."}, nil, func(s Stats) Histogram { return s.BatchLatency }},
+}
+
+// AllMetrics to enumerate the Descriptions of every Metric a Queue exposes
+func AllMetrics() []Description {
+	ds := make([]Description, len(metrics))
+	for i, m := range metrics {
+		ds[i] = m.Description
+	}
+	return ds
+}
+
+// Metrics to read the current value of every Metric of the queue, in the order of AllMetrics
+func (q *Queue) Metrics() []Metric {
+	s := q.Stats()
+	ms := make([]Metric, len(metrics))
+	for i, m := range metrics {
+		if m.histogram != nil {
+			h := m.histogram(s)
+			ms[i] = Metric{Description: m.Description, Tag: s.Tag, Value: float64(h.Count), Histogram: &h}
+			continue
+		}
+		ms[i] = Metric{Description: m.Description, Tag: s.Tag, Value: m.value(s)}
+	}
+	return ms
+}
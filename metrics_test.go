@@ -0,0 +1,44 @@
+package payloadqueue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestQueueMetrics(t *testing.T) {
+	t.Run("Metrics follow the descriptions", func(t *testing.T) {
+		q := &payloadqueue.Queue{Tag: "QueueA", MaxSize: 2, MaxAge: 200, Work: func(pls []interface{}) int { return 0 }}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		q.Append(payloadqueue.Payload{Id: "2"})
+		q.Append(payloadqueue.Payload{Id: "3"})
+		time.Sleep(100 * time.Millisecond)
+
+		ds := payloadqueue.AllMetrics()
+		ms := q.Metrics()
+		if len(ms) != len(ds) {
+			t.Fatalf("Expected %d metrics, got %d", len(ds), len(ms))
+		}
+		values := map[string]float64{}
+		for i, m := range ms {
+			if m.Name != ds[i].Name || m.Tag != "QueueA" {
+				t.Errorf("Unexpected metric: %+v", m)
+			}
+			values[m.Name] = m.Value
+		}
+		if values["/queue/payloads/appended:payloads"] != 3 || values["/queue/payloads/delivered:payloads"] != 2 || values["/queue/payloads/pending:payloads"] != 1 {
+			t.Errorf("Unexpected values: %v", values)
+		}
+		q.Close()
+	})
+
+	t.Run("Metric kinds", func(t *testing.T) {
+		for _, d := range payloadqueue.AllMetrics() {
+			if d.Kind.String() != "counter" && d.Kind.String() != "gauge" && d.Kind.String() != "histogram" {
+				t.Errorf("Unexpected kind for %s", d.Name)
+			}
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Append when the queue holds MaxPending payloads and its Overflow is
+// OverflowReject.
+var ErrQueueFull = errors.New("the queue is full")
+
+// ErrWouldBlock is returned by Append when its Overflow is OverflowBlock and no room was made within
+// the MaxBlock.
+var ErrWouldBlock = errors.New("the queue is full and the wait for room timed out")
+
+// Overflow to choose what Append does once the queue holds MaxPending payloads
+type Overflow int
+
+const (
+	OverflowReject Overflow = iota // Append fails with ErrQueueFull
+	OverflowBlock                  // Append waits until batches complete, passing the back-pressure to the producer
+)
+
+// load to return the payloads the queue holds: buffered, spilled, delayed, in batches not yet
+// completed and admitted but not yet queued. The payloadMutex must be held.
+func (q *Queue) load() int {
+	return q.payloadQueue.len() + q.spilled + q.spilling + len(q.delayed) + q.inflight + q.reserved
+}
+
+// admit to make room for n new payloads under MaxPending, and while the process is under memory
+// pressure, rejecting them or waiting for batches to complete as the Overflow says. A burst larger
+// than MaxPending is admitted into an empty queue, as is any payload under memory pressure, so the
+// buffer is never what holds the memory.
+//
+// The room is reserved under the payloadMutex, so concurrent producers cannot all take the same
+// room, and returned as the number of payloads reserved, to be given back with unreserve once they
+// are queued. A blocked Append waits until the context ends, and fails with its cause, or until the
+// queue is closed, and fails with ErrQueueClosed. The memory pressure easing signals nothing, so
+// while it is monitored the wait reads it again every memorySampling on the Clock. The wait of each producer is
+// recorded, see Waits.
+func (q *Queue) admit(ctx context.Context, n int) (int, error) {
+	if (q.MaxPending <= 0 && q.MemoryPressure <= 0) || n == 0 || q.room == nil {
+		return 0, nil
+	}
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
+	broadcast := func() {
+		q.payloadMutex.Lock()
+		q.room.Broadcast()
+		q.payloadMutex.Unlock()
+	}
+	var started time.Time
+	for load := q.load(); load > 0 && ((q.MaxPending > 0 && load+n > q.MaxPending) || q.pressed()); load = q.load() {
+		if q.stopping.Load() {
+			// the queue was closed while the producer waited for room
+			return 0, ErrQueueClosed
+		}
+		if q.Overflow != OverflowBlock {
+			q.counters.add(func(s *Stats) { s.Rejected += int64(n) })
+			q.log(slog.LevelWarn, "queue full", "Buffer Queue: Full, rejected "+strconv.Itoa(n)+" payloads",
+				slog.Int("batch_size", n))
+			return 0, ErrQueueFull
+		}
+		if started.IsZero() {
+			started = q.now()
+			stop := context.AfterFunc(ctx, broadcast)
+			defer stop()
+		}
+		if ctx.Err() != nil {
+			err := context.Cause(ctx)
+			q.waits.record(producer(ctx), q.now().Sub(started), err)
+			q.counters.add(func(s *Stats) {
+				s.Blocked += int64(n)
+				if errors.Is(err, ErrWouldBlock) {
+					s.WouldBlock += int64(n)
+				}
+			})
+			q.log(slog.LevelWarn, "append timed out", "Buffer Queue: Full, gave up waiting for room for "+strconv.Itoa(n)+" payloads. "+err.Error(),
+				slog.Int("batch_size", n), slog.Duration("duration", q.now().Sub(started)))
+			return 0, err
+		}
+		if q.MemoryPressure > 0 {
+			recheck := q.afterFunc(memorySampling, broadcast)
+			q.room.Wait()
+			recheck()
+			continue
+		}
+		q.room.Wait()
+	}
+	if !started.IsZero() {
+		q.waits.record(producer(ctx), q.now().Sub(started), nil)
+		q.counters.add(func(s *Stats) { s.Blocked += int64(n) })
+	}
+	q.reserved += n
+	return n, nil
+}
+
+// unreserve to give back the room admit reserved for n payloads once they are queued, or were not
+func (q *Queue) unreserve(n int) {
+	if n == 0 {
+		return
+	}
+	q.payloadMutex.Lock()
+	q.reserved -= n
+	q.payloadMutex.Unlock()
+	q.release()
+}
+
+// AppendContext to add a Payload to the queue as Append does. When the Overflow is OverflowBlock and
+// the queue is full, it waits for room until the context ends, failing with its error, or until the
+// MaxBlock, failing with ErrWouldBlock, whichever comes first. Name the producer of the payload with
+// WithProducer to have its waits reported by Waits.
+func (q *Queue) AppendContext(ctx context.Context, p Payload) error {
+	if q.stopping.Load() && p.Attempts == 0 {
+		return ErrQueueClosed
+	}
+	if q.MaxBlock > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, q.MaxBlock, ErrWouldBlock)
+		defer cancel()
+	}
+	return q.appendContext(ctx, []Payload{p})
+}
+
+type producerKey struct{}
+
+// WithProducer to return a context naming the producer of the payloads appended with it, see Waits
+func WithProducer(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, producerKey{}, name)
+}
+
+// producer to return the name of the producer carried by the context, empty when there is none
+func producer(ctx context.Context) string {
+	name, _ := ctx.Value(producerKey{}).(string)
+	return name
+}
+
+// WaitStats to report how long the appends of a producer waited for room, see OverflowBlock
+type WaitStats struct {
+	Waits      int64         `json:"waits"`       // appends that waited for room
+	WouldBlock int64         `json:"would_block"` // appends that gave up waiting at the MaxBlock
+	Canceled   int64         `json:"canceled"`    // appends that gave up waiting as their context ended
+	Total      time.Duration `json:"total"`       // time spent waiting
+	Longest    time.Duration `json:"longest"`     // the longest wait
+}
+
+// producerWaits to hold the WaitStats of every producer
+type producerWaits struct {
+	mutex sync.Mutex
+	stats map[string]WaitStats
+}
+
+// record to add a wait of the producer that ended with the error, nil once room was made
+func (w *producerWaits) record(name string, waited time.Duration, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stats == nil {
+		w.stats = make(map[string]WaitStats)
+	}
+	s := w.stats[name]
+	s.Waits++
+	s.Total += waited
+	s.Longest = max(s.Longest, waited)
+	switch {
+	case errors.Is(err, ErrWouldBlock):
+		s.WouldBlock++
+	case err != nil:
+		s.Canceled++
+	}
+	w.stats[name] = s
+}
+
+// Waits to return the WaitStats of every producer that waited for room, by the name given with
+// WithProducer. Appends without a producer are reported under the empty name.
+func (q *Queue) Waits() map[string]WaitStats {
+	q.waits.mutex.Lock()
+	defer q.waits.mutex.Unlock()
+	out := make(map[string]WaitStats, len(q.waits.stats))
+	for name, s := range q.waits.stats {
+		out[name] = s
+	}
+	return out
+}
+
+// release to wake the appenders waiting for room once payloads have left the queue
+func (q *Queue) release() {
+	if q.room != nil {
+		q.room.Broadcast()
+	}
+}
@@ -1,16 +1,107 @@
 package payloadqueue
 
-import "math/rand"
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
 
 type Payload struct {
-	Id   string
-	Data interface{}
+	Id             string
+	Data           interface{}
+	NotBefore      time.Time         // the Payload is not eligible for batching before this time
+	ExpiresAt      time.Time         // the Payload is dropped (and handed to OnExpire) if it is still queued after this time
+	Attempts       int               // number of failed batches the Payload has been part of
+	Headers        map[string]string // metadata such as correlation, tenant or tracing Ids that travels with the Data
+	Count          int               // number of identical payloads the Payload stands for once coalesced, see CoalesceKey. Zero means 1
+	IdempotencyKey string            // identifies the logical payload, dispatched at most once across retries and restarts with an Idempotency store
+	Sequence       uint64            // position of the Payload in the order it was accepted by the queue, assigned by Append, see OrderHeaders
+	Batch          uint64            // Number of the batch the Payload was last pushed in, see Batch.Number
+	appended       time.Time         // when the Payload was accepted, for the Latency and the Ledger, kept in the Envelope
+	bytes          int               // size of the Data as encoded by the Codec, see MaxBatchBytes
+	size           int               // size counted against the MemoryBudget, by the SizeFunc or as the bytes
+	digest         uint64            // hash of the Data as encoded by the Codec, see CoalesceKey
+	tenant         string            // the tenant by the TenantKey of the queue
+	coalesced      []string          // Ids of the payloads folded into this one, resolved with it
+	claimed        bool              // the IdempotencyKey was claimed for dispatch by this queue, so a retry may dispatch it again
+}
+
+// headerText to format the Headers for the event feed
+func (p Payload) headerText() string {
+	return mapText(p.Headers)
+}
+
+// mapText to format the Headers or annotations for the event feed, ordered by key
+func mapText(m map[string]string) string {
+	if len(m) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := " {"
+	for i, k := range keys {
+		if i > 0 {
+			s += ", "
+		}
+		s += k + "=" + m[k]
+	}
+	return s + "}"
 }
 
 // work to be implemented by the consumer to handle the batched (array) payload
 type workHandler func([]interface{}) int
 type rateWorkHandler func(interface{}) int
 
+// workContextHandler to handle the batched payload within a context that is cancelled on WorkTimeout
+type workContextHandler func(context.Context, []interface{}) error
+
+// WorkFunc is the handler a Middleware wraps: the WorkContext, or the Work adapted to it
+type WorkFunc = workContextHandler
+
+// Middleware to wrap the handler of every batch with cross-cutting behaviour such as logging,
+// metrics, refreshing an auth token or transforming the payloads, without changing the handler:
+//
+//	func Logging(next payloadqueue.WorkFunc) payloadqueue.WorkFunc {
+//		return func(ctx context.Context, pls []interface{}) error {
+//			err := next(ctx, pls)
+//			log.Printf("batch of %d: %v", len(pls), err)
+//			return err
+//		}
+//	}
+//
+// It runs within the WorkTimeout of the batch.
+type Middleware func(next WorkFunc) WorkFunc
+
+// batchStartHandler to observe a batch before it is pushed to the handler
+type batchStartHandler func(context.Context, *Batch)
+
+// batchEndHandler to observe a batch once processed, with the error of the handler
+type batchEndHandler func(context.Context, *Batch, error)
+
+// preflightHandler to validate that the downstream matches the expectations of the Work handler
+type preflightHandler func(context.Context) error
+
+// deadLetterHandler to receive the payloads of a failed batch that have no retries left
+type deadLetterHandler func([]Payload, error)
+
+// ResultCodeError is the error reported for a batch whose Work handler returned a non-zero result code
+type ResultCodeError int
+
+func (e ResultCodeError) Error() string {
+	return "result code " + strconv.Itoa(int(e))
+}
+
+// appendHandler to observe the new payloads accepted by Append
+type appendHandler func(Payload)
+
+// expireHandler to receive the payloads that expired in the queue before they were batched
+type expireHandler func(Payload)
+
 // eventFeed to pass information/verbose to the client for handling
 type eventFeed func(string)
 
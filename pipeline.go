@@ -0,0 +1,97 @@
+package payloadqueue
+
+import (
+	"errors"
+	"time"
+)
+
+// Pipeline to wire a source, transforms, a Queue and a sink together:
+//
+//	p := payloadqueue.From(events).Filter(valid).Map(enrich).Batch(500, 5*time.Second)
+//	err := p.To(sink)
+//	...
+//	p.Wait() // returns once the source is closed and everything has been delivered
+//
+// The Queue behind the pipeline can be configured further with Configure before To is called.
+type Pipeline struct {
+	source     <-chan interface{}
+	transforms []func(interface{}) (interface{}, bool)
+	queue      *Queue
+	done       chan struct{}
+}
+
+// From to start a pipeline that reads the data from the source until it is closed
+func From(source <-chan interface{}) *Pipeline {
+	return &Pipeline{source: source, queue: &Queue{}}
+}
+
+// Filter to only pass on the data f returns true for
+func (p *Pipeline) Filter(f func(interface{}) bool) *Pipeline {
+	p.transforms = append(p.transforms, func(v interface{}) (interface{}, bool) {
+		return v, f(v)
+	})
+	return p
+}
+
+// Map to replace the data with the result of m
+func (p *Pipeline) Map(m func(interface{}) interface{}) *Pipeline {
+	p.transforms = append(p.transforms, func(v interface{}) (interface{}, bool) {
+		return m(v), true
+	})
+	return p
+}
+
+// Batch to set the batch triggers of the queue: the MaxSize and the MaxAge, rounded up to the
+// second.
+func (p *Pipeline) Batch(size int, age time.Duration) *Pipeline {
+	p.queue.MaxSize = size
+	p.queue.MaxAge = int((age + time.Second - 1) / time.Second)
+	return p
+}
+
+// Configure to set any other option of the Queue behind the pipeline
+func (p *Pipeline) Configure(f func(q *Queue)) *Pipeline {
+	f(p.queue)
+	return p
+}
+
+// To to start the pipeline with the sink as the WorkContext of the queue. When the source is
+// closed the pending payloads are flushed and the queue is closed.
+func (p *Pipeline) To(sink workContextHandler) error {
+	if p.done != nil {
+		return errors.New("the pipeline is already started")
+	}
+	p.queue.WorkContext = sink
+	if err := p.queue.Start(); err != nil {
+		return err
+	}
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+	next:
+		for v := range p.source {
+			for _, t := range p.transforms {
+				var ok bool
+				if v, ok = t(v); !ok {
+					continue next
+				}
+			}
+			p.queue.Append(p.queue.NewPayload(v))
+		}
+		p.queue.Flush()
+		p.queue.Close()
+	}()
+	return nil
+}
+
+// Queue to return the Queue behind the pipeline
+func (p *Pipeline) Queue() *Queue {
+	return p.queue
+}
+
+// Wait to block until the source is closed and all of its data has been processed
+func (p *Pipeline) Wait() {
+	if p.done != nil {
+		<-p.done
+	}
+}
@@ -0,0 +1,61 @@
+package payloadqueue_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestPipeline(t *testing.T) {
+	t.Run("Filter, map and batch to a sink", func(t *testing.T) {
+		source := make(chan interface{})
+		var runMutex sync.Mutex
+		batches := [][]interface{}{}
+		p := payloadqueue.From(source).
+			Filter(func(v interface{}) bool { return v.(int)%2 == 0 }).
+			Map(func(v interface{}) interface{} { return v.(int) * 10 }).
+			Batch(3, time.Minute)
+		err := p.To(func(ctx context.Context, batch []interface{}) error {
+			runMutex.Lock()
+			batches = append(batches, batch)
+			runMutex.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		for i := 1; i <= 10; i++ {
+			source <- i
+		}
+		close(source)
+		p.Wait()
+
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		total, sum := 0, 0
+		for _, b := range batches {
+			for _, v := range b {
+				total++
+				sum += v.(int)
+			}
+		}
+		if len(batches) != 2 || total != 5 || sum != 300 {
+			t.Errorf("Unexpected batches: %v", batches)
+		}
+	})
+
+	t.Run("Start a pipeline twice", func(t *testing.T) {
+		source := make(chan interface{})
+		p := payloadqueue.From(source)
+		sink := func(ctx context.Context, batch []interface{}) error { return nil }
+		p.To(sink)
+		if err := p.To(sink); err == nil {
+			t.Errorf("Expected error - the pipeline is already started")
+		}
+		close(source)
+		p.Wait()
+	})
+}
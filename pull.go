@@ -0,0 +1,211 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"slices"
+	"sync"
+)
+
+// AckFunc to settle the payloads returned by Receive. A nil error acknowledges them as delivered;
+// an error fails them, so they are retried or dead-lettered as for a failed batch, and a BatchError
+// fails only the payloads it reports, by their index among those received. Only the first call
+// counts.
+type AckFunc func(err error)
+
+// puller to hold the batches of a Pull queue until they are received
+type puller struct {
+	mutex   sync.Mutex
+	offers  []*offer      // batches with payloads not yet received, oldest first
+	arrived chan struct{} // closed, and replaced, when a batch is offered
+}
+
+// offer of a batch to the consumers. It is guarded by the mutex of the puller.
+type offer struct {
+	batch    *Batch
+	payloads []Payload
+	next     int     // index of the first payload not yet received
+	errs     []error // the outcome of each payload, once acknowledged
+	acked    int     // payloads acknowledged
+	settled  bool    // the batch is complete, or has timed out, and acknowledgements no longer count
+	done     chan struct{}
+}
+
+// Receive to take up to max payloads of the next batch cut by a Pull queue, waiting until one is cut
+// or the context ends; then it returns no payloads. The payloads stay with the consumer until the
+// AckFunc is called, within the WorkTimeout of the queue: a batch that is not acknowledged in time
+// fails, and its payloads are retried or dead-lettered. A batch larger than max is shared by the
+// following calls.
+//
+//	for ctx.Err() == nil {
+//		pls, ack := q.Receive(ctx, 100)
+//		if len(pls) > 0 {
+//			ack(store(pls))
+//		}
+//	}
+func (q *Queue) Receive(ctx context.Context, max int) ([]Payload, AckFunc) {
+	o, start, end, ok := q.take(ctx, max)
+	if !ok {
+		return nil, func(error) {}
+	}
+	return slices.Clone(o.payloads[start:end]), q.acker(o, start, end)
+}
+
+// take to take up to max payloads of the first offer, all of them when max is zero, waiting until a
+// batch is offered. It reports false once the context ends.
+func (q *Queue) take(ctx context.Context, max int) (*offer, int, int, bool) {
+	p := q.pulled()
+	for {
+		p.mutex.Lock()
+		if len(p.offers) > 0 {
+			o := p.offers[0]
+			start := o.next
+			end := len(o.payloads)
+			if max > 0 {
+				end = min(end, start+max)
+			}
+			o.next = end
+			if o.next == len(o.payloads) {
+				p.offers = p.offers[1:]
+			}
+			p.mutex.Unlock()
+			return o, start, end, true
+		}
+		if p.arrived == nil {
+			p.arrived = make(chan struct{})
+		}
+		arrived := p.arrived
+		p.mutex.Unlock()
+		select {
+		case <-arrived:
+		case <-ctx.Done():
+			return nil, 0, 0, false
+		}
+	}
+}
+
+// Batches to iterate over the batches cut by a Pull queue, as an alternative to Receive, until the
+// context ends. Each Batch is settled with Ack or Nack within the WorkTimeout of the queue:
+//
+//	for b := range q.Batches(ctx) {
+//		if err := store(b.Payloads); err != nil {
+//			b.Nack(err)
+//			continue
+//		}
+//		b.Ack()
+//	}
+func (q *Queue) Batches(ctx context.Context) iter.Seq[*Batch] {
+	return func(yield func(*Batch) bool) {
+		for {
+			o, start, end, ok := q.take(ctx, 0)
+			if !ok {
+				return
+			}
+			b := o.batch
+			b.mutex.Lock()
+			if start > 0 || b.ack != nil {
+				// the start of the batch was taken by Receive
+				b.mutex.Unlock()
+				b = &Batch{Id: o.batch.Id, Number: o.batch.Number, Tag: o.batch.Tag, SplitFrom: o.batch.SplitFrom,
+					Payloads: slices.Clone(o.payloads[start:end])}
+				b.mutex.Lock()
+			}
+			b.ack = q.acker(o, start, end)
+			b.mutex.Unlock()
+			if !yield(b) {
+				return
+			}
+		}
+	}
+}
+
+// acker to return the AckFunc of the payloads of the offer from start to end
+func (q *Queue) acker(o *offer, start, end int) AckFunc {
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() {
+			p := q.pulled()
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			if o.settled {
+				return
+			}
+			var partial *BatchError
+			if errors.As(err, &partial) {
+				for _, r := range partial.Results {
+					if r.Index >= 0 && start+r.Index < end {
+						o.errs[start+r.Index] = r.Err
+					}
+				}
+			} else {
+				for i := start; i < end; i++ {
+					o.errs[i] = err
+				}
+			}
+			if o.acked += end - start; o.acked == len(o.payloads) {
+				o.settled = true
+				close(o.done)
+			}
+		})
+	}
+}
+
+// pulled to return the puller the batches of the queue are offered on. A sub-queue shares that of
+// its queue, so its batches are received with those of the queue.
+func (q *Queue) pulled() *puller {
+	if q.parent != nil {
+		return q.parent.pulled()
+	}
+	return &q.puller
+}
+
+// deliver to offer the batch to Receive and wait until all of its payloads are acknowledged or the
+// context ends. It is the handler of a Pull queue.
+func (q *Queue) deliver(ctx context.Context, pls []interface{}) error {
+	batch, ok := BatchFromContext(ctx)
+	if !ok || len(batch.Payloads) != len(pls) {
+		return errors.New("the batch of a pull queue is missing")
+	}
+	o := &offer{batch: batch, payloads: batch.Payloads, errs: make([]error, len(pls)), done: make(chan struct{})}
+	p := q.pulled()
+	p.mutex.Lock()
+	p.offers = append(p.offers, o)
+	if p.arrived != nil {
+		close(p.arrived)
+		p.arrived = nil
+	}
+	p.mutex.Unlock()
+	select {
+	case <-o.done:
+	case <-ctx.Done():
+		p.mutex.Lock()
+		acked := o.settled
+		if !acked {
+			// what was not received is no longer offered, and late acknowledgements do not count
+			p.offers = slices.DeleteFunc(p.offers, func(other *offer) bool { return other == o })
+			o.settled = true
+		}
+		p.mutex.Unlock()
+		if !acked {
+			return ctx.Err()
+		}
+	}
+	var failed *BatchError
+	for i, err := range o.errs {
+		if err == nil {
+			continue
+		}
+		if failed == nil {
+			failed = &BatchError{}
+		}
+		failed.Results = append(failed.Results, PayloadResult{Index: i, Err: err})
+	}
+	if failed == nil {
+		return nil
+	}
+	if len(failed.Results) == len(pls) {
+		return failed.Results[0].Err
+	}
+	return failed
+}
@@ -1,9 +1,16 @@
 package payloadqueue
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,25 +18,182 @@ import (
 
 // Queue to hold the main application queuing mechanism.
 type Queue struct {
-	Tag          string
-	MaxSize      int
-	MaxAge       int // seconds
-	Work         workHandler
-	EventFeed    eventFeed
-	payloadMutex sync.Mutex
-	payloadQueue []Payload
-	payloadChan  chan Payload
-	quitChan     chan bool
-	expires      time.Time
-	activeWork   int // holds the number of active work routines that have not been completed.
+	Tag              string
+	MaxSize          int
+	MaxAge           int                  // seconds
+	MaxAgeJitter     float64              // fraction of the window by which each batch window is randomly shortened, e.g. 0.1, so instances started together do not flush together
+	LatencySLO       time.Duration        // when supplied, the batch window adapts to the traffic to deliver the payloads within it, never beyond the MaxAge
+	TimeInQueueSLO   time.Duration        // when supplied, a warning event is emitted when the p99 time the payloads batched over a SLOWindow spent in the queue exceeds it
+	SLOWindow        time.Duration        // the period the TimeInQueueSLO is checked over. Default is 1 minute
+	MaxBatchSize     int                  // most payloads per call to the handler, however many a flush cuts. Zero means the MaxSize
+	MaxBatchBytes    int                  // most bytes of Data, as encoded by the Codec, per call to the handler. Zero means no limit
+	TenantKey        func(Payload) string // when supplied, the tenant of a payload, so the tenants share out the batches and are held to their TenantLimit
+	TenantLimit      int                  // most pending payloads per tenant, past which Append rejects the new payloads of the tenant with a QuotaError. Zero means no limit
+	TenantLimits     map[string]int       // the TenantLimit of specific tenants
+	TenantWeights    map[string]int       // payloads each tenant gives per round when a flush shares out the batches, e.g. 3 for a tenant paying for a larger share. Default is 1
+	Work             workHandler
+	WorkContext      workContextHandler   // used instead of Work when supplied
+	Pull             bool                 // the batches are taken by consumers calling Receive instead of being pushed to a handler, see Receive
+	WorkTimeout      time.Duration        // deadline of the context passed to WorkContext. Zero means no deadline
+	TooLarge         func(error) bool     // classifies an error of the handler as the batch being too large, so it is split in halves and pushed again. Default is errors.Is(err, ErrBatchTooLarge)
+	MaxRetries       int                  // number of times a failed payload is re-queued before it is dead-lettered
+	RetryDelay       time.Duration        // how long a failed payload waits before it is eligible for batching again
+	DeadLetter       deadLetterHandler    // receives the payloads that failed after all retries
+	BreakerThreshold int                  // batches in a row that deliver nothing after which the breaker opens and holds the batches, as Pause does, for the BreakerCooldown. Zero means no breaker
+	BreakerCooldown  time.Duration        // how long an open breaker holds the batches before they probe the downstream again. Default is 30 seconds
+	Pricing          *BatchPricing        // when supplied, the batch size is optimized for cost within the latency target
+	Preflight        preflightHandler     // validates the downstream (schema, endpoint) at Start. An error fails Start
+	DecisionLog      io.Writer            // when supplied, every trigger evaluation and scheduling decision is recorded, see Decision
+	Journal          io.Writer            // when supplied, every processed batch is recorded with its annotations, see BatchRecord
+	AwaitHistory     int                  // outcomes remembered for Await calls made after the payload left the queue. Default is 1024
+	Idempotency      IdempotencyStore     // when supplied, a payload already claimed by another instance is dropped at Append
+	IdempotencyTTL   time.Duration        // how long a claimed key is remembered. Default is 24 hours
+	DedupKey         func(Payload) string // the key the payload is claimed by. Default is the IdempotencyKey, then the Id
+	Validator        func(Payload) error  // when supplied, a new payload it returns an error for is rejected by Append with a ValidationError instead of being queued
+	CoalesceKey      func(Payload) string // when supplied, a new payload with the key and Data of the last pending payload is folded into it, see Payload.Count. An empty key is never coalesced
+	SequentialIds    bool                 // NewPayload assigns the Tag and a counter as the Id instead of a random UUID, which is cheaper but only unique within the run of the queue
+	Concurrency      int                  // batches processed at the same time. Default is Defaults.Workers
+	ChannelBuffer    int                  // capacity of the Input channel. Default is Defaults.ChannelBuffer
+	InputBatch       int                  // most payloads drained from the Input channel per lock. Default is 64
+	DrainBatch       int                  // size of the batches cut by Drain. Default is a quarter of the MaxSize
+	DrainTimeout     time.Duration        // deadline of each batch cut by Drain, capped by the time left. Default is a quarter of the WorkTimeout, or of the time left without one
+	MaxPending       int                  // most payloads held, including the batches not yet completed, before the Overflow applies. Zero means no limit
+	Overflow         Overflow             // what Append does once MaxPending is reached. Default is OverflowReject
+	MaxBlock         time.Duration        // with OverflowBlock, the longest Append waits for room before it fails with ErrWouldBlock. Zero means no limit
+	MemoryPressure   float64              // fraction of the GOMEMLIMIT, e.g. 0.85, past which pending payloads are flushed and the Overflow applies to new ones. Zero means not monitored
+	MemoryBudget     int                  // most bytes of pending payloads, measured by the SizeFunc, held in memory before the oldest are spilled to the Spill storage. Zero means no budget
+	SizeFunc         func(Payload) int    // measures a payload against the MemoryBudget. Default is the size of its Data as encoded by the Codec
+	Spill            Storage              // where the payloads over the MemoryBudget are kept until a batch is cut, e.g. a sqlitestore on local disk
+	Storage          Storage              // when supplied, payloads are persisted and batches are cut from the claimed payloads
+	PollInterval     time.Duration        // how often the Storage is checked for payloads put by other instances. Default is 1 second
+	Replicator       Replicator           // when supplied, accepted payloads are mirrored to a warm standby, see Standby
+	Heartbeat        time.Duration        // how often an idle queue signals the Replicator that it is alive. Default is 1 second
+	Codec            Codec                // serializes the Data for the Storage, the Replicator and the network modules, see CodecFromContext. Default is JSONCodec
+	Encryption       KeyProvider          // when supplied, the Data is encrypted with AES-GCM before it reaches the Storage or the Spill storage, see KeyProvider
+	DarkQueue        *Queue               // when supplied, a started test queue with its own sink that receives copies of real traffic
+	DarkRatio        float64              // fraction of the appended payloads copied to the DarkQueue, e.g. 0.01. Default is 0.01
+	DarkLimit        int                  // most payloads copied to the DarkQueue per second. Zero means no limit
+	// Deprecated: the EventFeed receives every event as unstructured text. Use the Logger or
+	// Subscribe instead.
+	EventFeed        eventFeed         // receives every event as text
+	Logger           *slog.Logger      // when supplied, receives every event as a structured record with the tag, payload_id, batch_size, duration and result
+	SubscriberBuffer int               // events buffered per subscriber before the oldest is dropped, see Subscribe. Default is 256
+	Clock            Clock             // tells the time of the batch windows, delays and expiries, e.g. queuetest.Clock in tests. Default is the system clock
+	WallClock        bool              // the batch windows follow the wall clock, jumps included, instead of the monotonic clock of a MonotonicClock
+	Schema           *SchemaMonitor    // when supplied, infers the schema of the appended payloads and reports drift
+	Seed             string            // path of an NDJSON file of payloads appended at Start, e.g. for a re-processing job, see Seeded
+	Ledger           Ledger            // keeps the daily counts of appended, delivered, failed, dropped and expired payloads, see Reconcile. Default is in memory, lost on restart
+	OnExpire         expireHandler     // receives the payloads that passed their ExpiresAt before being batched
+	OnAppend         appendHandler     // sees every new payload accepted by Append, e.g. to sample it
+	OnPayloadQueued  appendHandler     // sees every payload that enters the buffer, including retries and delayed payloads once due
+	OnBatchStart     batchStartHandler // called before a batch is pushed to the handler
+	OnBatchEnd       batchEndHandler   // called once the batch is processed, with the error of the handler
+	OnBatchDone      batchDoneHandler  // receives the BatchResult of every batch once its failed payloads are retried or dead-lettered
+	FlagProvider     FlagProvider      // when supplied, evaluates the feature flags of each batch into its context, see FlagsFromContext
+	BatchTransformer BatchTransformer  // when supplied, reworks each cut batch before it is pushed, e.g. to merge updates to the same entity, see BatchTransformer
+	Middleware       []Middleware      // wraps the Work or WorkContext handler, the first one outermost, see Middleware
+	Compressor       Compressor        // when supplied, the batch is available serialized and compressed to the handler, see CompressedBatch
+	EncodeWorkers    int               // with a Compressor, batches serialized and compressed at the same time ahead of the Concurrency, so encoding does not hold a slot another batch could send on. Zero means the handler encodes in its own slot
+	workMutex        sync.RWMutex      // guards Work and WorkContext once the queue is running, see SetWork
+	payloadMutex     sync.Mutex
+	payloadQueue     ring      // the pending payloads, in the order they are batched
+	delayed          []Payload // payloads waiting on their NotBefore, ordered by due time
+	payloadChan      chan Payload
+	wakeChan         chan struct{}
+	quitChan         chan bool
+	loops            sync.WaitGroup // the internal goroutines Close waits for
+	expires          time.Duration  // when the open batch window closes, elapsed since the origin, guarded by the payloadMutex
+	window           time.Duration  // length of the open batch window, guarded by the payloadMutex
+	tuner            windowTuner    // adapts the batch window to the LatencySLO
+	origin           clockReading   // the clock when the queue started, see elapsed
+	watched          clockReading   // the clock at the last wake of the timer, see watchClock
+	replicated       time.Time      // when the Replicator was last called
+	activeWork       atomic.Int64   // holds the number of active work routines that have not been completed.
+	sequenced        atomic.Uint64  // the Sequence of the last payload accepted
+	numbered         atomic.Uint64  // the Number of the last batch pushed
+	ids              atomic.Uint64  // the last Id assigned by NewPayload, see SequentialIds
+	running          atomic.Bool    // set between Start and Close, see Healthy
+	stopping         atomic.Bool    // set once Close or Shutdown is called, new payloads are refused
+	stopOnce         sync.Once      // stops the queue once per Start, see stop
+	kept             bool           // a Shutdown has persisted the payloads left, so retries are kept as they come, guarded by the payloadMutex
+	lateRetries      atomic.Int64   // retries kept once the payloads left were persisted, see ShutdownReport.Late
+	idlers           idleWaiters    // wait for the active work to complete, see idle
+	breaker          breaker        // holds the batches after too many failed, see BreakerThreshold
+	paused           bool           // no batches are cut while set, see Pause
+	draining         bool           // batches are only cut by Drain while set
+	inflight         int            // payloads in batches not yet completed, guarded by the payloadMutex
+	room             *sync.Cond     // signalled on the payloadMutex when payloads leave the queue, see MaxPending
+	memory           memoryGauge    // the last reading of the memory use, see MemoryPressure
+	spilled          int            // pending payloads kept in the Spill storage, guarded by the payloadMutex
+	spilling         int            // pending payloads being put into the Spill storage, guarded by the payloadMutex
+	reserved         int            // payloads admitted under MaxPending and not yet queued, guarded by the payloadMutex
+	tenantsOut       map[string]int // payloads per tenant spilled or in batches not yet completed, when counted, guarded by the payloadMutex
+	tenantsReserved  map[string]int // payloads per tenant admitted under their TenantLimit and not yet queued, guarded by the payloadMutex
+	spillLeft        bool           // the Spill storage may hold payloads left by a previous run, guarded by the payloadMutex
+	slots            *workSlots     // one per batch being processed, bounded by Concurrency
+	encoders         *workSlots     // one per batch being encoded, bounded by the EncodeWorkers
+	optimizer        *costOptimizer
+	recorder         *decisionRecorder
+	journal          *journalWriter
+	outcomes         outcomes
+	counters         counters
+	waits            producerWaits
+	subscribers      subscribers
+	parent           *Queue // the queue of a sub-queue, whose worker pool and subscribers it shares, see Sub
+	subs             subQueues
+	puller           puller // the batches of a Pull queue waiting for Receive
+	group            Group  // the Group of Go, in which the batches run so it waits for them
+	latencies        latencies
+	slo              sloWindow // the time in queue of the current SLOWindow
+	darkBudget       darkBudget
+	defaultLedger    sync.Once
+	memoryLedger     *FileLedger  // the Ledger when none is supplied
+	ledgerCounts     ledgerCounts // the counts not yet added to the Ledger, see flushLedger
+	seeded           chan struct{}
+	replayMutex      sync.Mutex      // held across a replay in the Storage and a claim from it, see replaying
+	replaying        map[string]bool // payloads replayed and not yet claimed back, which take over the dispatch claim of their IdempotencyKey, guarded by the replayMutex
 }
 
 // Start to open the queue to receive payload to batch
 func (q *Queue) Start() error {
-	q.expires = time.Now().Add(time.Duration(q.MaxAge) * time.Second)
-	if q.Work == nil {
+	q.group = nil
+	return q.start(context.Background(), func(f func()) { go f() })
+}
+
+// start to open the queue, running its internal goroutines with spawn. They stop when the context
+// ends or the queue is closed.
+func (q *Queue) start(ctx context.Context, spawn func(func())) error {
+	if q.Pricing != nil {
+		q.optimizer = &costOptimizer{pricing: *q.Pricing}
+	}
+	if q.DecisionLog != nil {
+		q.recorder = &decisionRecorder{enc: json.NewEncoder(q.DecisionLog)}
+	}
+	if q.Journal != nil {
+		q.journal = &journalWriter{enc: json.NewEncoder(q.Journal)}
+	}
+	q.origin = q.read()
+	q.watched = q.origin
+	q.reopen()
+	if q.Pull {
+		if q.Work != nil || q.WorkContext != nil {
+			return errors.New("a Pull queue takes no Work function")
+		}
+		if q.WorkTimeout == 0 {
+			q.WorkTimeout = 30 * time.Second
+			q.event("WorkTimeout: Default value of 30s was used for the Pull queue")
+		}
+	}
+	if !q.Pull && q.Work == nil && q.WorkContext == nil {
 		return errors.New("the Work function is not supplied")
 	}
+	if q.MaxAgeJitter < 0 || q.MaxAgeJitter >= 1 {
+		return errors.New("the MaxAgeJitter must be at least 0 and below 1")
+	}
+	if q.MemoryBudget > 0 && q.Spill == nil && q.Storage == nil {
+		return errors.New("the MemoryBudget needs a Spill storage")
+	}
+	q.spillLeft = q.Spill != nil
 	if q.MaxSize == 0 {
 		q.MaxSize = 100
 		q.event("MaxSize: Default value of 100 was used")
@@ -42,43 +206,160 @@ func (q *Queue) Start() error {
 		q.Tag = defaultTag(12)
 		q.event("Tag: Random value assigned is: " + q.Tag)
 	}
-	q.activeWork = 0
-
-	go func() {
-		// Check for the max age
-		for {
-			time.Sleep(2 * time.Second)
-			if time.Now().After(q.expires) {
-				q.Append(Payload{})
-			}
-		}
-	}()
+	defaults := CurrentDefaults()
+	if q.Concurrency == 0 {
+		q.Concurrency = defaults.Workers
+		q.event("Concurrency: Default value of " + strconv.Itoa(q.Concurrency) + " was used")
+	}
+	if q.ChannelBuffer == 0 {
+		q.ChannelBuffer = defaults.ChannelBuffer
+		q.event("ChannelBuffer: Default value of " + strconv.Itoa(q.ChannelBuffer) + " was used")
+	}
+	if q.Storage != nil && q.PollInterval == 0 {
+		q.PollInterval = time.Second
+		q.event("PollInterval: Default value of 1s was used")
+	}
+	if q.Replicator != nil && q.Heartbeat == 0 {
+		q.Heartbeat = time.Second
+		q.event("Heartbeat: Default value of 1s was used")
+	}
+	if q.DarkQueue != nil && q.DarkRatio == 0 {
+		q.DarkRatio = 0.01
+		q.event("DarkRatio: Default value of 0.01 was used")
+	}
+	if q.InputBatch == 0 {
+		q.InputBatch = 64
+		q.event("InputBatch: Default value of 64 was used")
+	}
+	if q.BreakerThreshold > 0 && q.BreakerCooldown == 0 {
+		q.BreakerCooldown = 30 * time.Second
+		q.event("BreakerCooldown: Default value of 30s was used")
+	}
+	if q.TimeInQueueSLO > 0 && q.SLOWindow == 0 {
+		q.SLOWindow = time.Minute
+		q.event("SLOWindow: Default value of 1m was used")
+	}
+	if q.AwaitHistory == 0 {
+		q.AwaitHistory = 1024
+		q.event("AwaitHistory: Default value of 1024 was used")
+	}
+	q.payloadMutex.Lock()
+	q.payloadQueue.reserve(q.MaxSize)
+	if q.TenantKey != nil && q.payloadQueue.tenants == nil {
+		q.payloadQueue.tenants = make(map[string]int)
+		q.tenantsOut = make(map[string]int)
+		q.tenantsReserved = make(map[string]int)
+	}
+	q.payloadMutex.Unlock()
+	q.outcomes.mutex.Lock()
+	q.outcomes.limit = q.AwaitHistory
+	q.outcomes.mutex.Unlock()
+	if err := q.preflight(); err != nil {
+		return err
+	}
+	q.activeWork.Store(0)
+	if q.room == nil {
+		// kept across restarts, as a batch of the previous run may still release it
+		q.room = sync.NewCond(&q.payloadMutex)
+	}
+	q.wakeChan = make(chan struct{}, 1)
+	if q.parent != nil {
+		q.slots = q.parent.slots
+	} else {
+		q.slots = newWorkSlots(q.Concurrency)
+	}
+	if q.EncodeWorkers > 0 {
+		q.encoders = newWorkSlots(q.EncodeWorkers)
+	}
+	q.payloadChan = make(chan Payload, q.ChannelBuffer)
+	q.quitChan = make(chan bool)
+	if err := q.seed(spawn); err != nil {
+		return err
+	}
+	q.stopOnce = sync.Once{}
+	q.payloadMutex.Lock()
+	q.kept = false
+	q.payloadMutex.Unlock()
+	q.lateRetries.Store(0)
+	q.stopping.Store(false)
+	q.running.Store(true)
 
-	go func() {
+	q.loops.Add(1)
+	spawn(func() {
+		defer q.loops.Done()
+		// Wake up on the max age or when the earliest delayed payload is due
 		for {
+			next := q.nextWake()
+			q.recordSchedule(next)
+			timer := q.clock().NewTimer(next)
 			select {
-			case p := <-q.payloadChan:
-				// Payload has been added for queuing
-				q.Append(p)
-
+			case <-timer.C():
+			case <-q.wakeChan:
 			case <-q.quitChan:
-				// We have been asked to stop.
-				q.Close()
+				timer.Stop()
+				return
+			case <-ctx.Done():
+				timer.Stop()
 				return
 			}
+			timer.Stop()
+			q.watchClock()
+			q.expire()
+			q.promote()
+			q.fill()
+			q.heartbeat()
+			q.check("timer")
 		}
-	}()
+	})
+
+	q.loops.Add(1)
+	spawn(func() {
+		defer q.loops.Done()
+		buf := make([]Payload, 0, q.InputBatch)
+		// the channel is closed by Close once the queue stops
+		for p := range q.payloadChan {
+			// Payload has been added for queuing. Drain whatever else is already waiting
+			// so a burst is queued under a single lock.
+			pls := append(buf[:0], p)
+		drain:
+			for len(pls) < q.InputBatch {
+				select {
+				case p, ok := <-q.payloadChan:
+					if !ok {
+						break drain
+					}
+					pls = append(pls, p)
+				default:
+					break drain
+				}
+			}
+			q.appendBatch(pls)
+		}
+	})
+
+	q.loops.Add(1)
+	quit := q.quitChan
+	spawn(func() {
+		defer q.loops.Done()
+		q.keepLedger(quit)
+	})
 	q.event("BP Queue: Started")
 	return nil
 }
 
-func (q Queue) NewPayload(pl interface{}) Payload {
+func (q *Queue) NewPayload(pl interface{}) Payload {
 	if pl == nil {
 		return Payload{
 			Id:   "",
 			Data: "",
 		}
 	}
+	if q.SequentialIds {
+		return Payload{
+			Id:   q.Tag + "-" + strconv.FormatUint(q.ids.Add(1), 10),
+			Data: pl,
+		}
+	}
 	u := uuid.New()
 	return Payload{
 		Id:   u.String(),
@@ -86,72 +367,706 @@ func (q Queue) NewPayload(pl interface{}) Payload {
 	}
 }
 
-// Run to push the Batch for processing
+// preflight to run the Preflight check, bound by the WorkTimeout, before the queue opens
+func (q *Queue) preflight() error {
+	if q.Preflight == nil {
+		return nil
+	}
+	ctx := context.Background()
+	if q.WorkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.WorkTimeout)
+		defer cancel()
+	}
+	if err := q.Preflight(ctx); err != nil {
+		q.log(slog.LevelError, "preflight failed", "Preflight: Failed. "+err.Error(), resultAttr(err))
+		return fmt.Errorf("preflight check for queue %s failed: %w", q.Tag, err)
+	}
+	q.event("Preflight: Passed")
+	return nil
+}
+
+// SetWork to swap the Work handler while the queue is running. Batches already handed to the
+// previous handler finish on it; batches cut after the swap use the new handler.
+func (q *Queue) SetWork(work workHandler) error {
+	if work == nil {
+		return errors.New("the Work function is not supplied")
+	}
+	if q.Pull {
+		return errors.New("a Pull queue takes no Work function")
+	}
+	q.workMutex.Lock()
+	q.Work = work
+	q.WorkContext = nil
+	q.workMutex.Unlock()
+	q.event("Work: Handler replaced")
+	return nil
+}
+
+// SetWorkContext to swap the WorkContext handler while the queue is running, see SetWork.
+func (q *Queue) SetWorkContext(work workContextHandler) error {
+	if work == nil {
+		return errors.New("the Work function is not supplied")
+	}
+	if q.Pull {
+		return errors.New("a Pull queue takes no Work function")
+	}
+	q.workMutex.Lock()
+	q.WorkContext = work
+	q.workMutex.Unlock()
+	q.event("Work: Handler replaced")
+	return nil
+}
+
+// handler to return the handler that new batches should use. A Work handler is adapted so that a
+// non-zero result code is reported as an error, then the Middleware is wrapped around it. A Pull
+// queue offers its batches to Receive instead.
+func (q *Queue) handler() workContextHandler {
+	q.workMutex.RLock()
+	defer q.workMutex.RUnlock()
+	var work workContextHandler
+	if q.Pull {
+		work = q.deliver
+	} else if q.WorkContext != nil {
+		work = q.WorkContext
+	} else if w := q.Work; w != nil {
+		work = func(ctx context.Context, pl []interface{}) error {
+			if result := w(pl); result != 0 {
+				return ResultCodeError(result)
+			}
+			return nil
+		}
+	} else {
+		return nil
+	}
+	if q.Compressor != nil {
+		work = q.compressing(work, q.Compressor)
+	}
+	for i := len(q.Middleware) - 1; i >= 0; i-- {
+		work = q.Middleware[i](work)
+	}
+	return work
+}
+
+// Run to push the Batch for processing and return the error of the handler once the failed payloads
+// are retried or dead-lettered. A Work handler that returns a non-zero result code fails with a
+// ResultCodeError.
 func (q *Queue) Run(Payloads []Payload) error {
-	if q.Work == nil {
+	q.activeWork.Add(1)
+	return q.run(q.handler(), Payloads)
+}
+
+// dispatch to push the Batch for processing in the background. It is counted as active work
+// straight away, so a Close that follows waits for it. The payloadMutex must be held.
+func (q *Queue) dispatch(Payloads []Payload) {
+	q.activeWork.Add(1)
+	q.inflight += len(Payloads)
+	q.countOut(Payloads, 1)
+	batch := func() {
+		q.run(q.handler(), Payloads)
+		q.payloadMutex.Lock()
+		q.inflight -= len(Payloads)
+		q.countOut(Payloads, -1)
+		spilled := q.spilled
+		q.payloadMutex.Unlock()
+		q.release()
+		// the timer cuts the next batch from the spilled payloads as this one completes
+		if spilled > 0 {
+			q.wake()
+		}
+	}
+	if q.group == nil {
+		go batch()
+		return
+	}
+	q.group.Go(func() error {
+		batch()
+		return nil
+	})
+}
+
+// run to push the Batch to the given handler. Failed batches are retried or dead-lettered.
+func (q *Queue) run(work workContextHandler, Payloads []Payload) error {
+	return q.runWithin(work, Payloads, q.WorkTimeout)
+}
+
+// runWithin to push the Batch to the given handler with the timeout as its deadline, see run
+func (q *Queue) runWithin(work workContextHandler, Payloads []Payload, timeout time.Duration) error {
+	defer q.finish()
+	if work == nil {
 		return errors.New("no Work() is passed")
 	}
-	q.event("Batch Push [" + q.Tag + "]: Running. Queue Size: " + strconv.Itoa(len(Payloads)) + " @ " + time.Now().String())
-	q.activeWork++
-	pl := make([]interface{}, 0)
-	for _, v := range Payloads {
+	var body *batchBody
+	if q.BatchTransformer == nil {
+		// a transformed batch is encoded once transformed, in its slot
+		body = q.preencode(Payloads)
+	}
+	if q.slots != nil {
+		q.slots.acquire()
+		defer q.slots.release()
+	}
+	screened := q.screen(Payloads)
+	if len(screened) != len(Payloads) {
+		body = nil
+	}
+	if Payloads = screened; len(Payloads) == 0 {
+		return nil
+	}
+	batch := &Batch{Id: uuid.New().String(), Tag: q.Tag, Payloads: Payloads}
+	ctx := q.flag(withBatch(context.Background(), batch), batch)
+	Payloads, err := q.transform(ctx, batch)
+	if err != nil {
+		// the batch fails as if the handler had returned the error
+		work = func(context.Context, []interface{}) error { return err }
+	}
+	if len(Payloads) == 0 {
+		return nil
+	}
+	return q.push(ctx, work, batch, body, timeout)
+}
+
+// push to number the batch and push it to the handler, then deliver, retry or dead-letter its
+// payloads by the outcome. A batch the handler rejects as too large is split, see TooLarge.
+func (q *Queue) push(ctx context.Context, work workContextHandler, batch *Batch, body *batchBody, timeout time.Duration) error {
+	Payloads := batch.Payloads
+	q.number(batch)
+	q.log(slog.LevelInfo, "batch running",
+		"Batch Push ["+q.Tag+"]: Running. Queue Size: "+strconv.Itoa(len(Payloads))+" @ "+q.now().String(),
+		slog.String("batch_id", batch.Id), slog.Int("batch_size", len(Payloads)))
+	var pl []interface{}
+	if body != nil {
+		pl = body.batch
+		ctx = context.WithValue(ctx, bodyKey{}, body)
+	} else {
+		pl = batchData(Payloads)
+	}
+	if q.OnBatchStart != nil {
+		q.OnBatchStart(ctx, batch)
+	}
+	started := q.now()
+	err := q.call(ctx, work, pl, timeout)
+	if q.OnBatchEnd != nil {
+		q.OnBatchEnd(ctx, batch, err)
+	}
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	annotations := batch.Annotations()
+	q.log(level, "batch finished",
+		"Batch Push ["+q.Tag+"]: Finished. Result: "+resultText(err)+mapText(annotations)+" @ "+q.now().String(),
+		slog.String("batch_id", batch.Id), slog.Int("batch_size", len(Payloads)), slog.Duration("duration", q.now().Sub(started)),
+		resultAttr(err), mapAttr("annotations", annotations))
+	if len(Payloads) > 1 && q.tooLarge(err) {
+		return q.chunk(work, batch, started, timeout, err)
+	}
+	failures := []Payload(nil)
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		failures = batchErr.failures(Payloads)
+	} else if err != nil {
+		failures = Payloads
+	}
+	q.record(q.batchRecord(batch, started, failures, err))
+	q.timed(Payloads, started)
+	q.counters.add(func(s *Stats) {
+		s.Batches++
+		s.Delivered += int64(len(Payloads) - len(failures))
+		s.Failed += int64(len(failures))
+	})
+	q.trip(len(failures) < len(Payloads))
+	var dead []Payload
+	if len(failures) > 0 {
+		dead = q.failed(failures, err)
+		q.settle(batch, dead, false, err)
+	}
+	sent := delivered(Payloads, failures)
+	q.tally(sent, func(c *DailyCounts, n int64) { c.Delivered += n })
+	q.measure(sent)
+	q.dispatched(sent)
+	q.archive(batch, sent)
+	q.settle(batch, sent, true, nil)
+	if q.OnBatchDone != nil {
+		q.OnBatchDone(newBatchResult(batch, started, q.now(), failures, dead, err))
+	}
+	return err
+}
+
+// batchData to return the Data of the payloads, as handed to the handler
+func batchData(pls []Payload) []interface{} {
+	pl := make([]interface{}, 0, len(pls))
+	for _, v := range pls {
 		pl = append(pl, v.Data)
 	}
-	result := q.Work(pl)
-	q.event("Batch Push [" + q.Tag + "]: Finished. Result Code: " + strconv.Itoa(result) + " @ " + time.Now().String())
-	q.activeWork--
+	return pl
+}
 
-	return nil
+// call to invoke the handler with a context bound by the timeout, the WorkTimeout unless draining.
+// A handler that does not return by the deadline is abandoned and the batch is reported as failed.
+func (q *Queue) call(ctx context.Context, work workContextHandler, pl []interface{}, timeout time.Duration) error {
+	if timeout <= 0 {
+		return work(ctx, pl)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- work(ctx, pl)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// Append to add a Payload to the queue. This is a
+// failed to re-queue the payloads of a failed batch that have retries left and dead-letter the rest,
+// which are returned
+func (q *Queue) failed(Payloads []Payload, err error) []Payload {
+	var dead []Payload
+	for _, p := range Payloads {
+		if p.Attempts < q.MaxRetries {
+			p.Attempts++
+			q.undispatch(&p, err)
+			q.counters.add(func(s *Stats) { s.Retried++ })
+			q.log(slog.LevelInfo, "payload retry", "Payload Retry [id]: "+p.Id+" attempt "+strconv.Itoa(p.Attempts),
+				slog.String("payload_id", p.Id), slog.Int("attempts", p.Attempts))
+			q.AppendAfter(p, q.RetryDelay)
+			continue
+		}
+		dead = append(dead, p)
+	}
+	q.deadLetter(dead, err)
+	return dead
+}
+
+// deadLetter to hand the payloads to the DeadLetter, or discard them, for the error
+func (q *Queue) deadLetter(dead []Payload, err error) {
+	if len(dead) == 0 {
+		return
+	}
+	q.counters.add(func(s *Stats) { s.DeadLettered += int64(len(dead)) })
+	q.tally(dead, func(c *DailyCounts, n int64) { c.Failed += n })
+	q.bury(dead, err)
+	if q.DeadLetter == nil {
+		q.log(slog.LevelWarn, "batch discarded", "Batch Push ["+q.Tag+"]: Discarded "+strconv.Itoa(len(dead))+" failed payloads",
+			slog.Int("batch_size", len(dead)), resultAttr(err))
+		return
+	}
+	q.log(slog.LevelWarn, "batch dead-lettered", "Batch Push ["+q.Tag+"]: Dead-lettered "+strconv.Itoa(len(dead))+" failed payloads",
+		slog.Int("batch_size", len(dead)), resultAttr(err))
+	q.DeadLetter(dead, err)
+}
+
+// delivered to return the payloads of the batch that are not among the failures
+func delivered(Payloads []Payload, failures []Payload) []Payload {
+	if len(failures) == 0 {
+		return Payloads
+	}
+	failed := make(map[string]bool, len(failures))
+	for _, p := range failures {
+		failed[p.Id] = true
+	}
+	pls := make([]Payload, 0, len(Payloads)-len(failures))
+	for _, p := range Payloads {
+		if !failed[p.Id] {
+			pls = append(pls, p)
+		}
+	}
+	return pls
+}
+
+// resultText to describe the result of a batch for the event feed
+func resultText(err error) string {
+	if err == nil {
+		return "OK"
+	}
+	return err.Error()
+}
+
+// Append to add a Payload to the queue. A Payload with a NotBefore in the future is held back
+// until it is due. Once the queue is closed, it fails with ErrQueueClosed.
 func (q *Queue) Append(p Payload) error {
-	// Add to the queue
-	if p.Id != "" {
-		q.payloadMutex.Lock()
-		q.payloadQueue = append(q.payloadQueue, p)
+	return q.AppendContext(context.Background(), p)
+}
+
+// appendBatch to add the payloads to the queue under a single lock and evaluate the triggers once.
+func (q *Queue) appendBatch(pls []Payload) error {
+	return q.appendContext(context.Background(), pls)
+}
+
+// appendContext to add the payloads as appendBatch does, waiting for room no longer than the
+// context, see AppendContext. The payloads the Validator rejects, and those over the quota of their
+// tenant, are left out and the error of the first one is returned.
+func (q *Queue) appendContext(ctx context.Context, pls []Payload) error {
+	pls, refused := q.validate(pls)
+	q.assign(pls)
+	pls, reserved, over := q.quota(pls)
+	defer q.unquota(reserved)
+	if refused == nil {
+		refused = over
+	}
+	if len(pls) == 0 {
+		return refused
+	}
+	if err := q.appendValid(ctx, pls); err != nil {
+		return err
+	}
+	return refused
+}
+
+// appendValid to add the validated payloads, see appendContext
+func (q *Queue) appendValid(ctx context.Context, pls []Payload) error {
+	fresh := 0
+	for _, p := range pls {
+		if p.Id != "" && p.Attempts == 0 {
+			fresh++
+		}
+	}
+	// retries are already held by the queue, so only new payloads wait for room
+	q.relieve()
+	reserved, err := q.admit(ctx, fresh)
+	if err != nil {
+		return err
+	}
+	defer q.unreserve(reserved)
+	if q.Idempotency == nil {
+		return q.accept(pls, "append")
+	}
+	claimed := make([]Payload, 0, len(pls))
+	for _, p := range pls {
+		if q.claim(p) {
+			claimed = append(claimed, p)
+		}
+	}
+	return q.accept(claimed, "append")
+}
+
+// accept to add the claimed payloads to the queue and evaluate the triggers. With a Storage the
+// new payloads are persisted and the batch is filled from the Storage; with a Replicator they are
+// mirrored to the standby.
+func (q *Queue) accept(pls []Payload, trigger string) error {
+	now := q.now()
+	q.weigh(pls)
+	// new payloads that are ready for batching, the common case, are taken as they are
+	plain := q.Storage == nil
+	for i := range pls {
+		p := &pls[i]
+		if p.appended.IsZero() {
+			p.appended = now
+		}
+		q.sequence(p)
+		plain = plain && p.Id != "" && p.Attempts == 0 && !now.Before(p.NotBefore)
+	}
+	ready, accepted := pls, pls
+	var persist []Payload
+	if plain {
+		q.counters.add(func(s *Stats) { s.Appended += int64(len(pls)) })
+	} else {
+		ready, accepted = make([]Payload, 0, len(pls)), nil
+		for _, p := range pls {
+			if p.Id != "" && p.Attempts == 0 {
+				accepted = append(accepted, p)
+			}
+			if p.Id != "" && p.Attempts == 0 && q.Storage != nil {
+				persist = append(persist, p)
+				continue
+			}
+			if p.Id != "" && p.Attempts == 0 {
+				q.counters.add(func(s *Stats) { s.Appended++ })
+			}
+			if p.Id != "" && now.Before(p.NotBefore) {
+				q.delay(p)
+				continue
+			}
+			if p.Id != "" {
+				ready = append(ready, p)
+			}
+		}
+	}
+	if err := q.persist(persist); err != nil {
+		return err
+	}
+	if len(persist) > 0 {
+		q.counters.add(func(s *Stats) { s.Appended += int64(len(persist)) })
+	}
+	q.tally(accepted, func(c *DailyCounts, n int64) { c.Appended += n })
+	if len(accepted) > 0 {
+		q.replicate(accepted)
+	}
+	if q.OnAppend != nil {
+		for _, p := range accepted {
+			q.OnAppend(p)
+		}
+	}
+	q.darken(accepted)
+	q.checkSchema(accepted)
+	q.enqueue(now, ready)
+	q.fill()
+	q.check(trigger)
+	return nil
+}
+
+// enqueue to add the payloads that are ready for batching to the queue
+func (q *Queue) enqueue(now time.Time, ready []Payload) {
+	if len(ready) == 0 {
+		return
+	}
+	q.digest(ready)
+	queued, folded := ready, []Payload(nil)
+	q.payloadMutex.Lock()
+	if q.kept {
+		q.payloadMutex.Unlock()
+		q.late(ready)
+		return
+	}
+	if q.CoalesceKey == nil {
+		q.payloadQueue.push(ready...)
+	} else {
+		queued = nil
+		for _, p := range ready {
+			if q.coalesce(p) {
+				folded = append(folded, p)
+				continue
+			}
+			q.payloadQueue.push(p)
+			queued = append(queued, p)
+		}
+	}
+	q.payloadMutex.Unlock()
+	q.folded(folded)
+	q.spill()
+	wake := false
+	for _, p := range queued {
+		q.queued(p)
+		wake = wake || !p.ExpiresAt.IsZero()
+	}
+	if wake {
+		q.wake()
+	}
+	if q.optimizer != nil {
+		q.optimizer.observe(now, len(ready))
+	}
+	if q.LatencySLO > 0 {
+		q.tuner.observe(now, len(ready), q.MaxSize, q.LatencySLO)
+	}
+}
+
+// queued to report a payload that entered the buffer and may be batched
+func (q *Queue) queued(p Payload) {
+	if q.logging(slog.LevelDebug) {
+		q.log(slog.LevelDebug, "payload queued", "Payload Queued [id]: "+p.Id+p.headerText(),
+			slog.String("payload_id", p.Id), p.headerAttr())
+	}
+	if q.OnPayloadQueued != nil {
+		q.OnPayloadQueued(p)
+	}
+}
+
+// delay to hold the payload back until its NotBefore
+func (q *Queue) delay(p Payload) {
+	q.payloadMutex.Lock()
+	if q.kept {
 		q.payloadMutex.Unlock()
-		q.event("Payload Queued [id]: " + p.Id)
+		q.late([]Payload{p})
+		return
+	}
+	i := sort.Search(len(q.delayed), func(i int) bool { return q.delayed[i].NotBefore.After(p.NotBefore) })
+	q.delayed = append(q.delayed, Payload{})
+	copy(q.delayed[i+1:], q.delayed[i:])
+	q.delayed[i] = p
+	q.payloadMutex.Unlock()
+	if q.logging(slog.LevelDebug) {
+		q.log(slog.LevelDebug, "payload delayed", "Payload Delayed [id]: "+p.Id+p.headerText()+" until "+p.NotBefore.String(),
+			slog.String("payload_id", p.Id), p.headerAttr(), slog.Time("not_before", p.NotBefore))
+	}
+	if i == 0 || !p.ExpiresAt.IsZero() {
+		q.wake()
+	}
+}
+
+// check to cut a batch and push it for processing when a trigger has fired
+func (q *Queue) check(trigger string) {
+	// a paused queue cuts no batches
+	if q.hold() {
+		return
 	}
 	// Check the conditions for firing the Work()
 	// 1. Queue is full
 	// 2. MaxAge has expired
-	if len(q.payloadQueue) >= q.MaxSize || time.Now().After(q.expires) {
-		q.payloadMutex.Lock()
-		pls := q.payloadQueue
-		go q.Run(pls)
-		// reset the queue
-		q.payloadQueue = nil
-		q.payloadMutex.Unlock()
-		q.expires = time.Now().Add(time.Duration(q.MaxAge) * time.Second)
+	q.payloadMutex.Lock()
+	full := q.payloadQueue.len()+q.spilled >= q.batchSize()
+	expired := q.elapsed() >= q.expires
+	q.payloadMutex.Unlock()
+	q.recordTrigger(trigger, full, expired)
+	if full || expired {
+		q.flush()
 	}
-	return nil
 }
 
-// Close to close the channels and wait for Work funcs to quit the execution.
-func (q *Queue) Close() {
-	q.event("Buffer Queue: Stopping...")
-	if q.payloadChan != nil {
-		close(q.payloadChan)
+// Flush to cut a batch from the pending payloads and push it for processing now, irrespective of
+// the MaxSize and MaxAge.
+func (q *Queue) Flush() {
+	q.event("Buffer Queue: Flush requested")
+	q.flush()
+}
+
+// flush to cut a batch from the pending payloads, push it to the handler and reopen the window
+func (q *Queue) flush() {
+	q.reload()
+	q.expire()
+	q.payloadMutex.Lock()
+	size := q.batchSize()
+	// a burst appended in one go is cut into batches of at most the batch size, split further by
+	// the limits of the downstream, and processed within the Concurrency
+	for _, pls := range q.split(q.fair(q.payloadQueue.take(q.payloadQueue.len())), size) {
+		q.dispatch(pls)
+	}
+	q.reopen()
+	q.payloadMutex.Unlock()
+}
+
+// batchSize to return the number of payloads that fills a batch: the MaxSize, or the cost
+// optimized size when Pricing is supplied. The payloadMutex must be held.
+func (q *Queue) batchSize() int {
+	if q.optimizer == nil {
+		return q.MaxSize
+	}
+	return q.optimizer.batchSize(q.MaxSize)
+}
+
+// maxAge to return how long a batch may stay open: the MaxAge, capped by the LatencyTarget of
+// the Pricing. The payloadMutex must be held once the queue is running.
+func (q *Queue) maxAge() time.Duration {
+	age := time.Duration(q.MaxAge) * time.Second
+	if q.Pricing != nil && q.Pricing.LatencyTarget > 0 && q.Pricing.LatencyTarget < age {
+		return q.Pricing.LatencyTarget
+	}
+	return age
+}
+
+// Input to return the channel payloads can be sent on instead of calling Append. It is buffered by
+// the ChannelBuffer and closed by Close, so nothing may be sent on it after the queue is closed.
+func (q *Queue) Input() chan<- Payload {
+	return q.payloadChan
+}
+
+// AppendAfter to add a Payload that only becomes eligible for batching once the delay has elapsed.
+func (q *Queue) AppendAfter(p Payload, delay time.Duration) error {
+	p.NotBefore = q.now().Add(delay)
+	return q.Append(p)
+}
+
+// promote to move the delayed payloads that are now due into the queue
+func (q *Queue) promote() {
+	now := q.now()
+	q.payloadMutex.Lock()
+	i := sort.Search(len(q.delayed), func(i int) bool { return q.delayed[i].NotBefore.After(now) })
+	due := q.delayed[:i:i]
+	q.delayed = q.delayed[i:]
+	q.payloadQueue.push(due...)
+	q.payloadMutex.Unlock()
+	for _, p := range due {
+		q.queued(p)
+	}
+}
+
+// expire to remove the payloads that have passed their ExpiresAt and hand them to OnExpire
+func (q *Queue) expire() {
+	now := q.now()
+	passed := func(p Payload) bool {
+		return !p.ExpiresAt.IsZero() && now.After(p.ExpiresAt)
 	}
-	if q.quitChan != nil {
-		close(q.quitChan)
+	q.payloadMutex.Lock()
+	expired := q.payloadQueue.expire(now)
+	n := 0
+	for _, p := range q.delayed {
+		if passed(p) {
+			expired = append(expired, p)
+			continue
+		}
+		q.delayed[n] = p
+		n++
+	}
+	q.delayed = q.delayed[:n]
+	q.payloadMutex.Unlock()
+	if len(expired) > 0 {
+		q.release()
+		q.counters.add(func(s *Stats) { s.Expired += int64(len(expired)) })
+		q.tally(expired, func(c *DailyCounts, n int64) { c.Expired += n })
+		q.acknowledge(expired)
 	}
-	// wait for all active routines to be completed
-	for q.activeWork > 0 {
-		time.Sleep(time.Second * 1)
+	outs := make([]Outcome, len(expired))
+	for i, p := range expired {
+		outs[i] = Outcome{PayloadId: p.Id, Expired: true}
+	}
+	q.outcomes.resolve(outs)
+	for _, p := range expired {
+		q.log(slog.LevelInfo, "payload expired", "Payload Expired [id]: "+p.Id, slog.String("payload_id", p.Id))
+		if q.OnExpire != nil {
+			q.OnExpire(p)
+		}
+	}
+}
+
+// nextWake to return how long the timer should sleep: until the MaxAge expires, the earliest
+// delayed payload is due or a payload passes its ExpiresAt, whichever comes first.
+func (q *Queue) nextWake() time.Duration {
+	now := q.now()
+	q.payloadMutex.Lock()
+	wait := q.expires - q.elapsed()
+	if len(q.delayed) > 0 {
+		wait = min(wait, q.delayed[0].NotBefore.Sub(now))
 	}
+	if q.payloadQueue.expiring > 0 {
+		wait = min(wait, q.payloadQueue.expiresBy.Sub(now))
+	}
+	for _, p := range q.delayed {
+		if !p.ExpiresAt.IsZero() {
+			wait = min(wait, p.ExpiresAt.Sub(now))
+		}
+	}
+	q.payloadMutex.Unlock()
+	if q.Storage != nil && wait > q.PollInterval {
+		// other instances may have put payloads into the Storage
+		wait = q.PollInterval
+	}
+	if q.Replicator != nil && wait > q.Heartbeat {
+		wait = q.Heartbeat
+	}
+	return wait
+}
+
+// wake to interrupt the timer so that it recalculates its next deadline
+func (q *Queue) wake() {
+	select {
+	case q.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// Close to stop the intake of the queue and wait for the batches being processed to complete. The
+// payloads still pending are not delivered, see Shutdown.
+func (q *Queue) Close() {
+	if !q.stop() {
+		return
+	}
+	<-q.idle()
+	q.detach()
+	q.flushLedger()
 	q.event("Buffer Queue: All Work completed")
 }
 
-// event to write events into the Queue's feed
+// event to write an event that has no structured attributes of its own. It is logged under the
+// constant message "event" with its text as the text attribute.
 func (q *Queue) event(s string) {
-	if q.EventFeed != nil {
-		q.EventFeed("[" + q.Tag + "] " + s)
-	}
+	q.log(slog.LevelInfo, "event", s, slog.String("text", s))
 }
 
-// Size to return the number of payloads in the queue
+// Size to return the number of payloads in the queue, including the delayed payloads
 func (q *Queue) Size() int {
-	return len(q.payloadQueue)
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
+	return q.payloadQueue.len() + len(q.delayed) + q.spilled + q.spilling
 }
@@ -1,11 +1,28 @@
 package payloadqueue_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"golang.org/x/sync/errgroup"
+
 	"github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/queuetest"
 )
 
 func TestQueueStart(t *testing.T) {
@@ -19,6 +36,22 @@ func TestQueueStart(t *testing.T) {
 		}
 	})
 
+	t.Run("Start Queue with a failing Preflight", func(t *testing.T) {
+		qb := payloadqueue.Queue{
+			Tag:  "QueueB",
+			Work: func(pls []interface{}) int { return 0 },
+			Preflight: func(ctx context.Context) error {
+				return errors.New("column \"payload\" is missing")
+			},
+		}
+		err := qb.Start()
+		if err == nil {
+			t.Errorf("Expected error - Preflight failed")
+		} else if err.Error() != "preflight check for queue QueueB failed: column \"payload\" is missing" {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+	})
+
 	t.Run("Start Queue with no Work function", func(t *testing.T) {
 		qb := payloadqueue.Queue{
 			Tag: "QueueB",
@@ -88,9 +121,11 @@ func TestQueueRun(t *testing.T) {
 		// Delay is important to be sure that the Work() goroutine has been called before the assertion
 		time.Sleep(1 * time.Second)
 		// Ensure that Run was triggered and the queue was reset
+		runMutex.Lock()
 		if runtimes != 2 {
 			t.Errorf("Expected runtimes to be 2, got %d", runtimes)
 		}
+		runMutex.Unlock()
 		q.Close()
 	})
 
@@ -111,6 +146,33 @@ func TestQueueRun(t *testing.T) {
 		}
 		q.Close()
 	})
+
+	t.Run("Run returns the result of the handler", func(t *testing.T) {
+		var results []payloadqueue.BatchResult
+		q := &payloadqueue.Queue{
+			MaxSize:     2,
+			MaxAge:      200,
+			Tag:         "QueueA",
+			Work:        func(pls []interface{}) int { return 3 },
+			OnBatchDone: func(r payloadqueue.BatchResult) { results = append(results, r) },
+		}
+		q.Start()
+
+		err := q.Run([]payloadqueue.Payload{{Id: "1"}, {Id: "2"}})
+		var code payloadqueue.ResultCodeError
+		if !errors.As(err, &code) || code != 3 {
+			t.Errorf("Expected result code 3 from Run(), got %v", err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 batch result, got %d", len(results))
+		}
+		r := results[0]
+		if r.Tag != "QueueA" || r.BatchId == "" || r.Result != 3 || !errors.Is(r.Err, err) ||
+			len(r.PayloadIds) != 2 || len(r.Failed) != 2 || len(r.DeadLettered) != 2 {
+			t.Errorf("Unexpected batch result: %+v", r)
+		}
+		q.Close()
+	})
 }
 
 func TestQueueAppend(t *testing.T) {
@@ -176,3 +238,2892 @@ func TestQueueAppend(t *testing.T) {
 		q.Close()
 	})
 }
+
+func TestQueueAppendAfter(t *testing.T) {
+	t.Run("Delayed payload is batched once due", func(t *testing.T) {
+		var runMutex sync.Mutex
+		runtimes := 0
+
+		q := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				runtimes += 1
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		if err := q.AppendAfter(payloadqueue.Payload{Id: "1"}, 500*time.Millisecond); err != nil {
+			t.Errorf("AppendAfter had an error: %s", err.Error())
+		}
+		if q.Size() != 1 {
+			t.Errorf("Expected Size() to be 1, got %d", q.Size())
+		}
+		time.Sleep(200 * time.Millisecond)
+		runMutex.Lock()
+		if runtimes != 0 {
+			t.Errorf("Expected runtimes to be 0 before the delay, got %d", runtimes)
+		}
+		runMutex.Unlock()
+
+		time.Sleep(600 * time.Millisecond)
+		runMutex.Lock()
+		if runtimes != 1 {
+			t.Errorf("Expected runtimes to be 1 after the delay, got %d", runtimes)
+		}
+		runMutex.Unlock()
+		if q.Size() != 0 {
+			t.Errorf("Expected Size() to be 0, got %d", q.Size())
+		}
+		q.Close()
+	})
+}
+
+func TestQueueExpiresAt(t *testing.T) {
+	t.Run("Expired payload is handed to OnExpire", func(t *testing.T) {
+		var runMutex sync.Mutex
+		batched := 0
+		expired := []string{}
+
+		q := &payloadqueue.Queue{
+			MaxSize: 10,
+			MaxAge:  1,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched += len(pls)
+				runMutex.Unlock()
+				return 0
+			},
+			OnExpire: func(p payloadqueue.Payload) {
+				runMutex.Lock()
+				expired = append(expired, p.Id)
+				runMutex.Unlock()
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1", ExpiresAt: time.Now().Add(300 * time.Millisecond)})
+		q.Append(payloadqueue.Payload{Id: "2"})
+
+		time.Sleep(600 * time.Millisecond)
+		runMutex.Lock()
+		if len(expired) != 1 || expired[0] != "1" {
+			t.Errorf("Expected payload 1 to expire, got %v", expired)
+		}
+		runMutex.Unlock()
+		if q.Size() != 1 {
+			t.Errorf("Expected Size() to be 1, got %d", q.Size())
+		}
+
+		time.Sleep(1500 * time.Millisecond)
+		runMutex.Lock()
+		if batched != 1 {
+			t.Errorf("Expected 1 payload to be batched, got %d", batched)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+
+	t.Run("A payload expires on time once the one expiring before it left", func(t *testing.T) {
+		expired := make(chan string, 2)
+		q := &payloadqueue.Queue{
+			MaxSize:  10,
+			MaxAge:   60,
+			Work:     func(pls []interface{}) int { return 0 },
+			OnExpire: func(p payloadqueue.Payload) { expired <- p.Id },
+		}
+		q.Start()
+		defer q.Close()
+		q.Append(payloadqueue.Payload{Id: "1", ExpiresAt: time.Now().Add(30 * time.Millisecond)})
+		q.Append(payloadqueue.Payload{Id: "2", ExpiresAt: time.Now().Add(80 * time.Millisecond)})
+		q.Append(payloadqueue.Payload{Id: "3", ExpiresAt: time.Now().Add(time.Hour)})
+		q.Remove("1")
+		select {
+		case id := <-expired:
+			if id != "2" {
+				t.Errorf("Expected payload 2 to expire, got %s", id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected payload 2 to expire")
+		}
+		if q.Size() != 1 {
+			t.Errorf("Expected payload 3 left, got a size of %d", q.Size())
+		}
+	})
+}
+
+func TestQueueSetWork(t *testing.T) {
+	t.Run("Swap the Work handler at runtime", func(t *testing.T) {
+		var runMutex sync.Mutex
+		oldRuns, newRuns := 0, 0
+
+		q := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				oldRuns += 1
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		time.Sleep(100 * time.Millisecond)
+
+		err := q.SetWork(func(pls []interface{}) int {
+			runMutex.Lock()
+			newRuns += 1
+			runMutex.Unlock()
+			return 0
+		})
+		if err != nil {
+			t.Errorf("SetWork had an error: %s", err.Error())
+		}
+		q.Append(payloadqueue.Payload{Id: "2"})
+		time.Sleep(100 * time.Millisecond)
+
+		runMutex.Lock()
+		if oldRuns != 1 || newRuns != 1 {
+			t.Errorf("Expected 1 run on each handler, got %d and %d", oldRuns, newRuns)
+		}
+		runMutex.Unlock()
+		if err := q.SetWork(nil); err == nil {
+			t.Errorf("Expected error - Work function is not supplied")
+		}
+		q.Close()
+	})
+}
+
+func TestQueueWorkContext(t *testing.T) {
+	t.Run("Hung WorkContext times out and is dead-lettered", func(t *testing.T) {
+		dead := make(chan error, 1)
+		q := &payloadqueue.Queue{
+			MaxSize:     1,
+			MaxAge:      200,
+			Tag:         "QueueA",
+			WorkTimeout: 100 * time.Millisecond,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				select {} // never returns
+			},
+			DeadLetter: func(pls []payloadqueue.Payload, err error) {
+				dead <- err
+			},
+		}
+		if err := q.Start(); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		q.Append(payloadqueue.Payload{Id: "1"})
+		select {
+		case err := <-dead:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the batch to be dead-lettered")
+		}
+		q.Close()
+	})
+
+	t.Run("Failed payloads are retried", func(t *testing.T) {
+		var runMutex sync.Mutex
+		runtimes := 0
+		q := &payloadqueue.Queue{
+			MaxSize:    1,
+			MaxAge:     200,
+			Tag:        "QueueA",
+			MaxRetries: 2,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				runMutex.Lock()
+				defer runMutex.Unlock()
+				runtimes += 1
+				if runtimes < 3 {
+					return errors.New("downstream unavailable")
+				}
+				return nil
+			},
+			DeadLetter: func(pls []payloadqueue.Payload, err error) {
+				t.Errorf("Unexpected dead letter: %s", err.Error())
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		time.Sleep(300 * time.Millisecond)
+		runMutex.Lock()
+		if runtimes != 3 {
+			t.Errorf("Expected runtimes to be 3, got %d", runtimes)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+}
+
+func TestQueueHeaders(t *testing.T) {
+	t.Run("Headers reach WorkContext and the event feed", func(t *testing.T) {
+		headers := make(chan map[string]string, 1)
+		var feedMutex sync.Mutex
+		feed := []string{}
+		q := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				if b, ok := payloadqueue.BatchFromContext(ctx); ok {
+					headers <- b.Payloads[0].Headers
+				}
+				return nil
+			},
+			EventFeed: func(s string) {
+				feedMutex.Lock()
+				feed = append(feed, s)
+				feedMutex.Unlock()
+			},
+		}
+		q.Start()
+		p := q.NewPayload("data")
+		p.Headers = map[string]string{"tenant": "acme", "correlation": "c-1"}
+		q.Append(p)
+
+		select {
+		case h := <-headers:
+			if h["tenant"] != "acme" || h["correlation"] != "c-1" {
+				t.Errorf("Unexpected headers: %v", h)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the batch to reach WorkContext")
+		}
+		feedMutex.Lock()
+		found := false
+		for _, s := range feed {
+			if s == "[QueueA] Payload Queued [id]: "+p.Id+" {correlation=c-1, tenant=acme}" {
+				found = true
+			}
+		}
+		feedMutex.Unlock()
+		if !found {
+			t.Errorf("Expected the headers in the event feed")
+		}
+		q.Close()
+	})
+}
+
+func TestQueueBatchError(t *testing.T) {
+	t.Run("Only the failed payloads are retried", func(t *testing.T) {
+		var runMutex sync.Mutex
+		batches := [][]interface{}{}
+		q := &payloadqueue.Queue{
+			MaxSize:    3,
+			MaxAge:     200,
+			Tag:        "QueueA",
+			MaxRetries: 1,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				runMutex.Lock()
+				batches = append(batches, pls)
+				runMutex.Unlock()
+				if len(pls) == 3 {
+					return &payloadqueue.BatchError{Results: []payloadqueue.PayloadResult{
+						{Index: 0}, {Index: 1, Err: errors.New("rejected")}, {Index: 2},
+					}}
+				}
+				return nil
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1", Data: "a"})
+		q.Append(payloadqueue.Payload{Id: "2", Data: "b"})
+		q.Append(payloadqueue.Payload{Id: "3", Data: "c"})
+		time.Sleep(100 * time.Millisecond)
+		if q.Size() != 1 {
+			t.Errorf("Expected the failed payload to be re-queued, got Size() %d", q.Size())
+		}
+		q.Append(payloadqueue.Payload{Id: "4", Data: "d"})
+		q.Append(payloadqueue.Payload{Id: "5", Data: "e"})
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if len(batches) < 2 || batches[len(batches)-1][0] != "b" {
+			t.Errorf("Expected the failed payload to be retried first, got %v", batches)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+
+	t.Run("Failed payloads are dead-lettered individually", func(t *testing.T) {
+		dead := make(chan []payloadqueue.Payload, 1)
+		q := &payloadqueue.Queue{
+			MaxSize: 2,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				return &payloadqueue.BatchError{Results: []payloadqueue.PayloadResult{
+					{Index: 1, Err: errors.New("rejected")},
+				}}
+			},
+			DeadLetter: func(pls []payloadqueue.Payload, err error) {
+				dead <- pls
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		q.Append(payloadqueue.Payload{Id: "2"})
+		select {
+		case pls := <-dead:
+			if len(pls) != 1 || pls[0].Id != "2" {
+				t.Errorf("Expected only payload 2 to be dead-lettered, got %v", pls)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the failed payload to be dead-lettered")
+		}
+		q.Close()
+	})
+}
+
+func TestQueueDecisionLog(t *testing.T) {
+	t.Run("Trigger evaluations are recorded", func(t *testing.T) {
+		var log bytes.Buffer
+		q := &payloadqueue.Queue{
+			MaxSize:     2,
+			MaxAge:      200,
+			Tag:         "QueueA",
+			Work:        func(pls []interface{}) int { return 0 },
+			DecisionLog: &log,
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		q.Append(payloadqueue.Payload{Id: "2"})
+		q.Close()
+
+		ds, err := payloadqueue.ReadDecisions(&log)
+		if err != nil {
+			t.Errorf("ReadDecisions had an error: %s", err.Error())
+		}
+		flushes := 0
+		for _, d := range ds {
+			if d.Trigger != "append" {
+				continue
+			}
+			if d.Flush {
+				flushes++
+				if d.Reason != "full" || d.Depth != 2 {
+					t.Errorf("Expected a full flush at depth 2, got %s at %d", d.Reason, d.Depth)
+				}
+			}
+		}
+		if flushes != 1 {
+			t.Errorf("Expected 1 flush decision, got %d", flushes)
+		}
+	})
+}
+
+func TestQueueBatchWindow(t *testing.T) {
+	t.Run("The MaxAgeJitter shortens each window at random", func(t *testing.T) {
+		var log bytes.Buffer
+		q := &payloadqueue.Queue{
+			MaxSize:      1,
+			MaxAge:       1,
+			MaxAgeJitter: 0.5,
+			Tag:          "QueueA",
+			Work:         func(pls []interface{}) int { return 0 },
+			DecisionLog:  &log,
+		}
+		q.Start()
+		for i := 0; i < 20; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i)})
+		}
+		q.Close()
+		ds, _ := payloadqueue.ReadDecisions(&log)
+		windows := map[time.Duration]bool{}
+		for _, d := range ds {
+			if d.MaxAge <= 500*time.Millisecond || d.MaxAge > time.Second {
+				t.Fatalf("Expected a window between 500ms and 1s, got %s", d.MaxAge)
+			}
+			windows[d.MaxAge] = true
+		}
+		if len(windows) < 2 {
+			t.Errorf("Expected the windows to vary, got %v", windows)
+		}
+	})
+
+	t.Run("The window shrinks under a high arrival rate", func(t *testing.T) {
+		var log bytes.Buffer
+		clock := queuetest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		q := &payloadqueue.Queue{
+			MaxSize:     100,
+			MaxAge:      10,
+			LatencySLO:  2 * time.Second,
+			Tag:         "QueueA",
+			Clock:       clock,
+			Work:        func(pls []interface{}) int { return 0 },
+			DecisionLog: &log,
+		}
+		q.Start()
+		defer q.Close()
+		n := 0
+		appendN := func(count int) {
+			for i := 0; i < count; i++ {
+				n++
+				q.Append(payloadqueue.Payload{Id: strconv.Itoa(n)})
+			}
+		}
+		last := func() time.Duration {
+			appendN(1)
+			ds, _ := payloadqueue.ReadDecisions(bytes.NewReader(log.Bytes()))
+			return ds[len(ds)-1].MaxAge
+		}
+		if w := last(); w != 2*time.Second {
+			t.Errorf("Expected the LatencySLO as the window before a rate is observed, got %s", w)
+		}
+		clock.Advance(time.Second)
+		appendN(500)
+		clock.Advance(time.Second)
+		appendN(100)
+		if w := last(); w >= time.Second || w < 10*time.Millisecond {
+			t.Errorf("Expected the window to shrink to the time a batch fills, got %s", w)
+		}
+	})
+}
+
+// encodeCounter to compress nothing while counting the batches encoded
+type encodeCounter struct {
+	encoded chan []byte
+}
+
+func (c encodeCounter) Encoding() string { return "identity" }
+
+func (c encodeCounter) Compress(b []byte) ([]byte, error) {
+	c.encoded <- b
+	return b, nil
+}
+
+func TestQueueCompressor(t *testing.T) {
+	t.Run("The handler gets the batch compressed", func(t *testing.T) {
+		bodies := make(chan string, 1)
+		q := &payloadqueue.Queue{
+			MaxSize:    2,
+			MaxAge:     200,
+			Tag:        "QueueA",
+			Compressor: encodeCounter{encoded: make(chan []byte, 1)},
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				b, encoding, err := payloadqueue.CompressedBatch(ctx)
+				bodies <- encoding + " " + string(b)
+				return err
+			},
+		}
+		q.Start()
+		defer q.Close()
+		q.Append(payloadqueue.Payload{Id: "1", Data: "a"})
+		q.Append(payloadqueue.Payload{Id: "2", Data: "b"})
+		if b := <-bodies; b != `identity ["a","b"]` {
+			t.Errorf("Unexpected body: %s", b)
+		}
+	})
+
+	t.Run("The EncodeWorkers encode batches ahead of the Concurrency", func(t *testing.T) {
+		encoded := make(chan []byte, 2)
+		release := make(chan struct{})
+		q := &payloadqueue.Queue{
+			MaxSize:       1,
+			MaxAge:        200,
+			Tag:           "QueueA",
+			Concurrency:   1,
+			EncodeWorkers: 2,
+			Compressor:    encodeCounter{encoded: encoded},
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				<-release
+				return nil
+			},
+		}
+		q.Start()
+		defer q.Close()
+		q.Append(payloadqueue.Payload{Id: "1", Data: "a"})
+		q.Append(payloadqueue.Payload{Id: "2", Data: "b"})
+		for i := 0; i < 2; i++ {
+			select {
+			case <-encoded:
+			case <-time.After(time.Second):
+				t.Fatalf("Expected both batches encoded while the first holds the only slot, got %d", i)
+			}
+		}
+		close(release)
+	})
+}
+
+func TestQueueFlushAndStats(t *testing.T) {
+	t.Run("Flush pushes the pending payloads", func(t *testing.T) {
+		q := &payloadqueue.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				if len(pls) == 1 {
+					return 1
+				}
+				return 0
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		q.Append(payloadqueue.Payload{Id: "2"})
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		q.Append(payloadqueue.Payload{Id: "3"})
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+
+		s := q.Stats()
+		if s.Pending != 0 || s.Appended != 3 || s.Batches != 2 || s.Delivered != 2 || s.Failed != 1 || s.DeadLettered != 1 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+		q.Close()
+	})
+}
+
+func TestQueueConcurrentAccess(t *testing.T) {
+	t.Run("Appends, reads and reconfiguration from many goroutines are race-free", func(t *testing.T) {
+		var delivered sync.Map
+		q := &payloadqueue.Queue{
+			MaxSize: 5,
+			MaxAge:  1,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				for _, pl := range pls {
+					delivered.Store(pl, true)
+				}
+				return 0
+			},
+		}
+		q.Start()
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					id := strconv.Itoa(g) + "-" + strconv.Itoa(i)
+					q.Append(payloadqueue.Payload{Id: id, Data: id})
+					q.Size()
+					q.Stats()
+					if i%10 == 0 {
+						q.SetMaxSize(5 + g)
+						q.SetMaxAge(1 + g%2)
+						q.Flush()
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		q.Flush()
+		q.Close()
+
+		s := q.Stats()
+		if s.Appended != 400 || s.Delivered != 400 || s.Pending != 0 || s.ActiveWork != 0 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+		n := 0
+		delivered.Range(func(k, v any) bool {
+			n++
+			return true
+		})
+		if n != 400 {
+			t.Errorf("Expected 400 distinct payloads to be delivered, got %d", n)
+		}
+	})
+}
+
+func TestQueueMaxBatchSize(t *testing.T) {
+	t.Run("A flush is split into calls of at most MaxBatchSize", func(t *testing.T) {
+		var runMutex sync.Mutex
+		var sizes []int
+		q := &payloadqueue.Queue{
+			MaxSize:      100,
+			MaxAge:       200,
+			MaxBatchSize: 3,
+			Concurrency:  1,
+			Tag:          "QueueA",
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				sizes = append(sizes, len(pls))
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		for i := 0; i < 8; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i)})
+		}
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		sort.Ints(sizes)
+		if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 3 || sizes[2] != 3 {
+			t.Errorf("Expected calls of 3, 3 and 2 payloads, got %v", sizes)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+
+	t.Run("A flush is split into calls of at most MaxBatchBytes", func(t *testing.T) {
+		var runMutex sync.Mutex
+		var calls [][]interface{}
+		q := &payloadqueue.Queue{
+			MaxSize:       100,
+			MaxAge:        200,
+			MaxBatchBytes: 10,
+			Concurrency:   1,
+			Tag:           "QueueA",
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				calls = append(calls, pls)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		for i, data := range []string{"aaaa", "bbbb", "cccc", "dddddddddddddddd", "eeee"} {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: data})
+		}
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		sizes := make([]int, len(calls))
+		for i, c := range calls {
+			sizes[i] = len(c)
+			if len(c) > 1 {
+				bytes := 0
+				for _, pl := range c {
+					bytes += len(pl.(string))
+				}
+				if bytes > 10 {
+					t.Errorf("Expected at most 10 bytes per call, got %v", c)
+				}
+			}
+		}
+		sort.Ints(sizes)
+		if len(sizes) != 4 || sizes[0] != 1 || sizes[1] != 1 || sizes[2] != 1 || sizes[3] != 2 {
+			t.Errorf("Expected calls of 2, 1, 1 and 1 payloads, got %v", sizes)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+}
+
+func TestQueueInput(t *testing.T) {
+	t.Run("Bursts on the Input channel are batched up to MaxSize", func(t *testing.T) {
+		var runMutex sync.Mutex
+		total, largest := 0, 0
+		q := &payloadqueue.Queue{
+			MaxSize:       100,
+			MaxAge:        1,
+			Tag:           "QueueA",
+			ChannelBuffer: 300,
+			InputBatch:    32,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				total += len(pls)
+				if len(pls) > largest {
+					largest = len(pls)
+				}
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		for i := 0; i < 250; i++ {
+			q.Input() <- payloadqueue.Payload{Id: strconv.Itoa(i)}
+		}
+		time.Sleep(1500 * time.Millisecond)
+		runMutex.Lock()
+		if total != 250 {
+			t.Errorf("Expected 250 payloads to be batched, got %d", total)
+		}
+		if largest > 100 {
+			t.Errorf("Expected batches of at most 100, got %d", largest)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+}
+
+func TestQueueStandby(t *testing.T) {
+	t.Run("The standby holds what the primary has not delivered and takes it over", func(t *testing.T) {
+		standby := &payloadqueue.Standby{Tag: "QueueA"}
+		primary := &payloadqueue.Queue{
+			MaxSize:    10,
+			MaxAge:     200,
+			Tag:        "QueueA",
+			Replicator: standby,
+			Work:       func(pls []interface{}) int { return 0 },
+		}
+		primary.Start()
+		primary.Append(payloadqueue.Payload{Id: "1", Data: "a"})
+		primary.Append(payloadqueue.Payload{Id: "2", Data: "b"})
+		primary.Flush()
+		time.Sleep(100 * time.Millisecond)
+		primary.Append(payloadqueue.Payload{Id: "3", Data: "c"})
+		primary.Append(payloadqueue.Payload{Id: "4", Data: "d"})
+		if pls := standby.Pending(); len(pls) != 2 || pls[0].Id != "3" || pls[1].Id != "4" {
+			t.Fatalf("Expected payloads 3 and 4 to be held, got %+v", pls)
+		}
+
+		var runMutex sync.Mutex
+		batched := []interface{}{}
+		takeover := &payloadqueue.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		takeover.Start()
+		if err := standby.Promote(takeover); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		takeover.Flush()
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 2 || batched[0] != "c" || batched[1] != "d" {
+			t.Errorf("Expected the held payloads to be batched, got %v", batched)
+		}
+		runMutex.Unlock()
+		if err := standby.Replicate(context.Background(), nil); !errors.Is(err, payloadqueue.ErrPromoted) {
+			t.Errorf("Expected the old primary to be refused, got %v", err)
+		}
+		takeover.Close()
+	})
+
+	t.Run("Watch promotes once the primary is silent", func(t *testing.T) {
+		standby := &payloadqueue.Standby{Tag: "QueueA"}
+		standby.Replicate(context.Background(), []payloadqueue.Payload{{Id: "1", Data: "a"}})
+		takeover := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work:    func(pls []interface{}) int { return 0 },
+		}
+		takeover.Start()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := standby.Watch(ctx, takeover, 100*time.Millisecond); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if s := takeover.Stats(); s.Delivered != 1 {
+			t.Errorf("Expected the held payload to be delivered, got %+v", s)
+		}
+		takeover.Close()
+	})
+}
+
+func TestQueueDarkQueue(t *testing.T) {
+	t.Run("A share of the traffic is copied to the dark queue, whose failures stay there", func(t *testing.T) {
+		var runMutex sync.Mutex
+		real := 0
+		dark := &payloadqueue.Queue{
+			MaxSize: 1000,
+			MaxAge:  1,
+			Tag:     "Dark",
+			Work:    func(pls []interface{}) int { return 1 },
+		}
+		dark.Start()
+		q := &payloadqueue.Queue{
+			MaxSize:   10,
+			MaxAge:    200,
+			Tag:       "QueueA",
+			DarkQueue: dark,
+			DarkRatio: 0.5,
+			DarkLimit: 30,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				real += len(pls)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		for i := 0; i < 200; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+		}
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if real != 200 {
+			t.Errorf("Expected all 200 payloads delivered, got %d", real)
+		}
+		runMutex.Unlock()
+		if s := q.Stats(); s.Dark == 0 || s.Dark > 30 {
+			t.Errorf("Expected up to the limit of 30 payloads copied, got %d", s.Dark)
+		}
+		if s := dark.Stats(); s.Appended != q.Stats().Dark {
+			t.Errorf("Expected the dark queue to get every copy, got %+v", s)
+		}
+		if l := q.Latency(); l.Count != 200 || l.Max <= 0 || l.P50 > l.Max {
+			t.Errorf("Unexpected latency: %+v", l)
+		}
+		q.Close()
+		dark.Close()
+	})
+
+	t.Run("The dark queue measures the latency from the real append", func(t *testing.T) {
+		dark := &payloadqueue.Queue{
+			MaxSize: 1000,
+			MaxAge:  1,
+			Tag:     "Dark",
+			Work:    func(pls []interface{}) int { return 0 },
+		}
+		dark.Start()
+		q := &payloadqueue.Queue{
+			MaxSize:   10,
+			MaxAge:    200,
+			Tag:       "QueueA",
+			DarkQueue: dark,
+			DarkRatio: 1,
+			Work:      func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		time.Sleep(1500 * time.Millisecond)
+		if l := dark.Latency(); l.Count != 1 || l.Max < 900*time.Millisecond {
+			t.Errorf("Expected the MaxAge of the dark queue to show in its latency, got %+v", l)
+		}
+		q.Close()
+		dark.Close()
+	})
+}
+
+func TestQueueMaxPending(t *testing.T) {
+	t.Run("A full queue rejects payloads", func(t *testing.T) {
+		release := make(chan struct{})
+		q := &payloadqueue.Queue{
+			MaxSize:    2,
+			MaxAge:     200,
+			MaxPending: 4,
+			Tag:        "QueueA",
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				<-release
+				return nil
+			},
+		}
+		q.Start()
+		for i := 0; i < 4; i++ {
+			if err := q.Append(payloadqueue.Payload{Id: strconv.Itoa(i)}); err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+		}
+		if err := q.Append(payloadqueue.Payload{Id: "4"}); !errors.Is(err, payloadqueue.ErrQueueFull) {
+			t.Errorf("Expected ErrQueueFull, got %v", err)
+		}
+		if s := q.Stats(); s.Rejected != 1 {
+			t.Errorf("Expected 1 payload rejected, got %d", s.Rejected)
+		}
+		close(release)
+		time.Sleep(50 * time.Millisecond)
+		if err := q.Append(payloadqueue.Payload{Id: "4"}); err != nil {
+			t.Errorf("Expected room once the batches completed, got %s", err.Error())
+		}
+		q.Close()
+	})
+
+	t.Run("A full queue blocks until a batch completes", func(t *testing.T) {
+		release := make(chan struct{})
+		q := &payloadqueue.Queue{
+			MaxSize:    2,
+			MaxAge:     200,
+			MaxPending: 2,
+			Overflow:   payloadqueue.OverflowBlock,
+			Tag:        "QueueA",
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				<-release
+				return nil
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		q.Append(payloadqueue.Payload{Id: "2"})
+		appended := make(chan error)
+		go func() { appended <- q.Append(payloadqueue.Payload{Id: "3"}) }()
+		select {
+		case <-appended:
+			t.Fatal("Expected Append to block while the queue is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		select {
+		case err := <-appended:
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err.Error())
+			}
+		case <-time.After(time.Second):
+			t.Error("Expected Append to return once the batch completed")
+		}
+		q.Close()
+	})
+
+	t.Run("Concurrent producers never push the queue past MaxPending", func(t *testing.T) {
+		var held, most atomic.Int64
+		q := &payloadqueue.Queue{
+			MaxSize:    3,
+			MaxAge:     200,
+			MaxPending: 6,
+			Overflow:   payloadqueue.OverflowBlock,
+			Tag:        "QueueA",
+			OnAppend:   func(p payloadqueue.Payload) { time.Sleep(time.Millisecond) },
+			OnPayloadQueued: func(p payloadqueue.Payload) {
+				n := held.Add(1)
+				for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+				}
+			},
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				time.Sleep(time.Millisecond)
+				held.Add(-int64(len(pls)))
+				return nil
+			},
+		}
+		q.Start()
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					q.Append(payloadqueue.Payload{Id: strconv.Itoa(i*10 + j)})
+				}
+			}()
+		}
+		wg.Wait()
+		q.Close()
+		if m := most.Load(); m > 6 {
+			t.Errorf("Expected at most 6 payloads held, got %d", m)
+		}
+
+		release := make(chan struct{})
+		q = &payloadqueue.Queue{
+			MaxSize:    100,
+			MaxAge:     200,
+			MaxPending: 10,
+			Tag:        "QueueA",
+			// widens the gap between admitting a payload and queueing it
+			OnAppend: func(p payloadqueue.Payload) { time.Sleep(time.Millisecond) },
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				<-release
+				return nil
+			},
+		}
+		q.Start()
+		var accepted atomic.Int64
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if q.Append(payloadqueue.Payload{Id: strconv.Itoa(i)}) == nil {
+					accepted.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := accepted.Load(); n != 10 || q.Size() != 10 {
+			t.Errorf("Expected 10 payloads accepted, got %d and a size of %d", n, q.Size())
+		}
+		close(release)
+		q.Close()
+	})
+
+	t.Run("A blocked Append gives up at the MaxBlock or its context", func(t *testing.T) {
+		release := make(chan struct{})
+		q := &payloadqueue.Queue{
+			MaxSize:    2,
+			MaxAge:     200,
+			MaxPending: 2,
+			Overflow:   payloadqueue.OverflowBlock,
+			MaxBlock:   50 * time.Millisecond,
+			Tag:        "QueueA",
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				<-release
+				return nil
+			},
+		}
+		q.Start()
+		defer q.Close()
+		defer close(release)
+		q.Append(payloadqueue.Payload{Id: "1"})
+		q.Append(payloadqueue.Payload{Id: "2"})
+		ingest := payloadqueue.WithProducer(context.Background(), "ingest")
+		if err := q.AppendContext(ingest, payloadqueue.Payload{Id: "3"}); !errors.Is(err, payloadqueue.ErrWouldBlock) {
+			t.Errorf("Expected ErrWouldBlock, got %v", err)
+		}
+		ctx, cancel := context.WithTimeout(ingest, 10*time.Millisecond)
+		defer cancel()
+		if err := q.AppendContext(ctx, payloadqueue.Payload{Id: "4"}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the deadline of the context, got %v", err)
+		}
+		if s := q.Stats(); s.Blocked != 2 || s.WouldBlock != 1 {
+			t.Errorf("Expected 2 payloads blocked, 1 at the MaxBlock, got %d and %d", s.Blocked, s.WouldBlock)
+		}
+		w := q.Waits()["ingest"]
+		if w.Waits != 2 || w.WouldBlock != 1 || w.Canceled != 1 || w.Longest < 50*time.Millisecond || w.Total < w.Longest {
+			t.Errorf("Unexpected waits: %+v", w)
+		}
+	})
+
+	t.Run("Memory pressure flushes the buffer and rejects new payloads", func(t *testing.T) {
+		release := make(chan struct{})
+		var runMutex sync.Mutex
+		var batched []interface{}
+		q := &payloadqueue.Queue{
+			MaxSize:        100,
+			MaxAge:         200,
+			MemoryPressure: 0.9,
+			Tag:            "QueueA",
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				<-release
+				return nil
+			},
+		}
+		var pressed atomic.Bool
+		pressed.Store(true)
+		q.SetMemoryReader(func() (uint64, int64) {
+			if pressed.Load() {
+				return 95, 100
+			}
+			return 10, 100
+		})
+		q.Start()
+		if err := q.Append(payloadqueue.Payload{Id: "1", Data: "1"}); err != nil {
+			t.Errorf("Expected a payload admitted into the empty queue, got %s", err.Error())
+		}
+		if err := q.Append(payloadqueue.Payload{Id: "2", Data: "2"}); !errors.Is(err, payloadqueue.ErrQueueFull) {
+			t.Errorf("Expected ErrQueueFull, got %v", err)
+		}
+		pressed.Store(false)
+		time.Sleep(20 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 1 || batched[0] != "1" {
+			t.Errorf("Expected the pending payload flushed, got %v", batched)
+		}
+		runMutex.Unlock()
+		close(release)
+		time.Sleep(60 * time.Millisecond)
+		if err := q.Append(payloadqueue.Payload{Id: "2", Data: "2"}); err != nil {
+			t.Errorf("Expected the payload admitted once the pressure is relieved, got %s", err.Error())
+		}
+		if s := q.Stats(); s.Rejected != 1 || s.Pending != 1 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+		q.Close()
+	})
+
+	t.Run("A blocked Append proceeds once the memory pressure eases", func(t *testing.T) {
+		release := make(chan struct{})
+		clock := queuetest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		q := &payloadqueue.Queue{
+			MaxSize:        100,
+			MaxAge:         60000,
+			MemoryPressure: 0.9,
+			Overflow:       payloadqueue.OverflowBlock,
+			Clock:          clock,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				<-release
+				return nil
+			},
+		}
+		var pressed atomic.Bool
+		pressed.Store(true)
+		q.SetMemoryReader(func() (uint64, int64) {
+			if pressed.Load() {
+				return 95, 100
+			}
+			return 10, 100
+		})
+		q.Start()
+		defer q.Close()
+		defer close(release)
+		q.Append(payloadqueue.Payload{Id: "1", Data: "1"})
+		armed := clock.Timers()
+		appended := make(chan error, 1)
+		go func() { appended <- q.Append(payloadqueue.Payload{Id: "2", Data: "2"}) }()
+		clock.BlockUntil(armed + 1)
+		pressed.Store(false)
+		select {
+		case err := <-appended:
+			t.Fatalf("Expected the reading of the memory kept until the clock moves, got %v", err)
+		case <-time.After(80 * time.Millisecond):
+		}
+		// no batch completes, so only reading the memory again lets the Append through
+		clock.Advance(50 * time.Millisecond)
+		select {
+		case err := <-appended:
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err.Error())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the Append to proceed once the pressure eased")
+		}
+	})
+}
+
+func TestQueueMiddleware(t *testing.T) {
+	t.Run("Middleware wraps the Work in order", func(t *testing.T) {
+		var runMutex sync.Mutex
+		calls := []string{}
+		trace := func(name string) payloadqueue.Middleware {
+			return func(next payloadqueue.WorkFunc) payloadqueue.WorkFunc {
+				return func(ctx context.Context, pls []interface{}) error {
+					runMutex.Lock()
+					calls = append(calls, name)
+					runMutex.Unlock()
+					return next(ctx, pls)
+				}
+			}
+		}
+		double := func(next payloadqueue.WorkFunc) payloadqueue.WorkFunc {
+			return func(ctx context.Context, pls []interface{}) error {
+				for i, v := range pls {
+					pls[i] = v.(int) * 2
+				}
+				return next(ctx, pls)
+			}
+		}
+		sum := 0
+		q := &payloadqueue.Queue{
+			MaxSize:    3,
+			MaxAge:     200,
+			Tag:        "QueueA",
+			Middleware: []payloadqueue.Middleware{trace("outer"), trace("inner"), double},
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				calls = append(calls, "work")
+				for _, v := range pls {
+					sum += v.(int)
+				}
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		for i := 1; i <= 3; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+		}
+		q.Close()
+		if strings.Join(calls, ",") != "outer,inner,work" {
+			t.Errorf("Expected the middleware to run outermost first, got %v", calls)
+		}
+		if sum != 12 {
+			t.Errorf("Expected the payloads transformed by the middleware, got a sum of %d", sum)
+		}
+	})
+
+	t.Run("Hooks observe the queued payloads and the batches", func(t *testing.T) {
+		var runMutex sync.Mutex
+		queued, started, ended := 0, 0, []error{}
+		q := &payloadqueue.Queue{
+			MaxSize:    2,
+			MaxAge:     200,
+			MaxRetries: 1,
+			Tag:        "QueueA",
+			OnPayloadQueued: func(p payloadqueue.Payload) {
+				runMutex.Lock()
+				queued++
+				runMutex.Unlock()
+			},
+			OnBatchStart: func(ctx context.Context, b *payloadqueue.Batch) {
+				runMutex.Lock()
+				started++
+				runMutex.Unlock()
+			},
+			OnBatchEnd: func(ctx context.Context, b *payloadqueue.Batch, err error) {
+				runMutex.Lock()
+				ended = append(ended, err)
+				runMutex.Unlock()
+			},
+			Work: func(pls []interface{}) int { return 1 },
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		q.Append(payloadqueue.Payload{Id: "2"})
+		time.Sleep(100 * time.Millisecond)
+		q.Close()
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if queued != 4 {
+			t.Errorf("Expected 2 payloads queued and queued again for the retry, got %d", queued)
+		}
+		if started != 2 || len(ended) != 2 {
+			t.Errorf("Expected both batches started and ended, got %d and %d", started, len(ended))
+		}
+		for _, err := range ended {
+			if !errors.As(err, new(payloadqueue.ResultCodeError)) {
+				t.Errorf("Expected the result code of the Work, got %v", err)
+			}
+		}
+	})
+}
+
+func TestQueueReconfigure(t *testing.T) {
+	t.Run("A smaller MaxSize pushes the full batch", func(t *testing.T) {
+		batches := make(chan int, 1)
+		q := &payloadqueue.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				batches <- len(pls)
+				return 0
+			},
+		}
+		q.Start()
+		for i := 0; i < 3; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i)})
+		}
+		if err := q.SetMaxSize(0); err == nil {
+			t.Errorf("Expected an error for a MaxSize of 0")
+		}
+		q.SetMaxSize(3)
+		select {
+		case n := <-batches:
+			if n != 3 {
+				t.Errorf("Expected a batch of 3, got %d", n)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the batch pushed once the MaxSize was lowered")
+		}
+		q.Close()
+	})
+
+	t.Run("A shorter MaxAge closes the open window", func(t *testing.T) {
+		batches := make(chan int, 1)
+		q := &payloadqueue.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				batches <- len(pls)
+				return 0
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		time.Sleep(10 * time.Millisecond)
+		start := time.Now()
+		q.SetMaxAge(1)
+		select {
+		case <-batches:
+			if time.Since(start) > 1100*time.Millisecond {
+				t.Errorf("Expected the batch within the new MaxAge, took %s", time.Since(start))
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Expected the batch pushed within the new MaxAge")
+		}
+		q.Close()
+	})
+
+	t.Run("The Concurrency bounds the batches processed at the same time", func(t *testing.T) {
+		var runMutex sync.Mutex
+		running, most := 0, 0
+		q := &payloadqueue.Queue{
+			MaxSize:     1,
+			MaxAge:      200,
+			Tag:         "QueueA",
+			Concurrency: 4,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				if running++; running > most {
+					most = running
+				}
+				runMutex.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				runMutex.Lock()
+				running--
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		q.SetConcurrency(1)
+		for i := 0; i < 5; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i)})
+		}
+		time.Sleep(200 * time.Millisecond)
+		runMutex.Lock()
+		if most != 1 {
+			t.Errorf("Expected one batch at a time, got %d", most)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+}
+
+func TestQueueGo(t *testing.T) {
+	t.Run("The queue ends with the group", func(t *testing.T) {
+		var runMutex sync.Mutex
+		batched := 0
+		q := &payloadqueue.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched += len(pls)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		g, gctx := errgroup.WithContext(ctx)
+		if err := q.Go(gctx, g); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		q.Append(payloadqueue.Payload{Id: "1"})
+		q.Append(payloadqueue.Payload{Id: "2"})
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		if err := g.Wait(); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		runMutex.Lock()
+		if batched != 2 {
+			t.Errorf("Expected the pending payloads flushed on shutdown, got %d", batched)
+		}
+		runMutex.Unlock()
+	})
+
+	t.Run("The group waits for the batches of a queue closed before", func(t *testing.T) {
+		release := make(chan struct{})
+		q := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				<-release
+				return 0
+			},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		g, gctx := errgroup.WithContext(ctx)
+		if err := q.Go(gctx, g); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		q.Append(payloadqueue.Payload{Id: "1"})
+		time.Sleep(10 * time.Millisecond)
+		go q.Close()
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		waited := make(chan struct{})
+		go func() {
+			g.Wait()
+			close(waited)
+		}()
+		select {
+		case <-waited:
+			t.Fatal("Expected the group to wait for the batch still running")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+		select {
+		case <-waited:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the group to end once the batch completed")
+		}
+	})
+
+	t.Run("A failed Start is returned", func(t *testing.T) {
+		g, ctx := errgroup.WithContext(context.Background())
+		if err := (&payloadqueue.Queue{}).Go(ctx, g); err == nil {
+			t.Errorf("Expected error - no Work supplied")
+		}
+	})
+}
+
+func TestQueueLogger(t *testing.T) {
+	var runMutex sync.Mutex
+	var buf bytes.Buffer
+	q := &payloadqueue.Queue{
+		MaxSize: 2,
+		MaxAge:  200,
+		Tag:     "QueueA",
+		Logger: slog.New(slog.NewJSONHandler(writerFunc(func(b []byte) (int, error) {
+			runMutex.Lock()
+			defer runMutex.Unlock()
+			return buf.Write(b)
+		}), &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Work: func(pls []interface{}) int { return 0 },
+	}
+	q.Start()
+	q.Append(payloadqueue.Payload{Id: "1", Headers: map[string]string{"tenant": "acme"}})
+	q.Append(payloadqueue.Payload{Id: "2"})
+	time.Sleep(50 * time.Millisecond)
+	q.Close()
+
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	var queued, finished, completed map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var r map[string]interface{}
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if r["tag"] != "QueueA" {
+			t.Errorf("Expected every record tagged, got %v", r)
+		}
+		switch {
+		case r["msg"] == "payload queued" && r["payload_id"] == "1":
+			queued = r
+		case r["msg"] == "batch finished":
+			finished = r
+		case r["msg"] == "event" && r["text"] == "Buffer Queue: All Work completed":
+			completed = r
+		}
+	}
+	if queued == nil || queued["level"] != "DEBUG" || queued["headers"].(map[string]interface{})["tenant"] != "acme" {
+		t.Errorf("Unexpected queued record: %v", queued)
+	}
+	if finished == nil || finished["batch_size"] != 2.0 || finished["result"] != "OK" || finished["duration"] == nil {
+		t.Errorf("Unexpected finished record: %v", finished)
+	}
+	if completed == nil || completed["level"] != "INFO" {
+		t.Errorf("Expected the events without attributes under a constant message, got %v", completed)
+	}
+}
+
+// writerFunc to use a function as an io.Writer
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func TestQueueDrain(t *testing.T) {
+	t.Run("The oldest payloads are delivered within the grace period", func(t *testing.T) {
+		var runMutex sync.Mutex
+		delivered := []interface{}{}
+		q := &payloadqueue.Queue{
+			MaxSize:      100,
+			MaxAge:       200,
+			Tag:          "QueueA",
+			DrainBatch:   2,
+			DrainTimeout: 500 * time.Millisecond,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				select {
+				case <-time.After(20 * time.Millisecond):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				runMutex.Lock()
+				delivered = append(delivered, pls...)
+				runMutex.Unlock()
+				return nil
+			},
+		}
+		q.Start()
+		for i := 0; i < 20; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+		}
+		time.Sleep(10 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 90*time.Millisecond)
+		defer cancel()
+		left, err := q.Drain(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) || left == 0 {
+			t.Errorf("Expected payloads left past the grace period, got %d, %v", left, err)
+		}
+		runMutex.Lock()
+		// the batch running at the deadline is cut short and dead-lettered
+		if len(delivered) == 0 || left+len(delivered) < 18 {
+			t.Errorf("Expected the rest delivered, got %d delivered and %d left", len(delivered), left)
+		}
+		for i, v := range delivered {
+			if v != i {
+				t.Errorf("Expected the oldest payloads first, got %v", delivered)
+				break
+			}
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+
+	t.Run("A stuck batch only costs its DrainTimeout", func(t *testing.T) {
+		var runMutex sync.Mutex
+		delivered := 0
+		q := &payloadqueue.Queue{
+			MaxSize:      100,
+			MaxAge:       200,
+			Tag:          "QueueA",
+			DrainBatch:   1,
+			DrainTimeout: 20 * time.Millisecond,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				if pls[0] == 0 {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				runMutex.Lock()
+				delivered++
+				runMutex.Unlock()
+				return nil
+			},
+		}
+		q.Start()
+		for i := 0; i < 5; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+		}
+		time.Sleep(10 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if left, err := q.Drain(ctx); left != 0 || err != nil {
+			t.Errorf("Expected the buffer drained, got %d left, %v", left, err)
+		}
+		runMutex.Lock()
+		if delivered != 4 {
+			t.Errorf("Expected the 4 other payloads delivered, got %d", delivered)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+}
+
+func TestQueueSubscribe(t *testing.T) {
+	t.Run("Subscribers receive the events of their level", func(t *testing.T) {
+		q := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work:    func(pls []interface{}) int { return 1 },
+		}
+		debug, cancelDebug := q.Subscribe(payloadqueue.EventDebug)
+		warn, cancelWarn := q.Subscribe(payloadqueue.EventWarn)
+		defer cancelDebug()
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		time.Sleep(50 * time.Millisecond)
+		cancelWarn()
+		if _, ok := <-warn; !ok {
+			t.Fatal("Expected the warnings of the failed batch")
+		}
+		for e := range warn {
+			if e.Level < payloadqueue.EventWarn || e.Tag != "QueueA" {
+				t.Errorf("Unexpected event for a warning subscriber: %+v", e)
+			}
+		}
+		queued := false
+		for len(debug) > 0 {
+			e := <-debug
+			if e.Message == "Payload Queued [id]: 1" && e.Level == payloadqueue.EventDebug {
+				queued = true
+			}
+		}
+		if !queued {
+			t.Errorf("Expected the debug subscriber to see the payload queued")
+		}
+		q.Close()
+	})
+
+	t.Run("A slow subscriber drops the oldest events", func(t *testing.T) {
+		q := &payloadqueue.Queue{
+			MaxSize:          1000,
+			MaxAge:           200,
+			Tag:              "QueueA",
+			SubscriberBuffer: 4,
+			Work:             func(pls []interface{}) int { return 0 },
+		}
+		events, cancel := q.Subscribe(payloadqueue.EventDebug)
+		q.Start()
+		for i := 0; i < 20; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i)})
+		}
+		cancel()
+		last := ""
+		n := 0
+		for e := range events {
+			last = e.Message
+			n++
+		}
+		if n != 4 || last != "Payload Queued [id]: 19" {
+			t.Errorf("Expected the 4 newest events, got %d ending with %q", n, last)
+		}
+		q.Close()
+	})
+}
+
+func TestQueueSeed(t *testing.T) {
+	t.Run("The payloads of the seed file are appended at Start", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "seed.ndjson")
+		os.WriteFile(path, []byte(`{"id":"1","data":"a"}
+{"id":"2","data":"b","headers":{"tenant":"acme"}}
+not a payload
+
+{"data":"c"}
+{"id":"4","data":"d"}
+{"id":"5","data":"e"}
+`), 0o644)
+		var runMutex sync.Mutex
+		var batched []interface{}
+		var events []string
+		q := &payloadqueue.Queue{
+			MaxSize:    2,
+			MaxAge:     200,
+			InputBatch: 2,
+			Tag:        "QueueA",
+			Seed:       path,
+			EventFeed: func(e string) {
+				runMutex.Lock()
+				events = append(events, e)
+				runMutex.Unlock()
+			},
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		if err := q.Start(); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		select {
+		case <-q.Seeded():
+		case <-time.After(time.Second):
+			t.Fatal("Expected the seed to be loaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 4 || q.Size() != 1 {
+			t.Errorf("Expected 2 full batches and 1 payload pending, got %v and %d", batched, q.Size())
+		}
+		if !slices.Contains(events, "[QueueA] Seed: Appended 5 payloads from "+path+", skipped 1") {
+			t.Errorf("Expected the seed to be reported, got %v", events)
+		}
+		runMutex.Unlock()
+		q.Close()
+	})
+
+	t.Run("Close stops the loader and waits for it", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "seed.ndjson")
+		var lines strings.Builder
+		for i := range 1000 {
+			fmt.Fprintf(&lines, "{\"id\":\"%d\",\"data\":%d}\n", i, i)
+		}
+		os.WriteFile(path, []byte(lines.String()), 0o644)
+		q := &payloadqueue.Queue{
+			MaxSize:    100,
+			MaxAge:     60000,
+			InputBatch: 10,
+			MaxPending: 10,
+			Overflow:   payloadqueue.OverflowBlock,
+			Seed:       path,
+			Validator: func(payloadqueue.Payload) error {
+				time.Sleep(time.Millisecond)
+				return nil
+			},
+			Work: func(pls []interface{}) int { return 0 },
+		}
+		if err := q.Start(); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		time.Sleep(20 * time.Millisecond)
+		q.Close()
+		select {
+		case <-q.Seeded():
+		default:
+			t.Fatal("Expected the loader to be stopped once Close returns")
+		}
+	})
+
+	t.Run("A missing seed file fails Start", func(t *testing.T) {
+		q := &payloadqueue.Queue{Seed: filepath.Join(t.TempDir(), "missing.ndjson"), Work: func(pls []interface{}) int { return 0 }}
+		if err := q.Start(); err == nil {
+			t.Errorf("Expected Start to fail")
+		}
+	})
+}
+
+func TestQueueCoalesce(t *testing.T) {
+	var runMutex sync.Mutex
+	var batched []payloadqueue.Payload
+	q := &payloadqueue.Queue{
+		MaxSize:     100,
+		MaxAge:      200,
+		Tag:         "QueueA",
+		CoalesceKey: func(p payloadqueue.Payload) string { return p.Headers["device"] },
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			b, _ := payloadqueue.BatchFromContext(ctx)
+			runMutex.Lock()
+			batched = append(batched, b.Payloads...)
+			runMutex.Unlock()
+			return nil
+		},
+	}
+	q.Start()
+	defer q.Close()
+
+	ping := func(id, device, status string) {
+		q.Append(payloadqueue.Payload{Id: id, Data: map[string]string{"status": status}, Headers: map[string]string{"device": device}})
+	}
+	ping("1", "a", "up")
+	ping("2", "a", "up")
+	ping("3", "a", "up")
+	ping("4", "b", "up")
+	ping("5", "a", "up") // not consecutive with 1-3
+	ping("6", "a", "down")
+	q.Append(payloadqueue.Payload{Id: "7", Data: map[string]string{"status": "down"}}) // no key
+	q.Append(payloadqueue.Payload{Id: "8", Data: map[string]string{"status": "down"}})
+
+	t.Run("Runs of identical payloads are folded into one", func(t *testing.T) {
+		if q.Size() != 6 {
+			t.Errorf("Expected 6 payloads pending, got %d", q.Size())
+		}
+		q.Flush()
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		counts := make(map[string]int)
+		for _, p := range batched {
+			counts[p.Id] = p.Count
+		}
+		want := map[string]int{"1": 3, "4": 0, "5": 0, "6": 0, "7": 0, "8": 0}
+		if len(counts) != len(want) {
+			t.Fatalf("Expected payloads %v, got %v", want, counts)
+		}
+		for id, n := range want {
+			if counts[id] != n {
+				t.Errorf("Expected payload %s to count %d, got %d", id, n, counts[id])
+			}
+		}
+		if s := q.Stats(); s.Coalesced != 2 || s.Delivered != 6 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+	})
+
+	t.Run("The folded payloads share the outcome", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		o, err := q.Await(ctx, "3")
+		if err != nil || !o.Delivered {
+			t.Errorf("Unexpected outcome: %+v, %v", o, err)
+		}
+		r, _ := q.Reconcile(ctx, time.Now())
+		if r.Appended != 8 || r.Delivered != 8 || r.Outstanding != 0 {
+			t.Errorf("Unexpected reconciliation: %+v", r)
+		}
+	})
+}
+
+func TestQueueAnnotations(t *testing.T) {
+	var runMutex sync.Mutex
+	var journal bytes.Buffer
+	var events []string
+	q := &payloadqueue.Queue{
+		MaxSize: 2,
+		MaxAge:  200,
+		Tag:     "QueueA",
+		Journal: writerFunc(func(b []byte) (int, error) {
+			runMutex.Lock()
+			defer runMutex.Unlock()
+			return journal.Write(b)
+		}),
+		EventFeed: func(e string) {
+			runMutex.Lock()
+			defer runMutex.Unlock()
+			events = append(events, e)
+		},
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			b, _ := payloadqueue.BatchFromContext(ctx)
+			payloadqueue.Annotate(ctx, "location", "s3://bucket/"+b.Id+".json.gz")
+			if pls[0] == "fail" {
+				return errors.New("upload failed")
+			}
+			return nil
+		},
+	}
+	q.Start()
+	defer q.Close()
+
+	t.Run("Await returns the annotations of the batch", func(t *testing.T) {
+		q.Append(payloadqueue.Payload{Id: "1", Data: "a"})
+		q.Append(payloadqueue.Payload{Id: "2", Data: "b"})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		o, err := q.Await(ctx, "2")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if !o.Delivered || o.BatchId == "" || o.Annotations["location"] != "s3://bucket/"+o.BatchId+".json.gz" {
+			t.Errorf("Unexpected outcome: %+v", o)
+		}
+	})
+
+	t.Run("Await after the payload left the queue", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		o, err := q.Await(ctx, "1")
+		if err != nil || !o.Delivered || o.Annotations["location"] == "" {
+			t.Errorf("Unexpected outcome: %+v, %v", o, err)
+		}
+	})
+
+	t.Run("Await reports a discarded payload", func(t *testing.T) {
+		q.Append(payloadqueue.Payload{Id: "3", Data: "fail"})
+		q.Append(payloadqueue.Payload{Id: "4", Data: "fail"})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		o, err := q.Await(ctx, "3")
+		if err != nil || o.Delivered || o.Err == nil || o.Annotations["location"] == "" {
+			t.Errorf("Unexpected outcome: %+v, %v", o, err)
+		}
+	})
+
+	t.Run("Await ends with the context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := q.Await(ctx, "unknown"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the deadline to be exceeded, got %v", err)
+		}
+	})
+
+	t.Run("The journal and events carry the annotations", func(t *testing.T) {
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		records, err := payloadqueue.ReadJournal(bytes.NewReader(journal.Bytes()))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if len(records) != 2 {
+			t.Fatalf("Expected 2 batch records, got %d", len(records))
+		}
+		if r := records[0]; r.Tag != "QueueA" || len(r.PayloadIds) != 2 || r.Error != "" || r.Annotations["location"] != "s3://bucket/"+r.Id+".json.gz" {
+			t.Errorf("Unexpected record: %+v", r)
+		}
+		if r := records[1]; len(r.Failed) != 2 || r.Error != "upload failed" {
+			t.Errorf("Unexpected record: %+v", r)
+		}
+		found := false
+		for _, e := range events {
+			if strings.Contains(e, "Finished") && strings.Contains(e, "{location=s3://bucket/"+records[0].Id+".json.gz}") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected the annotations in the finished event, got %v", events)
+		}
+	})
+}
+
+func TestQueueValidator(t *testing.T) {
+	errNoUser := errors.New("the user is missing")
+	var runMutex sync.Mutex
+	var batched []interface{}
+	q := &payloadqueue.Queue{
+		MaxSize: 100,
+		MaxAge:  200,
+		Tag:     "QueueA",
+		Validator: func(p payloadqueue.Payload) error {
+			if m, _ := p.Data.(map[string]string); m["user"] == "" {
+				return errNoUser
+			}
+			return nil
+		},
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			runMutex.Lock()
+			batched = append(batched, pls...)
+			runMutex.Unlock()
+			return nil
+		},
+	}
+	q.Start()
+	defer q.Close()
+
+	t.Run("Append rejects an invalid payload", func(t *testing.T) {
+		err := q.Append(payloadqueue.Payload{Id: "1", Data: map[string]string{}})
+		if !errors.Is(err, payloadqueue.ErrInvalidPayload) || !errors.Is(err, errNoUser) {
+			t.Fatalf("Expected a validation error, got %v", err)
+		}
+		var invalid *payloadqueue.ValidationError
+		if !errors.As(err, &invalid) || invalid.PayloadId != "1" {
+			t.Errorf("Expected the Id of the invalid payload, got %v", err)
+		}
+		if err := q.Append(payloadqueue.Payload{Id: "2", Data: map[string]string{"user": "a"}}); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		if q.Size() != 1 {
+			t.Errorf("Expected 1 payload pending, got %d", q.Size())
+		}
+	})
+
+	t.Run("Only the valid payloads sent on the Input are batched", func(t *testing.T) {
+		q.Input() <- payloadqueue.Payload{Id: "3", Data: map[string]string{"user": "b"}}
+		q.Input() <- payloadqueue.Payload{Id: "4", Data: map[string]string{}}
+		time.Sleep(50 * time.Millisecond)
+		q.Flush()
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if len(batched) != 2 {
+			t.Errorf("Expected the 2 valid payloads, got %v", batched)
+		}
+		if s := q.Stats(); s.Invalid != 2 || s.Appended != 2 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+	})
+}
+
+func TestQueueBatchTransformer(t *testing.T) {
+	var runMutex sync.Mutex
+	var batched []interface{}
+	var dead []payloadqueue.Payload
+	fail := false
+	q := &payloadqueue.Queue{
+		MaxSize: 100,
+		MaxAge:  200,
+		Tag:     "QueueA",
+		// keep the last update of each entity, in the order of the entities
+		BatchTransformer: func(ctx context.Context, pls []payloadqueue.Payload) ([]payloadqueue.Payload, error) {
+			if fail {
+				return nil, errors.New("the cache is unavailable")
+			}
+			last := make(map[string]payloadqueue.Payload)
+			for _, p := range pls {
+				last[p.Headers["entity"]] = p
+			}
+			out := make([]payloadqueue.Payload, 0, len(last))
+			for _, p := range last {
+				out = append(out, p)
+			}
+			sort.Slice(out, func(i, j int) bool { return out[i].Headers["entity"] < out[j].Headers["entity"] })
+			return out, nil
+		},
+		DeadLetter: func(pls []payloadqueue.Payload, err error) {
+			runMutex.Lock()
+			dead = append(dead, pls...)
+			runMutex.Unlock()
+		},
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			runMutex.Lock()
+			batched = append(batched, pls...)
+			runMutex.Unlock()
+			return nil
+		},
+	}
+	q.Start()
+	defer q.Close()
+
+	update := func(id, entity string) {
+		q.Append(payloadqueue.Payload{Id: id, Data: entity + id, Headers: map[string]string{"entity": entity}})
+	}
+
+	t.Run("The handler receives the transformed batch", func(t *testing.T) {
+		update("1", "b")
+		update("2", "a")
+		update("3", "b")
+		q.Flush()
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if !slices.Equal(batched, []interface{}{"a2", "b3"}) {
+			t.Errorf("Expected the last update of each entity, got %v", batched)
+		}
+		if s := q.Stats(); s.Merged != 1 || s.Delivered != 2 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if r, _ := q.Reconcile(ctx, time.Now()); r.Dropped != 1 || r.Outstanding != 0 {
+			t.Errorf("Unexpected reconciliation: %+v", r)
+		}
+	})
+
+	t.Run("A failed transform fails the batch", func(t *testing.T) {
+		runMutex.Lock()
+		fail, batched = true, nil
+		runMutex.Unlock()
+		update("4", "a")
+		q.Flush()
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if len(batched) != 0 || len(dead) != 1 || dead[0].Id != "4" {
+			t.Errorf("Expected the batch dead-lettered without calling the handler, got %v and %v", batched, dead)
+		}
+	})
+}
+
+func TestQueueOrdering(t *testing.T) {
+	var runMutex sync.Mutex
+	var batches []*payloadqueue.Batch
+	var journal bytes.Buffer
+	q := &payloadqueue.Queue{
+		MaxSize:    2,
+		MaxAge:     200,
+		Tag:        "QueueA",
+		MaxRetries: 1,
+		Journal:    &journal,
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			b, _ := payloadqueue.BatchFromContext(ctx)
+			runMutex.Lock()
+			defer runMutex.Unlock()
+			batches = append(batches, b)
+			if len(batches) == 2 {
+				return errors.New("downstream unavailable")
+			}
+			return nil
+		},
+	}
+	q.Start()
+	for i := 1; i <= 4; i++ {
+		q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+		time.Sleep(20 * time.Millisecond)
+	}
+	q.Flush()
+	time.Sleep(50 * time.Millisecond)
+	q.Close()
+
+	t.Run("Payloads are numbered in the order they are appended", func(t *testing.T) {
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if len(batches) != 3 {
+			t.Fatalf("Expected 3 batches, got %d", len(batches))
+		}
+		for i, b := range batches {
+			if b.Number != uint64(i+1) {
+				t.Errorf("Expected batch %d to be numbered %d, got %d", i, i+1, b.Number)
+			}
+			for _, p := range b.Payloads {
+				if p.Batch != b.Number || strconv.FormatUint(p.Sequence, 10) != p.Id {
+					t.Errorf("Unexpected order of payload %s: sequence %d, batch %d", p.Id, p.Sequence, p.Batch)
+				}
+			}
+		}
+	})
+
+	t.Run("A retried payload keeps its sequence in a later batch", func(t *testing.T) {
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if len(batches[2].Payloads) != 2 || batches[2].Payloads[0].Sequence != 3 {
+			t.Errorf("Expected payloads 3 and 4 retried, got %+v", batches[2].Payloads)
+		}
+		records, _ := payloadqueue.ReadJournal(&journal)
+		if len(records) != 3 || records[2].Number != 3 {
+			t.Errorf("Expected the batch numbers in the journal, got %+v", records)
+		}
+	})
+}
+
+func TestQueueHealth(t *testing.T) {
+	clock := queuetest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var failing atomic.Bool
+	done := make(chan int, 10)
+	q := &payloadqueue.Queue{
+		MaxSize:          1,
+		MaxAge:           200,
+		Tag:              "QueueA",
+		Clock:            clock,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			defer func() { done <- len(pls) }()
+			if failing.Load() {
+				return errors.New("the downstream is down")
+			}
+			return nil
+		},
+	}
+	if err := q.Healthy(); !errors.Is(err, payloadqueue.ErrNotRunning) {
+		t.Errorf("Expected a queue that is not started to be unhealthy, got %v", err)
+	}
+	q.Start()
+	wait := func() int {
+		select {
+		case n := <-done:
+			time.Sleep(10 * time.Millisecond) // the batch is recorded after the handler returns
+			return n
+		case <-time.After(time.Second):
+			t.Fatal("Expected a batch")
+			return 0
+		}
+	}
+
+	t.Run("A running queue is healthy and ready", func(t *testing.T) {
+		q.Append(payloadqueue.Payload{Id: "1"})
+		wait()
+		h := q.Health()
+		if q.Healthy() != nil || q.Ready() != nil || h.Breaker != payloadqueue.BreakerClosed || !h.LastSuccess.Equal(clock.Now()) {
+			t.Errorf("Unexpected health: %+v", h)
+		}
+	})
+
+	t.Run("The breaker opens after the failed batches", func(t *testing.T) {
+		failing.Store(true)
+		q.Append(payloadqueue.Payload{Id: "2"})
+		wait()
+		if h := q.Health(); h.ConsecutiveFailures != 1 || h.Breaker != payloadqueue.BreakerClosed {
+			t.Errorf("Expected the breaker to stay closed after 1 failure, got %+v", h)
+		}
+		q.Append(payloadqueue.Payload{Id: "3"})
+		wait()
+		if err := q.Ready(); !errors.Is(err, payloadqueue.ErrNotReady) {
+			t.Errorf("Expected the queue not to be ready, got %v", err)
+		}
+		if err := q.Healthy(); err != nil {
+			t.Errorf("Expected the queue to stay healthy, got %v", err)
+		}
+		q.Append(payloadqueue.Payload{Id: "4"})
+		time.Sleep(50 * time.Millisecond)
+		if h := q.Health(); h.Breaker != payloadqueue.BreakerOpen || h.Depth != 1 {
+			t.Errorf("Expected the batch to be held, got %+v", h)
+		}
+	})
+
+	t.Run("The breaker closes once a batch is delivered after the cooldown", func(t *testing.T) {
+		failing.Store(false)
+		clock.Advance(time.Minute)
+		q.Append(payloadqueue.Payload{Id: "5"})
+		if n := wait() + wait(); n != 2 {
+			t.Errorf("Expected the held payload to be pushed, got %d payloads", n)
+		}
+		if h := q.Health(); h.Breaker != payloadqueue.BreakerClosed || h.ConsecutiveFailures != 0 || h.Depth != 0 {
+			t.Errorf("Unexpected health: %+v", h)
+		}
+	})
+
+	q.Close()
+	if err := q.Healthy(); !errors.Is(err, payloadqueue.ErrNotRunning) {
+		t.Errorf("Expected a closed queue to be unhealthy, got %v", err)
+	}
+}
+
+func TestQueueSub(t *testing.T) {
+	var runMutex sync.Mutex
+	batched := map[string][]interface{}{}
+	q := &payloadqueue.Queue{
+		MaxSize:     2,
+		MaxAge:      200,
+		Tag:         "QueueA",
+		Concurrency: 1,
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			batch, _ := payloadqueue.BatchFromContext(ctx)
+			runMutex.Lock()
+			batched[batch.Tag] = append(batched[batch.Tag], pls...)
+			runMutex.Unlock()
+			return nil
+		},
+	}
+	if _, err := q.Sub("emails"); !errors.Is(err, payloadqueue.ErrNotRunning) {
+		t.Errorf("Expected a queue that is not started to refuse a sub-queue, got %v", err)
+	}
+	q.Start()
+	events, cancel := q.Subscribe(payloadqueue.EventInfo)
+	defer cancel()
+	sub, err := q.Sub("emails", func(s *payloadqueue.Queue) { s.MaxSize = 3 })
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	t.Run("The sub-queue batches on its own triggers", func(t *testing.T) {
+		if sub.Tag != "QueueA.emails" || sub.MaxAge != 200 {
+			t.Errorf("Expected the sub-queue to inherit the MaxAge, got %s %d", sub.Tag, sub.MaxAge)
+		}
+		sub.Append(payloadqueue.Payload{Id: "1", Data: 1})
+		sub.Append(payloadqueue.Payload{Id: "2", Data: 2})
+		q.Append(payloadqueue.Payload{Id: "3", Data: 3})
+		q.Append(payloadqueue.Payload{Id: "4", Data: 4})
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched["QueueA"]) != 2 || len(batched["QueueA.emails"]) != 0 {
+			t.Errorf("Expected only the queue to cut a batch, got %v", batched)
+		}
+		runMutex.Unlock()
+		if sub.Size() != 2 || len(q.Subs()) != 1 {
+			t.Errorf("Expected the sub-queue to hold its payloads, got %d", sub.Size())
+		}
+	})
+
+	t.Run("The events of the sub-queue reach the subscribers of the queue", func(t *testing.T) {
+		for {
+			select {
+			case e := <-events:
+				if e.Tag == "QueueA.emails" {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected an event of the sub-queue")
+			}
+		}
+	})
+
+	t.Run("A sub-queue leaves the Concurrency it shares to its queue", func(t *testing.T) {
+		if err := sub.SetConcurrency(4); err == nil {
+			t.Errorf("Expected the sub-queue to refuse a Concurrency of its own")
+		}
+		if q.Concurrency != 1 {
+			t.Errorf("Expected the Concurrency of the queue unchanged, got %d", q.Concurrency)
+		}
+	})
+
+	t.Run("Closing the queue flushes and closes the sub-queue", func(t *testing.T) {
+		q.Close()
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if len(batched["QueueA.emails"]) != 2 {
+			t.Errorf("Expected the sub-queue to be flushed, got %v", batched)
+		}
+		if sub.Healthy() == nil || len(q.Subs()) != 0 {
+			t.Errorf("Expected the sub-queue to be closed")
+		}
+	})
+
+	t.Run("Closing a sub-queue its queue closed does nothing", func(t *testing.T) {
+		sub.Close()
+		q.Close()
+		if err := sub.Append(payloadqueue.Payload{Id: "5"}); !errors.Is(err, payloadqueue.ErrQueueClosed) {
+			t.Errorf("Expected the sub-queue to stay closed, got %v", err)
+		}
+	})
+
+	t.Run("A sub-queue of a Pull queue offers its batches to Receive on the queue", func(t *testing.T) {
+		q := &payloadqueue.Queue{MaxSize: 2, MaxAge: 200, Tag: "QueueA", Pull: true, WorkTimeout: time.Second}
+		q.Start()
+		defer q.Close()
+		sub, err := q.Sub("emails")
+		if err != nil || !sub.Pull {
+			t.Fatalf("Expected a Pull sub-queue, got %v", err)
+		}
+		sub.Append(payloadqueue.Payload{Id: "1", Data: 1})
+		sub.Append(payloadqueue.Payload{Id: "2", Data: 2})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		pls, ack := q.Receive(ctx, 10)
+		if len(pls) != 2 || pls[0].Id != "1" {
+			t.Fatalf("Expected the batch of the sub-queue received from the queue, got %v", pls)
+		}
+		outcome, stop := sub.Watch("1")
+		defer stop()
+		ack(nil)
+		select {
+		case o := <-outcome:
+			if !o.Delivered {
+				t.Errorf("Expected the payload acknowledged through the queue delivered, got %+v", o)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the batch of the sub-queue settled")
+		}
+	})
+}
+
+func TestQueueTooLarge(t *testing.T) {
+	var journal bytes.Buffer
+	var runMutex sync.Mutex
+	var batches [][]interface{}
+	q := &payloadqueue.Queue{
+		MaxSize: 5,
+		MaxAge:  200,
+		Tag:     "QueueA",
+		Journal: &journal,
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			if len(pls) > 2 {
+				return fmt.Errorf("413: %w", payloadqueue.ErrBatchTooLarge)
+			}
+			runMutex.Lock()
+			batches = append(batches, pls)
+			runMutex.Unlock()
+			return nil
+		},
+	}
+	q.Start()
+	defer q.Close()
+	for i := 1; i <= 5; i++ {
+		q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	t.Run("The batch is split until the handler accepts the chunks", func(t *testing.T) {
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if fmt.Sprint(batches) != "[[1 2] [3] [4 5]]" {
+			t.Errorf("Expected the chunks in order, got %v", batches)
+		}
+		if s := q.Stats(); s.Split != 2 || s.Delivered != 5 || s.Failed != 0 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+	})
+
+	t.Run("The split is recorded in the journal", func(t *testing.T) {
+		records, _ := payloadqueue.ReadJournal(&journal)
+		if len(records) != 5 {
+			t.Fatalf("Expected 5 records, got %+v", records)
+		}
+		id := records[0].Id
+		if !slices.Equal(records[0].SplitInto, []string{id + ".1", id + ".2"}) || records[0].Failed != nil {
+			t.Errorf("Expected the batch to be split in halves, got %+v", records[0])
+		}
+		if records[2].Id != id+".1.1" || records[2].SplitFrom != id+".1" || records[4].Id != id+".2" || records[4].Error != "" {
+			t.Errorf("Expected the chunks to be recorded, got %+v", records[2:])
+		}
+	})
+}
+
+func TestQueueShutdown(t *testing.T) {
+	t.Run("Shut down in phases", func(t *testing.T) {
+		release := make(chan struct{})
+		var runMutex sync.Mutex
+		var batched []interface{}
+		q := &payloadqueue.Queue{
+			MaxSize:     100,
+			MaxAge:      200,
+			Tag:         "QueueA",
+			Concurrency: 2,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				if pls[0] == "slow" {
+					<-release
+				}
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return nil
+			},
+		}
+		q.Start()
+		defer close(release)
+		q.Append(payloadqueue.Payload{Id: "slow", Data: "slow"})
+		q.Flush()
+		q.Append(payloadqueue.Payload{Id: "1", Data: "1"})
+		q.Append(payloadqueue.Payload{Id: "2", Data: "2"})
+		q.AppendAfter(payloadqueue.Payload{Id: "3", Data: "3"}, time.Hour)
+
+		r, err := q.Shutdown(context.Background(), payloadqueue.ShutdownPhases{Flush: time.Second, Wait: 50 * time.Millisecond})
+		if err == nil || !strings.Contains(err.Error(), "wait") {
+			t.Errorf("Expected the wait to end before the slow batch, got %v", err)
+		}
+		if r.Flushed != 2 || r.Abandoned != 1 || r.Dropped != 1 || r.Persisted != 0 {
+			t.Errorf("Unexpected report: %+v", r)
+		}
+		if len(r.Phases) != 4 || r.Phases[1].Name != "flush" || r.Phases[1].Err != nil || r.Phases[2].Err == nil {
+			t.Errorf("Unexpected phases: %+v", r.Phases)
+		}
+		runMutex.Lock()
+		if len(batched) != 2 {
+			t.Errorf("Expected the pending payloads flushed, got %v", batched)
+		}
+		runMutex.Unlock()
+		if err := q.Append(payloadqueue.Payload{Id: "4"}); !errors.Is(err, payloadqueue.ErrQueueClosed) {
+			t.Errorf("Expected the intake to be closed, got %v", err)
+		}
+	})
+
+	t.Run("Shutdown fails the blocked appenders and keeps the late retries", func(t *testing.T) {
+		release := make(chan struct{})
+		q := &payloadqueue.Queue{
+			MaxSize:    1,
+			MaxAge:     200,
+			MaxPending: 1,
+			MaxRetries: 1,
+			Overflow:   payloadqueue.OverflowBlock,
+			Tag:        "QueueA",
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				<-release
+				return errors.New("rejected")
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		appended := make(chan error)
+		go func() { appended <- q.Append(payloadqueue.Payload{Id: "2"}) }()
+		time.Sleep(20 * time.Millisecond)
+
+		r, _ := q.Shutdown(context.Background(), payloadqueue.ShutdownPhases{Wait: 20 * time.Millisecond})
+		select {
+		case err := <-appended:
+			if !errors.Is(err, payloadqueue.ErrQueueClosed) {
+				t.Errorf("Expected the blocked Append to fail with ErrQueueClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the blocked Append to return")
+		}
+		if r.Abandoned != 1 || r.Dropped != 0 {
+			t.Errorf("Unexpected report: %+v", r)
+		}
+		// a Close after the Shutdown does nothing
+		q.Close()
+		q.Close()
+
+		close(release)
+		time.Sleep(50 * time.Millisecond)
+		rec, _ := q.Reconcile(context.Background(), time.Now())
+		if q.Size() != 0 || rec.Dropped != 1 || rec.Outstanding != 0 {
+			t.Errorf("Expected the late retry dropped, got a size of %d and %+v", q.Size(), rec)
+		}
+	})
+
+	t.Run("Close waits for the batches being processed", func(t *testing.T) {
+		var delivered atomic.Bool
+		q := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				time.Sleep(50 * time.Millisecond)
+				delivered.Store(true)
+				return nil
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1"})
+		started := time.Now()
+		q.Close()
+		if !delivered.Load() || time.Since(started) > 500*time.Millisecond {
+			t.Errorf("Expected Close to return once the batch completed, took %s", time.Since(started))
+		}
+	})
+}
+
+func TestQueuePull(t *testing.T) {
+	var dead []payloadqueue.Payload
+	var deadMutex sync.Mutex
+	q := &payloadqueue.Queue{
+		MaxSize:     4,
+		MaxAge:      200,
+		Tag:         "QueueA",
+		Pull:        true,
+		WorkTimeout: 100 * time.Millisecond,
+		DeadLetter: func(pls []payloadqueue.Payload, err error) {
+			deadMutex.Lock()
+			dead = append(dead, pls...)
+			deadMutex.Unlock()
+		},
+	}
+	if err := q.Start(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer q.Close()
+
+	t.Run("Receive waits for a batch", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if pls, ack := q.Receive(ctx, 10); len(pls) != 0 || ack == nil {
+			t.Errorf("Expected no payloads once the context ended, got %v", pls)
+		}
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			for i := 1; i <= 4; i++ {
+				q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+			}
+		}()
+		pls, ack := q.Receive(context.Background(), 3)
+		if len(pls) != 3 || pls[0].Id != "1" {
+			t.Fatalf("Expected the first 3 payloads of the batch, got %v", pls)
+		}
+		ack(nil)
+		rest, ackRest := q.Receive(context.Background(), 3)
+		if len(rest) != 1 || rest[0].Id != "4" {
+			t.Fatalf("Expected the rest of the batch, got %v", rest)
+		}
+		ackRest(errors.New("the consumer failed"))
+		time.Sleep(20 * time.Millisecond)
+		if s := q.Stats(); s.Delivered != 3 || s.Failed != 1 || s.DeadLettered != 1 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+	})
+
+	t.Run("A batch that is not acknowledged in time fails", func(t *testing.T) {
+		for i := 5; i <= 8; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+		}
+		pls, ack := q.Receive(context.Background(), 10)
+		if len(pls) != 4 {
+			t.Fatalf("Expected the batch, got %v", pls)
+		}
+		time.Sleep(150 * time.Millisecond)
+		ack(nil)
+		deadMutex.Lock()
+		defer deadMutex.Unlock()
+		if len(dead) != 5 {
+			t.Errorf("Expected the batch to be dead-lettered, got %v", dead)
+		}
+	})
+
+	t.Run("A closed Pull queue starts again", func(t *testing.T) {
+		q.Close()
+		if err := q.Start(); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		q.Append(payloadqueue.Payload{Id: "9", Data: 9})
+		q.Flush()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		pls, ack := q.Receive(ctx, 10)
+		if len(pls) != 1 || pls[0].Id != "9" {
+			t.Fatalf("Expected the payload, got %v", pls)
+		}
+		ack(nil)
+		if err := q.SetWork(func(pls []interface{}) int { return 0 }); err == nil {
+			t.Errorf("Expected a Pull queue to refuse a Work function")
+		}
+	})
+
+	if err := (&payloadqueue.Queue{Pull: true, Work: func(pls []interface{}) int { return 0 }}).Start(); err == nil {
+		t.Errorf("Expected a Pull queue with a Work function to fail Start")
+	}
+}
+
+func TestQueueBatches(t *testing.T) {
+	q := &payloadqueue.Queue{
+		MaxSize:     3,
+		MaxAge:      200,
+		Tag:         "QueueA",
+		Pull:        true,
+		WorkTimeout: time.Second,
+		RetryDelay:  time.Millisecond,
+		MaxRetries:  1,
+	}
+	if err := q.Start(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer q.Close()
+	for i := 1; i <= 6; i++ {
+		q.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var seen []string
+	var rejected string
+	for b := range q.Batches(ctx) {
+		if len(b.Payloads) != 3 || b.Tag != "QueueA" {
+			t.Fatalf("Unexpected batch: %+v", b)
+		}
+		for _, p := range b.Payloads {
+			seen = append(seen, p.Id)
+		}
+		switch len(seen) {
+		case 3:
+			b.Ack()
+		case 6:
+			// the second payload of the second batch fails and is retried alone
+			rejected = b.Payloads[1].Id
+			b.Nack(&payloadqueue.BatchError{Results: []payloadqueue.PayloadResult{{Index: 1, Err: errors.New("rejected")}}})
+			b.Ack()
+		}
+		if len(seen) == 6 {
+			break
+		}
+	}
+	if slices.Sort(seen); strings.Join(seen, ",") != "1,2,3,4,5,6" {
+		t.Fatalf("Expected all the payloads, got %v", seen)
+	}
+	// the retry is cut once it is due, well before the MaxAge
+	time.Sleep(20 * time.Millisecond)
+	q.Flush()
+	retried := false
+	for b := range q.Batches(ctx) {
+		if len(b.Payloads) != 1 || b.Payloads[0].Id != rejected || b.Payloads[0].Attempts != 1 {
+			t.Fatalf("Expected the failed payload to be retried, got %+v", b.Payloads)
+		}
+		retried = true
+		b.Nack(nil)
+		break
+	}
+	if !retried {
+		t.Fatal("Expected the failed payload to be retried")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if s := q.Stats(); s.Delivered != 5 || s.Failed != 2 || s.Retried != 1 || s.DeadLettered != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+
+	b := &payloadqueue.Batch{}
+	b.Ack()
+	b.Nack(errors.New("ignored"))
+}
+
+func TestQueueTimeInQueue(t *testing.T) {
+	clock := queuetest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	events := &queuetest.EventRecorder{}
+	done := make(chan struct{}, 10)
+	q := &payloadqueue.Queue{
+		MaxSize:        2,
+		MaxAge:         200,
+		Tag:            "QueueA",
+		Clock:          clock,
+		TimeInQueueSLO: time.Second,
+		SLOWindow:      time.Second,
+		EventFeed:      events.Feed,
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			clock.Advance(100 * time.Millisecond)
+			done <- struct{}{}
+			return nil
+		},
+	}
+	q.Start()
+	defer q.Close()
+	batch := func(waited time.Duration) {
+		q.Append(q.NewPayload(1))
+		clock.Advance(waited)
+		q.Append(q.NewPayload(2))
+		select {
+		case <-done:
+			time.Sleep(10 * time.Millisecond) // the batch is recorded after the handler returns
+		case <-time.After(time.Second):
+			t.Fatal("Expected a batch")
+		}
+	}
+
+	batch(3 * time.Second)
+	s := q.Stats()
+	if s.TimeInQueue.Count != 2 || s.TimeInQueue.Sum != 3*time.Second || s.TimeInQueue.Counts[0] != 1 {
+		t.Errorf("Unexpected time in queue: %+v", s.TimeInQueue)
+	}
+	if s.BatchLatency.Count != 1 || s.BatchLatency.Mean() != 100*time.Millisecond {
+		t.Errorf("Unexpected batch latency: %+v", s.BatchLatency)
+	}
+	if p := s.TimeInQueue.Quantile(0.99); p <= 2500*time.Millisecond || p > 5*time.Second {
+		t.Errorf("Expected the p99 in the bucket of 3s, got %s", p)
+	}
+	if events.Contains("exceeds the SLO") {
+		t.Errorf("Expected no alert before the SLOWindow passed")
+	}
+
+	batch(5 * time.Second)
+	events.WaitForEvent(t, "exceeds the SLO of 1s", time.Second)
+	clock.Advance(time.Second)
+	batch(0)
+	events.WaitForEvent(t, "back within the SLO", time.Second)
+
+	if (payloadqueue.Histogram{}).Quantile(0.99) != 0 || len(payloadqueue.HistogramBounds()) != len(s.TimeInQueue.Counts)-1 {
+		t.Errorf("Unexpected empty histogram")
+	}
+}
+
+func TestQueueTimeInQueueOverLastBound(t *testing.T) {
+	clock := queuetest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	events := &queuetest.EventRecorder{}
+	done := make(chan struct{}, 10)
+	q := &payloadqueue.Queue{
+		MaxSize:        2,
+		MaxAge:         200,
+		Tag:            "QueueA",
+		Clock:          clock,
+		TimeInQueueSLO: 2 * time.Minute,
+		SLOWindow:      time.Second,
+		EventFeed:      events.Feed,
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			done <- struct{}{}
+			return nil
+		},
+	}
+	q.Start()
+	defer q.Close()
+	for i := 0; i < 2; i++ {
+		q.Append(q.NewPayload(1))
+		clock.Advance(3 * time.Minute)
+		q.Append(q.NewPayload(2))
+		select {
+		case <-done:
+			time.Sleep(10 * time.Millisecond)
+		case <-time.After(time.Second):
+			t.Fatal("Expected a batch")
+		}
+	}
+	s := q.Stats()
+	if p := s.TimeInQueue.Quantile(0.99); s.TimeInQueue.Max != 3*time.Minute || p <= 2*time.Minute || p > 3*time.Minute {
+		t.Errorf("Expected the p99 above the last bound, up to the max, got %s of %+v", p, s.TimeInQueue)
+	}
+	events.WaitForEvent(t, "exceeds the SLO of 2m0s", time.Second)
+}
+
+func TestQueueTenants(t *testing.T) {
+	var runMutex sync.Mutex
+	var batches [][]string
+	q := &payloadqueue.Queue{
+		MaxSize:       4,
+		MaxAge:        200,
+		Tag:           "QueueA",
+		TenantKey:     func(p payloadqueue.Payload) string { return p.Headers["tenant"] },
+		TenantLimit:   6,
+		TenantLimits:  map[string]int{"small": 1},
+		TenantWeights: map[string]int{"gold": 2},
+		Concurrency:   1,
+		WorkContext: func(ctx context.Context, pls []interface{}) error {
+			b, _ := payloadqueue.BatchFromContext(ctx)
+			var tenants []string
+			for _, p := range b.Payloads {
+				tenants = append(tenants, p.Headers["tenant"])
+			}
+			runMutex.Lock()
+			batches = append(batches, tenants)
+			runMutex.Unlock()
+			return nil
+		},
+	}
+	q.Start()
+	defer q.Close()
+	payload := func(id, tenant string) payloadqueue.Payload {
+		return payloadqueue.Payload{Id: id, Data: id, Headers: map[string]string{"tenant": tenant}}
+	}
+
+	t.Run("A tenant is held to its limit", func(t *testing.T) {
+		q.Pause()
+		if err := q.Append(payload("s1", "small")); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		err := q.Append(payload("s2", "small"))
+		var quota *payloadqueue.QuotaError
+		if !errors.As(err, &quota) || quota.Tenant != "small" || quota.Limit != 1 || !errors.Is(err, payloadqueue.ErrTenantQuota) || !errors.Is(err, payloadqueue.ErrQueueFull) {
+			t.Errorf("Expected a QuotaError for the small tenant, got %v", err)
+		}
+		for i := 1; i <= 7; i++ {
+			err = q.Append(payload("n"+strconv.Itoa(i), "noisy"))
+		}
+		if !errors.Is(err, payloadqueue.ErrTenantQuota) {
+			t.Errorf("Expected the 7th payload of the noisy tenant to be refused, got %v", err)
+		}
+		for i := 1; i <= 3; i++ {
+			q.Append(payload("g"+strconv.Itoa(i), "gold"))
+		}
+		if got := q.Tenants(); got["small"] != 1 || got["noisy"] != 6 || got["gold"] != 3 {
+			t.Errorf("Unexpected pending payloads per tenant: %v", got)
+		}
+		if s := q.Stats(); s.OverQuota != 2 {
+			t.Errorf("Expected 2 payloads over quota, got %d", s.OverQuota)
+		}
+	})
+
+	t.Run("The tenants share out the batches", func(t *testing.T) {
+		q.Resume()
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		got := make([]string, len(batches))
+		for i, b := range batches {
+			got[i] = strings.Join(b, ",")
+		}
+		// the batches may be processed in any order
+		want := []string{"noisy,gold,noisy,noisy", "noisy,noisy", "small,noisy,gold,gold"}
+		if slices.Sort(got); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("Expected the batches %v, got %v", want, got)
+		}
+		if len(q.Tenants()) != 0 {
+			t.Errorf("Expected no pending payloads left, got %v", q.Tenants())
+		}
+	})
+}
+
+func TestQueueTenantQuota(t *testing.T) {
+	payload := func(id string) payloadqueue.Payload {
+		return payloadqueue.Payload{Id: id, Data: id, Headers: map[string]string{"tenant": "acme"}}
+	}
+	tenantKey := func(p payloadqueue.Payload) string { return p.Headers["tenant"] }
+
+	t.Run("Concurrent appends never take a tenant past its limit", func(t *testing.T) {
+		q := &payloadqueue.Queue{
+			MaxSize:     100,
+			MaxAge:      60000,
+			TenantKey:   tenantKey,
+			TenantLimit: 5,
+			// widens the window between the quota and the payloads being queued
+			OnAppend: func(payloadqueue.Payload) { time.Sleep(time.Millisecond) },
+			Work:     func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		defer q.Close()
+		var accepted atomic.Int64
+		var wg sync.WaitGroup
+		for i := range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if q.Append(payload(strconv.Itoa(i))) == nil {
+					accepted.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if accepted.Load() != 5 || q.Tenants()["acme"] != 5 {
+			t.Errorf("Expected 5 payloads accepted and held, got %d and %v", accepted.Load(), q.Tenants())
+		}
+	})
+
+	t.Run("Delayed payloads and batches not yet completed count against the limit", func(t *testing.T) {
+		release := make(chan struct{})
+		q := &payloadqueue.Queue{
+			MaxSize:     2,
+			MaxAge:      60000,
+			TenantKey:   tenantKey,
+			TenantLimit: 3,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				<-release
+				return nil
+			},
+		}
+		q.Start()
+		defer q.Close()
+		q.Append(payload("1"))
+		q.Append(payload("2"))
+		later := payload("3")
+		later.NotBefore = time.Now().Add(time.Hour)
+		if err := q.Append(later); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err := q.Append(payload("4")); !errors.Is(err, payloadqueue.ErrTenantQuota) {
+			t.Errorf("Expected the tenant to be over its quota, got %v", err)
+		}
+		if got := q.Tenants()["acme"]; got != 3 {
+			t.Errorf("Expected 3 payloads held, got %d", got)
+		}
+		close(release)
+		time.Sleep(20 * time.Millisecond)
+		if err := q.Append(payload("5")); err != nil {
+			t.Errorf("Expected room once the batch completed, got %v", err)
+		}
+	})
+}
+
+func BenchmarkQueueAppend(b *testing.B) {
+	bench := func(b *testing.B, q *payloadqueue.Queue) {
+		q.MaxSize, q.MaxAge, q.Tag = 1000, 200, "QueueA"
+		q.Work = func(pls []interface{}) int { return 0 }
+		q.Start()
+		defer q.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				q.Append(q.NewPayload(1))
+			}
+		})
+	}
+	b.Run("Random ids", func(b *testing.B) {
+		bench(b, &payloadqueue.Queue{})
+	})
+	b.Run("Sequential ids", func(b *testing.B) {
+		bench(b, &payloadqueue.Queue{SequentialIds: true})
+	})
+	b.Run("Sequential ids with a Logger at info", func(b *testing.B) {
+		logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		bench(b, &payloadqueue.Queue{SequentialIds: true, Logger: logger})
+	})
+	// the baseline of the lazy events: at debug every event is formatted
+	b.Run("Sequential ids with a Logger at debug", func(b *testing.B) {
+		logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		bench(b, &payloadqueue.Queue{SequentialIds: true, Logger: logger})
+	})
+	// the payloads are taken InputBatch at a time under the lock, against one per Append above
+	b.Run("Sequential ids through the Input", func(b *testing.B) {
+		q := &payloadqueue.Queue{MaxSize: 1000, MaxAge: 200, Tag: "QueueA", SequentialIds: true}
+		q.Work = func(pls []interface{}) int { return 0 }
+		q.Start()
+		defer q.Close()
+		in := q.Input()
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				in <- q.NewPayload(1)
+			}
+		})
+	})
+}
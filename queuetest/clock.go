@@ -0,0 +1,154 @@
+// Package queuetest helps to test code built on payloadqueue deterministically. Its Clock replaces
+// real time in a Queue, so batch windows, delays and expiries can be stepped through without real
+// sleeps:
+//
+//	clock := queuetest.NewClock(time.Now())
+//	q := &payloadqueue.Queue{MaxAge: 10, Clock: clock, Work: work}
+//	q.Start()
+//	q.Append(p)
+//	clock.BlockUntil(1)             // the queue is waiting on its batch window
+//	clock.Advance(10 * time.Second) // the window closes and the batch is pushed
+//
+// Its Recorder captures the pushed batches and its EventRecorder the events, with helpers that wait
+// for them, and Flush pushes the pending payloads and waits for the batches to complete.
+package queuetest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Clock to tell a fake time that only moves on Advance, Set or Jump. It is a MonotonicClock: Advance
+// and Set move the wall and the monotonic time together, Jump only the wall time. It is safe for
+// concurrent use.
+type Clock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	elapsed time.Duration // the fake monotonic time
+	timers  []*timer
+	armed   chan struct{} // signalled whenever a timer is created, see BlockUntil
+}
+
+// NewClock to return a Clock that starts at the time
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start, armed: make(chan struct{}, 1)}
+}
+
+// Now to return the fake time
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Elapsed to return the fake monotonic time elapsed since the Clock was created
+func (c *Clock) Elapsed() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.elapsed
+}
+
+// NewTimer to return a Timer that fires once the fake time has moved by d
+func (c *Clock) NewTimer(d time.Duration) plq.Timer {
+	c.mutex.Lock()
+	t := &timer{clock: c, at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	c.mutex.Unlock()
+	select {
+	case c.armed <- struct{}{}:
+	default:
+	}
+	return t
+}
+
+// After to return a channel that receives the fake time once it has moved by d
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance to move the fake time by d, firing the timers that fall due in the order of their time
+func (c *Clock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set to move the fake time to t, firing the timers that fall due. Time never moves backwards.
+func (c *Clock) Set(t time.Time) {
+	c.mutex.Lock()
+	if t.After(c.now) {
+		c.elapsed += t.Sub(c.now)
+		c.now = t
+	}
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+	var due []*timer
+	for len(c.timers) > 0 && !c.timers[0].at.After(c.now) {
+		due = append(due, c.timers[0])
+		c.timers = c.timers[1:]
+	}
+	now := c.now
+	c.mutex.Unlock()
+	for _, t := range due {
+		t.ch <- now
+	}
+}
+
+// Jump to move the wall time by d, forwards or backwards, without moving the monotonic time, as an
+// NTP correction or a resumed VM does. No timer fires: they keep to the monotonic time, so the ones
+// waiting move along.
+func (c *Clock) Jump(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		t.at = t.at.Add(d)
+	}
+	c.mutex.Unlock()
+}
+
+// Timers to return the number of timers waiting to fire
+func (c *Clock) Timers() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil to wait until at least n timers are waiting to fire, e.g. until a Queue has armed
+// the timer of its batch window after an Advance, so the next Advance is not missed
+func (c *Clock) BlockUntil(n int) {
+	for c.Timers() < n {
+		select {
+		case <-c.armed:
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// timer of the Clock
+type timer struct {
+	clock *Clock
+	at    time.Time
+	ch    chan time.Time
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop to prevent the timer from firing, reporting whether it was waiting to
+func (t *timer) Stop() bool {
+	c := t.clock
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package queuetest_test
+
+import (
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/queuetest"
+)
+
+func TestClock(t *testing.T) {
+	t.Run("The batch window closes on the fake time", func(t *testing.T) {
+		clock := queuetest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		batches := make(chan []interface{}, 1)
+		q := &plq.Queue{
+			MaxSize: 100,
+			MaxAge:  10,
+			Tag:     "QueueA",
+			Clock:   clock,
+			Work: func(pls []interface{}) int {
+				batches <- pls
+				return 0
+			},
+		}
+		q.Start()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		clock.BlockUntil(1)
+		clock.Advance(9 * time.Second)
+		clock.BlockUntil(1)
+		select {
+		case pls := <-batches:
+			t.Fatalf("Expected no batch before the MaxAge, got %v", pls)
+		case <-time.After(20 * time.Millisecond):
+		}
+		clock.Advance(time.Second)
+		select {
+		case pls := <-batches:
+			if len(pls) != 1 {
+				t.Errorf("Expected a batch of 1, got %v", pls)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the batch once the MaxAge passed")
+		}
+		q.Close()
+	})
+
+	t.Run("Delayed payloads become due on the fake time", func(t *testing.T) {
+		clock := queuetest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		q := &plq.Queue{
+			MaxSize: 100,
+			MaxAge:  3600,
+			Tag:     "QueueA",
+			Clock:   clock,
+			Work:    func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		q.AppendAfter(plq.Payload{Id: "1"}, time.Minute)
+		clock.BlockUntil(1)
+		if s := q.Stats(); s.Delayed != 1 {
+			t.Errorf("Expected the payload delayed, got %+v", s)
+		}
+		clock.Advance(time.Minute)
+		for i := 0; i < 100 && q.Stats().Pending != 1; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if s := q.Stats(); s.Delayed != 0 || s.Pending != 1 {
+			t.Errorf("Expected the payload due, got %+v", s)
+		}
+		q.Close()
+	})
+
+	t.Run("A wall-clock jump does not move the batch window and is reported", func(t *testing.T) {
+		clock := queuetest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		rec := &queuetest.Recorder{}
+		events := &queuetest.EventRecorder{}
+		q := &plq.Queue{
+			MaxSize:     100,
+			MaxAge:      10,
+			Tag:         "QueueA",
+			Clock:       clock,
+			WorkContext: rec.Work,
+			EventFeed:   events.Feed,
+		}
+		q.Start()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		clock.BlockUntil(1)
+		clock.Jump(time.Hour)
+		q.Append(plq.Payload{Id: "2", Data: "b"})
+		if n := len(rec.Batches()); n != 0 {
+			t.Fatalf("Expected the window open after the jump, got %d batches", n)
+		}
+		clock.Advance(10 * time.Second)
+		rec.WaitForBatches(t, 1, time.Second)
+		events.WaitForEvent(t, "Wall clock jumped by 1h0m0s", time.Second)
+		q.Close()
+	})
+
+	t.Run("Stopped timers do not fire", func(t *testing.T) {
+		clock := queuetest.NewClock(time.Now())
+		timer := clock.NewTimer(time.Second)
+		fired := clock.After(2 * time.Second)
+		if !timer.Stop() || timer.Stop() {
+			t.Errorf("Expected the timer stopped once")
+		}
+		clock.Advance(2 * time.Second)
+		select {
+		case <-timer.C():
+			t.Errorf("Expected the stopped timer not to fire")
+		default:
+		}
+		if at := <-fired; !at.Equal(clock.Now()) {
+			t.Errorf("Expected After to receive the fake time, got %s", at)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package queuetest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Batch to hold a batch captured by a Recorder
+type Batch struct {
+	Id       string
+	Tag      string
+	Payloads []plq.Payload // the payloads of the batch with their Ids and Headers
+	Data     []interface{} // the Data the handler received
+	Err      error         // what the handler returned
+}
+
+// Recorder to capture the batches pushed to its Work handler, so tests can wait for them instead
+// of sleeping. It is safe for concurrent use.
+//
+//	rec := &queuetest.Recorder{}
+//	q := &payloadqueue.Queue{MaxSize: 2, WorkContext: rec.Work}
+//	q.Start()
+//	q.Append(p1)
+//	q.Append(p2)
+//	batches := rec.WaitForBatches(t, 1, time.Second)
+type Recorder struct {
+	Result  func(Batch) error // decides the outcome of each batch, e.g. to make some fail. Default is success
+	mutex   sync.Mutex
+	batches []Batch
+	changed chan struct{} // closed and replaced whenever a batch is recorded
+}
+
+// Work to record the batch, for the WorkContext of a Queue
+func (r *Recorder) Work(ctx context.Context, pls []interface{}) error {
+	b := Batch{Data: append([]interface{}(nil), pls...)}
+	if batch, ok := plq.BatchFromContext(ctx); ok {
+		b.Id, b.Tag = batch.Id, batch.Tag
+		b.Payloads = append([]plq.Payload(nil), batch.Payloads...)
+	}
+	if r.Result != nil {
+		b.Err = r.Result(b)
+	}
+	r.mutex.Lock()
+	r.batches = append(r.batches, b)
+	r.notify()
+	r.mutex.Unlock()
+	return b.Err
+}
+
+// Batches to return the batches recorded so far, in the order they were pushed
+func (r *Recorder) Batches() []Batch {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]Batch(nil), r.batches...)
+}
+
+// Data to return the Data of every recorded batch, in the order it was pushed
+func (r *Recorder) Data() []interface{} {
+	var data []interface{}
+	for _, b := range r.Batches() {
+		data = append(data, b.Data...)
+	}
+	return data
+}
+
+// Reset to forget the batches recorded so far
+func (r *Recorder) Reset() {
+	r.mutex.Lock()
+	r.batches = nil
+	r.mutex.Unlock()
+}
+
+// WaitForBatches to wait until at least n batches are recorded and return them. The test fails
+// if they are not recorded within the timeout.
+func (r *Recorder) WaitForBatches(t testing.TB, n int, timeout time.Duration) []Batch {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		r.mutex.Lock()
+		if len(r.batches) >= n {
+			batches := append([]Batch(nil), r.batches...)
+			r.mutex.Unlock()
+			return batches
+		}
+		changed := r.wait()
+		got := len(r.batches)
+		r.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("queuetest: expected %d batches within %s, got %d", n, timeout, got)
+			return nil
+		}
+	}
+}
+
+// wait to return the channel closed on the next change, under the mutex
+func (r *Recorder) wait() chan struct{} {
+	if r.changed == nil {
+		r.changed = make(chan struct{})
+	}
+	return r.changed
+}
+
+// notify to wake the waiters, under the mutex
+func (r *Recorder) notify() {
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+}
+
+// EventRecorder to capture the events of a Queue in memory. Its Feed is the EventFeed of the
+// Queue. It is safe for concurrent use.
+type EventRecorder struct {
+	mutex   sync.Mutex
+	events  []string
+	changed chan struct{} // closed and replaced whenever an event is recorded
+}
+
+// Feed to record the event, for the EventFeed of a Queue
+func (r *EventRecorder) Feed(e string) {
+	r.mutex.Lock()
+	r.events = append(r.events, e)
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+	r.mutex.Unlock()
+}
+
+// Events to return the events recorded so far
+func (r *EventRecorder) Events() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+// Contains to report whether an event containing the text was recorded
+func (r *EventRecorder) Contains(text string) bool {
+	return r.find(text) != ""
+}
+
+// WaitForEvent to wait until an event containing the text is recorded and return it. The test
+// fails if it is not recorded within the timeout.
+func (r *EventRecorder) WaitForEvent(t testing.TB, text string, timeout time.Duration) string {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		r.mutex.Lock()
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed := r.changed
+		r.mutex.Unlock()
+		if e := r.find(text); e != "" {
+			return e
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			t.Fatalf("queuetest: expected an event containing %q within %s", text, timeout)
+			return ""
+		}
+	}
+}
+
+// find to return the first event containing the text
+func (r *EventRecorder) find(text string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, e := range r.events {
+		if strings.Contains(e, text) {
+			return e
+		}
+	}
+	return ""
+}
+
+// Flush to flush the queue and wait until it holds no pending payloads and no batch is being
+// processed, so the outcome of the flushed batches can be asserted straight away. Payloads waiting
+// on a retry delay are not waited for. The test fails if the queue does not settle within the
+// timeout.
+func Flush(t testing.TB, q *plq.Queue, timeout time.Duration) {
+	t.Helper()
+	q.Flush()
+	deadline := time.Now().Add(timeout)
+	for {
+		s := q.Stats()
+		if s.Pending == 0 && s.ActiveWork == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queuetest: queue %s did not settle within %s, %d pending and %d batches active", s.Tag, timeout, s.Pending, s.ActiveWork)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
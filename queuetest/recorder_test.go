@@ -0,0 +1,71 @@
+package queuetest_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/queuetest"
+)
+
+func TestRecorder(t *testing.T) {
+	t.Run("WaitForBatches returns the recorded batches", func(t *testing.T) {
+		rec := &queuetest.Recorder{}
+		q := &plq.Queue{MaxSize: 2, MaxAge: 200, Tag: "QueueA", WorkContext: rec.Work}
+		q.Start()
+		defer q.Close()
+		q.Append(plq.Payload{Id: "1", Data: "a", Headers: map[string]string{"tenant": "acme"}})
+		q.Append(plq.Payload{Id: "2", Data: "b"})
+		batches := rec.WaitForBatches(t, 1, time.Second)
+		b := batches[0]
+		if b.Tag != "QueueA" || b.Id == "" || len(b.Data) != 2 || b.Payloads[0].Headers["tenant"] != "acme" {
+			t.Errorf("Unexpected batch: %+v", b)
+		}
+	})
+
+	t.Run("Result decides the outcome of the batch", func(t *testing.T) {
+		rec := &queuetest.Recorder{Result: func(b queuetest.Batch) error {
+			if b.Data[0] == "fail" {
+				return errors.New("sink down")
+			}
+			return nil
+		}}
+		events := &queuetest.EventRecorder{}
+		q := &plq.Queue{MaxSize: 100, MaxAge: 200, Tag: "QueueA", WorkContext: rec.Work, EventFeed: events.Feed}
+		q.Start()
+		defer q.Close()
+		q.Append(plq.Payload{Id: "1", Data: "fail"})
+		queuetest.Flush(t, q, time.Second)
+		if s := q.Stats(); s.Failed != 1 || s.DeadLettered != 1 {
+			t.Errorf("Expected the batch to fail, got %+v", s)
+		}
+		if e := events.WaitForEvent(t, "Discarded 1 failed payloads", time.Second); e == "" {
+			t.Error("Expected the discarded event")
+		}
+		if !events.Contains("Flush requested") {
+			t.Errorf("Expected the flush event, got %v", events.Events())
+		}
+	})
+
+	t.Run("Flush waits for the batches to complete", func(t *testing.T) {
+		rec := &queuetest.Recorder{}
+		q := &plq.Queue{MaxSize: 2, MaxAge: 200, Tag: "QueueA", WorkContext: rec.Work}
+		q.Start()
+		defer q.Close()
+		for _, id := range []string{"1", "2", "3", "4", "5"} {
+			q.Append(plq.Payload{Id: id, Data: id})
+		}
+		queuetest.Flush(t, q, time.Second)
+		if data := rec.Data(); len(data) != 5 {
+			t.Errorf("Expected 5 payloads delivered, got %v", data)
+		}
+		if s := q.Stats(); s.Delivered != 5 {
+			t.Errorf("Expected 5 payloads delivered, got %+v", s)
+		}
+		rec.Reset()
+		if len(rec.Batches()) != 0 {
+			t.Error("Expected the batches to be forgotten")
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -22,8 +23,8 @@ type RateQueue struct {
 	payloadQueue      []Payload
 	payloadChan       chan Payload
 	quitChan          chan bool
-	delay             time.Duration
-	active            bool
+	delay             atomic.Int64 // time.Duration between two pushes
+	active            atomic.Bool
 }
 
 // Start to open the queue to receive payload to batch
@@ -34,7 +35,7 @@ func (q *RateQueue) Start() error {
 	if q.Work == nil {
 		return errors.New("the Work function is not supplied")
 	}
-	q.delay = time.Duration(1000/q.RequestsPerSecond) * time.Millisecond
+	q.delay.Store(int64(time.Duration(1000/q.RequestsPerSecond) * time.Millisecond))
 	if q.MaxSize == 0 {
 		q.MaxSize = 100000
 		q.event("MaxSize: Default value of 100 was used")
@@ -51,7 +52,7 @@ func (q *RateQueue) Start() error {
 	go func() {
 		// Check for the max age
 		for {
-			time.Sleep(q.delay)
+			time.Sleep(time.Duration(q.delay.Load()))
 			q.RunNext()
 		}
 	}()
@@ -71,11 +72,11 @@ func (q *RateQueue) Start() error {
 		}
 	}()
 	q.event("RateQueue: Started")
-	q.active = true
+	q.active.Store(true)
 	return nil
 }
 
-func (q RateQueue) NewPayload(pl interface{}) Payload {
+func (q *RateQueue) NewPayload(pl interface{}) Payload {
 	if pl == nil {
 		return Payload{
 			Id:   "",
@@ -91,12 +92,16 @@ func (q RateQueue) NewPayload(pl interface{}) Payload {
 
 // Run to push the Batch for processing
 func (q *RateQueue) RunNext() {
-	if len(q.payloadQueue) < 1 || !q.active {
+	if !q.active.Load() {
 		return
 	}
 	var pl Payload
 
 	q.payloadMutex.Lock()
+	if len(q.payloadQueue) < 1 {
+		q.payloadMutex.Unlock()
+		return
+	}
 	pl, q.payloadQueue = q.payloadQueue[0], q.payloadQueue[1:]
 	q.payloadMutex.Unlock()
 	go q.event("Pushed [" + pl.Id + "] @ " + time.Now().UTC().String() + ". Result: " + strconv.Itoa(q.Work(pl.Data)))
@@ -107,15 +112,18 @@ func (q *RateQueue) Append(p Payload) error {
 
 	// Check the conditions for firing the Work()
 	// 1. Queue is full
+	q.payloadMutex.Lock()
 	if len(q.payloadQueue) >= q.MaxSize {
+		q.payloadMutex.Unlock()
 		q.event("Payload " + p.Id + " failed. RateQueue is full")
 		return errors.New("Payload " + p.Id + " failed. RateQueue is full. Try again later")
 	}
 	// Add to the queue
 	if p.Id != "" {
-		q.payloadMutex.Lock()
 		q.payloadQueue = append(q.payloadQueue, p)
-		q.payloadMutex.Unlock()
+	}
+	q.payloadMutex.Unlock()
+	if p.Id != "" {
 		q.event("Payload Queued [id]: " + p.Id)
 	}
 	return nil
@@ -123,17 +131,19 @@ func (q *RateQueue) Append(p Payload) error {
 
 // Size to return the number of jobs in the queue.
 func (q *RateQueue) Size() int {
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
 	return len(q.payloadQueue)
 }
 
 // Pause to return the number of jobs in the queue.
 func (q *RateQueue) Pause() {
-	q.active = false
+	q.active.Store(false)
 }
 
 // Restart to return the number of jobs in the queue.
 func (q *RateQueue) Restart() {
-	q.active = true
+	q.active.Store(true)
 }
 
 // Close to close the channels and wait for Work funcs to quit the execution.
@@ -147,13 +157,13 @@ func (q *RateQueue) Close() {
 	}
 	if !q.DiscardOnClose {
 		// Flush all active routines to be completed
-		q.delay = 100000
-		fmt.Println("Pending Payloads in Queue: " + strconv.Itoa(len(q.payloadQueue)))
-		for len(q.payloadQueue) > 0 {
+		q.delay.Store(100000)
+		fmt.Println("Pending Payloads in Queue: " + strconv.Itoa(q.Size()))
+		for q.Size() > 0 {
 			q.RunNext()
 		}
 	}
-	q.active = false
+	q.active.Store(false)
 	q.event("Rate Queue: All Work completed")
 }
 
@@ -100,9 +100,11 @@ func TestRateQRunNext(t *testing.T) {
 		// Delay is important to be sure that the Work() goroutine has been called before the assertion
 		time.Sleep(2400 * time.Millisecond)
 		// Ensure that Run was triggered and the queue was reset
+		runMutex.Lock()
 		if runtimes != 2 {
 			t.Errorf("Expected runtimes to be 2, got %d", runtimes)
 		}
+		runMutex.Unlock()
 		if q.Size() != 2 {
 			t.Errorf("Expected q.Size() to be 2, got %d", q.Size())
 		}
@@ -217,15 +219,51 @@ func TestRateQPauseAndRestart(t *testing.T) {
 		q.Start()
 		q.Pause()
 		time.Sleep(2 * time.Second)
+		runMutex.Lock()
 		if runtimes > 0 {
 			t.Errorf("Pause Failed: Expected runtimes to be 0, got %d", runtimes)
 		}
+		runMutex.Unlock()
 		q.Restart()
 		time.Sleep(2 * time.Second)
 
+		runMutex.Lock()
 		if runtimes <= 3 {
 			t.Errorf("Expected runtimes to be > 2, got %d", runtimes)
 		}
+		runMutex.Unlock()
 		q.Close()
 	})
 }
+
+func TestRateQConcurrentAccess(t *testing.T) {
+	t.Run("Appends and reads from many goroutines are race-free", func(t *testing.T) {
+		q := &payloadqueue.RateQueue{
+			MaxSize:           1000,
+			RequestsPerSecond: 1000,
+			Tag:               "QueueA",
+			Work:              func(pls interface{}) int { return 0 },
+		}
+		q.Start()
+
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 25; i++ {
+					q.Append(payloadqueue.Payload{Id: "1"})
+					q.Size()
+					q.Pause()
+					q.Restart()
+				}
+			}()
+		}
+		wg.Wait()
+		q.Close()
+
+		if q.Size() != 0 {
+			t.Errorf("Expected q.Size() to be 0 after Close, got %d", q.Size())
+		}
+	})
+}
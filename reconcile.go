@@ -0,0 +1,266 @@
+package payloadqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ledgerFlush is how often the counts tallied by a Queue are added to its Ledger
+const ledgerFlush = time.Second
+
+// DailyCounts to count the payloads appended to a Queue on a day by how they left it
+type DailyCounts struct {
+	Appended  int64 `json:"appended"`  // payloads accepted by Append
+	Delivered int64 `json:"delivered"` // payloads in batches that succeeded
+	Failed    int64 `json:"failed"`    // payloads dead-lettered or discarded once their retries were used up
+	Dropped   int64 `json:"dropped"`   // payloads removed by Purge or Remove, or left out by the BatchTransformer
+	Expired   int64 `json:"expired"`   // payloads that passed their ExpiresAt in the queue
+}
+
+// add to add the other counts to these
+func (c *DailyCounts) add(o DailyCounts) {
+	c.Appended += o.Appended
+	c.Delivered += o.Delivered
+	c.Failed += o.Failed
+	c.Dropped += o.Dropped
+	c.Expired += o.Expired
+}
+
+// Reconciliation to account for the payloads appended to a Queue on a day, see Reconcile
+type Reconciliation struct {
+	Tag  string `json:"tag"`
+	Date string `json:"date"` // the day in UTC, as 2006-01-02
+	DailyCounts
+	// Outstanding is the number of appended payloads that were neither delivered, failed, dropped
+	// nor expired. It is the payloads still held by the queue; once the queue is drained, anything
+	// left is missing.
+	Outstanding int64 `json:"outstanding"`
+}
+
+// Ledger to keep the DailyCounts of queues, e.g. in a file or a database shared by the instances of
+// a queue, so that a Reconciliation covers restarts and every instance.
+type Ledger interface {
+	// Add adds the counts to the ones kept for the queue with the tag on the day, as 2006-01-02.
+	Add(ctx context.Context, tag string, day string, counts DailyCounts) error
+	// Counts returns the counts kept for the queue with the tag on the day, as 2006-01-02.
+	Counts(ctx context.Context, tag string, day string) (DailyCounts, error)
+}
+
+// Reconcile to report how the payloads appended on the day of the date (in UTC) left the queue,
+// from the counts kept by the Ledger. An outcome is counted on the day its payload was appended,
+// so the report of a past day balances once its payloads have all left the queue, including those
+// restored from a Storage or a Spill storage after a restart, as the Envelope keeps the time they
+// were appended. The default Ledger is in memory and starts empty with every run, so the reports
+// only cover restarts with a durable Ledger, such as a FileLedger with a Path. The counts the queue
+// has not yet added to the Ledger are added first.
+func (q *Queue) Reconcile(ctx context.Context, date time.Time) (Reconciliation, error) {
+	q.flushLedger()
+	day := date.UTC().Format(time.DateOnly)
+	c, err := q.ledger().Counts(ctx, q.Tag, day)
+	if err != nil {
+		return Reconciliation{Tag: q.Tag, Date: day}, err
+	}
+	return Reconciliation{
+		Tag:         q.Tag,
+		Date:        day,
+		DailyCounts: c,
+		Outstanding: c.Appended - c.Delivered - c.Failed - c.Dropped - c.Expired,
+	}, nil
+}
+
+// ledger to return the Ledger, an in-memory FileLedger unless one is supplied
+func (q *Queue) ledger() Ledger {
+	if q.Ledger != nil {
+		return q.Ledger
+	}
+	q.defaultLedger.Do(func() { q.memoryLedger = &FileLedger{} })
+	return q.memoryLedger
+}
+
+// ledgerCounts to hold the counts tallied by a Queue until they are added to its Ledger, so the
+// Ledger is written every ledgerFlush rather than for every batch
+type ledgerCounts struct {
+	mutex sync.Mutex
+	days  map[string]DailyCounts // counts by day, as 2006-01-02
+}
+
+// tally to add the payloads, by their Count, to the counts of the days they were appended on. The
+// counts are held in memory and added to the Ledger by flushLedger.
+func (q *Queue) tally(pls []Payload, count func(c *DailyCounts, n int64)) {
+	if len(pls) == 0 {
+		return
+	}
+	now := q.now()
+	// the payloads are nearly always from one day, so each day is only formatted once
+	type dayCount struct {
+		date time.Time
+		n    int64
+	}
+	var days []dayCount
+	for _, p := range pls {
+		at := p.appended
+		if at.IsZero() {
+			at = now
+		}
+		y, m, d := at.UTC().Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		i := slices.IndexFunc(days, func(t dayCount) bool { return t.date.Equal(date) })
+		if i < 0 {
+			i = len(days)
+			days = append(days, dayCount{date: date})
+		}
+		days[i].n += int64(max(p.Count, 1))
+	}
+	b := &q.ledgerCounts
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.days == nil {
+		b.days = make(map[string]DailyCounts)
+	}
+	for _, t := range days {
+		day := t.date.Format(time.DateOnly)
+		c := b.days[day]
+		count(&c, t.n)
+		b.days[day] = c
+	}
+}
+
+// flushLedger to add the counts tallied since the last flush to the Ledger. A Ledger that cannot be
+// reached does not block the queue; it is reported on the event feed and the counts are kept for
+// the next flush.
+func (q *Queue) flushLedger() {
+	b := &q.ledgerCounts
+	b.mutex.Lock()
+	days := b.days
+	b.days = nil
+	b.mutex.Unlock()
+	if len(days) == 0 {
+		return
+	}
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if q.Ledger != nil {
+		ctx, cancel = q.storageContext()
+	}
+	defer cancel()
+	failed := make(map[string]DailyCounts)
+	for day, c := range days {
+		if err := q.ledger().Add(ctx, q.Tag, day, c); err != nil {
+			failed[day] = c
+			q.event("Ledger: Add for " + day + " failed. " + err.Error())
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.days == nil {
+		b.days = make(map[string]DailyCounts)
+	}
+	for day, c := range failed {
+		kept := b.days[day]
+		kept.add(c)
+		b.days[day] = kept
+	}
+}
+
+// keepLedger to flush the tallied counts to the Ledger every ledgerFlush until the queue closes
+func (q *Queue) keepLedger(quit chan bool) {
+	ticker := time.NewTicker(ledgerFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.flushLedger()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// FileLedger to keep the DailyCounts of queues in a JSON file, rewritten on every change, for
+// queues of a single process. Without a Path the counts are kept in memory only.
+type FileLedger struct {
+	Path  string // the file the counts are kept in, created when missing
+	mutex sync.Mutex
+	days  map[string]map[string]DailyCounts // counts by tag and day, loaded from the Path on first use
+}
+
+// Add to add the counts to the ones kept for the queue with the tag on the day and save the file
+func (l *FileLedger) Add(ctx context.Context, tag string, day string, counts DailyCounts) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.load(); err != nil {
+		return err
+	}
+	if l.days[tag] == nil {
+		l.days[tag] = make(map[string]DailyCounts)
+	}
+	c := l.days[tag][day]
+	c.add(counts)
+	l.days[tag][day] = c
+	return l.save()
+}
+
+// Counts to return the counts kept for the queue with the tag on the day
+func (l *FileLedger) Counts(ctx context.Context, tag string, day string) (DailyCounts, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.load(); err != nil {
+		return DailyCounts{}, err
+	}
+	return l.days[tag][day], nil
+}
+
+// load to read the file once. The mutex must be held.
+func (l *FileLedger) load() error {
+	if l.days != nil {
+		return nil
+	}
+	days := make(map[string]map[string]DailyCounts)
+	if l.Path != "" {
+		b, err := os.ReadFile(l.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &days); err != nil {
+				return err
+			}
+		}
+	}
+	l.days = days
+	return nil
+}
+
+// save to replace the file with the counts, so a crash never leaves it half written. The mutex
+// must be held.
+func (l *FileLedger) save() error {
+	if l.Path == "" {
+		return nil
+	}
+	b, err := json.Marshal(l.days)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.Path), filepath.Base(l.Path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), l.Path)
+}
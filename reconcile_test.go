@@ -0,0 +1,124 @@
+package payloadqueue_test
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestQueueReconcile(t *testing.T) {
+	t.Run("Every appended payload is accounted for", func(t *testing.T) {
+		q := &payloadqueue.Queue{
+			MaxSize: 2,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work: func(pls []interface{}) int {
+				if pls[0] == "fail" {
+					return 1
+				}
+				return 0
+			},
+		}
+		q.Start()
+		q.Append(payloadqueue.Payload{Id: "1", Data: "ok"})
+		q.Append(payloadqueue.Payload{Id: "2", Data: "ok"})
+		q.Append(payloadqueue.Payload{Id: "3", Data: "fail"})
+		q.Append(payloadqueue.Payload{Id: "4", Data: "fail"})
+		q.Append(payloadqueue.Payload{Id: "5", Data: "ok", ExpiresAt: time.Now().Add(-time.Second)})
+		q.Append(payloadqueue.Payload{Id: "6", Data: "ok"}) // pushed alone, 5 has expired
+		q.Append(payloadqueue.Payload{Id: "7", Data: "ok"})
+		time.Sleep(50 * time.Millisecond)
+		q.Purge()
+		q.Append(payloadqueue.Payload{Id: "8", Data: "ok"})
+		time.Sleep(50 * time.Millisecond)
+
+		r, err := q.Reconcile(context.Background(), time.Now())
+		if err != nil {
+			t.Errorf("Reconcile had an error: %s", err.Error())
+		}
+		want := payloadqueue.DailyCounts{Appended: 8, Delivered: 3, Failed: 2, Dropped: 1, Expired: 1}
+		if r.DailyCounts != want || r.Outstanding != 1 || r.Tag != "QueueA" || r.Date != time.Now().UTC().Format(time.DateOnly) {
+			t.Errorf("Unexpected reconciliation: %+v", r)
+		}
+		q.Close()
+	})
+
+	t.Run("A FileLedger keeps the counts across restarts", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ledger.json")
+		for i := 0; i < 2; i++ {
+			q := &payloadqueue.Queue{
+				MaxSize: 1,
+				MaxAge:  200,
+				Tag:     "QueueA",
+				Work:    func(pls []interface{}) int { return 0 },
+				Ledger:  &payloadqueue.FileLedger{Path: path},
+			}
+			q.Start()
+			q.Append(payloadqueue.Payload{Id: "1"})
+			time.Sleep(50 * time.Millisecond)
+			q.Close()
+		}
+
+		q := &payloadqueue.Queue{Tag: "QueueA", Ledger: &payloadqueue.FileLedger{Path: path}}
+		r, err := q.Reconcile(context.Background(), time.Now())
+		if err != nil {
+			t.Errorf("Reconcile had an error: %s", err.Error())
+		}
+		if r.Appended != 2 || r.Delivered != 2 || r.Outstanding != 0 {
+			t.Errorf("Expected 2 payloads appended and delivered over the restarts, got %+v", r)
+		}
+		r, _ = q.Reconcile(context.Background(), time.Now().AddDate(0, 0, -1))
+		if r.Appended != 0 {
+			t.Errorf("Expected nothing counted the day before, got %+v", r)
+		}
+	})
+
+	t.Run("The counts are added to the Ledger in the background, not for every batch", func(t *testing.T) {
+		ledger := &countingLedger{FileLedger: &payloadqueue.FileLedger{}}
+		q := &payloadqueue.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Work:    func(pls []interface{}) int { return 0 },
+			Ledger:  ledger,
+		}
+		q.Start()
+		for i := 0; i < 50; i++ {
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(i)})
+		}
+		time.Sleep(50 * time.Millisecond)
+		if n := ledger.adds.Load(); n != 0 {
+			t.Errorf("Expected no Add before the flush, got %d", n)
+		}
+		r, err := q.Reconcile(context.Background(), time.Now())
+		if err != nil || r.Appended != 50 || r.Delivered != 50 {
+			t.Errorf("Expected Reconcile to add the pending counts first, got %+v and %v", r, err)
+		}
+		if n := ledger.adds.Load(); n != 1 {
+			t.Errorf("Expected the counts of the day added at once, got %d Adds", n)
+		}
+		q.Append(payloadqueue.Payload{Id: "last"})
+		time.Sleep(50 * time.Millisecond)
+		q.Close()
+		c, _ := ledger.Counts(context.Background(), "QueueA", time.Now().UTC().Format(time.DateOnly))
+		if c.Appended != 51 || c.Delivered != 51 {
+			t.Errorf("Expected Close to add the pending counts, got %+v", c)
+		}
+	})
+}
+
+// countingLedger to count the Adds to a FileLedger
+type countingLedger struct {
+	*payloadqueue.FileLedger
+	adds atomic.Int64
+}
+
+func (l *countingLedger) Add(ctx context.Context, tag string, day string, counts payloadqueue.DailyCounts) error {
+	l.adds.Add(1)
+	return l.FileLedger.Add(ctx, tag, day, counts)
+}
@@ -0,0 +1,103 @@
+package payloadqueue
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SetMaxSize to change the MaxSize while the queue is running. When the buffer already holds a
+// full batch at the new size, it is pushed straight away. With Pricing, the size stays bounded by
+// the cost optimizer.
+func (q *Queue) SetMaxSize(size int) error {
+	if size <= 0 {
+		return errors.New("the MaxSize must be positive")
+	}
+	q.payloadMutex.Lock()
+	old := q.MaxSize
+	q.MaxSize = size
+	q.payloadMutex.Unlock()
+	q.event("MaxSize: Changed from " + strconv.Itoa(old) + " to " + strconv.Itoa(size))
+	q.check("reconfigure")
+	return nil
+}
+
+// SetMaxAge to change the MaxAge, in seconds, while the queue is running, e.g. to widen the batch
+// window during a downstream slowdown. The open window is moved by the difference, so it closes
+// as if it had been opened with the new MaxAge, and the timer is rescheduled.
+func (q *Queue) SetMaxAge(age int) error {
+	if age <= 0 {
+		return errors.New("the MaxAge must be positive")
+	}
+	q.payloadMutex.Lock()
+	old := q.MaxAge
+	q.MaxAge = age
+	q.expires += time.Duration(age-old) * time.Second
+	q.window += time.Duration(age-old) * time.Second
+	q.payloadMutex.Unlock()
+	q.event("MaxAge: Changed from " + strconv.Itoa(old) + " to " + strconv.Itoa(age))
+	q.wake()
+	return nil
+}
+
+// SetConcurrency to change the number of batches processed at the same time while the queue is
+// running. Lowering it lets the batches already running finish; new batches wait until they are
+// under the new limit. A sub-queue shares the Concurrency of its queue, so it is changed there.
+func (q *Queue) SetConcurrency(n int) error {
+	if n <= 0 {
+		return errors.New("the Concurrency must be positive")
+	}
+	if q.parent != nil {
+		return errors.New("a sub-queue shares the Concurrency of its queue, change it there")
+	}
+	q.payloadMutex.Lock()
+	old := q.Concurrency
+	q.Concurrency = n
+	q.payloadMutex.Unlock()
+	if q.slots != nil {
+		q.slots.resize(n)
+	}
+	q.event("Concurrency: Changed from " + strconv.Itoa(old) + " to " + strconv.Itoa(n))
+	return nil
+}
+
+// workSlots to bound the batches processed at the same time by a limit that can change
+type workSlots struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	limit int
+	held  int
+}
+
+func newWorkSlots(limit int) *workSlots {
+	s := &workSlots{limit: limit}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// acquire to wait for a slot under the limit
+func (s *workSlots) acquire() {
+	s.mutex.Lock()
+	for s.held >= s.limit {
+		s.cond.Wait()
+	}
+	s.held++
+	s.mutex.Unlock()
+}
+
+// release to give the slot back
+func (s *workSlots) release() {
+	s.mutex.Lock()
+	s.held--
+	s.mutex.Unlock()
+	s.cond.Signal()
+}
+
+// resize to change the limit, waking the batches waiting for a slot when it is raised
+func (s *workSlots) resize(limit int) {
+	s.mutex.Lock()
+	s.limit = limit
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
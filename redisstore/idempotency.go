@@ -0,0 +1,41 @@
+// Package redisstore implements the payloadqueue extension points on Redis, so that several
+// instances of an application can share the state of a logical queue.
+package redisstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IdempotencyStore to claim payload keys with SET NX, so that a key is only claimed by the first
+// instance that appends it within the ttl.
+type IdempotencyStore struct {
+	Client redis.UniversalClient
+	Prefix string // prepended to every key. Default is "payloadqueue:idempotency:"
+}
+
+// Claim to record the key for the ttl, reporting false when it was already recorded.
+func (s *IdempotencyStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return s.Client.SetNX(ctx, s.prefix()+key, 1, ttl).Result()
+}
+
+// Recorded to report whether the key is recorded, without claiming it. It implements
+// payloadqueue.KeyLookup.
+func (s *IdempotencyStore) Recorded(ctx context.Context, key string) (bool, error) {
+	n, err := s.Client.Exists(ctx, s.prefix()+key).Result()
+	return n > 0, err
+}
+
+// Release to forget the key, so it can be claimed again. It implements payloadqueue.KeyReleaser.
+func (s *IdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.Client.Del(ctx, s.prefix()+key).Err()
+}
+
+func (s *IdempotencyStore) prefix() string {
+	if s.Prefix == "" {
+		return "payloadqueue:idempotency:"
+	}
+	return s.Prefix
+}
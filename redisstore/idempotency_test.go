@@ -0,0 +1,161 @@
+package redisstore_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/redisstore"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := &redisstore.IdempotencyStore{Client: client}
+
+	t.Run("Claim a key once", func(t *testing.T) {
+		ctx := context.Background()
+		if ok, err := store.Claim(ctx, "k1", time.Minute); !ok || err != nil {
+			t.Errorf("Expected the first claim to succeed, got %v %v", ok, err)
+		}
+		if ok, err := store.Claim(ctx, "k1", time.Minute); ok || err != nil {
+			t.Errorf("Expected the second claim to fail, got %v %v", ok, err)
+		}
+		mr.FastForward(2 * time.Minute)
+		if ok, _ := store.Claim(ctx, "k1", time.Minute); !ok {
+			t.Errorf("Expected the claim to succeed after the ttl")
+		}
+	})
+
+	t.Run("Two queues batch a shared payload once", func(t *testing.T) {
+		work := func(pls []interface{}) int { return 0 }
+		qa := &plq.Queue{Tag: "Shared", MaxSize: 10, MaxAge: 200, Work: work, Idempotency: store}
+		qb := &plq.Queue{Tag: "Shared", MaxSize: 10, MaxAge: 200, Work: work, Idempotency: store}
+		qa.Start()
+		qb.Start()
+		qa.Append(plq.Payload{Id: "order-1", Data: "a"})
+		qb.Append(plq.Payload{Id: "order-1", Data: "a"})
+		qb.Append(plq.Payload{Id: "order-2", Data: "b"})
+		if qa.Size() != 1 || qb.Size() != 1 {
+			t.Errorf("Expected 1 payload in each queue, got %d and %d", qa.Size(), qb.Size())
+		}
+		if qb.Stats().Duplicates != 1 {
+			t.Errorf("Expected 1 duplicate, got %d", qb.Stats().Duplicates)
+		}
+		qa.Close()
+		qb.Close()
+	})
+
+	t.Run("A payload key is dispatched once across a restart", func(t *testing.T) {
+		ctx := context.Background()
+		// bill-2 was delivered and bill-3 was in a batch when the previous instance crashed
+		store.Claim(ctx, "Billing:dispatch:bill-2", time.Minute)
+		store.Claim(ctx, "Billing:delivered:bill-2", time.Minute)
+		store.Claim(ctx, "Billing:dispatch:bill-3", time.Minute)
+
+		var runMutex sync.Mutex
+		var batched []interface{}
+		var dead []plq.Payload
+		var deadErr error
+		attempts := 0
+		q := &plq.Queue{
+			Tag:         "Billing",
+			MaxSize:     1,
+			MaxAge:      200,
+			MaxRetries:  1,
+			Idempotency: store,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				defer runMutex.Unlock()
+				if pls[0] == "4" && attempts == 0 {
+					attempts++
+					return 1
+				}
+				batched = append(batched, pls...)
+				return 0
+			},
+			DeadLetter: func(pls []plq.Payload, err error) {
+				runMutex.Lock()
+				dead, deadErr = append(dead, pls...), err
+				runMutex.Unlock()
+			},
+		}
+		q.Start()
+		for _, n := range []string{"1", "2", "3", "4"} {
+			q.Append(plq.Payload{Id: "p" + n, Data: n, IdempotencyKey: "bill-" + n})
+		}
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 2 || batched[0] != "1" || batched[1] != "4" {
+			t.Errorf("Expected bill-1 and the retried bill-4 delivered, got %v", batched)
+		}
+		if len(dead) != 1 || dead[0].Id != "p3" || !errors.Is(deadErr, plq.ErrUncertainDelivery) {
+			t.Errorf("Expected bill-3 dead-lettered as uncertain, got %v %v", dead, deadErr)
+		}
+		runMutex.Unlock()
+		if s := q.Stats(); s.Duplicates != 1 || s.DeadLettered != 1 {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+		if ok, _ := store.Recorded(ctx, "Billing:delivered:bill-4"); !ok {
+			t.Errorf("Expected bill-4 recorded as delivered")
+		}
+		q.Close()
+	})
+
+	t.Run("A retried payload is dispatched again when claimed back from the Storage", func(t *testing.T) {
+		storage := &redisstore.Storage{Client: client, Stream: "retries", Consumer: "a"}
+		failing := &plq.Queue{
+			Tag:         "Retries",
+			MaxSize:     1,
+			MaxAge:      200,
+			MaxRetries:  1,
+			RetryDelay:  time.Hour,
+			Idempotency: store,
+			Storage:     storage,
+			Work:        func(pls []interface{}) int { return 1 },
+		}
+		failing.Start()
+		failing.Append(plq.Payload{Id: "p1", Data: "1", IdempotencyKey: "retry-1"})
+		time.Sleep(50 * time.Millisecond)
+		// the instance goes away while the payload waits for its retry
+		failing.Close()
+
+		var runMutex sync.Mutex
+		var batched []interface{}
+		var dead []plq.Payload
+		q := &plq.Queue{
+			Tag:          "Retries",
+			MaxSize:      1,
+			MaxAge:       200,
+			Idempotency:  store,
+			Storage:      &redisstore.Storage{Client: client, Stream: "retries", Consumer: "b", ReclaimIdle: 10 * time.Millisecond},
+			PollInterval: 20 * time.Millisecond,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+			DeadLetter: func(pls []plq.Payload, err error) {
+				runMutex.Lock()
+				dead = append(dead, pls...)
+				runMutex.Unlock()
+			},
+		}
+		time.Sleep(20 * time.Millisecond)
+		q.Start()
+		defer q.Close()
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if len(batched) != 1 || batched[0] != "1" || len(dead) != 0 {
+			t.Errorf("Expected the retried payload delivered, got %v and dead %v", batched, dead)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Storage to persist the payloads of a Queue in a Redis stream, so several instances can share
+// one logical queue. Payloads are appended with XADD and claimed through a consumer group with
+// XREADGROUP; entries claimed by an instance that has not acknowledged them within ReclaimIdle
+// (e.g. because it crashed) are taken over with XAUTOCLAIM. Acknowledged entries are removed
+// from the stream.
+type Storage struct {
+	Client      redis.UniversalClient
+	Stream      string        // key of the stream. Default is "payloadqueue:payloads"
+	Group       string        // consumer group shared by the instances. Default is "payloadqueue"
+	Consumer    string        // name of this instance in the group. Default is the hostname with a random suffix
+	ReclaimIdle time.Duration // how long a claimed entry may stay unacknowledged. Default is 5 minutes. Keep it above MaxAge plus WorkTimeout
+	Codec       plq.Codec     // serializes the Data, encrypted by the Encryption of the queue when it has one. Default is the Codec of the queue
+	mutex       sync.Mutex
+	ready       bool
+	entries     map[string]string // payload id to the stream entry id of the claimed payloads
+}
+
+// Put to append the payloads to the stream
+func (s *Storage) Put(ctx context.Context, pls []plq.Payload) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	pipe := s.Client.Pipeline()
+	for _, p := range pls {
+		b, err := plq.EncodePayload(s.codec(ctx), p)
+		if err != nil {
+			return err
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: s.stream(), Values: map[string]interface{}{"id": p.Id, "payload": b}})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Claim to take over idle entries of other consumers first, then read new entries, up to max
+func (s *Storage) Claim(ctx context.Context, max int) ([]plq.Payload, error) {
+	if err := s.init(ctx); err != nil {
+		return nil, err
+	}
+	msgs, _, err := s.Client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   s.stream(),
+		Group:    s.group(),
+		Consumer: s.consumer(),
+		MinIdle:  s.reclaimIdle(),
+		Start:    "0-0",
+		Count:    int64(max),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) < max {
+		streams, err := s.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    s.group(),
+			Consumer: s.consumer(),
+			Streams:  []string{s.stream(), ">"},
+			Count:    int64(max - len(msgs)),
+			Block:    -1,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		for _, st := range streams {
+			msgs = append(msgs, st.Messages...)
+		}
+	}
+	pls := make([]plq.Payload, 0, len(msgs))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, m := range msgs {
+		raw, _ := m.Values["payload"].(string)
+		p, err := plq.DecodePayload(s.codec(ctx), []byte(raw))
+		if err != nil {
+			// an entry that cannot be decoded would be reclaimed forever
+			s.Client.XAck(ctx, s.stream(), s.group(), m.ID)
+			s.Client.XDel(ctx, s.stream(), m.ID)
+			continue
+		}
+		s.entries[p.Id] = m.ID
+		pls = append(pls, p)
+	}
+	return pls, nil
+}
+
+// Ack to acknowledge and remove the entries of the payloads
+func (s *Storage) Ack(ctx context.Context, ids []string) error {
+	s.mutex.Lock()
+	entries := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if e, ok := s.entries[id]; ok {
+			entries = append(entries, e)
+			delete(s.entries, id)
+		}
+	}
+	s.mutex.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	pipe := s.Client.Pipeline()
+	pipe.XAck(ctx, s.stream(), s.group(), entries...)
+	pipe.XDel(ctx, s.stream(), entries...)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// init to create the stream and the consumer group once
+func (s *Storage) init(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ready {
+		return nil
+	}
+	err := s.Client.XGroupCreateMkStream(ctx, s.stream(), s.group(), "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.New("redisstore: creating the consumer group failed: " + err.Error())
+	}
+	if s.entries == nil {
+		s.entries = make(map[string]string)
+	}
+	if s.Consumer == "" {
+		host, _ := os.Hostname()
+		s.Consumer = host + "-" + uuid.New().String()[:8]
+	}
+	s.ready = true
+	return nil
+}
+
+func (s *Storage) stream() string {
+	if s.Stream == "" {
+		return "payloadqueue:payloads"
+	}
+	return s.Stream
+}
+
+func (s *Storage) group() string {
+	if s.Group == "" {
+		return "payloadqueue"
+	}
+	return s.Group
+}
+
+func (s *Storage) consumer() string {
+	return s.Consumer
+}
+
+func (s *Storage) codec(ctx context.Context) plq.Codec {
+	return plq.StorageCodec(ctx, s.Codec)
+}
+
+func (s *Storage) reclaimIdle() time.Duration {
+	if s.ReclaimIdle <= 0 {
+		return 5 * time.Minute
+	}
+	return s.ReclaimIdle
+}
+
+// Pending to return the number of entries in the stream, claimed or not
+func (s *Storage) Pending(ctx context.Context) (int, error) {
+	n, err := s.Client.XLen(ctx, s.stream()).Result()
+	return int(n), err
+}
+
+var _ plq.Storage = (*Storage)(nil)
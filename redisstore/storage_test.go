@@ -0,0 +1,91 @@
+package redisstore_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/redisstore"
+)
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Claim, reclaim and acknowledge", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		a := &redisstore.Storage{Client: client, Consumer: "a", ReclaimIdle: 50 * time.Millisecond}
+		b := &redisstore.Storage{Client: client, Consumer: "b", ReclaimIdle: 50 * time.Millisecond}
+
+		err := a.Put(ctx, []plq.Payload{{Id: "1", Data: "a"}, {Id: "2", Data: "b"}, {Id: "3", Data: "c", Headers: map[string]string{"tenant": "acme"}}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		pls, err := a.Claim(ctx, 2)
+		if err != nil || len(pls) != 2 || pls[0].Id != "1" || pls[0].Data != "a" {
+			t.Fatalf("Unexpected claim: %v %v", pls, err)
+		}
+		pls, _ = b.Claim(ctx, 10)
+		if len(pls) != 1 || pls[0].Id != "3" || pls[0].Headers["tenant"] != "acme" {
+			t.Fatalf("Expected b to claim the remaining payload, got %v", pls)
+		}
+		if err := b.Ack(ctx, []string{"3"}); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+
+		// a goes away without acknowledging its payloads
+		time.Sleep(100 * time.Millisecond)
+		pls, _ = b.Claim(ctx, 10)
+		if len(pls) != 2 {
+			t.Fatalf("Expected b to reclaim 2 payloads, got %v", pls)
+		}
+		b.Ack(ctx, []string{"1", "2"})
+		if n, _ := b.Pending(ctx); n != 0 {
+			t.Errorf("Expected the stream to be empty, got %d", n)
+		}
+	})
+
+	t.Run("Queue takes over the payloads of a crashed instance", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		crashed := &redisstore.Storage{Client: client, Consumer: "crashed"}
+		crashed.Put(ctx, []plq.Payload{{Id: "1", Data: "a"}, {Id: "2", Data: "b"}})
+		crashed.Claim(ctx, 10)
+
+		var runMutex sync.Mutex
+		batched := []interface{}{}
+		store := &redisstore.Storage{Client: client, Consumer: "a", ReclaimIdle: 50 * time.Millisecond}
+		q := &plq.Queue{
+			Tag:          "Shared",
+			MaxSize:      3,
+			MaxAge:       200,
+			Storage:      store,
+			PollInterval: 50 * time.Millisecond,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		if err := q.Append(plq.Payload{Id: "3", Data: "c"}); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		time.Sleep(300 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 3 {
+			t.Errorf("Expected 3 payloads to be batched, got %v", batched)
+		}
+		runMutex.Unlock()
+		if n, _ := store.Pending(ctx); n != 0 {
+			t.Errorf("Expected the stream to be empty, got %d", n)
+		}
+		q.Close()
+	})
+}
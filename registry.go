@@ -0,0 +1,167 @@
+package payloadqueue
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// Registry to manage many named Queues, e.g. one per destination, with a coordinated lifecycle.
+// Queues registered without an EventFeed write to the shared EventFeed of the registry, and
+// without a Logger to its Logger.
+type Registry struct {
+	EventFeed eventFeed
+	Logger    *slog.Logger
+	mutex     sync.RWMutex
+	queues    map[string]*Queue
+	names     []string // in the order of registration
+	started   bool
+}
+
+// Register to add the queue under the name, which is also its Tag unless one is set. A queue
+// registered after StartAll is started straight away.
+func (r *Registry) Register(name string, q *Queue) (*Queue, error) {
+	if name == "" || q == nil {
+		return nil, errors.New("a queue needs a name to be registered")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.queues[name]; ok {
+		return nil, errors.New("queue " + name + " is already registered")
+	}
+	if q.Tag == "" {
+		q.Tag = name
+	}
+	if q.EventFeed == nil {
+		q.EventFeed = r.feed
+	}
+	if q.Logger == nil {
+		q.Logger = r.Logger
+	}
+	if r.started {
+		if err := q.Start(); err != nil {
+			return nil, errors.New("queue " + name + ": " + err.Error())
+		}
+	}
+	if r.queues == nil {
+		r.queues = make(map[string]*Queue)
+	}
+	r.queues[name] = q
+	r.names = append(r.names, name)
+	return q, nil
+}
+
+// Get to return the queue registered under the name
+func (r *Registry) Get(name string) (*Queue, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	q, ok := r.queues[name]
+	return q, ok
+}
+
+// Names to return the names of the queues in the order they were registered
+func (r *Registry) Names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]string(nil), r.names...)
+}
+
+// Queues to return the queues in the order they were registered, e.g. for the httpserver or grpc
+// Server
+func (r *Registry) Queues() []*Queue {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	queues := make([]*Queue, len(r.names))
+	for i, name := range r.names {
+		queues[i] = r.queues[name]
+	}
+	return queues
+}
+
+// StartAll to start the registered queues. If one fails to start, the ones already started are
+// closed again and the error is returned.
+func (r *Registry) StartAll() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.started {
+		return nil
+	}
+	for i, name := range r.names {
+		if err := r.queues[name].Start(); err != nil {
+			closeAll(r.queues, r.names[:i])
+			return errors.New("queue " + name + ": " + err.Error())
+		}
+	}
+	r.started = true
+	r.event("Registry: Started " + strconv.Itoa(len(r.names)) + " queues")
+	return nil
+}
+
+// CloseAll to close the registered queues, all at once, and wait for their Work to complete
+func (r *Registry) CloseAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.started {
+		return
+	}
+	closeAll(r.queues, r.names)
+	r.started = false
+	r.event("Registry: Closed " + strconv.Itoa(len(r.names)) + " queues")
+}
+
+// closeAll to close the named queues in parallel
+func closeAll(queues map[string]*Queue, names []string) {
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(q *Queue) {
+			defer wg.Done()
+			q.Close()
+		}(queues[name])
+	}
+	wg.Wait()
+}
+
+// Stats to return the Stats of every registered queue, in the order they were registered
+func (r *Registry) Stats() []Stats {
+	queues := r.Queues()
+	stats := make([]Stats, len(queues))
+	for i, q := range queues {
+		stats[i] = q.Stats()
+	}
+	return stats
+}
+
+// Total to return the Stats of all registered queues added up. Its Tag is empty.
+func (r *Registry) Total() Stats {
+	var t Stats
+	for _, s := range r.Stats() {
+		t.Pending += s.Pending
+		t.Delayed += s.Delayed
+		t.ActiveWork += s.ActiveWork
+		t.Appended += s.Appended
+		t.Batches += s.Batches
+		t.Delivered += s.Delivered
+		t.Failed += s.Failed
+		t.Retried += s.Retried
+		t.DeadLettered += s.DeadLettered
+		t.Expired += s.Expired
+		t.Duplicates += s.Duplicates
+		t.Dark += s.Dark
+		t.Rejected += s.Rejected
+	}
+	return t
+}
+
+// feed to pass the events of the queues on to the shared EventFeed
+func (r *Registry) feed(e string) {
+	if r.EventFeed != nil {
+		r.EventFeed(e)
+	}
+}
+
+// event to write events of the registry itself into the shared EventFeed
+func (r *Registry) event(e string) {
+	r.feed("[registry] " + e)
+}
@@ -0,0 +1,76 @@
+package payloadqueue_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestRegistry(t *testing.T) {
+	var feedMutex sync.Mutex
+	var events []string
+	r := &payloadqueue.Registry{
+		EventFeed: func(e string) {
+			feedMutex.Lock()
+			events = append(events, e)
+			feedMutex.Unlock()
+		},
+	}
+	work := func(pls []interface{}) int { return 0 }
+
+	t.Run("Register, start and route by name", func(t *testing.T) {
+		if _, err := r.Register("orders", &payloadqueue.Queue{MaxSize: 2, MaxAge: 200, Work: work}); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		r.Register("clicks", &payloadqueue.Queue{MaxSize: 10, MaxAge: 200, Work: work})
+		if _, err := r.Register("orders", &payloadqueue.Queue{Work: work}); err == nil {
+			t.Errorf("Expected error - name already registered")
+		}
+		if err := r.StartAll(); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		late, err := r.Register("late", &payloadqueue.Queue{MaxAge: 200, Work: work})
+		if err != nil || late.Tag != "late" {
+			t.Fatalf("Unexpected registration: %v", err)
+		}
+
+		orders, ok := r.Get("orders")
+		if !ok || orders.Tag != "orders" {
+			t.Fatalf("Expected the orders queue")
+		}
+		orders.Append(payloadqueue.Payload{Id: "1"})
+		orders.Append(payloadqueue.Payload{Id: "2"})
+		clicks, _ := r.Get("clicks")
+		clicks.Append(payloadqueue.Payload{Id: "3"})
+		late.Append(payloadqueue.Payload{Id: "4"})
+		time.Sleep(100 * time.Millisecond)
+
+		if names := r.Names(); strings.Join(names, ",") != "orders,clicks,late" {
+			t.Errorf("Unexpected names: %v", names)
+		}
+		total := r.Total()
+		if total.Appended != 4 || total.Delivered != 2 || total.Pending != 2 {
+			t.Errorf("Unexpected total: %+v", total)
+		}
+		if stats := r.Stats(); len(stats) != 3 || stats[1].Tag != "clicks" || stats[1].Pending != 1 {
+			t.Errorf("Unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("The queues share the event feed", func(t *testing.T) {
+		feedMutex.Lock()
+		defer feedMutex.Unlock()
+		seen := map[string]bool{}
+		for _, e := range events {
+			seen[e[:strings.Index(e, "]")+1]] = true
+		}
+		if !seen["[orders]"] || !seen["[clicks]"] || !seen["[late]"] || !seen["[registry]"] {
+			t.Errorf("Expected events of every queue and the registry, got %v", seen)
+		}
+	})
+
+	r.CloseAll()
+}
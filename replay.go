@@ -0,0 +1,98 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrNoArchive is returned by Replay and ReplaySince when the Storage of the queue does not keep the
+// delivered payloads, see ArchiveStorage
+var ErrNoArchive = errors.New("the storage of the queue does not keep delivered payloads")
+
+// ArchiveStorage is implemented by a Storage that keeps the delivered payloads by the batch they
+// were delivered in, for its retention, so they can be replayed. The Queue archives its delivered
+// payloads instead of acknowledging them.
+type ArchiveStorage interface {
+	Storage
+	// Archive acknowledges the claimed payloads with the ids as delivered in the batch with the id.
+	Archive(ctx context.Context, batchId string, ids []string) error
+	// Replay makes the payloads archived with the batch pending again and returns their ids.
+	Replay(ctx context.Context, batchId string) ([]string, error)
+	// ReplaySince makes the payloads archived at or after the time pending again and returns their
+	// ids.
+	ReplaySince(ctx context.Context, since time.Time) ([]string, error)
+}
+
+// archive to keep the delivered payloads of the batch in an ArchiveStorage, or acknowledge them
+// otherwise
+func (q *Queue) archive(batch *Batch, pls []Payload) {
+	as, ok := q.Storage.(ArchiveStorage)
+	if !ok || len(pls) == 0 {
+		q.acknowledge(pls)
+		return
+	}
+	ids := make([]string, len(pls))
+	for i, p := range pls {
+		ids[i] = p.Id
+	}
+	q.commit(ids)
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	if err := as.Archive(ctx, batch.Id, ids); err != nil {
+		q.event("Storage: Archive of " + strconv.Itoa(len(ids)) + " payloads failed. " + err.Error())
+	}
+}
+
+// Replay to enqueue again the payloads delivered in the batch with the id, as reported by Batch.Id,
+// returning how many were replayed, e.g. to recover from a downstream bug that corrupted what it
+// accepted. The payloads keep their Id and Data and start over with no Attempts; one past its
+// ExpiresAt expires again. With an Idempotency store a replayed payload takes over the dispatch claim
+// of its IdempotencyKey, so it is dispatched again even though the key is recorded as delivered. It fails with ErrNoArchive unless the Storage is an ArchiveStorage.
+func (q *Queue) Replay(ctx context.Context, batchId string) (int, error) {
+	as, ok := q.Storage.(ArchiveStorage)
+	if !ok {
+		return 0, ErrNoArchive
+	}
+	q.replayMutex.Lock()
+	ids, err := as.Replay(q.seal(withCodec(ctx, q.Codec)), batchId)
+	return q.replayed(ids, err, "of batch "+batchId)
+}
+
+// ReplaySince to enqueue again the payloads delivered at or after the time, as Replay does for one
+// batch, returning how many were replayed
+func (q *Queue) ReplaySince(ctx context.Context, since time.Time) (int, error) {
+	as, ok := q.Storage.(ArchiveStorage)
+	if !ok {
+		return 0, ErrNoArchive
+	}
+	q.replayMutex.Lock()
+	ids, err := as.ReplaySince(q.seal(withCodec(ctx, q.Codec)), since)
+	return q.replayed(ids, err, "delivered since "+since.Format(time.RFC3339))
+}
+
+// replayed to report a replay and claim the replayed payloads into the queue. The replayMutex is
+// held from the replay in the Storage, so the payloads are marked as replaying before they can be
+// claimed.
+func (q *Queue) replayed(ids []string, err error, what string) (int, error) {
+	if err != nil {
+		q.replayMutex.Unlock()
+		q.event("Storage: Replay of the payloads " + what + " failed. " + err.Error())
+		return 0, err
+	}
+	if q.Idempotency != nil && len(ids) > 0 {
+		if q.replaying == nil {
+			q.replaying = make(map[string]bool)
+		}
+		for _, id := range ids {
+			q.replaying[id] = true
+		}
+	}
+	q.replayMutex.Unlock()
+	n := len(ids)
+	q.event("Storage: Replayed " + strconv.Itoa(n) + " payloads " + what)
+	q.fill()
+	q.check("replay")
+	return n, nil
+}
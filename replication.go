@@ -0,0 +1,185 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrPromoted is returned by a Standby to a primary that is still replicating after the standby
+// took over.
+var ErrPromoted = errors.New("the standby has been promoted")
+
+// Replicator to mirror the payloads accepted by a Queue to a warm standby, so that the standby can
+// take over flushing them with minimal loss if the primary process dies.
+type Replicator interface {
+	// Replicate mirrors the payloads the queue has accepted. It is called with no payloads as a
+	// heartbeat when the queue has been idle for the Heartbeat.
+	Replicate(ctx context.Context, pls []Payload) error
+	// Commit releases the payloads with the ids once they are delivered, dead-lettered or expired.
+	Commit(ctx context.Context, ids []string) error
+}
+
+// replicate to mirror the accepted payloads to the Replicator. A failing standby does not stop the
+// primary; it is reported on the event feed.
+func (q *Queue) replicate(pls []Payload) {
+	if q.Replicator == nil {
+		return
+	}
+	q.payloadMutex.Lock()
+	q.replicated = q.now()
+	q.payloadMutex.Unlock()
+	ctx, cancel := q.callContext()
+	defer cancel()
+	if err := q.Replicator.Replicate(ctx, pls); err != nil {
+		q.event("Replication: Replicate of " + strconv.Itoa(len(pls)) + " payloads failed. " + err.Error())
+	}
+}
+
+// heartbeat to signal the Replicator that the queue is alive when nothing was replicated for the
+// Heartbeat
+func (q *Queue) heartbeat() {
+	if q.Replicator == nil {
+		return
+	}
+	q.payloadMutex.Lock()
+	idle := q.now().Sub(q.replicated) >= q.Heartbeat
+	q.payloadMutex.Unlock()
+	if idle {
+		q.replicate(nil)
+	}
+}
+
+// commit to release the payloads from the Replicator
+func (q *Queue) commit(ids []string) {
+	if q.Replicator == nil {
+		return
+	}
+	ctx, cancel := q.callContext()
+	defer cancel()
+	if err := q.Replicator.Commit(ctx, ids); err != nil {
+		q.event("Replication: Commit of " + strconv.Itoa(len(ids)) + " payloads failed. " + err.Error())
+	}
+}
+
+// Standby to hold the payloads replicated by a primary Queue that it has not committed yet. It is
+// the Replicator of the primary, directly or behind a transport such as the grpc package, and
+// hands the payloads to a Queue of its own on Promote.
+type Standby struct {
+	Tag      string // the Tag of the primary queue
+	mutex    sync.Mutex
+	entries  map[string]standbyEntry
+	seq      uint64
+	lastSeen time.Time
+	promoted bool
+}
+
+type standbyEntry struct {
+	seq     uint64
+	payload Payload
+}
+
+// Replicate to hold the payloads until they are committed
+func (s *Standby) Replicate(ctx context.Context, pls []Payload) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.promoted {
+		return ErrPromoted
+	}
+	s.lastSeen = time.Now()
+	if s.entries == nil {
+		s.entries = make(map[string]standbyEntry)
+	}
+	for _, p := range pls {
+		if e, ok := s.entries[p.Id]; ok {
+			// a retry of a held payload keeps its place
+			s.entries[p.Id] = standbyEntry{seq: e.seq, payload: p}
+			continue
+		}
+		s.seq++
+		s.entries[p.Id] = standbyEntry{seq: s.seq, payload: p}
+	}
+	return nil
+}
+
+// Commit to release the payloads the primary is done with
+func (s *Standby) Commit(ctx context.Context, ids []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.promoted {
+		return ErrPromoted
+	}
+	s.lastSeen = time.Now()
+	for _, id := range ids {
+		delete(s.entries, id)
+	}
+	return nil
+}
+
+// Pending to return the payloads held for the primary, in the order they were accepted
+func (s *Standby) Pending() []Payload {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries := make([]standbyEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	pls := make([]Payload, len(entries))
+	for i, e := range entries {
+		pls[i] = e.payload
+	}
+	return pls
+}
+
+// LastSeen to return when the primary last replicated, committed or sent a heartbeat
+func (s *Standby) LastSeen() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastSeen
+}
+
+// Promote to take over from the primary: the held payloads are handed to the started queue, which
+// batches them as its own, and any further replication from the old primary is refused.
+func (s *Standby) Promote(q *Queue) error {
+	pls := s.Pending()
+	s.mutex.Lock()
+	if s.promoted {
+		s.mutex.Unlock()
+		return ErrPromoted
+	}
+	s.promoted = true
+	s.entries = nil
+	s.mutex.Unlock()
+	q.event("Replication: Standby of " + s.Tag + " promoted with " + strconv.Itoa(len(pls)) + " payloads")
+	// the payloads were claimed by the primary, so they are not claimed again
+	return q.accept(pls, "takeover")
+}
+
+// Watch to Promote the standby into the queue once the primary has not been seen for the timeout,
+// which should be a few Heartbeats of the primary. It returns the context error if the context
+// ends first.
+func (s *Standby) Watch(ctx context.Context, q *Queue, timeout time.Duration) error {
+	s.mutex.Lock()
+	if s.lastSeen.IsZero() {
+		// the primary may not have connected yet
+		s.lastSeen = time.Now()
+	}
+	s.mutex.Unlock()
+	for {
+		wait := timeout - time.Since(s.LastSeen())
+		if wait <= 0 {
+			return s.Promote(q)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
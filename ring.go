@@ -0,0 +1,152 @@
+package payloadqueue
+
+import "time"
+
+// ring to hold the pending payloads of a Queue in a circular buffer. It is reserved for a batch at
+// Start, so appending does not grow it until more than a batch is pending, and cutting a batch
+// copies the payloads out and leaves the buffer to be reused. The zero ring is empty and ready to
+// use. It is guarded by the payloadMutex of its Queue.
+type ring struct {
+	buf     []Payload
+	head    int // index in buf of the oldest payload
+	n       int
+	tenants map[string]int // payloads held per tenant, when counted, see TenantKey
+	bytes   int            // total size of the payloads held, as counted against the MemoryBudget
+	// expiring is the number of payloads held with an ExpiresAt, none of which expires before
+	// expiresBy. It may be earlier than the earliest ExpiresAt, once that payload left.
+	expiring  int
+	expiresBy time.Time
+}
+
+// count to account for p being added, with a delta of 1, or taken, with -1: its size and, when the
+// tenants are counted, its tenant
+func (r *ring) count(p Payload, delta int) {
+	r.bytes += delta * p.size
+	countTenant(r.tenants, p.tenant, delta)
+	if p.ExpiresAt.IsZero() {
+		return
+	}
+	r.expiring += delta
+	switch {
+	case r.expiring == 0:
+		r.expiresBy = time.Time{}
+	case delta > 0 && (r.expiresBy.IsZero() || p.ExpiresAt.Before(r.expiresBy)):
+		r.expiresBy = p.ExpiresAt
+	}
+}
+
+// reserve to make room for at least size payloads without growing
+func (r *ring) reserve(size int) {
+	if size <= len(r.buf) {
+		return
+	}
+	buf := make([]Payload, size)
+	r.copyTo(buf)
+	r.buf, r.head = buf, 0
+}
+
+// len to return the number of payloads held
+func (r *ring) len() int {
+	return r.n
+}
+
+// at to return the payload at the position i, from the oldest
+func (r *ring) at(i int) *Payload {
+	return &r.buf[(r.head+i)%len(r.buf)]
+}
+
+// push to add the payloads after the newest, doubling the buffer when it is full
+func (r *ring) push(pls ...Payload) {
+	if r.n+len(pls) > len(r.buf) {
+		r.reserve(max(2*len(r.buf), r.n+len(pls), 16))
+	}
+	for _, p := range pls {
+		r.buf[(r.head+r.n)%len(r.buf)] = p
+		r.n++
+		r.count(p, 1)
+	}
+}
+
+// pushFront to add the payloads before the oldest, keeping their order
+func (r *ring) pushFront(pls []Payload) {
+	if r.n+len(pls) > len(r.buf) {
+		r.reserve(max(2*len(r.buf), r.n+len(pls), 16))
+	}
+	for i := len(pls) - 1; i >= 0; i-- {
+		r.head = (r.head - 1 + len(r.buf)) % len(r.buf)
+		r.buf[r.head] = pls[i]
+		r.n++
+		r.count(pls[i], 1)
+	}
+}
+
+// take to remove up to n of the oldest payloads and return them in a slice of their own
+func (r *ring) take(n int) []Payload {
+	n = min(n, r.n)
+	if n == 0 {
+		return nil
+	}
+	pls := make([]Payload, n)
+	for i := range pls {
+		p := r.at(i)
+		pls[i], *p = *p, Payload{} // the slot no longer holds on to the Data
+		r.count(pls[i], -1)
+	}
+	r.head = (r.head + n) % len(r.buf)
+	r.n -= n
+	return pls
+}
+
+// remove to take the payloads that match out of the ring and return them, keeping the order of the
+// others
+func (r *ring) remove(match func(Payload) bool) []Payload {
+	var out []Payload
+	kept := 0
+	for i := 0; i < r.n; i++ {
+		p := *r.at(i)
+		if match(p) {
+			out = append(out, p)
+			r.count(p, -1)
+			continue
+		}
+		*r.at(kept) = p
+		kept++
+	}
+	for i := kept; i < r.n; i++ {
+		*r.at(i) = Payload{}
+	}
+	r.n = kept
+	return out
+}
+
+// expire to take the payloads that passed their ExpiresAt by now out of the ring. It is only scanned
+// once the expiresBy has passed, and the expiresBy is then the earliest ExpiresAt left.
+func (r *ring) expire(now time.Time) []Payload {
+	if r.expiring == 0 || !now.After(r.expiresBy) {
+		return nil
+	}
+	var next time.Time
+	expired := r.remove(func(p Payload) bool {
+		switch {
+		case p.ExpiresAt.IsZero():
+			return false
+		case now.After(p.ExpiresAt):
+			return true
+		case next.IsZero() || p.ExpiresAt.Before(next):
+			next = p.ExpiresAt
+		}
+		return false
+	})
+	r.expiresBy = next
+	return expired
+}
+
+// copyTo to copy the payloads, from the oldest, into the start of buf
+func (r *ring) copyTo(buf []Payload) {
+	if r.n == 0 {
+		return
+	}
+	end := min(r.head+r.n, len(r.buf))
+	k := copy(buf, r.buf[r.head:end])
+	copy(buf[k:], r.buf[:r.n-k])
+}
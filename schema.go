@@ -0,0 +1,268 @@
+package payloadqueue
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Shape of the Data of a payload: the path of every field of JSON-like data with its type, one of
+// string, number, bool, null, object or array. Nested fields are joined with dots and the elements
+// of arrays are marked with [], e.g. {"user.id": "number", "tags[]": "string"}.
+type Shape map[string]string
+
+// ShapeOf to infer the Shape of the data. Values other than maps, slices and scalars are seen the
+// way the JSONCodec would encode them.
+func ShapeOf(v interface{}) Shape {
+	s := make(Shape)
+	if j, ok := jsonLike(v); ok {
+		v = j
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		// the fields of an object root stand on their own
+		for k, f := range m {
+			s.add(k, f)
+		}
+		return s
+	}
+	s.add("$", v)
+	return s
+}
+
+// add to record the value at the path and the fields below it
+func (s Shape) add(path string, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		s[path] = "null"
+	case string:
+		s[path] = "string"
+	case bool:
+		s[path] = "bool"
+	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, json.Number:
+		s[path] = "number"
+	case map[string]interface{}:
+		s[path] = "object"
+		for k, f := range v {
+			s.add(path+"."+k, f)
+		}
+	case []interface{}:
+		s[path] = "array"
+		for _, e := range v {
+			s.add(path+"[]", e)
+		}
+	default:
+		if j, ok := jsonLike(v); ok {
+			s.add(path, j)
+			return
+		}
+		s[path] = "object"
+	}
+}
+
+// jsonLike to turn a value that is not JSON-like, e.g. a struct, into its JSON form, reporting
+// whether it was turned
+func jsonLike(v interface{}) (interface{}, bool) {
+	switch v.(type) {
+	case nil, string, bool, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		json.Number, map[string]interface{}, []interface{}:
+		return v, false
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v, false
+	}
+	var out interface{}
+	if json.Unmarshal(b, &out) != nil {
+		return v, false
+	}
+	return out, true
+}
+
+// Fingerprint to return a short hash of the fields and their types
+func (s Shape) Fingerprint() string {
+	fields := make([]string, 0, len(s))
+	for path, typ := range s {
+		fields = append(fields, path+":"+typ)
+	}
+	sort.Strings(fields)
+	h := fnv.New64a()
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// SchemaDrift to report that producers started sending differently-shaped data
+type SchemaDrift struct {
+	Tag         string
+	Added       []string // fields that were not in the schema
+	Removed     []string // fields of the schema that are no longer sent
+	Changed     []string // fields sent with another type, as "field: old -> new"
+	Baseline    string   // fingerprint of the schema before the drift
+	Fingerprint string   // fingerprint of the schema after the drift
+}
+
+// SchemaMonitor to infer the schema of the payload Data of a Queue from a sample of the appended
+// payloads and detect drift, catching upstream breaking changes before the sink fails. The first
+// Window samples establish the schema; after that a field added, removed or sent with another type
+// by at least the Threshold of the recent samples is reported as a drift, both as an event of the
+// queue and to OnDrift, and becomes part of the schema.
+type SchemaMonitor struct {
+	SampleEvery int               // one in this many appended payloads is sampled. Default is 10
+	Window      int               // samples the rolling schema is built from. Default is 100
+	Threshold   float64           // fraction of the window a change must be seen in to be a drift. Default is 0.1
+	OnDrift     func(SchemaDrift) // receives every drift detected
+	mutex       sync.Mutex
+	seen        int
+	baseline    Shape
+	recent      []Shape        // the last Window samples, oldest first
+	counts      map[string]int // recent samples by "field:type"
+	fields      map[string]int // recent samples by field
+}
+
+// Schema to return the inferred schema, empty until the first Window samples are taken
+func (m *SchemaMonitor) Schema() Shape {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := make(Shape, len(m.baseline))
+	for path, typ := range m.baseline {
+		s[path] = typ
+	}
+	return s
+}
+
+// observe to sample the payload, returning the drift it reveals, if any
+func (m *SchemaMonitor) observe(p Payload) (SchemaDrift, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.seen++
+	every := m.SampleEvery
+	if every <= 0 {
+		every = 10
+	}
+	if (m.seen-1)%every != 0 {
+		return SchemaDrift{}, false
+	}
+	window := m.Window
+	if window <= 0 {
+		window = 100
+	}
+	s := ShapeOf(p.Data)
+	if m.counts == nil {
+		m.counts, m.fields = make(map[string]int), make(map[string]int)
+	}
+	m.recent = append(m.recent, s)
+	m.count(s, 1)
+	if len(m.recent) > window {
+		m.count(m.recent[0], -1)
+		m.recent = m.recent[1:]
+	}
+	if m.baseline == nil {
+		if len(m.recent) == window {
+			m.baseline = m.learn()
+		}
+		return SchemaDrift{}, false
+	}
+	return m.drift()
+}
+
+// count to add the fields of the sample to the counts of the recent samples
+func (m *SchemaMonitor) count(s Shape, delta int) {
+	for path, typ := range s {
+		m.counts[path+":"+typ] += delta
+		m.fields[path] += delta
+	}
+}
+
+// learn to build the schema from the recent samples: every field seen, with its most frequent type
+func (m *SchemaMonitor) learn() Shape {
+	s := make(Shape)
+	best := make(map[string]int)
+	for key, n := range m.counts {
+		i := strings.LastIndex(key, ":")
+		path, typ := key[:i], key[i+1:]
+		if n > best[path] || (n == best[path] && typ < s[path]) {
+			s[path], best[path] = typ, n
+		}
+	}
+	return s
+}
+
+// drift to compare the recent samples with the schema and adopt the changes they agree on
+func (m *SchemaMonitor) drift() (SchemaDrift, bool) {
+	threshold := m.Threshold
+	if threshold <= 0 {
+		threshold = 0.1
+	}
+	min := int(threshold * float64(len(m.recent)))
+	if min < 1 {
+		min = 1
+	}
+	d := SchemaDrift{Baseline: m.baseline.Fingerprint()}
+	for key, n := range m.counts {
+		if n < min {
+			continue
+		}
+		i := strings.LastIndex(key, ":")
+		path, typ := key[:i], key[i+1:]
+		old, ok := m.baseline[path]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, path)
+			m.baseline[path] = typ
+		case old != typ && n > m.counts[path+":"+old]:
+			d.Changed = append(d.Changed, path+": "+old+" -> "+typ)
+			m.baseline[path] = typ
+		}
+	}
+	if len(m.recent) == m.window() {
+		for path := range m.baseline {
+			if m.fields[path] == 0 {
+				d.Removed = append(d.Removed, path)
+				delete(m.baseline, path)
+			}
+		}
+	}
+	if len(d.Added)+len(d.Removed)+len(d.Changed) == 0 {
+		return SchemaDrift{}, false
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+	d.Fingerprint = m.baseline.Fingerprint()
+	return d, true
+}
+
+func (m *SchemaMonitor) window() int {
+	if m.Window <= 0 {
+		return 100
+	}
+	return m.Window
+}
+
+// checkSchema to pass the new payloads to the SchemaMonitor and report the drift they reveal
+func (q *Queue) checkSchema(pls []Payload) {
+	if q.Schema == nil {
+		return
+	}
+	for _, p := range pls {
+		d, ok := q.Schema.observe(p)
+		if !ok {
+			continue
+		}
+		d.Tag = q.Tag
+		q.log(slog.LevelWarn, "schema drift",
+			"Schema: Drift detected, added "+strings.Join(d.Added, ", ")+"; removed "+strings.Join(d.Removed, ", ")+
+				"; changed "+strings.Join(d.Changed, ", "),
+			slog.Any("added", d.Added), slog.Any("removed", d.Removed), slog.Any("changed", d.Changed),
+			slog.String("baseline", d.Baseline), slog.String("fingerprint", d.Fingerprint))
+		if q.Schema.OnDrift != nil {
+			q.Schema.OnDrift(d)
+		}
+	}
+}
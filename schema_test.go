@@ -0,0 +1,89 @@
+package payloadqueue_test
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestShapeOf(t *testing.T) {
+	type user struct {
+		Id   int      `json:"id"`
+		Tags []string `json:"tags"`
+	}
+	got := payloadqueue.ShapeOf(map[string]interface{}{"name": "a", "user": user{Id: 1, Tags: []string{"x"}}, "none": nil})
+	want := payloadqueue.Shape{"name": "string", "none": "null", "user": "object", "user.id": "number", "user.tags": "array", "user.tags[]": "string"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected shape: %v", got)
+	}
+	if got := payloadqueue.ShapeOf(3); !reflect.DeepEqual(got, payloadqueue.Shape{"$": "number"}) {
+		t.Errorf("Unexpected shape of a scalar: %v", got)
+	}
+	if payloadqueue.ShapeOf(want).Fingerprint() == (payloadqueue.Shape{"name": "number"}).Fingerprint() {
+		t.Errorf("Expected different shapes to have different fingerprints")
+	}
+}
+
+func TestQueueSchema(t *testing.T) {
+	var runMutex sync.Mutex
+	drifts := []payloadqueue.SchemaDrift{}
+	monitor := &payloadqueue.SchemaMonitor{
+		SampleEvery: 1,
+		Window:      10,
+		Threshold:   0.3,
+		OnDrift: func(d payloadqueue.SchemaDrift) {
+			runMutex.Lock()
+			drifts = append(drifts, d)
+			runMutex.Unlock()
+		},
+	}
+	q := &payloadqueue.Queue{
+		MaxSize: 1000,
+		MaxAge:  200,
+		Tag:     "QueueA",
+		Schema:  monitor,
+		Work:    func(pls []interface{}) int { return 0 },
+	}
+	q.Start()
+	n := 0
+	appendData := func(count int, data map[string]interface{}) {
+		for i := 0; i < count; i++ {
+			n++
+			q.Append(payloadqueue.Payload{Id: strconv.Itoa(n), Data: data})
+		}
+	}
+	appendData(10, map[string]interface{}{"id": 1.0, "name": "a"})
+	if s := monitor.Schema(); s["id"] != "number" || s["name"] != "string" {
+		t.Errorf("Unexpected schema: %v", s)
+	}
+	// a single odd payload is not a drift
+	appendData(1, map[string]interface{}{"id": 1.0, "name": "a", "debug": true})
+	appendData(5, map[string]interface{}{"id": 1.0, "name": "a"})
+	runMutex.Lock()
+	if len(drifts) != 0 {
+		t.Errorf("Expected no drift for a single payload, got %+v", drifts)
+	}
+	runMutex.Unlock()
+
+	// the producer starts sending the id as a string
+	appendData(10, map[string]interface{}{"id": "1", "name": "a"})
+	time.Sleep(10 * time.Millisecond)
+	runMutex.Lock()
+	if len(drifts) != 1 || !reflect.DeepEqual(drifts[0].Changed, []string{"id: number -> string"}) || drifts[0].Tag != "QueueA" {
+		t.Errorf("Expected the type change reported once, got %+v", drifts)
+	}
+	runMutex.Unlock()
+
+	// the producer stops sending the name
+	appendData(10, map[string]interface{}{"id": "1"})
+	runMutex.Lock()
+	if len(drifts) != 2 || !reflect.DeepEqual(drifts[1].Removed, []string{"name"}) || drifts[1].Baseline != drifts[0].Fingerprint {
+		t.Errorf("Expected the removed field reported, got %+v", drifts)
+	}
+	runMutex.Unlock()
+	q.Close()
+}
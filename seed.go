@@ -0,0 +1,112 @@
+package payloadqueue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// seedProgress is every how many payloads the seeding reports its progress
+const seedProgress = 10000
+
+// seedLine is the format of a line of the Seed file
+type seedLine struct {
+	Id      string            `json:"id"`
+	Data    interface{}       `json:"data"`
+	Headers map[string]string `json:"headers"`
+}
+
+// seed to open the Seed file at Start and append its payloads in the background, closing the
+// seeded channel once it is read. Close waits for the loader, which stops at the next line once the
+// queue closes. A missing file fails Start.
+func (q *Queue) seed(spawn func(func())) error {
+	q.seeded = make(chan struct{})
+	if q.Seed == "" {
+		close(q.seeded)
+		return nil
+	}
+	f, err := os.Open(q.Seed)
+	if err != nil {
+		close(q.seeded)
+		return err
+	}
+	quit := q.quitChan
+	q.loops.Add(1)
+	spawn(func() {
+		defer q.loops.Done()
+		defer close(q.seeded)
+		defer f.Close()
+		q.loadSeed(f.Name(), bufio.NewScanner(f), quit)
+	})
+	return nil
+}
+
+// loadSeed to append the payloads of the seed file in chunks of the InputBatch, as the Input does, so
+// the same triggers apply as for live traffic. A malformed line, a payload the Validator rejects or
+// a rejected chunk is reported and skipped.
+func (q *Queue) loadSeed(name string, lines *bufio.Scanner, quit chan bool) {
+	lines.Buffer(nil, 16<<20)
+	n, line, skipped := 0, 0, 0
+	chunk := make([]Payload, 0, q.InputBatch)
+	push := func() {
+		valid, _ := q.validate(chunk)
+		skipped += len(chunk) - len(valid)
+		chunk = chunk[:0]
+		if len(valid) == 0 {
+			return
+		}
+		if err := q.appendValid(context.Background(), valid); err != nil {
+			skipped += len(valid)
+			q.event("Seed: " + strconv.Itoa(len(valid)) + " payloads up to line " + strconv.Itoa(line) + " were not appended. " + err.Error())
+		} else {
+			n += len(valid)
+		}
+		if before := n - len(valid); n/seedProgress > before/seedProgress {
+			q.log(slog.LevelInfo, "seed progress", "Seed: Appended "+strconv.Itoa(n)+" payloads from "+name,
+				slog.Int("batch_size", n))
+		}
+	}
+	for lines.Scan() {
+		select {
+		case <-quit:
+			q.event("Seed: Stopped at line " + strconv.Itoa(line) + " as the queue closed")
+			return
+		default:
+		}
+		line++
+		if len(lines.Bytes()) == 0 {
+			continue
+		}
+		var l seedLine
+		if err := json.Unmarshal(lines.Bytes(), &l); err != nil || l.Data == nil {
+			skipped++
+			q.event("Seed: Line " + strconv.Itoa(line) + " of " + name + " is not a payload, skipped")
+			continue
+		}
+		p := q.NewPayload(l.Data)
+		if l.Id != "" {
+			p.Id = l.Id
+		}
+		p.Headers = l.Headers
+		if chunk = append(chunk, p); len(chunk) == q.InputBatch {
+			push()
+		}
+	}
+	if len(chunk) > 0 {
+		push()
+	}
+	if err := lines.Err(); err != nil {
+		q.event("Seed: Reading " + name + " failed at line " + strconv.Itoa(line) + ". " + err.Error())
+	}
+	q.log(slog.LevelInfo, "seed loaded", "Seed: Appended "+strconv.Itoa(n)+" payloads from "+name+", skipped "+strconv.Itoa(skipped),
+		slog.Int("batch_size", n))
+}
+
+// Seeded to return a channel closed once the payloads of the Seed file are appended, e.g. to Drain
+// the queue at the end of a re-processing job. Without a Seed it is closed at Start.
+func (q *Queue) Seeded() <-chan struct{} {
+	return q.seeded
+}
@@ -0,0 +1,39 @@
+package payloadqueue
+
+import "strconv"
+
+// HeaderSequence and HeaderBatch are the message headers the sinks carry the Sequence and the Batch
+// of a payload in, so consumers downstream can detect reordering or loss and resequence.
+const (
+	HeaderSequence = "Payload-Sequence"
+	HeaderBatch    = "Batch-Number"
+)
+
+// OrderHeaders to return the Sequence and the Batch of the payload as HeaderSequence and
+// HeaderBatch, leaving out those that are not set
+func (p Payload) OrderHeaders() map[string]string {
+	h := make(map[string]string, 2)
+	if p.Sequence > 0 {
+		h[HeaderSequence] = strconv.FormatUint(p.Sequence, 10)
+	}
+	if p.Batch > 0 {
+		h[HeaderBatch] = strconv.FormatUint(p.Batch, 10)
+	}
+	return h
+}
+
+// sequence to number the new payloads in the order they are accepted. A payload that already has a
+// Sequence, e.g. restored from a Storage, keeps it.
+func (q *Queue) sequence(p *Payload) {
+	if p.Sequence == 0 && p.Id != "" && p.Attempts == 0 {
+		p.Sequence = q.sequenced.Add(1)
+	}
+}
+
+// number to give the batch the next batch number of the queue and stamp it on its payloads
+func (q *Queue) number(batch *Batch) {
+	batch.Number = q.numbered.Add(1)
+	for i := range batch.Payloads {
+		batch.Payloads[i].Batch = batch.Number
+	}
+}
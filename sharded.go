@@ -0,0 +1,263 @@
+package payloadqueue
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ShardedQueue to spread the payloads over several Queues by a consistent hash of their key, so
+// that batching scales past a single queue's lock while payloads with the same key stay together.
+// The shard count can be changed at runtime with SetShards; only the buffered payloads whose key
+// now hashes to a different shard are moved.
+type ShardedQueue struct {
+	Tag          string
+	Shards       int                    // number of shards. Default is Defaults.Shards
+	VirtualNodes int                    // points per shard on the hash ring. Default is 64
+	NewShard     func(shard int) *Queue // builds the (unstarted) queue of the shard. Its Tag defaults to Tag-shard
+	Key          func(Payload) string   // the key a payload is sharded by. Default is the Id
+	EventFeed    eventFeed
+	mutex        sync.RWMutex // held for writing while the shards are rebalanced
+	queues       []*Queue
+	ring         []ringPoint
+}
+
+// ringPoint to hold one virtual node of a shard on the hash ring
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// Start to build and start the shards
+func (s *ShardedQueue) Start() error {
+	if s.NewShard == nil {
+		return errors.New("the NewShard function is not supplied")
+	}
+	if s.Tag == "" {
+		s.Tag = defaultTag(12)
+		s.event("Tag: Random value assigned is: " + s.Tag)
+	}
+	if s.Shards == 0 {
+		s.Shards = CurrentDefaults().Shards
+		s.event("Shards: Default value of " + strconv.Itoa(s.Shards) + " was used")
+	}
+	if s.VirtualNodes == 0 {
+		s.VirtualNodes = 64
+		s.event("VirtualNodes: Default value of 64 was used")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	queues, err := s.grow(nil, s.Shards)
+	if err != nil {
+		return err
+	}
+	s.queues = queues
+	s.ring = s.buildRing(len(queues))
+	s.event("Sharded Queue: Started with " + strconv.Itoa(len(queues)) + " shards")
+	return nil
+}
+
+// grow to build and start the shards from len(queues) up to n
+func (s *ShardedQueue) grow(queues []*Queue, n int) ([]*Queue, error) {
+	for i := len(queues); i < n; i++ {
+		q := s.NewShard(i)
+		if q == nil {
+			return queues, errors.New("the NewShard function returned no queue for shard " + strconv.Itoa(i))
+		}
+		if q.Tag == "" {
+			q.Tag = s.Tag + "-" + strconv.Itoa(i)
+		}
+		if err := q.Start(); err != nil {
+			return queues, err
+		}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+// buildRing to place the virtual nodes of n shards on the hash ring
+func (s *ShardedQueue) buildRing(n int) []ringPoint {
+	ring := make([]ringPoint, 0, n*s.VirtualNodes)
+	for shard := 0; shard < n; shard++ {
+		for v := 0; v < s.VirtualNodes; v++ {
+			ring = append(ring, ringPoint{hash: hashKey(strconv.Itoa(shard) + "#" + strconv.Itoa(v)), shard: shard})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// hashKey to hash a key onto the ring
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// locate to return the shard that owns the key on the ring
+func locate(ring []ringPoint, key string) int {
+	h := hashKey(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].shard
+}
+
+// key to return the key the payload is sharded by
+func (s *ShardedQueue) key(p Payload) string {
+	if s.Key != nil {
+		return s.Key(p)
+	}
+	return p.Id
+}
+
+// Append to add the Payload to the shard that owns its key
+func (s *ShardedQueue) Append(p Payload) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.queues) == 0 {
+		return errors.New("the sharded queue is not started")
+	}
+	return s.queues[locate(s.ring, s.key(p))].Append(p)
+}
+
+// Shard to return the queue of the shard that owns the key
+func (s *ShardedQueue) Shard(key string) *Queue {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.queues) == 0 {
+		return nil
+	}
+	return s.queues[locate(s.ring, key)]
+}
+
+// Queues to return the queues of the shards
+func (s *ShardedQueue) Queues() []*Queue {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]*Queue(nil), s.queues...)
+}
+
+// SetShards to change the number of shards while the queue is running. New shards are built and
+// started, the buffered payloads whose key is now owned by another shard are moved to it, and
+// removed shards are closed once their batches in flight are done. Appends wait for the
+// rebalance, so no payload is lost.
+func (s *ShardedQueue) SetShards(n int) error {
+	if n <= 0 {
+		return errors.New("the number of shards must be positive")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.queues) == 0 {
+		return errors.New("the sharded queue is not started")
+	}
+	from := len(s.queues)
+	if n == from {
+		return nil
+	}
+	queues, err := s.grow(s.queues, n)
+	if err != nil {
+		for _, q := range queues[from:] {
+			q.Close()
+		}
+		return err
+	}
+	ring := s.buildRing(n)
+	s.event("Shard Rebalance [" + s.Tag + "]: " + strconv.Itoa(from) + " -> " + strconv.Itoa(n) + " shards")
+	moved := 0
+	for i, q := range queues[:from] {
+		migrating := make(map[int][]Payload)
+		q.extract(func(p Payload) bool {
+			to := locate(ring, s.key(p))
+			if to == i {
+				return false
+			}
+			migrating[to] = append(migrating[to], p)
+			return true
+		})
+		for to, pls := range migrating {
+			s.event("Shard Migration [" + s.Tag + "]: " + strconv.Itoa(len(pls)) + " payloads from shard " + strconv.Itoa(i) + " to shard " + strconv.Itoa(to))
+			queues[to].adopt(pls)
+			moved += len(pls)
+		}
+	}
+	for _, q := range queues[n:] {
+		q.Close()
+	}
+	s.queues = queues[:n]
+	s.ring = ring
+	s.event("Shard Rebalance [" + s.Tag + "]: Done, " + strconv.Itoa(moved) + " payloads moved")
+	return nil
+}
+
+// Flush to push the pending payloads of every shard now
+func (s *ShardedQueue) Flush() {
+	for _, q := range s.Queues() {
+		q.Flush()
+	}
+}
+
+// Size to return the number of payloads buffered over all shards
+func (s *ShardedQueue) Size() int {
+	n := 0
+	for _, q := range s.Queues() {
+		n += q.Size()
+	}
+	return n
+}
+
+// Close to close every shard
+func (s *ShardedQueue) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, q := range s.queues {
+		q.Close()
+	}
+	s.queues = nil
+	s.event("Sharded Queue: Closed")
+}
+
+// event to write events into the ShardedQueue's feed
+func (s *ShardedQueue) event(e string) {
+	if s.EventFeed != nil {
+		s.EventFeed("[" + s.Tag + "] " + e)
+	}
+}
+
+// extract to remove the buffered payloads, pending or delayed, that match from the queue
+func (q *Queue) extract(match func(Payload) bool) []Payload {
+	q.payloadMutex.Lock()
+	out := q.payloadQueue.remove(match)
+	n := 0
+	for _, p := range q.delayed {
+		if match(p) {
+			out = append(out, p)
+			continue
+		}
+		q.delayed[n] = p
+		n++
+	}
+	q.delayed = q.delayed[:n]
+	q.payloadMutex.Unlock()
+	q.release()
+	return out
+}
+
+// adopt to take over payloads already accepted by another queue, without claiming, persisting or
+// counting them again
+func (q *Queue) adopt(pls []Payload) {
+	now := q.now()
+	ready := make([]Payload, 0, len(pls))
+	for _, p := range pls {
+		if now.Before(p.NotBefore) {
+			q.delay(p)
+			continue
+		}
+		ready = append(ready, p)
+	}
+	q.enqueue(now, ready)
+	q.check("rebalance")
+}
@@ -0,0 +1,91 @@
+package payloadqueue_test
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sam-ish/payloadqueue"
+)
+
+func TestShardedQueue(t *testing.T) {
+	var runMutex sync.Mutex
+	delivered := map[string]string{} // payload id to the tag of the shard that batched it
+	var events []string
+	s := &payloadqueue.ShardedQueue{
+		Tag:       "Sharded",
+		Shards:    2,
+		EventFeed: func(e string) { runMutex.Lock(); events = append(events, e); runMutex.Unlock() },
+		NewShard: func(shard int) *payloadqueue.Queue {
+			return &payloadqueue.Queue{
+				MaxSize: 1000,
+				MaxAge:  200,
+				WorkContext: func(ctx context.Context, pls []interface{}) error {
+					b, _ := payloadqueue.BatchFromContext(ctx)
+					runMutex.Lock()
+					for _, p := range b.Payloads {
+						if _, ok := delivered[p.Id]; ok {
+							t.Errorf("Payload %s delivered twice", p.Id)
+						}
+						delivered[p.Id] = b.Tag
+					}
+					runMutex.Unlock()
+					return nil
+				},
+			}
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for i := 0; i < 400; i++ {
+		s.Append(payloadqueue.Payload{Id: strconv.Itoa(i), Data: i})
+	}
+
+	t.Run("Scaling up moves only the payloads of the new shards", func(t *testing.T) {
+		if err := s.SetShards(4); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if s.Size() != 400 {
+			t.Errorf("Expected 400 payloads buffered, got %d", s.Size())
+		}
+		moved := -1
+		runMutex.Lock()
+		for _, e := range events {
+			if m := regexp.MustCompile(`Done, (\d+) payloads moved`).FindStringSubmatch(e); m != nil {
+				moved, _ = strconv.Atoi(m[1])
+			}
+		}
+		runMutex.Unlock()
+		// about half the keys move to the two new shards, none move between the old ones
+		if moved <= 0 || moved >= 300 {
+			t.Errorf("Expected about 200 payloads to move, got %d", moved)
+		}
+	})
+
+	t.Run("Every payload is batched by the shard that owns its key", func(t *testing.T) {
+		if err := s.SetShards(3); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		owners := map[string]string{}
+		for i := 0; i < 400; i++ {
+			owners[strconv.Itoa(i)] = s.Shard(strconv.Itoa(i)).Tag
+		}
+		s.Flush()
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if len(delivered) != 400 {
+			t.Errorf("Expected 400 payloads delivered, got %d", len(delivered))
+		}
+		for id, tag := range delivered {
+			if owners[id] != tag {
+				t.Errorf("Payload %s batched by %s, owned by %s", id, tag, owners[id])
+			}
+		}
+		runMutex.Unlock()
+	})
+	s.Close()
+}
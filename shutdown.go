@@ -0,0 +1,229 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrQueueClosed is returned by Append once the queue is closed or shutting down
+var ErrQueueClosed = errors.New("the queue is closed")
+
+// ShutdownPhases to bound the phases of a Shutdown. Each phase also ends with the context.
+type ShutdownPhases struct {
+	Flush   time.Duration // how long the pending payloads are delivered for, see Drain. Zero means until the context ends
+	Wait    time.Duration // how long the batches still being processed are waited for. Zero means until the context ends
+	Persist time.Duration // how long the undelivered payloads are put into the Spill storage. Zero means until the context ends
+}
+
+// ShutdownPhase to report how a phase of a Shutdown went
+type ShutdownPhase struct {
+	Name string // intake, flush, wait or persist
+	Took time.Duration
+	Err  error // the phase ended before it was done, or failed
+}
+
+// ShutdownReport to account for the payloads of a queue once it is shut down
+type ShutdownReport struct {
+	Tag       string
+	Flushed   int // payloads pushed in batches while flushing, including those that failed
+	Persisted int // undelivered payloads kept for the next run: put into the Spill storage, or left in the Storage
+	Dropped   int // undelivered payloads lost, as the queue has no Spill storage or Storage, or persisting them failed
+	Abandoned int // payloads in batches still being processed when the wait ended
+	Late      int // retries of abandoned batches that came back after the persist phase, until Shutdown returned. They, and those after, are persisted or dropped like the others, and logged
+	Phases    []ShutdownPhase
+}
+
+// Shutdown to close the queue in phases, each bounded by the phases and the context, and account
+// for its payloads:
+//
+//  1. intake: Append fails with ErrQueueClosed, the Input is closed and what was sent on it is
+//     queued, and the sub-queues are flushed and closed
+//  2. flush: the pending payloads are delivered, oldest first, as Drain does
+//  3. wait: the batches still being processed are waited for
+//  4. persist: what could not be delivered is put into the Spill storage, for the next run to
+//     reload. With a Storage, it is left there for another instance to claim; without either, it
+//     is dropped
+//
+// It returns the error of the first phase that ended before it was done, with the report.
+func (q *Queue) Shutdown(ctx context.Context, phases ShutdownPhases) (ShutdownReport, error) {
+	r := ShutdownReport{Tag: q.Tag}
+	phase := func(name string, started time.Time, err error) {
+		r.Phases = append(r.Phases, ShutdownPhase{Name: name, Took: time.Since(started), Err: err})
+	}
+	started := time.Now()
+	q.stop()
+	phase("intake", started, nil)
+
+	started = time.Now()
+	before := q.Size()
+	fctx, cancel := phaseContext(ctx, phases.Flush)
+	left, err := q.Drain(fctx)
+	cancel()
+	r.Flushed = max(before-left, 0)
+	phase("flush", started, err)
+
+	started = time.Now()
+	wctx, cancel := phaseContext(ctx, phases.Wait)
+	select {
+	case <-q.idle():
+		err = nil
+	case <-wctx.Done():
+		err = wctx.Err()
+		q.payloadMutex.Lock()
+		r.Abandoned = q.inflight
+		q.payloadMutex.Unlock()
+	}
+	cancel()
+	phase("wait", started, err)
+
+	started = time.Now()
+	pctx, cancel := phaseContext(ctx, phases.Persist)
+	r.Persisted, r.Dropped, err = q.keep(pctx)
+	cancel()
+	phase("persist", started, err)
+	r.Late = int(q.lateRetries.Load())
+
+	q.detach()
+	q.flushLedger()
+	q.log(slog.LevelInfo, "queue shut down", "Buffer Queue: Shut down. Flushed "+strconv.Itoa(r.Flushed)+", persisted "+strconv.Itoa(r.Persisted)+
+		", dropped "+strconv.Itoa(r.Dropped)+", abandoned "+strconv.Itoa(r.Abandoned)+" payloads",
+		slog.Int("flushed", r.Flushed), slog.Int("persisted", r.Persisted), slog.Int("dropped", r.Dropped), slog.Int("abandoned", r.Abandoned))
+	for _, p := range r.Phases {
+		if p.Err != nil {
+			return r, errors.New("shutdown " + p.Name + ": " + p.Err.Error())
+		}
+	}
+	return r, nil
+}
+
+// phaseContext to bound a phase of a Shutdown by its timeout, when it has one
+func phaseContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// stop to close the intake of the queue: new payloads are refused, appenders waiting for room fail
+// with ErrQueueClosed, the sub-queues are closed, and the internal goroutines queue what was sent on
+// the Input and stop. Only the first call stops the queue, until it is started again; it reports
+// whether it was this one.
+func (q *Queue) stop() bool {
+	stopped := false
+	q.stopOnce.Do(func() {
+		stopped = true
+		q.event("Buffer Queue: Stopping...")
+		q.stopping.Store(true)
+		q.running.Store(false)
+		q.payloadMutex.Lock()
+		if q.room != nil {
+			q.room.Broadcast()
+		}
+		q.payloadMutex.Unlock()
+		q.closeSubs()
+		if q.payloadChan != nil {
+			close(q.payloadChan)
+		}
+		if q.quitChan != nil {
+			close(q.quitChan)
+		}
+	})
+	// wait for the timer to stop, so nothing is recorded after Close returns
+	q.loops.Wait()
+	return stopped
+}
+
+// keep to take the payloads left in the queue and persist them for the next run, returning how many
+// were persisted and how many were dropped
+func (q *Queue) keep(ctx context.Context) (int, int, error) {
+	q.payloadMutex.Lock()
+	left := append(q.payloadQueue.take(q.payloadQueue.len()), q.delayed...)
+	q.delayed = nil
+	q.kept = true
+	spilled := q.spilled + q.spilling
+	q.payloadMutex.Unlock()
+	switch {
+	case q.Storage != nil:
+		// the payloads are claimed and not acknowledged, so they are claimed again
+		return len(left), 0, nil
+	case len(left) == 0:
+		return spilled, 0, nil
+	case q.Spill != nil:
+		if err := q.Spill.Put(q.seal(withCodec(ctx, q.Codec)), left); err != nil {
+			q.event("Spill: Put of " + strconv.Itoa(len(left)) + " payloads failed, dropped. " + err.Error())
+			q.tally(left, func(c *DailyCounts, n int64) { c.Dropped += n })
+			return spilled, len(left), err
+		}
+		return spilled + len(left), 0, nil
+	}
+	q.tally(left, func(c *DailyCounts, n int64) { c.Dropped += n })
+	return 0, len(left), nil
+}
+
+// late to persist, or drop, the retries of abandoned batches that come back once a Shutdown has
+// persisted the payloads left, as keep did, rather than queue them where nothing takes them
+func (q *Queue) late(pls []Payload) {
+	if len(pls) == 0 {
+		return
+	}
+	q.lateRetries.Add(int64(len(pls)))
+	n := strconv.Itoa(len(pls))
+	if q.Storage != nil {
+		// the payloads are claimed and not acknowledged, so they are claimed again
+		q.log(slog.LevelWarn, "late retries", "Buffer Queue: "+n+" retries of an abandoned batch came back after the shutdown, left in the Storage",
+			slog.Int("batch_size", len(pls)))
+		return
+	}
+	if q.Spill != nil {
+		ctx, cancel := q.storageContext()
+		err := q.Spill.Put(ctx, pls)
+		cancel()
+		if err == nil {
+			q.log(slog.LevelWarn, "late retries", "Buffer Queue: "+n+" retries of an abandoned batch came back after the shutdown, persisted",
+				slog.Int("batch_size", len(pls)))
+			return
+		}
+		q.event("Spill: Put of " + n + " payloads failed, dropped. " + err.Error())
+	}
+	q.tally(pls, func(c *DailyCounts, n int64) { c.Dropped += n })
+	q.flushLedger()
+	q.log(slog.LevelWarn, "late retries", "Buffer Queue: "+n+" retries of an abandoned batch came back after the shutdown, dropped",
+		slog.Int("batch_size", len(pls)))
+}
+
+// idleWaiters to hold the channels closed once no batch of a Queue is active, see idle
+type idleWaiters struct {
+	mutex sync.Mutex
+	chans []chan struct{}
+}
+
+// idle to return a channel closed once no batch is being processed
+func (q *Queue) idle() <-chan struct{} {
+	ch := make(chan struct{})
+	q.idlers.mutex.Lock()
+	defer q.idlers.mutex.Unlock()
+	if q.activeWork.Load() == 0 {
+		close(ch)
+	} else {
+		q.idlers.chans = append(q.idlers.chans, ch)
+	}
+	return ch
+}
+
+// finish to end the active work of a batch, releasing those waiting for the queue to be idle once
+// it was the last
+func (q *Queue) finish() {
+	q.idlers.mutex.Lock()
+	defer q.idlers.mutex.Unlock()
+	if q.activeWork.Add(-1) > 0 {
+		return
+	}
+	for _, ch := range q.idlers.chans {
+		close(ch)
+	}
+	q.idlers.chans = nil
+}
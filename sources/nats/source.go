@@ -0,0 +1,159 @@
+// Package nats feeds a payloadqueue Queue from a NATS JetStream consumer. Each message is appended
+// as a payload and acknowledged to the broker only once the batch carrying it is delivered, so the
+// path from the stream to the bulk sink is at-least-once:
+//
+//	cons, _ := js.CreateOrUpdateConsumer(ctx, "ORDERS", jetstream.ConsumerConfig{Durable: "bulk", AckPolicy: jetstream.AckExplicitPolicy})
+//	src := &nats.Source{Queue: q, Progress: 10 * time.Second}
+//	cc, _ := cons.Consume(func(m jetstream.Msg) { src.Handle(m) })
+//	...
+//	cc.Stop()
+//	src.Close()
+//
+// A payload that is dead-lettered or expires is nak'd, so the broker redelivers its message, or
+// terminated with Term. A message the queue refuses, e.g. when it is full, is nak'd straight away,
+// and one its Validator rejects is terminated. A message whose payload is coalesced into another is
+// settled with that payload. A message whose payload never leaves the queue, as when it is purged,
+// is redelivered by the broker once its AckWait passes.
+package nats
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Msg to settle a message with the broker. It is satisfied by jetstream.Msg of
+// github.com/nats-io/nats.go/jetstream.
+type Msg interface {
+	Data() []byte
+	Subject() string
+	Ack() error
+	Nak() error
+	Term() error
+	InProgress() error
+}
+
+// Source to append the messages of a JetStream consumer to a Queue
+type Source struct {
+	Queue    *plq.Queue
+	Decode   func(Msg) (interface{}, error) // the Data of the payload. Default is a copy of the message data. An error terminates the message
+	Id       func(Msg) string               // the Id of the payload, e.g. from the Nats-Msg-Id header. Default is a new Id of the queue
+	Headers  func(Msg) map[string]string    // the Headers of the payload. Default is the subject as "subject"
+	Term     bool                           // a dead-lettered or expired payload terminates its message instead of having it redelivered
+	Progress time.Duration                  // how often the broker is told a message waiting in the queue is still being worked on, so its AckWait does not redeliver it. Zero means never
+	once     sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+	waiting  sync.WaitGroup
+	acked    atomic.Int64
+	nacked   atomic.Int64
+	termed   atomic.Int64
+}
+
+// Handle to append the message to the queue and settle it with the broker once its payload leaves
+// the queue. It is shaped to be called from a jetstream.MessageHandler.
+func (s *Source) Handle(msg Msg) {
+	s.once.Do(func() { s.ctx, s.cancel = context.WithCancel(context.Background()) })
+	if s.ctx.Err() != nil {
+		s.settle(msg.Nak, &s.nacked)
+		return
+	}
+	data, err := s.decode(msg)
+	if err != nil {
+		s.settle(msg.Term, &s.termed)
+		return
+	}
+	p := s.Queue.NewPayload(data)
+	if s.Id != nil {
+		p.Id = s.Id(msg)
+	}
+	if s.Headers != nil {
+		p.Headers = s.Headers(msg)
+	} else {
+		p.Headers = map[string]string{"subject": msg.Subject()}
+	}
+	// the outcome is watched before the payload is appended, so it is not missed under load
+	outcome, stop := s.Queue.Watch(p.Id)
+	if err := s.Queue.AppendContext(s.ctx, p); err != nil {
+		stop()
+		if errors.Is(err, plq.ErrInvalidPayload) {
+			s.settle(msg.Term, &s.termed)
+		} else {
+			s.settle(msg.Nak, &s.nacked)
+		}
+		return
+	}
+	s.waiting.Add(1)
+	go s.await(msg, outcome, stop)
+}
+
+// decode to return the Data of the payload of the message
+func (s *Source) decode(msg Msg) (interface{}, error) {
+	if s.Decode != nil {
+		return s.Decode(msg)
+	}
+	return append([]byte(nil), msg.Data()...), nil
+}
+
+// await to wait for the outcome of the payload, telling the broker the message is in progress
+// every Progress, and settle the message by it
+func (s *Source) await(msg Msg, outcome <-chan plq.Outcome, stop func()) {
+	defer s.waiting.Done()
+	defer stop()
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	if s.Progress > 0 {
+		go func() {
+			ticker := time.NewTicker(s.Progress)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					msg.InProgress()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	var o plq.Outcome
+	select {
+	case o = <-outcome:
+	case <-ctx.Done():
+		// the Source is closed, the broker redelivers the message once its AckWait passes
+		return
+	}
+	switch {
+	case o.Delivered:
+		s.settle(msg.Ack, &s.acked)
+	case s.Term:
+		s.settle(msg.Term, &s.termed)
+	default:
+		s.settle(msg.Nak, &s.nacked)
+	}
+}
+
+// settle to send the acknowledgement to the broker and count it once sent
+func (s *Source) settle(ack func() error, count *atomic.Int64) {
+	if ack() == nil {
+		count.Add(1)
+	}
+}
+
+// Settled to return the number of messages acknowledged, nak'd and terminated so far
+func (s *Source) Settled() (acked, nacked, terminated int64) {
+	return s.acked.Load(), s.nacked.Load(), s.termed.Load()
+}
+
+// Close to stop waiting for the payloads in the queue. The messages not settled yet are left for the
+// broker to redeliver, so stop the consumer and Shutdown the queue first to settle as many as
+// possible.
+func (s *Source) Close() {
+	s.once.Do(func() { s.ctx, s.cancel = context.WithCancel(context.Background()) })
+	s.cancel()
+	s.waiting.Wait()
+}
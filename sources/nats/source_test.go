@@ -0,0 +1,179 @@
+package nats_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/sources/nats"
+)
+
+// fakeMsg to record how a message was settled with the broker
+type fakeMsg struct {
+	data     string
+	mutex    sync.Mutex
+	settled  string
+	progress int
+}
+
+func (m *fakeMsg) Data() []byte    { return []byte(m.data) }
+func (m *fakeMsg) Subject() string { return "orders.created" }
+func (m *fakeMsg) Ack() error      { return m.settle("ack") }
+func (m *fakeMsg) Nak() error      { return m.settle("nak") }
+func (m *fakeMsg) Term() error     { return m.settle("term") }
+
+func (m *fakeMsg) InProgress() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.progress++
+	return nil
+}
+
+func (m *fakeMsg) settle(how string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.settled = how
+	return nil
+}
+
+func (m *fakeMsg) state() (string, int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.settled, m.progress
+}
+
+func TestSource(t *testing.T) {
+	t.Run("Ack the messages once their batch is delivered", func(t *testing.T) {
+		var runMutex sync.Mutex
+		var batched []interface{}
+		var subjects []string
+		q := &plq.Queue{
+			Tag:    "QueueA",
+			MaxAge: 200,
+			WorkContext: func(ctx context.Context, pls []interface{}) error {
+				b, _ := plq.BatchFromContext(ctx)
+				runMutex.Lock()
+				defer runMutex.Unlock()
+				batched = append(batched, pls...)
+				for _, p := range b.Payloads {
+					subjects = append(subjects, p.Headers["subject"])
+				}
+				return nil
+			},
+		}
+		q.Start()
+		defer q.Close()
+		src := &nats.Source{Queue: q, Progress: 10 * time.Millisecond}
+		defer src.Close()
+		msgs := []*fakeMsg{{data: "a"}, {data: "b"}}
+		for _, m := range msgs {
+			src.Handle(m)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if settled, progress := msgs[0].state(); settled != "" || progress == 0 {
+			t.Errorf("Expected the message in progress until its batch is delivered, got %q after %d", settled, progress)
+		}
+		q.Flush()
+		time.Sleep(50 * time.Millisecond)
+		for i, m := range msgs {
+			if settled, _ := m.state(); settled != "ack" {
+				t.Errorf("Expected message %d to be acked, got %q", i, settled)
+			}
+		}
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if len(batched) != 2 || string(batched[0].([]byte)) != "a" || subjects[1] != "orders.created" {
+			t.Errorf("Unexpected batch: %v %v", batched, subjects)
+		}
+		if acked, nacked, _ := src.Settled(); acked != 2 || nacked != 0 {
+			t.Errorf("Expected 2 messages acked, got %d and %d nak'd", acked, nacked)
+		}
+	})
+
+	t.Run("Ack the messages whose payloads were coalesced with the one delivered", func(t *testing.T) {
+		q := &plq.Queue{
+			Tag:         "QueueA",
+			MaxAge:      200,
+			CoalesceKey: func(p plq.Payload) string { return p.Headers["subject"] },
+			Work:        func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		defer q.Close()
+		src := &nats.Source{Queue: q}
+		defer src.Close()
+		msgs := []*fakeMsg{{data: "a"}, {data: "a"}}
+		for _, m := range msgs {
+			src.Handle(m)
+		}
+		if q.Size() != 1 {
+			t.Fatalf("Expected the messages coalesced into one payload, got %d", q.Size())
+		}
+		q.Flush()
+		time.Sleep(50 * time.Millisecond)
+		for i, m := range msgs {
+			if settled, _ := m.state(); settled != "ack" {
+				t.Errorf("Expected message %d to be acked, got %q", i, settled)
+			}
+		}
+	})
+
+	t.Run("Settle every message when the outcomes outpace the AwaitHistory", func(t *testing.T) {
+		q := &plq.Queue{
+			Tag:          "QueueA",
+			MaxSize:      1,
+			MaxAge:       200,
+			AwaitHistory: 1,
+			Work:         func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		defer q.Close()
+		src := &nats.Source{Queue: q}
+		defer src.Close()
+		msgs := make([]*fakeMsg, 200)
+		for i := range msgs {
+			msgs[i] = &fakeMsg{data: strconv.Itoa(i)}
+			src.Handle(msgs[i])
+		}
+		time.Sleep(100 * time.Millisecond)
+		if acked, _, _ := src.Settled(); acked != int64(len(msgs)) {
+			t.Errorf("Expected every message acked, got %d", acked)
+		}
+	})
+
+	t.Run("Nak the messages of a dead-lettered payload and terminate the invalid ones", func(t *testing.T) {
+		q := &plq.Queue{
+			Tag:         "QueueA",
+			MaxSize:     1,
+			MaxAge:      200,
+			Validator:   func(p plq.Payload) error { return validate(p) },
+			WorkContext: func(ctx context.Context, pls []interface{}) error { return errors.New("the sink is down") },
+		}
+		q.Start()
+		defer q.Close()
+		n := 0
+		src := &nats.Source{Queue: q, Id: func(nats.Msg) string { n++; return strconv.Itoa(n) }}
+		defer src.Close()
+		failed, invalid := &fakeMsg{data: "a"}, &fakeMsg{data: ""}
+		src.Handle(failed)
+		src.Handle(invalid)
+		time.Sleep(50 * time.Millisecond)
+		if settled, _ := failed.state(); settled != "nak" {
+			t.Errorf("Expected the failed message to be nak'd, got %q", settled)
+		}
+		if settled, _ := invalid.state(); settled != "term" {
+			t.Errorf("Expected the invalid message to be terminated, got %q", settled)
+		}
+	})
+}
+
+// validate to reject a payload without data
+func validate(p plq.Payload) error {
+	if len(p.Data.([]byte)) == 0 {
+		return errors.New("the message is empty")
+	}
+	return nil
+}
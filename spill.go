@@ -0,0 +1,115 @@
+package payloadqueue
+
+import (
+	"log/slog"
+	"strconv"
+)
+
+// spill to put the oldest pending payloads into the Spill storage while those held in memory weigh
+// more than the MemoryBudget. The newest payload is always kept in memory. A queue with a Storage
+// holds no more than a batch in memory and does not spill.
+func (q *Queue) spill() {
+	if q.MemoryBudget <= 0 || q.Spill == nil || q.Storage != nil {
+		return
+	}
+	q.payloadMutex.Lock()
+	total := q.payloadQueue.bytes
+	n := 0
+	for ; total > q.MemoryBudget && n < q.payloadQueue.len()-1; n++ {
+		total -= q.payloadQueue.at(n).size
+	}
+	if n == 0 {
+		q.payloadMutex.Unlock()
+		return
+	}
+	spilled := q.payloadQueue.take(n)
+	q.spilling += n
+	q.countOut(spilled, 1)
+	q.payloadMutex.Unlock()
+
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	err := q.Spill.Put(ctx, spilled)
+	q.payloadMutex.Lock()
+	q.spilling -= n
+	if err != nil {
+		q.countOut(spilled, -1)
+		q.payloadQueue.pushFront(spilled)
+	} else {
+		q.spilled += n
+	}
+	q.payloadMutex.Unlock()
+	if err != nil {
+		q.event("Spill: Put of " + strconv.Itoa(n) + " payloads failed, kept in memory. " + err.Error())
+		return
+	}
+	q.log(slog.LevelDebug, "payloads spilled", "Buffer Queue: Spilled "+strconv.Itoa(n)+" payloads",
+		slog.Int("batch_size", n))
+}
+
+// reload to claim up to a batch of the spilled payloads back from the Spill storage, ahead of the
+// payloads held in memory since they are older. A queue started with a Spill storage reloads what
+// a previous run left in it.
+func (q *Queue) reload() {
+	if q.Spill == nil || q.Storage != nil {
+		return
+	}
+	q.payloadMutex.Lock()
+	n := q.batchSize()
+	if q.spilled == 0 && !q.spillLeft {
+		n = 0
+	}
+	q.payloadMutex.Unlock()
+	pls := q.unspill(n)
+	if len(pls) == 0 {
+		return
+	}
+	q.weigh(pls)
+	q.payloadMutex.Lock()
+	q.payloadQueue.pushFront(pls)
+	q.payloadMutex.Unlock()
+	q.log(slog.LevelDebug, "payloads reloaded", "Buffer Queue: Reloaded "+strconv.Itoa(len(pls))+" spilled payloads",
+		slog.Int("batch_size", len(pls)))
+}
+
+// unspill to claim up to n payloads from the Spill storage and acknowledge them there, as they are
+// held in memory from then on
+func (q *Queue) unspill(n int) []Payload {
+	if n <= 0 {
+		return nil
+	}
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	pls, err := q.Spill.Claim(ctx, n)
+	if err != nil {
+		q.event("Spill: Claim failed. " + err.Error())
+		return nil
+	}
+	q.assign(pls)
+	q.payloadMutex.Lock()
+	q.spilled = max(q.spilled-len(pls), 0)
+	q.countOut(pls, -1)
+	if len(pls) < n {
+		q.spillLeft = false
+	}
+	q.payloadMutex.Unlock()
+	if len(pls) == 0 {
+		return nil
+	}
+	ids := make([]string, len(pls))
+	for i, p := range pls {
+		ids[i] = p.Id
+	}
+	if err := q.Spill.Ack(ctx, ids); err != nil {
+		q.event("Spill: Ack of " + strconv.Itoa(len(ids)) + " payloads failed. " + err.Error())
+	}
+	return pls
+}
+
+// sizeOf to measure the payload against the MemoryBudget, once, see weigh
+func (q *Queue) sizeOf(p Payload) int {
+	if q.SizeFunc != nil {
+		return q.SizeFunc(p)
+	}
+	return p.bytes
+}
@@ -0,0 +1,115 @@
+package payloadqueue
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// ErrBatchTooLarge is returned, or wrapped, by a handler whose downstream rejected the batch as too
+// large, e.g. an HTTP 413. The batch is split in halves and the halves are pushed again, see
+// TooLarge.
+var ErrBatchTooLarge = errors.New("the batch is too large")
+
+// split to cut the payloads of a flush into the calls to the handler: at most the batch size or the
+// MaxBatchSize, whichever is smaller, and at most MaxBatchBytes of Data each. A payload larger than
+// MaxBatchBytes is pushed on its own. The payloadMutex must be held.
+func (q *Queue) split(pls []Payload, size int) [][]Payload {
+	if q.MaxBatchSize > 0 && q.MaxBatchSize < size {
+		size = q.MaxBatchSize
+	}
+	if size <= 0 {
+		size = len(pls)
+	}
+	var calls [][]Payload
+	start, bytes := 0, 0
+	for i, p := range pls {
+		n := i - start
+		if n > 0 && (n >= size || (q.MaxBatchBytes > 0 && bytes+p.bytes > q.MaxBatchBytes)) {
+			calls = append(calls, pls[start:i:i])
+			start, bytes = i, 0
+		}
+		bytes += p.bytes
+	}
+	return append(calls, pls[start:])
+}
+
+// weigh to record the size of the Data of the payloads as encoded by the Codec, once, when the
+// MaxBatchBytes or the MemoryBudget applies. Data that is a []byte or a string is counted as is.
+// With a MemoryBudget, the size counted against it is recorded too.
+func (q *Queue) weigh(pls []Payload) {
+	if q.MemoryBudget > 0 {
+		defer func() {
+			for i := range pls {
+				if pls[i].size == 0 {
+					pls[i].size = q.sizeOf(pls[i])
+				}
+			}
+		}()
+	}
+	if q.MaxBatchBytes <= 0 && (q.MemoryBudget <= 0 || q.SizeFunc != nil) {
+		return
+	}
+	codec := q.Codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	for i := range pls {
+		if pls[i].bytes > 0 {
+			continue
+		}
+		switch d := pls[i].Data.(type) {
+		case []byte:
+			pls[i].bytes = len(d)
+		case string:
+			pls[i].bytes = len(d)
+		default:
+			if b, err := codec.Marshal(d); err == nil {
+				pls[i].bytes = len(b)
+			}
+		}
+	}
+}
+
+// tooLarge to classify the error of the handler as the batch being too large, by the TooLarge or
+// as ErrBatchTooLarge
+func (q *Queue) tooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+	if q.TooLarge != nil {
+		return q.TooLarge(err)
+	}
+	return errors.Is(err, ErrBatchTooLarge)
+}
+
+// chunk to split a batch the handler rejected as too large in halves, and push each as a batch of
+// its own, split again while the handler rejects it. None of the payloads were delivered, so
+// pushing them again is safe. Each chunk has the Id of the batch followed by its index, e.g.
+// 9c1f.1, so it is stable for an idempotency key, and the split is recorded in the Journal.
+func (q *Queue) chunk(work workContextHandler, batch *Batch, started time.Time, timeout time.Duration, err error) error {
+	half := (len(batch.Payloads) + 1) / 2
+	chunks := []*Batch{
+		{Id: batch.Id + ".1", Tag: batch.Tag, Payloads: batch.Payloads[:half:half], SplitFrom: batch.Id},
+		{Id: batch.Id + ".2", Tag: batch.Tag, Payloads: batch.Payloads[half:], SplitFrom: batch.Id},
+	}
+	r := q.batchRecord(batch, started, nil, err)
+	r.SplitInto = []string{chunks[0].Id, chunks[1].Id}
+	q.record(r)
+	q.counters.add(func(s *Stats) {
+		s.Batches++
+		s.Split++
+	})
+	q.log(slog.LevelWarn, "batch split", "Batch Push ["+q.Tag+"]: Too large, split "+strconv.Itoa(len(batch.Payloads))+" payloads in halves",
+		slog.String("batch_id", batch.Id), slog.Int("batch_size", len(batch.Payloads)), resultAttr(err))
+	var errs []error
+	for _, c := range chunks {
+		ctx := q.flag(withBatch(context.Background(), c), c)
+		if err := q.push(ctx, work, c, nil, timeout); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,429 @@
+// Package sqlitestore persists the payloads of a payloadqueue Queue in an embedded SQLite
+// database, for single-node durability without external infrastructure. Every payload is kept
+// with its status, so the history stays queryable until the Retention removes it, and the delivered
+// payloads are kept by their batch, so they can be replayed until then.
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Status of a stored payload
+type Status string
+
+const (
+	StatusPending  Status = "pending"   // put, waiting to be claimed
+	StatusInFlight Status = "in-flight" // claimed into a batch
+	StatusDone     Status = "done"      // delivered or expired
+	StatusDead     Status = "dead"      // dead-lettered
+)
+
+// cleanupEvery is how often Ack removes the records past the Retention
+const cleanupEvery = time.Minute
+
+// Storage to persist the payloads of a Queue in a table of a SQLite database. It is meant for one
+// process per database: payloads left in flight by a crashed process are put back to pending when
+// the next process first uses the Storage.
+type Storage struct {
+	DB        *sql.DB
+	Table     string        // name of the table, created when missing. Default is "payloads"
+	Retention time.Duration // how long done and dead payloads are kept, and delivered ones can be replayed. Zero keeps them forever
+	Codec     plq.Codec     // serializes the Data, encrypted by the Encryption of the queue when it has one. Default is the Codec of the queue
+	mutex     sync.Mutex
+	ready     bool
+	cleaned   time.Time
+}
+
+// Open to open (or create) the SQLite database file at the path as a Storage
+func Open(path string) (*Storage, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite serialises writers; a single connection avoids busy errors between them
+	db.SetMaxOpenConns(1)
+	return &Storage{DB: db}, nil
+}
+
+// Close to close the database
+func (s *Storage) Close() error {
+	return s.DB.Close()
+}
+
+// Put to insert the payloads as pending. A payload with an id that is already stored is ignored.
+func (s *Storage) Put(ctx context.Context, pls []plq.Payload) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixNano()
+	for _, p := range pls {
+		b, err := plq.EncodePayload(s.codec(ctx), p)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO "+s.table()+
+			" (id, payload, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+			p.Id, b, StatusPending, now, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Claim to mark up to max pending payloads in flight, oldest first, and return them
+func (s *Storage) Claim(ctx context.Context, max int) ([]plq.Payload, error) {
+	if err := s.init(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "SELECT id, payload FROM "+s.table()+
+		" WHERE status = ? ORDER BY seq LIMIT ?", StatusPending, max)
+	if err != nil {
+		return nil, err
+	}
+	var pls []plq.Payload
+	status := make(map[string]Status)
+	for rows.Next() {
+		var id string
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p, err := plq.DecodePayload(s.codec(ctx), raw)
+		if err != nil {
+			// a record that cannot be decoded is marked dead rather than claimed forever
+			status[id] = StatusDead
+			continue
+		}
+		status[id] = StatusInFlight
+		pls = append(pls, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	for id, st := range status {
+		_, err := tx.ExecContext(ctx, "UPDATE "+s.table()+" SET status = ?, updated_at = ? WHERE id = ?", st, now, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pls, tx.Commit()
+}
+
+// Ack to mark the payloads done
+func (s *Storage) Ack(ctx context.Context, ids []string) error {
+	if err := s.mark(ctx, ids, StatusDone, nil); err != nil {
+		return err
+	}
+	return s.cleanup(ctx)
+}
+
+// Archive to mark the payloads done, as delivered in the batch with the id
+func (s *Storage) Archive(ctx context.Context, batchId string, ids []string) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixNano()
+	for _, id := range ids {
+		_, err := tx.ExecContext(ctx, "UPDATE "+s.table()+" SET status = ?, error = '', batch_id = ?, updated_at = ? WHERE id = ?",
+			StatusDone, batchId, now, id)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.cleanup(ctx)
+}
+
+// Replay to make the payloads delivered in the batch with the id pending again, so the queue
+// claims them again
+func (s *Storage) Replay(ctx context.Context, batchId string) ([]string, error) {
+	return s.replay(ctx, "batch_id = ?", batchId)
+}
+
+// ReplaySince to make the payloads delivered at or after the time pending again, so the queue
+// claims them again
+func (s *Storage) ReplaySince(ctx context.Context, since time.Time) ([]string, error) {
+	return s.replay(ctx, "batch_id != '' AND updated_at >= ?", since.UnixNano())
+}
+
+// replay to make the done payloads that match the condition pending again, in the order they were
+// put, returning their ids
+func (s *Storage) replay(ctx context.Context, cond string, arg interface{}) ([]string, error) {
+	if err := s.init(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.QueryContext(ctx, "UPDATE "+s.table()+" SET status = ?, batch_id = '', updated_at = ? WHERE status = ? AND "+cond+" RETURNING id",
+		StatusPending, time.Now().UnixNano(), StatusDone, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Bury to mark the payloads dead, recording the reason
+func (s *Storage) Bury(ctx context.Context, ids []string, reason error) error {
+	return s.mark(ctx, ids, StatusDead, reason)
+}
+
+// Redrive to make the dead payloads pending again, so the queue claims them for another round of
+// attempts
+func (s *Storage) Redrive(ctx context.Context) (int, error) {
+	if err := s.init(ctx); err != nil {
+		return 0, err
+	}
+	res, err := s.DB.ExecContext(ctx, "UPDATE "+s.table()+" SET status = ?, error = '', updated_at = ? WHERE status = ?",
+		StatusPending, time.Now().UnixNano(), StatusDead)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// DeadLetters to return up to max of the dead payloads, most recently dead-lettered first
+func (s *Storage) DeadLetters(ctx context.Context, max int) ([]plq.DeadLetter, error) {
+	records, err := s.History(ctx, Query{Status: StatusDead, Limit: max})
+	if err != nil {
+		return nil, err
+	}
+	dead := make([]plq.DeadLetter, 0, len(records))
+	for _, r := range records {
+		dead = append(dead, plq.DeadLetter{Payload: r.Payload, Reason: r.Error, At: r.UpdatedAt})
+	}
+	return dead, nil
+}
+
+// mark to set the status of the payloads
+func (s *Storage) mark(ctx context.Context, ids []string, status Status, reason error) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	msg := ""
+	if reason != nil {
+		msg = reason.Error()
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixNano()
+	for _, id := range ids {
+		_, err := tx.ExecContext(ctx, "UPDATE "+s.table()+" SET status = ?, error = ?, updated_at = ? WHERE id = ?", status, msg, now, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Record of a stored payload
+type Record struct {
+	Payload   plq.Payload
+	Status    Status
+	Error     string // why the payload was dead-lettered
+	BatchId   string // the batch the payload was delivered in, when it was archived
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Query to select the records returned by History. Zero fields do not filter.
+type Query struct {
+	Status  Status
+	BatchId string    // only records delivered in the batch
+	Since   time.Time // only records updated at or after
+	Limit   int
+}
+
+// History to return the stored records that match the query, most recently updated first
+func (s *Storage) History(ctx context.Context, query Query) ([]Record, error) {
+	if err := s.init(ctx); err != nil {
+		return nil, err
+	}
+	where := []string{"updated_at >= ?"}
+	args := []interface{}{query.Since.UnixNano()}
+	if query.Since.IsZero() {
+		args[0] = 0
+	}
+	if query.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, query.Status)
+	}
+	if query.BatchId != "" {
+		where = append(where, "batch_id = ?")
+		args = append(args, query.BatchId)
+	}
+	stmt := "SELECT payload, status, error, batch_id, created_at, updated_at FROM " + s.table() +
+		" WHERE " + strings.Join(where, " AND ") + " ORDER BY updated_at DESC, seq DESC"
+	if query.Limit > 0 {
+		stmt += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+	rows, err := s.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		var raw []byte
+		var r Record
+		var created, updated int64
+		if err := rows.Scan(&raw, &r.Status, &r.Error, &r.BatchId, &created, &updated); err != nil {
+			return nil, err
+		}
+		// an undecodable payload is still part of the history, without its content
+		r.Payload, _ = plq.DecodePayload(s.codec(ctx), raw)
+		r.CreatedAt = time.Unix(0, created)
+		r.UpdatedAt = time.Unix(0, updated)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// Count to return the number of stored payloads with the status
+func (s *Storage) Count(ctx context.Context, status Status) (int, error) {
+	if err := s.init(ctx); err != nil {
+		return 0, err
+	}
+	var n int
+	err := s.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+s.table()+" WHERE status = ?", status).Scan(&n)
+	return n, err
+}
+
+// Cleanup to remove the done and dead payloads that are older than the Retention, returning how
+// many were removed. It is run by Ack every minute when a Retention is set.
+func (s *Storage) Cleanup(ctx context.Context) (int64, error) {
+	if s.Retention <= 0 {
+		return 0, nil
+	}
+	if err := s.init(ctx); err != nil {
+		return 0, err
+	}
+	res, err := s.DB.ExecContext(ctx, "DELETE FROM "+s.table()+" WHERE status IN (?, ?) AND updated_at < ?",
+		StatusDone, StatusDead, time.Now().Add(-s.Retention).UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// cleanup to run the Cleanup when it is due
+func (s *Storage) cleanup(ctx context.Context) error {
+	if s.Retention <= 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	due := time.Since(s.cleaned) >= cleanupEvery
+	if due {
+		s.cleaned = time.Now()
+	}
+	s.mutex.Unlock()
+	if !due {
+		return nil
+	}
+	_, err := s.Cleanup(ctx)
+	return err
+}
+
+// init to create the table once and recover the payloads a crashed process left in flight
+func (s *Storage) init(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ready {
+		return nil
+	}
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS " + s.table() + ` (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			id TEXT NOT NULL UNIQUE,
+			payload BLOB NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			batch_id TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`,
+		"CREATE INDEX IF NOT EXISTS " + s.table() + "_status ON " + s.table() + " (status, seq)",
+		"CREATE INDEX IF NOT EXISTS " + s.table() + "_updated ON " + s.table() + " (updated_at)",
+	}
+	for _, stmt := range stmts {
+		if _, err := s.DB.ExecContext(ctx, stmt); err != nil {
+			return errors.New("sqlitestore: creating the table failed: " + err.Error())
+		}
+	}
+	// a table created before payloads were archived by their batch lacks the batch_id
+	var archived int
+	err := s.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'batch_id'", s.table()).Scan(&archived)
+	if err == nil && archived == 0 {
+		_, err = s.DB.ExecContext(ctx, "ALTER TABLE "+s.table()+" ADD COLUMN batch_id TEXT NOT NULL DEFAULT ''")
+	}
+	if err == nil {
+		_, err = s.DB.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS "+s.table()+"_batch ON "+s.table()+" (batch_id)")
+	}
+	if err != nil {
+		return errors.New("sqlitestore: adding the batch_id failed: " + err.Error())
+	}
+	_, err = s.DB.ExecContext(ctx, "UPDATE "+s.table()+" SET status = ? WHERE status = ?", StatusPending, StatusInFlight)
+	if err != nil {
+		return errors.New("sqlitestore: recovering the payloads in flight failed: " + err.Error())
+	}
+	s.ready = true
+	return nil
+}
+
+func (s *Storage) codec(ctx context.Context) plq.Codec {
+	return plq.StorageCodec(ctx, s.Codec)
+}
+
+func (s *Storage) table() string {
+	if s.Table == "" {
+		return "payloads"
+	}
+	return s.Table
+}
+
+var (
+	_ plq.RedriveStorage   = (*Storage)(nil)
+	_ plq.DeadLetterReader = (*Storage)(nil)
+	_ plq.ArchiveStorage   = (*Storage)(nil)
+)
@@ -0,0 +1,576 @@
+package sqlitestore_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/queuetest"
+	"github.com/sam-ish/payloadqueue/sqlitestore"
+)
+
+// open to open a Storage on a database file in the test's directory
+func open(t *testing.T, path string) *sqlitestore.Storage {
+	s, err := sqlitestore.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Claim, acknowledge, bury and query the history", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "queue.db"))
+		err := s.Put(ctx, []plq.Payload{{Id: "1", Data: "a"}, {Id: "2", Data: "b"}, {Id: "3", Data: "c", Headers: map[string]string{"tenant": "acme"}}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		pls, err := s.Claim(ctx, 2)
+		if err != nil || len(pls) != 2 || pls[0].Id != "1" || pls[0].Data != "a" {
+			t.Fatalf("Unexpected claim: %v %v", pls, err)
+		}
+		pls, _ = s.Claim(ctx, 10)
+		if len(pls) != 1 || pls[0].Headers["tenant"] != "acme" {
+			t.Fatalf("Expected the remaining payload to be claimed, got %v", pls)
+		}
+		if err := s.Ack(ctx, []string{"1", "3"}); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		if err := s.Bury(ctx, []string{"2"}, errors.New("rejected")); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+		if n, _ := s.Count(ctx, sqlitestore.StatusDone); n != 2 {
+			t.Errorf("Expected 2 done payloads, got %d", n)
+		}
+		dead, err := s.History(ctx, sqlitestore.Query{Status: sqlitestore.StatusDead})
+		if err != nil || len(dead) != 1 || dead[0].Payload.Id != "2" || dead[0].Error != "rejected" {
+			t.Errorf("Unexpected history: %+v %v", dead, err)
+		}
+		all, _ := s.History(ctx, sqlitestore.Query{Limit: 2})
+		if len(all) != 2 || all[0].Payload.Id != "2" {
+			t.Errorf("Expected the most recently updated first, got %+v", all)
+		}
+	})
+
+	t.Run("Payloads in flight are recovered after a crash", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "queue.db")
+		crashed := open(t, path)
+		crashed.Put(ctx, []plq.Payload{{Id: "1", Data: "a"}, {Id: "2", Data: "b"}})
+		if pls, _ := crashed.Claim(ctx, 10); len(pls) != 2 {
+			t.Fatalf("Expected 2 payloads claimed, got %v", pls)
+		}
+		crashed.Ack(ctx, []string{"1"})
+		crashed.Close()
+
+		s := open(t, path)
+		pls, err := s.Claim(ctx, 10)
+		if err != nil || len(pls) != 1 || pls[0].Id != "2" {
+			t.Errorf("Expected the unacknowledged payload to be claimed again, got %v %v", pls, err)
+		}
+	})
+
+	t.Run("Done and dead payloads past the retention are removed", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "queue.db"))
+		s.Retention = 50 * time.Millisecond
+		s.Put(ctx, []plq.Payload{{Id: "1", Data: "a"}, {Id: "2", Data: "b"}})
+		s.Claim(ctx, 1)
+		s.Ack(ctx, []string{"1"})
+		time.Sleep(100 * time.Millisecond)
+		n, err := s.Cleanup(ctx)
+		if err != nil || n != 1 {
+			t.Errorf("Expected 1 payload removed, got %d %v", n, err)
+		}
+		if n, _ := s.Count(ctx, sqlitestore.StatusPending); n != 1 {
+			t.Errorf("Expected the pending payload to be kept, got %d", n)
+		}
+	})
+
+	t.Run("A queue records delivered and dead-lettered payloads", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "queue.db"))
+		q := &plq.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Storage: s,
+			Work: func(pls []interface{}) int {
+				if pls[0] == "bad" {
+					return 1
+				}
+				return 0
+			},
+		}
+		q.Start()
+		q.Append(plq.Payload{Id: "1", Data: "good"})
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		q.Append(plq.Payload{Id: "2", Data: "bad"})
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		q.Close()
+		done, _ := s.Count(ctx, sqlitestore.StatusDone)
+		dead, _ := s.History(ctx, sqlitestore.Query{Status: sqlitestore.StatusDead})
+		if done != 1 || len(dead) != 1 || dead[0].Payload.Id != "2" || dead[0].Error == "" {
+			t.Errorf("Unexpected records: %d done, dead %+v", done, dead)
+		}
+	})
+
+	t.Run("A queue spills the payloads over its MemoryBudget", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "spill.db"))
+		var runMutex sync.Mutex
+		var batched []interface{}
+		var measured atomic.Int64
+		q := &plq.Queue{
+			MaxSize:      4,
+			MaxAge:       200,
+			Tag:          "QueueA",
+			MemoryBudget: 10,
+			SizeFunc: func(p plq.Payload) int {
+				measured.Add(1)
+				return len(p.Data.(string))
+			},
+			Spill: s,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		if err := q.Start(); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		q.Append(plq.Payload{Id: "1", Data: "aaaa"})
+		q.Append(plq.Payload{Id: "2", Data: "bbbb"})
+		q.Append(plq.Payload{Id: "3", Data: "cccc"})
+		if st := q.Stats(); st.Spilled != 1 || st.Pending != 3 || q.Size() != 3 {
+			t.Errorf("Expected the oldest payload spilled, got %+v", st)
+		}
+		q.Append(plq.Payload{Id: "4", Data: "dddd"})
+		time.Sleep(50 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 4 || batched[0] != "aaaa" || batched[1] != "bbbb" || batched[3] != "dddd" {
+			t.Errorf("Expected the spilled payloads reloaded ahead of the others, got %v", batched)
+		}
+		runMutex.Unlock()
+		if st := q.Stats(); st.Spilled != 0 || st.Pending != 0 {
+			t.Errorf("Expected nothing left spilled, got %+v", st)
+		}
+		if n, _ := s.Count(ctx, sqlitestore.StatusPending); n != 0 {
+			t.Errorf("Expected the spilled payloads acknowledged, got %d pending", n)
+		}
+		// each payload is measured as it is appended, and the 2 spilled ones again as they are reloaded
+		if n := measured.Load(); n != 6 {
+			t.Errorf("Expected the SizeFunc called once per payload held, got %d calls", n)
+		}
+		q.Close()
+
+		q = &plq.Queue{MemoryBudget: 10, Work: func(pls []interface{}) int { return 0 }}
+		if err := q.Start(); err == nil {
+			t.Errorf("Expected a MemoryBudget without a Spill storage to fail Start")
+		}
+	})
+
+	t.Run("A shutdown persists what it could not deliver into the Spill storage", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "spill.db"))
+		q := &plq.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Spill:   s,
+			Work:    func(pls []interface{}) int { return 1 },
+		}
+		q.Start()
+		q.AppendAfter(plq.Payload{Id: "1", Data: "a"}, time.Hour)
+		r, err := q.Shutdown(ctx, plq.ShutdownPhases{})
+		if err != nil || r.Persisted != 1 || r.Dropped != 0 {
+			t.Fatalf("Expected the delayed payload persisted, got %+v, %v", r, err)
+		}
+
+		var runMutex sync.Mutex
+		var batched []interface{}
+		q = &plq.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Spill:   s,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+		}
+		q.Start()
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		q.Close()
+		runMutex.Lock()
+		defer runMutex.Unlock()
+		if len(batched) != 1 || batched[0] != "a" {
+			t.Errorf("Expected the next run to deliver the persisted payload, got %v", batched)
+		}
+	})
+
+	t.Run("Dead payloads are redriven to the queue", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "queue.db"))
+		var runMutex sync.Mutex
+		healthy := false
+		q := &plq.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Storage: s,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				defer runMutex.Unlock()
+				if !healthy {
+					return 1
+				}
+				return 0
+			},
+		}
+		q.Start()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		q.Append(plq.Payload{Id: "2", Data: "b"})
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		healthy = true
+		runMutex.Unlock()
+		dls, err := q.DeadLetters(ctx, 1)
+		if err != nil || len(dls) != 1 || dls[0].Reason == "" || dls[0].At.IsZero() || (dls[0].Payload.Id != "1" && dls[0].Payload.Id != "2") {
+			t.Fatalf("Expected the last dead-lettered payload, got %+v, %v", dls, err)
+		}
+		n, err := q.Redrive(ctx)
+		if err != nil || n != 2 {
+			t.Fatalf("Expected 2 payloads redriven, got %d, %v", n, err)
+		}
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		q.Close()
+		done, _ := s.Count(ctx, sqlitestore.StatusDone)
+		dead, _ := s.Count(ctx, sqlitestore.StatusDead)
+		if done != 2 || dead != 0 {
+			t.Errorf("Expected the redriven payloads delivered, got %d done and %d dead", done, dead)
+		}
+	})
+
+	t.Run("The queue's Codec serializes the Data", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "queue.db"))
+		batched := make(chan interface{}, 1)
+		q := &plq.Queue{
+			MaxSize: 1,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Storage: s,
+			Codec:   plq.GobCodec{},
+			Work: func(pls []interface{}) int {
+				batched <- pls[0]
+				return 0
+			},
+		}
+		q.Start()
+		defer q.Close()
+		q.Append(plq.Payload{Id: "1", Data: 42})
+		select {
+		case v := <-batched:
+			if v != 42 {
+				t.Errorf("Expected the int to survive the storage, got %#v", v)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected a batch")
+		}
+	})
+
+	t.Run("The Data is encrypted at rest with the queue's Encryption", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "queue.db"))
+		batched := make(chan interface{}, 1)
+		q := &plq.Queue{
+			MaxSize:    1,
+			MaxAge:     200,
+			Tag:        "QueueA",
+			Storage:    s,
+			Encryption: plq.StaticKey{Id: "k1", Secret: []byte("0123456789abcdef0123456789abcdef")},
+			Work: func(pls []interface{}) int {
+				batched <- pls[0]
+				return 0
+			},
+		}
+		q.Start()
+		defer q.Close()
+		q.Pause()
+		q.Append(plq.Payload{Id: "1", Data: "123-45-6789"})
+		var raw []byte
+		if err := s.DB.QueryRowContext(ctx, "SELECT payload FROM payloads WHERE id = '1'").Scan(&raw); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if _, err := plq.DecodePayload(plq.JSONCodec{}, raw); err == nil {
+			t.Errorf("Expected the stored Data not to decode without the key")
+		}
+		q.Resume()
+		select {
+		case v := <-batched:
+			if v != "123-45-6789" {
+				t.Errorf("Expected the Data decrypted for the handler, got %#v", v)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected a batch")
+		}
+	})
+
+	t.Run("The Data is encrypted at rest with a Codec of the storage", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "queue.db"))
+		s.Codec = plq.JSONCodec{}
+		batched := make(chan interface{}, 1)
+		q := &plq.Queue{
+			MaxSize:    1,
+			MaxAge:     200,
+			Tag:        "QueueA",
+			Storage:    s,
+			Encryption: plq.StaticKey{Id: "k1", Secret: []byte("0123456789abcdef0123456789abcdef")},
+			Work: func(pls []interface{}) int {
+				batched <- pls[0]
+				return 0
+			},
+		}
+		q.Start()
+		defer q.Close()
+		q.Pause()
+		q.Append(plq.Payload{Id: "1", Data: "123-45-6789"})
+		var raw []byte
+		if err := s.DB.QueryRowContext(ctx, "SELECT payload FROM payloads WHERE id = '1'").Scan(&raw); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if p, err := plq.DecodePayload(plq.JSONCodec{}, raw); err == nil {
+			t.Errorf("Expected the stored Data not to be plaintext, got %#v", p.Data)
+		}
+		q.Resume()
+		select {
+		case v := <-batched:
+			if v != "123-45-6789" {
+				t.Errorf("Expected the Data decrypted for the handler, got %#v", v)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected a batch")
+		}
+	})
+
+	t.Run("A payload restored after a restart is reconciled on the day it was appended", func(t *testing.T) {
+		dir := t.TempDir()
+		path, ledger := filepath.Join(dir, "queue.db"), filepath.Join(dir, "ledger.json")
+		yesterday := time.Now().AddDate(0, 0, -1)
+		q := &plq.Queue{
+			MaxSize: 10,
+			MaxAge:  200,
+			Tag:     "QueueA",
+			Storage: open(t, path),
+			Clock:   queuetest.NewClock(yesterday),
+			Ledger:  &plq.FileLedger{Path: ledger},
+			Work:    func(pls []interface{}) int { return 0 },
+		}
+		q.Start()
+		q.Pause()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		q.Close()
+
+		delivered := make(chan struct{}, 1)
+		q = &plq.Queue{
+			MaxSize:      1,
+			MaxAge:       200,
+			Tag:          "QueueA",
+			Storage:      open(t, path),
+			PollInterval: 20 * time.Millisecond,
+			Ledger:       &plq.FileLedger{Path: ledger},
+			Work: func(pls []interface{}) int {
+				delivered <- struct{}{}
+				return 0
+			},
+		}
+		q.Start()
+		defer q.Close()
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the restored payload to be delivered")
+		}
+		time.Sleep(20 * time.Millisecond)
+		r, err := q.Reconcile(ctx, yesterday)
+		if err != nil || r.Appended != 1 || r.Delivered != 1 || r.Outstanding != 0 {
+			t.Errorf("Expected the payload appended and delivered yesterday, got %+v and %v", r, err)
+		}
+	})
+
+	t.Run("Delivered batches are replayed by their id or since a time", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "queue.db"))
+		var runMutex sync.Mutex
+		var batched []interface{}
+		var batchIds []string
+		q := &plq.Queue{
+			MaxSize:      2,
+			MaxAge:       200,
+			Tag:          "QueueA",
+			Storage:      s,
+			PollInterval: 50 * time.Millisecond,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+			OnBatchDone: func(r plq.BatchResult) {
+				runMutex.Lock()
+				batchIds = append(batchIds, r.BatchId)
+				runMutex.Unlock()
+			},
+		}
+		q.Start()
+		defer q.Close()
+		q.Append(plq.Payload{Id: "1", Data: "a"})
+		q.Append(plq.Payload{Id: "2", Data: "b"})
+		time.Sleep(100 * time.Millisecond)
+		since := time.Now()
+		q.Append(plq.Payload{Id: "3", Data: "c"})
+		q.Append(plq.Payload{Id: "4", Data: "d"})
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if len(batchIds) != 2 || len(batched) != 4 {
+			t.Fatalf("Expected 2 batches delivered, got %v %v", batchIds, batched)
+		}
+		first := batchIds[0]
+		batched = nil
+		runMutex.Unlock()
+		archived, _ := s.History(ctx, sqlitestore.Query{BatchId: first})
+		if len(archived) != 2 || archived[0].Status != sqlitestore.StatusDone {
+			t.Errorf("Expected the payloads of the first batch archived, got %+v", archived)
+		}
+
+		n, err := q.Replay(ctx, first)
+		if err != nil || n != 2 {
+			t.Fatalf("Expected 2 payloads replayed, got %d %v", n, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 2 || batched[0] != "a" || batched[1] != "b" {
+			t.Errorf("Expected the first batch delivered again, got %v", batched)
+		}
+		batched = nil
+		runMutex.Unlock()
+		if n, _ := q.Replay(ctx, "unknown"); n != 0 {
+			t.Errorf("Expected nothing replayed for an unknown batch, got %d", n)
+		}
+
+		n, err = q.ReplaySince(ctx, since)
+		if err != nil || n != 4 {
+			t.Fatalf("Expected the 4 payloads delivered since replayed, got %d %v", n, err)
+		}
+		// a batch is claimed at a time, the next one when the Storage is polled
+		time.Sleep(300 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 4 || batched[0] != "a" || batched[2] != "c" {
+			t.Errorf("Expected the payloads replayed in the order they were put, got %v", batched)
+		}
+		runMutex.Unlock()
+	})
+
+	t.Run("A batch delivered on an idempotent queue is replayed", func(t *testing.T) {
+		s := open(t, filepath.Join(t.TempDir(), "queue.db"))
+		var runMutex sync.Mutex
+		var batched []interface{}
+		var batchIds []string
+		q := &plq.Queue{
+			MaxSize:      2,
+			MaxAge:       200,
+			Tag:          "QueueA",
+			Storage:      s,
+			Idempotency:  &keyStore{keys: make(map[string]bool)},
+			PollInterval: 50 * time.Millisecond,
+			Work: func(pls []interface{}) int {
+				runMutex.Lock()
+				batched = append(batched, pls...)
+				runMutex.Unlock()
+				return 0
+			},
+			OnBatchDone: func(r plq.BatchResult) {
+				runMutex.Lock()
+				batchIds = append(batchIds, r.BatchId)
+				runMutex.Unlock()
+			},
+		}
+		q.Start()
+		defer q.Close()
+		q.Append(plq.Payload{Id: "1", Data: "a", IdempotencyKey: "key-a"})
+		q.Append(plq.Payload{Id: "2", Data: "b", IdempotencyKey: "key-b"})
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if len(batchIds) != 1 || len(batched) != 2 {
+			t.Fatalf("Expected a batch delivered, got %v %v", batchIds, batched)
+		}
+		first := batchIds[0]
+		batched = nil
+		runMutex.Unlock()
+
+		if n, err := q.Replay(ctx, first); err != nil || n != 2 {
+			t.Fatalf("Expected 2 payloads replayed, got %d %v", n, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 2 || batched[0] != "a" || batched[1] != "b" {
+			t.Errorf("Expected the batch delivered again despite its recorded keys, got %v", batched)
+		}
+		runMutex.Unlock()
+		if d := q.Stats().Duplicates; d != 0 {
+			t.Errorf("Expected no replayed payload taken for a duplicate, got %d", d)
+		}
+	})
+
+	t.Run("A table created before the batch_id is migrated", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "queue.db")
+		old := open(t, path)
+		_, err := old.DB.Exec(`CREATE TABLE payloads (seq INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT NOT NULL UNIQUE,
+			payload BLOB NOT NULL, status TEXT NOT NULL, error TEXT NOT NULL DEFAULT '', created_at INTEGER NOT NULL, updated_at INTEGER NOT NULL)`)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		old.Close()
+
+		s := open(t, path)
+		s.Put(ctx, []plq.Payload{{Id: "1", Data: "a"}})
+		s.Claim(ctx, 1)
+		if err := s.Archive(ctx, "batch", []string{"1"}); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if ids, err := s.Replay(ctx, "batch"); err != nil || len(ids) != 1 || ids[0] != "1" {
+			t.Errorf("Expected the archived payload replayed, got %v %v", ids, err)
+		}
+	})
+}
+
+// keyStore is an IdempotencyStore in memory that can look up its keys
+type keyStore struct {
+	mutex sync.Mutex
+	keys  map[string]bool
+}
+
+func (k *keyStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.keys[key] {
+		return false, nil
+	}
+	k.keys[key] = true
+	return true, nil
+}
+
+func (k *keyStore) Recorded(ctx context.Context, key string) (bool, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.keys[key], nil
+}
@@ -0,0 +1,62 @@
+package payloadqueue
+
+import "sync"
+
+// Stats to report the activity of a Queue since it was started
+type Stats struct {
+	Tag             string    `json:"tag"`
+	Pending         int       `json:"pending"`          // payloads waiting to be batched, including the spilled ones
+	Spilled         int       `json:"spilled"`          // pending payloads kept in the Spill storage, see MemoryBudget
+	Delayed         int       `json:"delayed"`          // payloads waiting on their NotBefore
+	ActiveWork      int       `json:"active_work"`      // batches being processed
+	Appended        int64     `json:"appended"`         // payloads accepted by Append
+	Batches         int64     `json:"batches"`          // batches pushed to the handler
+	Delivered       int64     `json:"delivered"`        // payloads in batches that succeeded
+	Failed          int64     `json:"failed"`           // payloads in batches that failed, including the retried ones
+	Retried         int64     `json:"retried"`          // failed payloads re-queued for another attempt
+	DeadLettered    int64     `json:"dead_lettered"`    // failed payloads handed to DeadLetter or discarded
+	Expired         int64     `json:"expired"`          // payloads that passed their ExpiresAt in the queue
+	Duplicates      int64     `json:"duplicates"`       // payloads dropped because their key was already claimed
+	Dark            int64     `json:"dark"`             // payloads copied to the DarkQueue
+	Rejected        int64     `json:"rejected"`         // payloads refused by Append because the queue was full
+	Blocked         int64     `json:"blocked"`          // payloads whose Append waited for room, see OverflowBlock
+	WouldBlock      int64     `json:"would_block"`      // payloads whose Append gave up waiting at the MaxBlock
+	Invalid         int64     `json:"invalid"`          // payloads refused by Append because the Validator rejected them
+	Removed         int64     `json:"removed"`          // payloads pulled out of the queue by Remove
+	Merged          int64     `json:"merged"`           // payloads left out of their batch by the BatchTransformer
+	Coalesced       int64     `json:"coalesced"`        // payloads folded into an identical pending payload, see CoalesceKey
+	Split           int64     `json:"split"`            // batches the handler rejected as too large, pushed again in halves, see TooLarge
+	OverQuota       int64     `json:"over_quota"`       // payloads refused by Append because their tenant had its TenantLimit pending
+	SerializedBytes int64     `json:"serialized_bytes"` // bytes of the batches serialized for the Compressor
+	CompressedBytes int64     `json:"compressed_bytes"` // bytes of the same batches once compressed
+	TimeInQueue     Histogram `json:"time_in_queue"`    // how long the payloads of the pushed batches waited, from their Append to their batch being pushed
+	BatchLatency    Histogram `json:"batch_latency"`    // how long the handler took for each pushed batch
+}
+
+// counters to hold the cumulative Stats of a Queue
+type counters struct {
+	mutex sync.Mutex
+	stats Stats
+}
+
+// add to update the counters under the mutex
+func (c *counters) add(update func(s *Stats)) {
+	c.mutex.Lock()
+	update(&c.stats)
+	c.mutex.Unlock()
+}
+
+// Stats to return a snapshot of the queue's activity
+func (q *Queue) Stats() Stats {
+	q.counters.mutex.Lock()
+	s := q.counters.stats
+	q.counters.mutex.Unlock()
+	q.payloadMutex.Lock()
+	s.Tag = q.Tag
+	s.Spilled = q.spilled + q.spilling
+	s.Pending = q.payloadQueue.len() + s.Spilled
+	s.Delayed = len(q.delayed)
+	q.payloadMutex.Unlock()
+	s.ActiveWork = int(q.activeWork.Load())
+	return s
+}
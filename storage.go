@@ -0,0 +1,164 @@
+package payloadqueue
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Storage to persist the payloads of a Queue outside of the process. When a Queue has a Storage,
+// appended payloads are put into it and the batches are cut from the payloads claimed from it, so
+// several instances sharing one Storage form one logical queue and a crashed instance loses
+// nothing that it had accepted.
+type Storage interface {
+	// Put persists the payloads.
+	Put(ctx context.Context, pls []Payload) error
+	// Claim takes up to max persisted payloads for batching by this instance. Payloads that were
+	// claimed by an instance which did not acknowledge them in time are claimed again.
+	Claim(ctx context.Context, max int) ([]Payload, error)
+	// Ack removes the claimed payloads with the ids once they are delivered, dead-lettered or
+	// expired.
+	Ack(ctx context.Context, ids []string) error
+}
+
+// DeadLetterStorage is implemented by a Storage that keeps the dead-lettered payloads apart from the
+// delivered ones. The Queue buries its dead-lettered payloads instead of acknowledging them.
+type DeadLetterStorage interface {
+	Storage
+	// Bury marks the claimed payloads with the ids as dead-lettered for the reason.
+	Bury(ctx context.Context, ids []string, reason error) error
+}
+
+// RedriveStorage is implemented by a DeadLetterStorage that can return its dead-lettered payloads
+// to the queue, see Redrive.
+type RedriveStorage interface {
+	DeadLetterStorage
+	// Redrive makes the dead-lettered payloads pending again and returns how many there were.
+	Redrive(ctx context.Context) (int, error)
+}
+
+// DeadLetterReader is implemented by a DeadLetterStorage that can list its dead-lettered payloads,
+// see DeadLetters.
+type DeadLetterReader interface {
+	DeadLetterStorage
+	// DeadLetters returns up to max dead-lettered payloads, most recent first. Zero means all.
+	DeadLetters(ctx context.Context, max int) ([]DeadLetter, error)
+}
+
+// DeadLetter to describe a payload dead-lettered in a Storage
+type DeadLetter struct {
+	Payload Payload   `json:"payload"`
+	Reason  string    `json:"reason"` // the error the payload was dead-lettered for
+	At      time.Time `json:"at"`     // when it was dead-lettered
+}
+
+// storageContext to return the context storage calls are made with, bound by the WorkTimeout and
+// carrying the Codec, which encrypts the Data when the queue has an Encryption
+func (q *Queue) storageContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := q.callContext()
+	return q.seal(ctx), cancel
+}
+
+// callContext to return the context the Replicator is called with, bound by the WorkTimeout and
+// carrying the Codec
+func (q *Queue) callContext() (context.Context, context.CancelFunc) {
+	ctx := withCodec(context.Background(), q.Codec)
+	if q.WorkTimeout > 0 {
+		return context.WithTimeout(ctx, q.WorkTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// persist to put the new payloads into the Storage
+func (q *Queue) persist(pls []Payload) error {
+	if len(pls) == 0 {
+		return nil
+	}
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	if err := q.Storage.Put(ctx, pls); err != nil {
+		q.event("Storage: Put of " + strconv.Itoa(len(pls)) + " payloads failed. " + err.Error())
+		return err
+	}
+	return nil
+}
+
+// fill to claim payloads from the Storage until the batch is full
+func (q *Queue) fill() {
+	if q.Storage == nil {
+		return
+	}
+	q.payloadMutex.Lock()
+	n := q.batchSize() - q.payloadQueue.len()
+	q.payloadMutex.Unlock()
+	if n <= 0 {
+		return
+	}
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	q.replayMutex.Lock()
+	pls, err := q.Storage.Claim(ctx, n)
+	if err != nil {
+		q.replayMutex.Unlock()
+		q.event("Storage: Claim failed. " + err.Error())
+		return
+	}
+	for i, p := range pls {
+		if q.replaying[p.Id] {
+			pls[i].claimed = true
+			delete(q.replaying, p.Id)
+		}
+	}
+	q.replayMutex.Unlock()
+	q.weigh(pls)
+	q.assign(pls)
+	now := q.now()
+	ready := make([]Payload, 0, len(pls))
+	for _, p := range pls {
+		if now.Before(p.NotBefore) {
+			q.delay(p)
+			continue
+		}
+		ready = append(ready, p)
+	}
+	q.enqueue(now, ready)
+}
+
+// acknowledge to remove the payloads from the Storage and release them from the Replicator
+func (q *Queue) acknowledge(pls []Payload) {
+	if (q.Storage == nil && q.Replicator == nil) || len(pls) == 0 {
+		return
+	}
+	ids := make([]string, len(pls))
+	for i, p := range pls {
+		ids[i] = p.Id
+	}
+	q.commit(ids)
+	if q.Storage == nil {
+		return
+	}
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	if err := q.Storage.Ack(ctx, ids); err != nil {
+		q.event("Storage: Ack of " + strconv.Itoa(len(ids)) + " payloads failed. " + err.Error())
+	}
+}
+
+// bury to mark the dead-lettered payloads in a DeadLetterStorage, or acknowledge them otherwise
+func (q *Queue) bury(pls []Payload, reason error) {
+	dls, ok := q.Storage.(DeadLetterStorage)
+	if !ok || len(pls) == 0 {
+		q.acknowledge(pls)
+		return
+	}
+	ids := make([]string, len(pls))
+	for i, p := range pls {
+		ids[i] = p.Id
+	}
+	q.commit(ids)
+	ctx, cancel := q.storageContext()
+	defer cancel()
+	if err := dls.Bury(ctx, ids, reason); err != nil {
+		q.event("Storage: Bury of " + strconv.Itoa(len(ids)) + " payloads failed. " + err.Error())
+	}
+}
@@ -0,0 +1,102 @@
+package payloadqueue
+
+import (
+	"errors"
+	"sync"
+)
+
+// subQueues to hold the running sub-queues of a Queue, see Sub
+type subQueues struct {
+	mutex  sync.Mutex
+	queues []*Queue
+}
+
+// Sub to create and start a child queue tagged Tag.tag, e.g. for a module that wants its own
+// batching without managing a lifecycle. The child inherits the handler, the triggers, the retries,
+// the Codec, the Clock, the EventFeed and the Logger of the queue, which the configure functions can
+// change before it starts:
+//
+//	emails, err := q.Sub("emails", func(s *plq.Queue) { s.MaxSize = 50 })
+//
+// Its batches are processed in the worker pool of the queue, within its Concurrency, and its events
+// also reach the subscribers of the queue. The sub-queue of a Pull queue is a Pull queue too, whose
+// batches are received with those of the queue. Closing the queue flushes and closes its sub-queues
+// first; a module may still Close its sub-queue after that, which does nothing. The queue must be
+// running.
+func (q *Queue) Sub(tag string, configure ...func(*Queue)) (*Queue, error) {
+	if tag == "" {
+		return nil, errors.New("a sub-queue needs a tag")
+	}
+	if !q.running.Load() {
+		return nil, ErrNotRunning
+	}
+	q.workMutex.RLock()
+	child := &Queue{
+		Tag:           q.Tag + "." + tag,
+		MaxSize:       q.MaxSize,
+		MaxAge:        q.MaxAge,
+		MaxBatchSize:  q.MaxBatchSize,
+		MaxBatchBytes: q.MaxBatchBytes,
+		Work:          q.Work,
+		WorkContext:   q.WorkContext,
+		Pull:          q.Pull,
+		WorkTimeout:   q.WorkTimeout,
+		MaxRetries:    q.MaxRetries,
+		RetryDelay:    q.RetryDelay,
+		DeadLetter:    q.DeadLetter,
+		Middleware:    q.Middleware,
+		Concurrency:   q.Concurrency,
+		Codec:         q.Codec,
+		Clock:         q.Clock,
+		EventFeed:     q.EventFeed,
+		Logger:        q.Logger,
+		parent:        q,
+	}
+	q.workMutex.RUnlock()
+	for _, c := range configure {
+		c(child)
+	}
+	if err := child.Start(); err != nil {
+		return nil, errors.New("sub-queue " + child.Tag + ": " + err.Error())
+	}
+	q.subs.mutex.Lock()
+	q.subs.queues = append(q.subs.queues, child)
+	q.subs.mutex.Unlock()
+	q.event("Buffer Queue: Sub-queue " + child.Tag + " started")
+	return child, nil
+}
+
+// Subs to return the running sub-queues of the queue, in the order they were created
+func (q *Queue) Subs() []*Queue {
+	q.subs.mutex.Lock()
+	defer q.subs.mutex.Unlock()
+	return append([]*Queue(nil), q.subs.queues...)
+}
+
+// closeSubs to flush and close the sub-queues, as the queue closes
+func (q *Queue) closeSubs() {
+	q.subs.mutex.Lock()
+	children := q.subs.queues
+	q.subs.queues = nil
+	q.subs.mutex.Unlock()
+	for _, child := range children {
+		child.Flush()
+		child.Close()
+	}
+}
+
+// detach to remove a closed sub-queue from its parent
+func (q *Queue) detach() {
+	if q.parent == nil {
+		return
+	}
+	subs := &q.parent.subs
+	subs.mutex.Lock()
+	defer subs.mutex.Unlock()
+	for i, child := range subs.queues {
+		if child == q {
+			subs.queues = append(subs.queues[:i], subs.queues[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package payloadqueue
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// EventLevel to grade the events of a queue, on the scale of the slog levels
+type EventLevel int
+
+const (
+	EventDebug EventLevel = EventLevel(slog.LevelDebug) // per-payload activity, e.g. a payload queued
+	EventInfo  EventLevel = EventLevel(slog.LevelInfo)  // batches and lifecycle
+	EventWarn  EventLevel = EventLevel(slog.LevelWarn)  // failed batches, dead letters and rejected payloads
+	EventError EventLevel = EventLevel(slog.LevelError) // failures of the queue itself, e.g. a failed preflight
+)
+
+func (l EventLevel) String() string {
+	return slog.Level(l).String()
+}
+
+// Event of a queue as received by a subscriber
+type Event struct {
+	Time    time.Time
+	Tag     string
+	Level   EventLevel
+	Message string      // the text written to the EventFeed
+	Attrs   []slog.Attr // the attributes written to the Logger, e.g. payload_id or batch_size
+}
+
+// subscription of a subscriber to the events at or above its level
+type subscription struct {
+	level EventLevel
+	ch    chan Event
+}
+
+// subscribers to hold the subscriptions of a Queue
+type subscribers struct {
+	mutex sync.RWMutex
+	subs  map[*subscription]struct{}
+}
+
+// Subscribe to receive the events of the queue at or above the level, e.g. EventWarn to watch
+// failures while another subscriber watches EventDebug. Each subscriber has a buffer of the
+// SubscriberBuffer; when it is full the oldest event is dropped, so a slow subscriber never stalls
+// the queue. The cancel function ends the subscription and closes the channel.
+func (q *Queue) Subscribe(level EventLevel) (<-chan Event, func()) {
+	size := q.SubscriberBuffer
+	if size <= 0 {
+		size = 256
+	}
+	sub := &subscription{level: level, ch: make(chan Event, size)}
+	q.subscribers.mutex.Lock()
+	if q.subscribers.subs == nil {
+		q.subscribers.subs = make(map[*subscription]struct{})
+	}
+	q.subscribers.subs[sub] = struct{}{}
+	q.subscribers.mutex.Unlock()
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			q.subscribers.mutex.Lock()
+			delete(q.subscribers.subs, sub)
+			q.subscribers.mutex.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// publish to pass the event to the subscribers of its level, and to those of the parent of a
+// sub-queue
+func (q *Queue) publish(level slog.Level, text string, attrs []slog.Attr) {
+	var e *Event
+	for s := q; s != nil; s = s.parent {
+		s.subscribers.mutex.RLock()
+		for sub := range s.subscribers.subs {
+			if e == nil {
+				e = &Event{Time: q.now(), Tag: q.Tag, Level: EventLevel(level), Message: text, Attrs: attrs}
+			}
+			if e.Level >= sub.level {
+				sub.send(*e)
+			}
+		}
+		s.subscribers.mutex.RUnlock()
+	}
+}
+
+// send to buffer the event, dropping the oldest one when the buffer is full
+func (s *subscription) send(e Event) {
+	for {
+		select {
+		case s.ch <- e:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+		default:
+		}
+	}
+}
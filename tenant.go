@@ -0,0 +1,193 @@
+package payloadqueue
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+)
+
+// ErrTenantQuota is wrapped by the QuotaError Append returns for a payload whose tenant already has
+// its TenantLimit of payloads pending.
+var ErrTenantQuota = errors.New("the tenant has its quota of pending payloads")
+
+// QuotaError is returned by Append for a payload whose tenant already has its TenantLimit of
+// payloads pending. It wraps ErrTenantQuota and ErrQueueFull, so the servers refuse it as they
+// refuse a full queue.
+type QuotaError struct {
+	PayloadId string
+	Tenant    string
+	Limit     int
+}
+
+func (e *QuotaError) Error() string {
+	return "payload " + e.PayloadId + " is over the quota of tenant " + e.Tenant + " of " + strconv.Itoa(e.Limit) + " pending payloads"
+}
+
+func (e *QuotaError) Unwrap() []error {
+	return []error{ErrTenantQuota, ErrQueueFull}
+}
+
+// assign to set the tenant of the payloads by the TenantKey, for those that do not have it yet,
+// e.g. payloads claimed from a Storage
+func (q *Queue) assign(pls []Payload) {
+	if q.TenantKey == nil {
+		return
+	}
+	for i := range pls {
+		if pls[i].tenant == "" {
+			pls[i].tenant = q.TenantKey(pls[i])
+		}
+	}
+}
+
+// tenantLimit to return the most pending payloads of the tenant, zero for no limit
+func (q *Queue) tenantLimit(tenant string) int {
+	if limit, ok := q.TenantLimits[tenant]; ok {
+		return limit
+	}
+	return q.TenantLimit
+}
+
+// quota to return the payloads whose tenant has room under its limit, the slots they reserve, and
+// the error of the first one that is over it. A tenant holds the payloads that are pending, delayed,
+// spilled, in batches not yet completed and reserved by other appends, so concurrent appends cannot
+// take it past its limit. The reserved slots are given back with unquota once the payloads are
+// queued. The payloads over their quota are counted and reported, and are never queued. Retries are
+// already held by the queue and are always let in.
+func (q *Queue) quota(pls []Payload) ([]Payload, map[string]int, error) {
+	if q.TenantKey == nil || (q.TenantLimit <= 0 && len(q.TenantLimits) == 0) {
+		return pls, nil, nil
+	}
+	kept := pls[:0:0]
+	var over []Payload
+	reserved := make(map[string]int)
+	q.payloadMutex.Lock()
+	held := q.held()
+	for _, p := range pls {
+		if p.Id == "" || p.Attempts > 0 {
+			kept = append(kept, p)
+			continue
+		}
+		if limit := q.tenantLimit(p.tenant); limit > 0 && held[p.tenant]+reserved[p.tenant] >= limit {
+			over = append(over, p)
+			continue
+		}
+		reserved[p.tenant]++
+		kept = append(kept, p)
+	}
+	for tenant, n := range reserved {
+		countTenant(q.tenantsReserved, tenant, n)
+	}
+	q.payloadMutex.Unlock()
+	var first error
+	for _, p := range over {
+		limit := q.tenantLimit(p.tenant)
+		q.counters.add(func(s *Stats) { s.OverQuota++ })
+		q.log(slog.LevelWarn, "tenant over quota", "Payload Over Quota [id]: "+p.Id+" of tenant "+p.tenant+", limit "+strconv.Itoa(limit),
+			slog.String("payload_id", p.Id), slog.String("tenant", p.tenant), slog.Int("limit", limit))
+		if first == nil {
+			first = &QuotaError{PayloadId: p.Id, Tenant: p.tenant, Limit: limit}
+		}
+	}
+	return kept, reserved, first
+}
+
+// unquota to give back the slots reserved by quota
+func (q *Queue) unquota(reserved map[string]int) {
+	if len(reserved) == 0 {
+		return
+	}
+	q.payloadMutex.Lock()
+	for tenant, n := range reserved {
+		countTenant(q.tenantsReserved, tenant, -n)
+	}
+	q.payloadMutex.Unlock()
+}
+
+// held to return the payloads every tenant holds, as counted against the TenantLimit. The
+// payloadMutex must be held.
+func (q *Queue) held() map[string]int {
+	out := make(map[string]int, len(q.payloadQueue.tenants))
+	for _, counts := range []map[string]int{q.payloadQueue.tenants, q.tenantsOut, q.tenantsReserved} {
+		for tenant, n := range counts {
+			out[tenant] += n
+		}
+	}
+	for _, p := range q.delayed {
+		out[p.tenant]++
+	}
+	return out
+}
+
+// countOut to add delta to the payloads of their tenants that are spilled or in batches not yet
+// completed, when the tenants are counted. The payloadMutex must be held.
+func (q *Queue) countOut(pls []Payload, delta int) {
+	if q.tenantsOut == nil {
+		return
+	}
+	for _, p := range pls {
+		countTenant(q.tenantsOut, p.tenant, delta)
+	}
+}
+
+// countTenant to add delta to the count of the tenant, dropping it once none are left. A nil
+// counts is left alone, as the tenants are not counted.
+func countTenant(counts map[string]int, tenant string, delta int) {
+	if counts == nil {
+		return
+	}
+	if counts[tenant] += delta; counts[tenant] <= 0 {
+		delete(counts, tenant)
+	}
+}
+
+// Tenants to return the number of payloads every tenant that has some holds, as counted against
+// the TenantLimit: pending, delayed, spilled or in batches not yet completed. It is empty without
+// a TenantKey.
+func (q *Queue) Tenants() map[string]int {
+	q.payloadMutex.Lock()
+	defer q.payloadMutex.Unlock()
+	if q.payloadQueue.tenants == nil {
+		return map[string]int{}
+	}
+	return q.held()
+}
+
+// fair to order the payloads cut by a flush so the batches they are split into share out among the
+// tenants: in rounds, each tenant in turn, in the order they first appear, gives its TenantWeights
+// of its oldest payloads. A noisy tenant then fills the later batches instead of every one. The
+// payloadMutex must be held.
+func (q *Queue) fair(pls []Payload) []Payload {
+	if q.TenantKey == nil || len(pls) <= q.batchSize() {
+		return pls
+	}
+	var order []string
+	byTenant := make(map[string][]Payload)
+	for _, p := range pls {
+		if _, ok := byTenant[p.tenant]; !ok {
+			order = append(order, p.tenant)
+		}
+		byTenant[p.tenant] = append(byTenant[p.tenant], p)
+	}
+	if len(order) == 1 {
+		return pls
+	}
+	out := make([]Payload, 0, len(pls))
+	for len(out) < len(pls) {
+		for _, tenant := range order {
+			queued := byTenant[tenant]
+			n := min(q.tenantWeight(tenant), len(queued))
+			out = append(out, queued[:n]...)
+			byTenant[tenant] = queued[n:]
+		}
+	}
+	return out
+}
+
+// tenantWeight to return the payloads the tenant gives per round of fair, at least 1
+func (q *Queue) tenantWeight(tenant string) int {
+	if w := q.TenantWeights[tenant]; w > 0 {
+		return w
+	}
+	return 1
+}
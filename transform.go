@@ -0,0 +1,51 @@
+package payloadqueue
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strconv"
+)
+
+// BatchTransformer to rework a cut batch before it is pushed to the handler, e.g. to merge the
+// updates to the same entity, sort the payloads or enrich them from a cache. It returns the
+// payloads to push, keeping the Id of each one it keeps; those it leaves out are dropped. An error
+// fails the batch as the handler would, without calling it.
+//
+// It is called with the context of the batch, see BatchFromContext, and is given its own copy of the
+// payloads.
+type BatchTransformer func(ctx context.Context, pls []Payload) ([]Payload, error)
+
+// transform to apply the BatchTransformer to the batch, returning the payloads to push. The
+// payloads it leaves out are acknowledged and counted as merged. On error, the payloads of the batch
+// are returned unchanged with the error.
+func (q *Queue) transform(ctx context.Context, batch *Batch) ([]Payload, error) {
+	if q.BatchTransformer == nil {
+		return batch.Payloads, nil
+	}
+	pls, err := q.BatchTransformer(ctx, slices.Clone(batch.Payloads))
+	if err != nil {
+		q.log(slog.LevelWarn, "batch transform failed", "Batch Push ["+q.Tag+"]: Transform failed. "+err.Error(),
+			slog.String("batch_id", batch.Id), slog.Int("batch_size", len(batch.Payloads)), resultAttr(err))
+		return batch.Payloads, err
+	}
+	kept := make(map[string]bool, len(pls))
+	for _, p := range pls {
+		kept[p.Id] = true
+	}
+	var merged []Payload
+	for _, p := range batch.Payloads {
+		if !kept[p.Id] {
+			merged = append(merged, p)
+		}
+	}
+	if len(merged) > 0 {
+		q.counters.add(func(s *Stats) { s.Merged += int64(len(merged)) })
+		q.tally(merged, func(c *DailyCounts, n int64) { c.Dropped += n })
+		q.acknowledge(merged)
+		q.log(slog.LevelDebug, "batch transformed", "Batch Push ["+q.Tag+"]: Transformed, left out "+strconv.Itoa(len(merged))+" payloads",
+			slog.String("batch_id", batch.Id), slog.Int("batch_size", len(pls)))
+	}
+	batch.Payloads = pls
+	return pls, nil
+}
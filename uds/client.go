@@ -0,0 +1,323 @@
+package uds
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// ErrSpoolFull is returned by Send when the SpoolLimit of payloads is waiting for the daemon
+var ErrSpoolFull = errors.New("uds: the spool is full")
+
+// ErrClosed is returned by Send once the Client is closed
+var ErrClosed = errors.New("uds: the client is closed")
+
+// Client to send payloads to a Server on the socket Path. Sent payloads are spooled until the
+// server acknowledges them; while the server is away the client keeps reconnecting and sends the
+// spool once it is back. With a SpoolFile the spool also survives a restart of the client.
+// Delivery is at least once: frames in flight when a connection drops are sent again.
+type Client struct {
+	Path       string
+	SpoolFile  string        // when supplied, spooled frames are kept in the file and sent again after a restart
+	SpoolLimit int           // most payloads spooled before Send fails with ErrSpoolFull. Default is 10000
+	RetryDelay time.Duration // first wait between reconnects, doubling up to 5 seconds. Default is 100ms
+	Codec      plq.Codec     // serializes the Data as the Codec of the remote queue. Default is JSONCodec
+	OnError    func(error)   // receives the frames the server rejected
+	once       sync.Once
+	mutex      sync.Mutex
+	spool      []frame // not yet acknowledged, in order
+	spooled    int     // payloads in the spool
+	seq        uint64
+	sentSeq    uint64 // highest sequence number written on the current connection
+	conn       net.Conn
+	kick       chan struct{}
+	acked      chan struct{}
+	closed     chan struct{}
+}
+
+// Send to spool the payloads for the remote queue with the tag and send them when connected
+func (c *Client) Send(tag string, pls ...plq.Payload) error {
+	c.once.Do(c.start)
+	codec := c.Codec
+	if codec == nil {
+		codec = plq.JSONCodec{}
+	}
+	f := frame{Tag: tag}
+	for _, p := range pls {
+		b, err := plq.EncodePayload(codec, p)
+		if err != nil {
+			return err
+		}
+		f.Payloads = append(f.Payloads, b)
+	}
+	c.mutex.Lock()
+	select {
+	case <-c.closed:
+		c.mutex.Unlock()
+		return ErrClosed
+	default:
+	}
+	if c.spooled+len(pls) > c.spoolLimit() {
+		c.mutex.Unlock()
+		return ErrSpoolFull
+	}
+	c.seq++
+	f.Seq = c.seq
+	if err := c.persist(f); err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	c.spool = append(c.spool, f)
+	c.spooled += len(pls)
+	c.mutex.Unlock()
+	signal(c.kick)
+	return nil
+}
+
+// Spooled to return the number of payloads waiting to be acknowledged
+func (c *Client) Spooled() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.spooled
+}
+
+// Wait to block until the spool is acknowledged or the context ends
+func (c *Client) Wait(ctx context.Context) error {
+	c.once.Do(c.start)
+	for {
+		if c.Spooled() == 0 {
+			return nil
+		}
+		select {
+		case <-c.acked:
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close to stop sending. The spool is kept in the SpoolFile, if any, for the next client.
+func (c *Client) Close() error {
+	c.once.Do(c.start)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// start to load the SpoolFile and run the connection in the background
+func (c *Client) start() {
+	c.kick = make(chan struct{}, 1)
+	c.acked = make(chan struct{}, 1)
+	c.closed = make(chan struct{})
+	if err := c.load(); err != nil && c.OnError != nil {
+		c.OnError(err)
+	}
+	go c.run()
+}
+
+// run to keep a connection to the server, reconnecting with a backoff, and send the spool on it
+func (c *Client) run() {
+	delay := c.retryDelay()
+	for {
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		conn, err := net.Dial("unix", c.Path)
+		if err != nil {
+			select {
+			case <-time.After(delay):
+			case <-c.closed:
+				return
+			}
+			if delay *= 2; delay > 5*time.Second {
+				delay = 5 * time.Second
+			}
+			continue
+		}
+		c.mutex.Lock()
+		c.conn = conn
+		c.sentSeq = 0
+		c.mutex.Unlock()
+		done := make(chan struct{})
+		progress := false
+		go func() {
+			progress = c.readAcks(conn)
+			close(done)
+		}()
+		c.write(conn, done)
+		conn.Close()
+		<-done
+		if progress {
+			delay = c.retryDelay()
+			continue
+		}
+		// the server dropped the connection without acknowledging anything
+		select {
+		case <-time.After(delay):
+		case <-c.closed:
+			return
+		}
+		if delay *= 2; delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
+	}
+}
+
+// write to send the spooled frames not yet written on the connection whenever more are spooled,
+// until the connection fails
+func (c *Client) write(conn net.Conn, done chan struct{}) {
+	w := bufio.NewWriter(conn)
+	for {
+		c.mutex.Lock()
+		var frames []frame
+		for _, f := range c.spool {
+			if f.Seq > c.sentSeq {
+				frames = append(frames, f)
+			}
+		}
+		c.mutex.Unlock()
+		for _, f := range frames {
+			if err := writeFrame(w, f); err != nil {
+				return
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+		if len(frames) > 0 {
+			c.mutex.Lock()
+			c.sentSeq = frames[len(frames)-1].Seq
+			c.mutex.Unlock()
+		}
+		select {
+		case <-c.kick:
+		case <-done:
+			return
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// readAcks to remove the acknowledged frames from the spool until the connection fails, reporting
+// whether any frame was acknowledged
+func (c *Client) readAcks(conn net.Conn) bool {
+	r := bufio.NewReader(conn)
+	progress := false
+	for {
+		var a ack
+		if err := readFrame(r, &a); err != nil {
+			return progress
+		}
+		progress = true
+		c.mutex.Lock()
+		for len(c.spool) > 0 && c.spool[0].Seq <= a.Seq {
+			c.spooled -= len(c.spool[0].Payloads)
+			c.spool = c.spool[1:]
+		}
+		var err error
+		if len(c.spool) == 0 {
+			err = c.truncate()
+		}
+		c.mutex.Unlock()
+		if a.Error != "" {
+			err = errors.New("uds: frame " + strconv.FormatUint(a.Seq, 10) + " rejected: " + a.Error)
+		}
+		if err != nil && c.OnError != nil {
+			c.OnError(err)
+		}
+		signal(c.acked)
+	}
+}
+
+// persist to append the frame to the SpoolFile
+func (c *Client) persist(f frame) error {
+	if c.SpoolFile == "" {
+		return nil
+	}
+	file, err := os.OpenFile(c.SpoolFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writeFrame(file, f)
+}
+
+// truncate to empty the SpoolFile once everything in it is acknowledged
+func (c *Client) truncate() error {
+	if c.SpoolFile == "" {
+		return nil
+	}
+	return os.Truncate(c.SpoolFile, 0)
+}
+
+// load to spool the frames left in the SpoolFile by a previous client
+func (c *Client) load() error {
+	if c.SpoolFile == "" {
+		return nil
+	}
+	file, err := os.Open(c.SpoolFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for {
+		var f frame
+		if err := readFrame(r, &f); err != nil {
+			// the end of the file, or a frame cut short by a crash, ends the spool
+			break
+		}
+		c.seq++
+		f.Seq = c.seq
+		c.spool = append(c.spool, f)
+		c.spooled += len(f.Payloads)
+	}
+	return nil
+}
+
+func (c *Client) spoolLimit() int {
+	if c.SpoolLimit <= 0 {
+		return 10000
+	}
+	return c.SpoolLimit
+}
+
+func (c *Client) retryDelay() time.Duration {
+	if c.RetryDelay <= 0 {
+		return 100 * time.Millisecond
+	}
+	return c.RetryDelay
+}
+
+// signal to notify the channel without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,83 @@
+package uds_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/uds"
+)
+
+func TestClient(t *testing.T) {
+	work := func(pls []interface{}) int { return 0 }
+
+	t.Run("Payloads sent while the daemon is away are delivered once it is up", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "pq.sock")
+		c := &uds.Client{Path: path, RetryDelay: 20 * time.Millisecond}
+		defer c.Close()
+		c.Send("QueueA", plq.Payload{Id: "1", Data: "a"})
+		time.Sleep(100 * time.Millisecond)
+		if c.Spooled() != 1 {
+			t.Fatalf("Expected the payload to be spooled, got %d", c.Spooled())
+		}
+
+		q := &plq.Queue{Tag: "QueueA", MaxAge: 200, Work: work}
+		q.Start()
+		defer q.Close()
+		srv := daemon(t, path, q)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := c.Wait(ctx); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+
+		// the daemon restarts
+		srv.Close()
+		c.Send("QueueA", plq.Payload{Id: "2", Data: "b"})
+		daemon(t, path, q)
+		if err := c.Wait(ctx); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if s := q.Stats(); s.Appended != 2 {
+			t.Errorf("Expected 2 payloads appended, got %+v", s)
+		}
+	})
+
+	t.Run("The spool file survives a restart of the client", func(t *testing.T) {
+		dir := t.TempDir()
+		path, spool := filepath.Join(dir, "pq.sock"), filepath.Join(dir, "spool")
+		c := &uds.Client{Path: path, SpoolFile: spool}
+		c.Send("QueueA", plq.Payload{Id: "1", Data: "a"}, plq.Payload{Id: "2", Data: "b"})
+		c.Close()
+		if err := c.Send("QueueA", plq.Payload{Id: "3"}); !errors.Is(err, uds.ErrClosed) {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+
+		q := &plq.Queue{Tag: "QueueA", MaxAge: 200, Work: work}
+		q.Start()
+		defer q.Close()
+		daemon(t, path, q)
+		restarted := &uds.Client{Path: path, SpoolFile: spool, RetryDelay: 20 * time.Millisecond}
+		defer restarted.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := restarted.Wait(ctx); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if s := q.Stats(); s.Appended != 2 {
+			t.Errorf("Expected the spooled payloads appended, got %+v", s)
+		}
+	})
+
+	t.Run("The spool is bounded", func(t *testing.T) {
+		c := &uds.Client{Path: filepath.Join(t.TempDir(), "pq.sock"), SpoolLimit: 2}
+		defer c.Close()
+		c.Send("QueueA", plq.Payload{Id: "1"}, plq.Payload{Id: "2"})
+		if err := c.Send("QueueA", plq.Payload{Id: "3"}); !errors.Is(err, uds.ErrSpoolFull) {
+			t.Errorf("Expected ErrSpoolFull, got %v", err)
+		}
+	})
+}
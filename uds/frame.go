@@ -0,0 +1,60 @@
+// Package uds carries payloads from sidecar processes into the Queues of a central batching daemon
+// on the same host over a Unix domain socket. Frames are length-prefixed JSON, much lighter than
+// HTTP or gRPC. The Client spools what it sends until the daemon acknowledges it and reconnects
+// when the daemon restarts, so payloads survive the daemon being briefly away.
+package uds
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// maxFrame is the largest frame accepted, to protect against a corrupt length
+const maxFrame = 64 << 20
+
+// frame to carry payloads for the queue with the tag. The payloads are plq Envelopes, so their
+// Data is encoded by the Codec.
+type frame struct {
+	Seq      uint64   `json:"seq"`
+	Tag      string   `json:"tag"`
+	Payloads [][]byte `json:"payloads"`
+}
+
+// ack to acknowledge the frame with the sequence number. A frame with an Error was rejected and is
+// not sent again.
+type ack struct {
+	Seq   uint64 `json:"seq"`
+	Error string `json:"error,omitempty"`
+}
+
+// writeFrame to write the value as a length-prefixed JSON frame
+func writeFrame(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+// readFrame to read a length-prefixed JSON frame into the value
+func readFrame(r io.Reader, v interface{}) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrame {
+		return errors.New("uds: frame too large")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,134 @@
+package uds
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	plq "github.com/sam-ish/payloadqueue"
+)
+
+// Server to append the payloads sent by Clients to the Queues, routed by their Tag
+type Server struct {
+	Queues    []*plq.Queue
+	mutex     sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+}
+
+// ListenAndServe to listen on the socket path and serve until Close. A socket file left behind
+// by a previous daemon is removed.
+func (s *Server) ListenAndServe(path string) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve to accept connections on the listener until Close
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mutex.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mutex.Lock()
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]bool)
+		}
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// Close to stop listening and drop the connections. Clients keep what was not acknowledged.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.listeners, s.conns = nil, nil
+	return nil
+}
+
+// serve to append the frames of the connection and acknowledge them in order. When the queue
+// fails to append, the connection is dropped without acknowledging the frame, so the client sends
+// it again.
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		var f frame
+		if err := readFrame(r, &f); err != nil {
+			return
+		}
+		a, ok := s.append(f)
+		if !ok {
+			return
+		}
+		if err := writeFrame(conn, a); err != nil {
+			return
+		}
+	}
+}
+
+// append to decode the payloads of the frame and append them to its queue
+func (s *Server) append(f frame) (ack, bool) {
+	q := s.queue(f.Tag)
+	if q == nil {
+		return ack{Seq: f.Seq, Error: "queue " + f.Tag + " does not exist"}, true
+	}
+	codec := q.Codec
+	if codec == nil {
+		codec = plq.JSONCodec{}
+	}
+	pls := make([]plq.Payload, 0, len(f.Payloads))
+	for _, b := range f.Payloads {
+		p, err := plq.DecodePayload(codec, b)
+		if err != nil {
+			return ack{Seq: f.Seq, Error: "payload cannot be decoded: " + err.Error()}, true
+		}
+		if p.Id == "" {
+			p.Id = q.NewPayload(p.Data).Id
+		}
+		pls = append(pls, p)
+	}
+	for _, p := range pls {
+		if err := q.Append(p); err != nil {
+			return ack{}, false
+		}
+	}
+	return ack{Seq: f.Seq}, true
+}
+
+// queue to find the Queue with the tag
+func (s *Server) queue(tag string) *plq.Queue {
+	for _, q := range s.Queues {
+		if q.Tag == tag {
+			return q
+		}
+	}
+	return nil
+}
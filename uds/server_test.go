@@ -0,0 +1,77 @@
+package uds_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	plq "github.com/sam-ish/payloadqueue"
+	"github.com/sam-ish/payloadqueue/uds"
+)
+
+// daemon to serve the queue on a socket in the test's directory, returning the socket path
+func daemon(t *testing.T, path string, q *plq.Queue) *uds.Server {
+	srv := &uds.Server{Queues: []*plq.Queue{q}}
+	go srv.ListenAndServe(path)
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func TestServer(t *testing.T) {
+	var runMutex sync.Mutex
+	batched := []interface{}{}
+	q := &plq.Queue{
+		Tag:    "QueueA",
+		MaxAge: 200,
+		Work: func(pls []interface{}) int {
+			runMutex.Lock()
+			batched = append(batched, pls...)
+			runMutex.Unlock()
+			return 0
+		},
+	}
+	q.Start()
+	defer q.Close()
+	path := filepath.Join(t.TempDir(), "pq.sock")
+	daemon(t, path, q)
+
+	t.Run("Payloads are appended to the queue with the tag", func(t *testing.T) {
+		c := &uds.Client{Path: path}
+		defer c.Close()
+		c.Send("QueueA", plq.Payload{Id: "1", Data: "a"}, plq.Payload{Data: "b", Headers: map[string]string{"tenant": "acme"}})
+		c.Send("QueueA", plq.Payload{Id: "3", Data: "c"})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := c.Wait(ctx); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		q.Flush()
+		time.Sleep(100 * time.Millisecond)
+		runMutex.Lock()
+		if len(batched) != 3 || batched[0] != "a" || batched[2] != "c" {
+			t.Errorf("Unexpected batch: %v", batched)
+		}
+		runMutex.Unlock()
+	})
+
+	t.Run("Frames for an unknown queue are rejected", func(t *testing.T) {
+		errs := make(chan error, 1)
+		c := &uds.Client{Path: path, OnError: func(err error) { errs <- err }}
+		defer c.Close()
+		c.Send("QueueZ", plq.Payload{Id: "1", Data: "a"})
+		select {
+		case err := <-errs:
+			if !strings.Contains(err.Error(), "QueueZ does not exist") {
+				t.Errorf("Unexpected error: %s", err.Error())
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the frame to be rejected")
+		}
+		if c.Spooled() != 0 {
+			t.Errorf("Expected the rejected frame to leave the spool")
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package payloadqueue
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// ErrInvalidPayload is wrapped by the ValidationError Append returns for a payload the Validator
+// rejected.
+var ErrInvalidPayload = errors.New("the payload is invalid")
+
+// ValidationError is returned by Append for a payload its Validator rejected, wrapping the error of
+// the Validator and ErrInvalidPayload.
+type ValidationError struct {
+	PayloadId string
+	Err       error
+}
+
+func (e *ValidationError) Error() string {
+	return "payload " + e.PayloadId + " is invalid: " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() []error {
+	return []error{ErrInvalidPayload, e.Err}
+}
+
+// validate to return the payloads the Validator accepts, and the error of the first one it rejects.
+// The rejected payloads are counted and reported, and are never queued. Retries were validated
+// when they were first appended.
+func (q *Queue) validate(pls []Payload) ([]Payload, error) {
+	if q.Validator == nil {
+		return pls, nil
+	}
+	var first error
+	valid := pls[:0:0]
+	for _, p := range pls {
+		if p.Id == "" || p.Attempts > 0 {
+			valid = append(valid, p)
+			continue
+		}
+		err := q.Validator(p)
+		if err == nil {
+			valid = append(valid, p)
+			continue
+		}
+		q.counters.add(func(s *Stats) { s.Invalid++ })
+		q.log(slog.LevelWarn, "payload invalid", "Payload Invalid [id]: "+p.Id+". "+err.Error(),
+			slog.String("payload_id", p.Id), resultAttr(err))
+		if first == nil {
+			first = &ValidationError{PayloadId: p.Id, Err: err}
+		}
+	}
+	return valid, first
+}
@@ -0,0 +1,78 @@
+package payloadqueue
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// minWindow is the shortest batch window the LatencySLO adapts to
+const minWindow = 10 * time.Millisecond
+
+// windowTuner to adapt the batch window of a queue to its traffic, see LatencySLO. The window is
+// the time a batch takes to fill at the observed arrival rate, capped by a ceiling that starts at
+// the LatencySLO and follows the observed latency: it shrinks while the payloads take longer than
+// the LatencySLO to be delivered and widens back while they take less.
+type windowTuner struct {
+	mutex    sync.Mutex
+	arrivals arrivals
+	latency  time.Duration // latency of the delivered payloads, smoothed
+	ceiling  time.Duration // the longest window, zero until the first update
+	window   time.Duration // the adapted window, zero until a rate is observed
+}
+
+// observe to record n payloads arriving at now, adapting the window once a second
+func (t *windowTuner) observe(now time.Time, n int, size int, slo time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.arrivals.observe(now, n) {
+		return
+	}
+	if t.ceiling == 0 {
+		t.ceiling = slo
+	}
+	if t.latency > 0 {
+		t.ceiling = time.Duration(float64(t.ceiling) * float64(slo) / float64(t.latency))
+		t.ceiling = min(max(t.ceiling, minWindow), slo)
+	}
+	t.window = t.ceiling
+	if t.arrivals.rate > 0 {
+		fill := time.Duration(float64(size) / t.arrivals.rate * float64(time.Second))
+		t.window = max(min(fill, t.ceiling), minWindow)
+	}
+}
+
+// delivered to record the mean latency of a delivered batch
+func (t *windowTuner) delivered(latency time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.latency == 0 {
+		t.latency = latency
+	} else {
+		t.latency = (7*t.latency + 3*latency) / 10
+	}
+}
+
+// adapted to return the adapted window, or the LatencySLO until a rate is observed
+func (t *windowTuner) adapted(slo time.Duration) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.window == 0 {
+		return slo
+	}
+	return t.window
+}
+
+// reopen to open the next batch window: the MaxAge, adapted to the traffic under a LatencySLO and
+// shortened by the MaxAgeJitter. The payloadMutex must be held once the queue is running.
+func (q *Queue) reopen() {
+	window := q.maxAge()
+	if q.LatencySLO > 0 {
+		window = min(window, q.tuner.adapted(q.LatencySLO))
+	}
+	if q.MaxAgeJitter > 0 {
+		window -= time.Duration(rand.Float64() * q.MaxAgeJitter * float64(window))
+	}
+	q.window = window
+	q.expires = q.elapsed() + window
+}